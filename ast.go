@@ -48,12 +48,21 @@ func (_ *VarRef) node()             {}
 func (_ *NumberLiteral) node()      {}
 func (_ *StringLiteral) node()      {}
 func (_ *BooleanLiteral) node()     {}
+func (_ *NullLiteral) node()        {}
 func (_ *TimeLiteral) node()        {}
 func (_ *DurationLiteral) node()    {}
 func (_ *BinaryExpr) node()         {}
 func (_ *ParenExpr) node()          {}
 func (_ *SliceStringLiteral) node() {}
 func (_ *SliceNumberLiteral) node() {}
+func (_ *MapLiteral) node()         {}
+func (_ *UnaryExpr) node()          {}
+func (_ *QuantifierExpr) node()     {}
+func (_ *CallExpr) node()           {}
+func (_ *RuleRef) node()            {}
+func (_ *ConditionalExpr) node()    {}
+func (_ *RangeExpr) node()          {}
+func (_ *TupleExpr) node()          {}
 
 // Expr represents an expression that can be evaluated to a value.
 type Expr interface {
@@ -66,16 +75,28 @@ func (_ *VarRef) expr()             {}
 func (_ *NumberLiteral) expr()      {}
 func (_ *StringLiteral) expr()      {}
 func (_ *BooleanLiteral) expr()     {}
+func (_ *NullLiteral) expr()        {}
 func (_ *TimeLiteral) expr()        {}
 func (_ *DurationLiteral) expr()    {}
 func (_ *BinaryExpr) expr()         {}
 func (_ *ParenExpr) expr()          {}
 func (_ *SliceStringLiteral) expr() {}
 func (_ *SliceNumberLiteral) expr() {}
+func (_ *MapLiteral) expr()         {}
+func (_ *UnaryExpr) expr()          {}
+func (_ *QuantifierExpr) expr()     {}
+func (_ *CallExpr) expr()           {}
+func (_ *RuleRef) expr()            {}
+func (_ *ConditionalExpr) expr()    {}
+func (_ *RangeExpr) expr()          {}
+func (_ *TupleExpr) expr()          {}
 
 // VarRef represents a reference to a variable.
 type VarRef struct {
 	Val string
+	// Literal is set for ${...} references, whose name is a single key
+	// which is never split into a dotted path.
+	Literal bool
 }
 
 // String returns a string representation of the variable reference.
@@ -118,7 +139,7 @@ type SliceNumberLiteral struct {
 
 // String returns a string representation of the literal.
 func (l *SliceNumberLiteral) String() string {
-	return fmt.Sprintf("%s", l.Val)
+	return fmt.Sprintf("%v", l.Val)
 }
 
 func (l *SliceNumberLiteral) Args() []string {
@@ -126,6 +147,21 @@ func (l *SliceNumberLiteral) Args() []string {
 	return args
 }
 
+// MapLiteral represents a map value with string keys resolved from args.
+type MapLiteral struct {
+	Val map[string]interface{}
+}
+
+// String returns a string representation of the literal.
+func (l *MapLiteral) String() string {
+	return fmt.Sprintf("%v", l.Val)
+}
+
+func (l *MapLiteral) Args() []string {
+	args := []string{}
+	return args
+}
+
 // BooleanLiteral represents a boolean literal.
 type BooleanLiteral struct {
 	Val bool
@@ -144,6 +180,17 @@ func (l *BooleanLiteral) Args() []string {
 	return args
 }
 
+// NullLiteral represents the NULL literal, equal to the nil variables.
+type NullLiteral struct{}
+
+// String returns a string representation of the literal.
+func (l *NullLiteral) String() string { return "NULL" }
+
+func (l *NullLiteral) Args() []string {
+	args := []string{}
+	return args
+}
+
 // StringLiteral represents a string literal.
 type StringLiteral struct {
 	Val string
@@ -165,6 +212,11 @@ func (l *StringLiteral) Args() []string {
 // String returns a string representation of the literal.
 func (l *TimeLiteral) String() string { return l.Val.UTC().Format("2006-01-02 15:04:05.999") }
 
+func (l *TimeLiteral) Args() []string {
+	args := []string{}
+	return args
+}
+
 // DurationLiteral represents a duration literal.
 type DurationLiteral struct {
 	Val time.Duration
@@ -173,6 +225,11 @@ type DurationLiteral struct {
 // String returns a string representation of the literal.
 func (l *DurationLiteral) String() string { return FormatDuration(l.Val) }
 
+func (l *DurationLiteral) Args() []string {
+	args := []string{}
+	return args
+}
+
 // BinaryExpr represents an operation between two expressions.
 type BinaryExpr struct {
 	Op  Token
@@ -194,6 +251,155 @@ func (e *BinaryExpr) Args() []string {
 	return args
 }
 
+// UnaryExpr represents an operation on a single expression.
+type UnaryExpr struct {
+	Op   Token
+	Expr Expr
+}
+
+// String returns a string representation of the unary expression.
+func (e *UnaryExpr) String() string {
+	if e.Op.isPostfix() {
+		return fmt.Sprintf("%s %s", e.Expr.String(), e.Op)
+	}
+	return fmt.Sprintf("%s %s", e.Op, e.Expr.String())
+}
+
+func (e *UnaryExpr) Args() []string {
+	return e.Expr.Args()
+}
+
+// QuantifierExpr represents an ANY/ALL expression evaluated once per
+// element of the slice variable Var. The element is bound in Expr to the
+// variable named Binder, or to Var itself when Binder is empty.
+type QuantifierExpr struct {
+	Op     Token
+	Var    *VarRef
+	Binder string
+	Expr   Expr
+}
+
+// String returns a string representation of the quantifier expression.
+func (e *QuantifierExpr) String() string {
+	switch e.Binder {
+	case "":
+		return fmt.Sprintf("%s %s", e.Op, e.Expr.String())
+	case "_":
+		return fmt.Sprintf("%s %s %s %s", e.Op, e.Var, SATISFIES, e.Expr.String())
+	}
+	return fmt.Sprintf("%s %s %s %s %s %s", e.Op, e.Var, AS, QuoteIdent(e.Binder), SATISFIES, e.Expr.String())
+}
+
+// Args returns the variables of the quantifier, the element bound to
+// Binder excluded.
+func (e *QuantifierExpr) Args() []string {
+	args := e.Var.Args()
+	for _, a := range e.Expr.Args() {
+		if !e.binds(a) {
+			args = append(args, a)
+		}
+	}
+	return args
+}
+
+// binds reports whether the variable name refers to the element bound to
+// Binder, or to a path into it.
+func (e *QuantifierExpr) binds(name string) bool {
+	return e.Binder != "" && (name == e.Binder || strings.HasPrefix(name, e.Binder+"."))
+}
+
+// CallExpr represents a call of a builtin function.
+type CallExpr struct {
+	Name   string
+	Params []Expr
+}
+
+// String returns a string representation of the function call.
+func (e *CallExpr) String() string {
+	args := make([]string, len(e.Params))
+	for i, a := range e.Params {
+		args[i] = a.String()
+	}
+	return fmt.Sprintf("%s(%s)", e.Name, strings.Join(args, ", "))
+}
+
+func (e *CallExpr) Args() []string {
+	args := []string{}
+	for _, a := range e.Params {
+		args = append(args, a.Args()...)
+	}
+	return args
+}
+
+// RuleRef represents a reference to the result of a rule of a RuleSet.
+type RuleRef struct {
+	Name string
+}
+
+// String returns a string representation of the rule reference.
+func (r *RuleRef) String() string { return fmt.Sprintf("@rule(%s)", Quote(r.Name)) }
+
+// Args returns no variables, the variables of the referenced rule are only
+// known to its RuleSet, see RuleSet.Variables.
+func (r *RuleRef) Args() []string { return []string{} }
+
+// ConditionalExpr represents a cond ? then : else expression. Only the
+// branch chosen by the condition is evaluated.
+type ConditionalExpr struct {
+	Cond Expr
+	Then Expr
+	Else Expr
+}
+
+// String returns a string representation of the conditional expression.
+func (e *ConditionalExpr) String() string {
+	return fmt.Sprintf("%s ? %s : %s", e.Cond.String(), e.Then.String(), e.Else.String())
+}
+
+func (e *ConditionalExpr) Args() []string {
+	args := append(e.Cond.Args(), e.Then.Args()...)
+	return append(args, e.Else.Args()...)
+}
+
+// RangeExpr represents the inclusive "low AND high" bounds of SIZEBETWEEN
+// and BETWEEN.
+type RangeExpr struct {
+	Low  Expr
+	High Expr
+}
+
+// String returns a string representation of the range.
+func (e *RangeExpr) String() string {
+	return fmt.Sprintf("%s %s %s", e.Low.String(), AND, e.High.String())
+}
+
+func (e *RangeExpr) Args() []string {
+	return append(e.Low.Args(), e.High.Args()...)
+}
+
+// TupleExpr represents the space separated operands of operators taking
+// several, such as the ordinal and the weekday of ISNTHWEEKDAY.
+type TupleExpr struct {
+	Elems []Expr
+}
+
+// String returns a string representation of the tuple.
+func (e *TupleExpr) String() string {
+	elems := make([]string, len(e.Elems))
+	for i, x := range e.Elems {
+		elems[i] = x.String()
+	}
+	return strings.Join(elems, " ")
+}
+
+func (e *TupleExpr) Args() []string {
+	args := []string{}
+	for _, x := range e.Elems {
+		args = append(args, x.Args()...)
+	}
+	return args
+}
+
 // ParenExpr represents a parenthesized expression.
 type ParenExpr struct {
 	Expr Expr
@@ -228,9 +434,76 @@ func Walk(v Visitor, node Node) {
 
 	case *ParenExpr:
 		Walk(v, n.Expr)
+
+	case *UnaryExpr:
+		Walk(v, n.Expr)
+
+	case *QuantifierExpr:
+		Walk(v, n.Var)
+		Walk(v, n.Expr)
+
+	case *CallExpr:
+		for _, a := range n.Params {
+			Walk(v, a)
+		}
+
+	case *ConditionalExpr:
+		Walk(v, n.Cond)
+		Walk(v, n.Then)
+		Walk(v, n.Else)
+
+	case *RangeExpr:
+		Walk(v, n.Low)
+		Walk(v, n.High)
+
+	case *TupleExpr:
+		for _, x := range n.Elems {
+			Walk(v, x)
+		}
 	}
 }
 
+// RenameVars returns a copy of expr where every variable reference is
+// renamed by fn. The input expression is left untouched.
+func RenameVars(expr Expr, fn func(string) string) Expr {
+	switch n := expr.(type) {
+	case *VarRef:
+		return &VarRef{Val: fn(n.Val), Literal: n.Literal}
+	case *BinaryExpr:
+		return &BinaryExpr{Op: n.Op, LHS: RenameVars(n.LHS, fn), RHS: RenameVars(n.RHS, fn)}
+	case *ParenExpr:
+		return &ParenExpr{Expr: RenameVars(n.Expr, fn)}
+	case *UnaryExpr:
+		return &UnaryExpr{Op: n.Op, Expr: RenameVars(n.Expr, fn)}
+	case *QuantifierExpr:
+		// The element bound to the binder is not renamed.
+		inner := func(name string) string {
+			if n.binds(name) {
+				return name
+			}
+			return fn(name)
+		}
+		return &QuantifierExpr{Op: n.Op, Var: &VarRef{Val: fn(n.Var.Val), Literal: n.Var.Literal}, Binder: n.Binder, Expr: RenameVars(n.Expr, inner)}
+	case *CallExpr:
+		call := &CallExpr{Name: n.Name, Params: make([]Expr, len(n.Params))}
+		for i, a := range n.Params {
+			call.Params[i] = RenameVars(a, fn)
+		}
+		return call
+	case *ConditionalExpr:
+		return &ConditionalExpr{Cond: RenameVars(n.Cond, fn), Then: RenameVars(n.Then, fn), Else: RenameVars(n.Else, fn)}
+	case *RangeExpr:
+		return &RangeExpr{Low: RenameVars(n.Low, fn), High: RenameVars(n.High, fn)}
+	case *TupleExpr:
+		tuple := &TupleExpr{Elems: make([]Expr, len(n.Elems))}
+		for i, x := range n.Elems {
+			tuple.Elems[i] = RenameVars(x, fn)
+		}
+		return tuple
+	}
+	return expr
+}
+
 // WalkFunc traverses a node hierarchy in depth-first order.
 func WalkFunc(node Node, fn func(Node)) {
 	Walk(walkFuncVisitor(fn), node)
@@ -240,11 +513,41 @@ type walkFuncVisitor func(Node)
 
 func (fn walkFuncVisitor) Visit(n Node) Visitor { fn(n); return fn }
 
-// Quote returns a quoted string.
+// Inspect traverses a node hierarchy in depth-first order, calling fn on
+// each node before its children. The children of a node are skipped when
+// fn returns false for it. For instance, this collects the strings of an
+// expression outside of function calls:
+//
+//	var strs []string
+//	Inspect(expr, func(n Node) bool {
+//		if s, ok := n.(*StringLiteral); ok {
+//			strs = append(strs, s.Val)
+//		}
+//		_, call := n.(*CallExpr)
+//		return !call
+//	})
+func Inspect(node Node, fn func(Node) bool) {
+	Walk(inspector(fn), node)
+}
+
+type inspector func(Node) bool
+
+func (fn inspector) Visit(n Node) Visitor {
+	if fn(n) {
+		return fn
+	}
+	return nil
+}
+
+// Quote returns a double-quoted string the parser reads back as s.
 func Quote(s string) string {
-	return `"` + strings.NewReplacer("\n", `\n`, `\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	return `"` + quoteReplacer.Replace(s) + `"`
 }
 
+// quoteReplacer escapes the characters which can not appear as is in a
+// double-quoted string.
+var quoteReplacer = strings.NewReplacer("\n", `\n`, "\t", `\t`, "\r", `\r`, `\`, `\\`, `"`, `\"`)
+
 // QuoteIdent returns a quoted identifier if the identifier requires quoting.
 // Otherwise returns the original string passed in.
 func QuoteIdent(s string) string {
@@ -268,7 +571,9 @@ func FormatDuration(d time.Duration) string {
 		return fmt.Sprintf("%ds", d/time.Second)
 	} else if d%time.Millisecond == 0 {
 		return fmt.Sprintf("%dms", d/time.Millisecond)
+	} else if d%time.Microsecond == 0 {
+		return fmt.Sprintf("%dus", d/time.Microsecond)
 	} else {
-		return fmt.Sprintf("%d", d/time.Microsecond)
+		return fmt.Sprintf("%dns", d)
 	}
 }
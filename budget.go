@@ -0,0 +1,61 @@
+package conditions
+
+// Estimation model of the memory accounted against Options.MemoryBudget,
+// in bytes. Exact allocations are not tracked, instead:
+//
+//   - every value produced by evaluating a node costs literalBytes, plus
+//     its contents: the bytes of strings, elemBytes and the bytes of each
+//     element of slices and each entry of maps. This covers arguments,
+//     which are copied into literals each time they are referenced, and
+//     the results of operators and functions.
+//   - coercing a string into a number costs literalBytes.
+//   - a regular expression match costs regexBytes per byte of the pattern
+//     for its compilation, plus the bytes of the subject.
+//   - ANY/ALL cost literalBytes per element of the quantified slice.
+//   - functions splitting or scanning strings, such as part and ENTROPY,
+//     cost elemBytes per byte of their input.
+//   - EvaluateWithTrace costs traceBytes per node evaluated, for its
+//     Trace. Its value is accounted as above.
+const (
+	literalBytes = 32
+	elemBytes    = 16
+	regexBytes   = 64
+	traceBytes   = 80
+)
+
+// alloc accounts n bytes of memory used by the evaluation.
+func (e *evaluator) alloc(n int) {
+	e.used += n
+}
+
+// checkBudget returns an *ErrMemoryBudget if the evaluation used more than
+// the memory budget.
+func (e *evaluator) checkBudget() error {
+	if e.opts.MemoryBudget > 0 && e.used > e.opts.MemoryBudget {
+		return &ErrMemoryBudget{Budget: e.opts.MemoryBudget, Used: e.used}
+	}
+	return nil
+}
+
+// valueBytes estimates the memory used by an evaluated value.
+func valueBytes(x Expr) int {
+	n := literalBytes
+	switch v := x.(type) {
+	case *StringLiteral:
+		n += len(v.Val)
+	case *SliceStringLiteral:
+		for _, s := range v.Val {
+			n += elemBytes + len(s)
+		}
+	case *SliceNumberLiteral:
+		n += elemBytes * len(v.Val)
+	case *MapLiteral:
+		for k, val := range v.Val {
+			n += 2*elemBytes + len(k)
+			if s, ok := val.(string); ok {
+				n += len(s)
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,365 @@
+package conditions
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// builtinFunc implements a builtin function on evaluated arguments.
+type builtinFunc func(e *evaluator, args []Expr) (Expr, error)
+
+// builtin describes a builtin function callable from expressions.
+type builtin struct {
+	// Number of arguments accepted by the function
+	minArgs, maxArgs int
+	fn               builtinFunc
+	// Optional check of the unevaluated arguments, run by the parser
+	check func(params []Expr) error
+}
+
+// builtins lists the functions callable from expressions by lower-case name.
+var builtins map[string]*builtin
+
+func init() {
+	builtins = map[string]*builtin{
+		"part":     {3, 3, builtinPart, nil},
+		"overlaps": {4, 4, builtinOverlaps, nil},
+		"convert":  {3, 3, builtinConvert, nil},
+		"floor":    {1, 1, numberBuiltin(math.Floor), nil},
+		"ceil":     {1, 1, numberBuiltin(math.Ceil), nil},
+		"round":    {1, 1, numberBuiltin(math.Round), nil},
+		"trunc":    {1, 1, numberBuiltin(math.Trunc), nil},
+		"abs":      {1, 1, numberBuiltin(math.Abs), nil},
+		"idiv":     {2, 2, builtinIdiv, nil},
+		"sum":      {1, 1, builtinSum, nil},
+		"avg":      {1, 1, builtinAvg, nil},
+		"sample":   {2, 3, builtinSample, checkSample},
+		"now":      {0, 0, builtinNow, nil},
+		"extract":  {2, 2, builtinExtract, checkExtract},
+	}
+}
+
+// lookupBuiltin returns the builtin function with the case insensitive name.
+func lookupBuiltin(name string) *builtin {
+	return builtins[strings.ToLower(name)]
+}
+
+// evaluateCall evaluates the arguments of a function call and applies the
+// builtin function to them.
+func (e *evaluator) evaluateCall(n *CallExpr) (Expr, error) {
+	b := lookupBuiltin(n.Name)
+	if b == nil {
+		return falseExpr, fmt.Errorf("Unknown function %s", n.Name)
+	}
+	if len(n.Params) < b.minArgs || len(n.Params) > b.maxArgs {
+		if b.minArgs == b.maxArgs {
+			return falseExpr, fmt.Errorf("%s expects %d arguments, got %d", n.Name, b.minArgs, len(n.Params))
+		}
+		return falseExpr, fmt.Errorf("%s expects %d to %d arguments, got %d", n.Name, b.minArgs, b.maxArgs, len(n.Params))
+	}
+
+	args := make([]Expr, len(n.Params))
+	for i, a := range n.Params {
+		v, err := e.evaluateSubtree(a)
+		if err != nil {
+			return falseExpr, err
+		}
+		args[i] = v
+	}
+
+	v, err := b.fn(e, args)
+	if err != nil {
+		return falseExpr, fmt.Errorf("%s: %w", n.Name, err)
+	}
+	return v, nil
+}
+
+// getInt returns the value of a number literal which must be integral.
+func getInt(e Expr) (int64, error) {
+	f, err := getNumber(e)
+	if err != nil {
+		return 0, err
+	}
+	if f != math.Trunc(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("Number is not an integer: %v", f)
+	}
+	if f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("Number is out of the integer range: %v", f)
+	}
+	return int64(f), nil
+}
+
+// builtinPart implements part(str, sep, index): the element at the zero
+// based index of str split around sep. An out of range index is an error.
+func builtinPart(e *evaluator, args []Expr) (Expr, error) {
+	s, err := getString(args[0])
+	if err != nil {
+		return nil, err
+	}
+	e.alloc(elemBytes * len(s))
+	sep, err := getString(args[1])
+	if err != nil {
+		return nil, err
+	}
+	index, err := getInt(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(s, sep)
+	if index < 0 || index >= int64(len(parts)) {
+		return nil, fmt.Errorf("index %d out of range, %q has %d parts", index, s, len(parts))
+	}
+	return &StringLiteral{Val: parts[index]}, nil
+}
+
+// builtinExtract implements extract(str, pattern): the first capture group
+// of the leftmost match of the regular expression pattern in str, or the
+// whole match if pattern has no group. It is "" if pattern doesn't match,
+// or if the group is not part of the match.
+func builtinExtract(e *evaluator, args []Expr) (Expr, error) {
+	s, err := getString(args[0])
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := getString(args[1])
+	if err != nil {
+		return nil, err
+	}
+	e.alloc(regexBytes * len(pattern))
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	m := re.FindStringSubmatch(s)
+	switch {
+	case m == nil:
+		return &StringLiteral{Val: ""}, nil
+	case len(m) > 1:
+		return &StringLiteral{Val: m[1]}, nil
+	}
+	return &StringLiteral{Val: m[0]}, nil
+}
+
+// checkExtract rejects invalid literal patterns when parsing.
+func checkExtract(params []Expr) error {
+	if len(params) > 1 {
+		if p, ok := params[1].(*StringLiteral); ok {
+			_, err := regexp.Compile(p.Val)
+			return err
+		}
+	}
+	return nil
+}
+
+// builtinOverlaps implements overlaps(start1, end1, start2, end2): whether
+// the two time ranges intersect. Ranges are half-open, the start is
+// included and the end excluded, so adjacent ranges and empty ranges never
+// overlap. A range ending before it starts is an error.
+func builtinOverlaps(_ *evaluator, args []Expr) (Expr, error) {
+	var bounds [4]time.Time
+	for i, a := range args {
+		t, err := getTime(a)
+		if err != nil {
+			return nil, err
+		}
+		bounds[i] = t
+	}
+	for i := 0; i < 4; i += 2 {
+		if bounds[i+1].Before(bounds[i]) {
+			return nil, fmt.Errorf("range %d ends before it starts", i/2+1)
+		}
+	}
+	overlaps := bounds[0].Before(bounds[1]) && bounds[2].Before(bounds[3]) &&
+		bounds[0].Before(bounds[3]) && bounds[2].Before(bounds[1])
+	return &BooleanLiteral{Val: overlaps}, nil
+}
+
+// numberBuiltin returns a builtin applying fn to its number argument,
+// such as floor or abs. round rounds half away from zero: round(2.5) is
+// 3 and round(-2.5) is -3.
+func numberBuiltin(fn func(float64) float64) builtinFunc {
+	return func(_ *evaluator, args []Expr) (Expr, error) {
+		f, err := getNumber(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &NumberLiteral{Val: fn(f)}, nil
+	}
+}
+
+// builtinIdiv implements idiv(a, b): the integer quotient of a by b,
+// truncated toward zero like Go integer division, so idiv(-7, 2) is -3.
+// Operands are truncated to integers first, unless the StrictIntegers
+// option is set which makes fractional operands an error.
+func builtinIdiv(e *evaluator, args []Expr) (Expr, error) {
+	var ops [2]int64
+	for i, a := range args {
+		f, err := getNumber(a)
+		if err != nil {
+			return nil, err
+		}
+		if !e.opts.StrictIntegers {
+			f = math.Trunc(f)
+		}
+		if ops[i], err = getInt(&NumberLiteral{Val: f}); err != nil {
+			return nil, err
+		}
+	}
+	if ops[1] == 0 {
+		return nil, fmt.Errorf("Division by zero")
+	}
+	return &NumberLiteral{Val: float64(ops[0] / ops[1])}, nil
+}
+
+// aggregateValues returns the elements of a number slice to aggregate,
+// applying the NaN policy of the evaluation.
+func (e *evaluator) aggregateValues(x Expr) ([]float64, error) {
+	values, err := getSliceNumber(x)
+	if err != nil {
+		return nil, err
+	}
+	if e.opts.NaN == NaNPropagate {
+		return values, nil
+	}
+
+	result := make([]float64, 0, len(values))
+	for i, v := range values {
+		if !math.IsNaN(v) {
+			result = append(result, v)
+			continue
+		}
+		switch e.opts.NaN {
+		case NaNZero:
+			result = append(result, 0)
+		case NaNError:
+			return nil, fmt.Errorf("element %d is NaN", i)
+		}
+	}
+	return result, nil
+}
+
+// builtinSum implements sum(slice): the sum of the numbers of the slice,
+// 0 for an empty slice.
+func builtinSum(e *evaluator, args []Expr) (Expr, error) {
+	values, err := e.aggregateValues(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return &NumberLiteral{Val: sum}, nil
+}
+
+// builtinAvg implements avg(slice): the mean of the numbers of the slice.
+// An empty slice is an error.
+func builtinAvg(e *evaluator, args []Expr) (Expr, error) {
+	values, err := e.aggregateValues(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no values to average")
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return &NumberLiteral{Val: sum / float64(len(values))}, nil
+}
+
+// sampleBucket returns the rollout bucket of key, between 0 and 99: the
+// FNV-1a 64-bit hash of key, mixed with the MurmurHash3 fmix64 finalizer,
+// modulo 100. The finalizer spreads the low bits, without it buckets of
+// different salts would be shifted copies of each other. With a salt, the
+// hash is computed on salt + ":" + key instead. Buckets must never change
+// for a given input, rollouts rely on keys staying in the same bucket
+// across releases.
+func sampleBucket(key, salt string) uint64 {
+	f := fnv.New64a()
+	if salt != "" {
+		f.Write([]byte(salt + ":"))
+	}
+	f.Write([]byte(key))
+
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h % 100
+}
+
+// builtinSample implements sample(key, percent[, salt]): whether the key
+// falls in the given percentage of a deterministic rollout, see
+// sampleBucket. Keys are strings or numbers, experiments using different
+// salts sample independent sets of keys.
+func builtinSample(_ *evaluator, args []Expr) (Expr, error) {
+	var key string
+	switch k := args[0].(type) {
+	case *StringLiteral:
+		key = k.Val
+	case *NumberLiteral:
+		key = strconv.FormatFloat(k.Val, 'f', -1, 64)
+	default:
+		return nil, fmt.Errorf("key must be a string or a number, got %s", k)
+	}
+	percent, err := getNumber(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPercent(percent); err != nil {
+		return nil, err
+	}
+	var salt string
+	if len(args) == 3 {
+		if salt, err = getString(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	return &BooleanLiteral{Val: float64(sampleBucket(key, salt)) < percent}, nil
+}
+
+// checkSample rejects literal percentages out of range when parsing.
+func checkSample(params []Expr) error {
+	if len(params) > 1 {
+		if n, ok := params[1].(*NumberLiteral); ok {
+			return checkPercent(n.Val)
+		}
+	}
+	return nil
+}
+
+func checkPercent(percent float64) error {
+	if !(percent >= 0 && percent <= 100) {
+		return fmt.Errorf("percentage must be between 0 and 100, got %v", percent)
+	}
+	return nil
+}
+
+// builtinNow implements now(): the current time, read once per evaluation
+// from the clock of the options.
+func builtinNow(e *evaluator, _ []Expr) (Expr, error) {
+	return e.inLocation(&TimeLiteral{Val: e.currentTime()}), nil
+}
+
+// currentTime returns the time of the evaluation, read from the clock of
+// the options on first use so that it stays the same throughout.
+func (e *evaluator) currentTime() time.Time {
+	if e.now.IsZero() {
+		clock := e.opts.Clock
+		if clock == nil {
+			clock = time.Now
+		}
+		e.now = clock()
+	}
+	return e.now
+}
@@ -0,0 +1,92 @@
+package conditions
+
+import "fmt"
+
+// Default limits on the complexity of expressions, used when
+// ParserOptions or Options leave them zero.
+const (
+	// DefaultMaxDepth is the maximum nesting of an expression tree.
+	// Chains of operators of the same precedence, like a OR b OR c, don't
+	// nest, so that long generated rules stay within it.
+	DefaultMaxDepth = 1000
+	// DefaultMaxNodes is the maximum number of nodes of an expression, and
+	// of node evaluations during an evaluation.
+	DefaultMaxNodes = 1000000
+)
+
+// ErrTooComplex is returned when an expression exceeds the depth or node
+// count limits of ParserOptions or Options.
+type ErrTooComplex struct {
+	// Limit is "depth" or "nodes"
+	Limit string
+	// Max is the exceeded limit
+	Max int
+}
+
+func (e *ErrTooComplex) Error() string {
+	return fmt.Sprintf("Expression too complex: %s exceeds the limit of %d", e.Limit, e.Max)
+}
+
+// complexityLimit returns the limit to enforce for the configured value
+// max: the default if zero, none if negative.
+func complexityLimit(max, def int) int {
+	if max == 0 {
+		return def
+	}
+	return max
+}
+
+// checkComplexity returns an *ErrTooComplex if expr is deeper or has more
+// nodes than allowed. Negative limits are not enforced.
+func checkComplexity(expr Expr, maxDepth, maxNodes int) error {
+	c := &complexity{maxDepth: maxDepth, maxNodes: maxNodes}
+	Walk(complexityVisitor{c: c}, expr)
+	return c.err
+}
+
+// continuesChain reports whether x, an operand of parent, continues a
+// chain of binary operators of the same precedence, such as the LHS of
+// the last OR of a OR b OR c. Chains don't count as nesting.
+func continuesChain(parent, x Node) bool {
+	p, ok := parent.(*BinaryExpr)
+	if !ok {
+		return false
+	}
+	b, ok := x.(*BinaryExpr)
+	return ok && b.Op.Precedence() == p.Op.Precedence()
+}
+
+// complexity accumulates the size of an expression tree.
+type complexity struct {
+	maxDepth, maxNodes int
+	nodes              int
+	err                error
+}
+
+// complexityVisitor visits the children of parent, which is at the given
+// depth.
+type complexityVisitor struct {
+	c      *complexity
+	parent Node
+	depth  int
+}
+
+func (v complexityVisitor) Visit(n Node) Visitor {
+	if v.c.err != nil {
+		return nil
+	}
+	v.c.nodes++
+	depth := v.depth + 1
+	if continuesChain(v.parent, n) {
+		depth = v.depth
+	}
+	if v.c.maxDepth >= 0 && depth > v.c.maxDepth {
+		v.c.err = &ErrTooComplex{Limit: "depth", Max: v.c.maxDepth}
+		return nil
+	}
+	if v.c.maxNodes >= 0 && v.c.nodes > v.c.maxNodes {
+		v.c.err = &ErrTooComplex{Limit: "nodes", Max: v.c.maxNodes}
+		return nil
+	}
+	return complexityVisitor{c: v.c, parent: n, depth: depth}
+}
@@ -0,0 +1,12 @@
+// Command conditionsmigrate reports the evaluations of conditions
+// expressions relying on defaults planned to change, see the
+// conditionsmigrate package. Run it with -fix to add the options keeping
+// the current behavior.
+package main
+
+import (
+	"github.com/yowenter/conditions/conditionsmigrate"
+	"golang.org/x/tools/go/analysis/singlechecker"
+)
+
+func main() { singlechecker.Main(conditionsmigrate.Analyzer) }
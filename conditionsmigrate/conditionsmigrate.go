@@ -0,0 +1,364 @@
+// Package conditionsmigrate provides an analyzer reporting the evaluations
+// of conditions expressions whose behavior will change once the defaults
+// of conditions.Options planned to change are switched. Each report
+// suggests the functional option keeping the current behavior, so that the
+// new defaults can be adopted one call site at a time.
+//
+// A call is reported unless it sets the option explicitly. Expressions
+// parsed from a constant in the same function are checked for the
+// constructs affected by the change, and calls evaluating unaffected
+// expressions are not reported. Calls passing options the analyzer can't
+// see through, such as a variable or a spread slice, are not reported.
+package conditionsmigrate
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"github.com/yowenter/conditions"
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+const pkgPath = "github.com/yowenter/conditions"
+
+// Analyzer reports the evaluations relying on defaults planned to change.
+var Analyzer = &analysis.Analyzer{
+	Name:     "conditionsmigrate",
+	Doc:      "report conditions evaluations relying on defaults planned to change",
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      run,
+}
+
+// defaultChange describes a default of conditions.Options planned to
+// change.
+type defaultChange struct {
+	// Field of conditions.Options, and the functional option setting it
+	field, option string
+	// Current and future defaults, and the argument of option keeping the
+	// current behavior
+	current, future string
+	// What changes for the affected expressions
+	effect string
+	// affects reports whether the evaluation of expr may change
+	affects func(expr conditions.Expr) bool
+}
+
+var changes = []defaultChange{
+	{
+		field:   "Equality",
+		option:  "WithEquality",
+		current: "EqualityLenient",
+		future:  "EqualityStrict",
+		effect:  "== and != on operands other than strings, numbers and booleans will fail instead of being false",
+		affects: comparesNonScalars,
+	},
+}
+
+// comparesNonScalars reports whether expr has an == or != comparison whose
+// left operand may be something else than a string, number or boolean.
+func comparesNonScalars(expr conditions.Expr) bool {
+	found := false
+	conditions.WalkFunc(expr, func(n conditions.Node) {
+		if b, ok := n.(*conditions.BinaryExpr); ok && (b.Op == conditions.EQ || b.Op == conditions.NEQ) {
+			found = found || !isScalar(b.LHS)
+		}
+	})
+	return found
+}
+
+// isScalar reports whether expr always evaluates to a string, number or
+// boolean.
+func isScalar(expr conditions.Expr) bool {
+	switch n := expr.(type) {
+	case *conditions.StringLiteral, *conditions.NumberLiteral, *conditions.BooleanLiteral:
+		return true
+	case *conditions.ParenExpr:
+		return isScalar(n.Expr)
+	case *conditions.BinaryExpr:
+		switch n.Op {
+		case conditions.ADD, conditions.SUB, conditions.MUL, conditions.DIV, conditions.BAND, conditions.BOR, conditions.BXOR:
+			return true
+		}
+	}
+	return false
+}
+
+// evaluation describes an evaluating function or method of the package.
+type evaluation struct {
+	// Index of the expression argument, -1 for rules of a RuleSet
+	expr int
+	// Index of the first option, -1 if options are not accepted
+	opts int
+	// Name of the variant accepting options
+	withOptions string
+}
+
+var evaluations = map[string]evaluation{
+	"Evaluate":                       {expr: 0, opts: -1, withOptions: "EvaluateWithOptions"},
+	"EvaluateWithOptions":            {expr: 0, opts: 2, withOptions: "EvaluateWithOptions"},
+	"(*RuleSet).Evaluate":            {expr: -1, opts: -1, withOptions: "EvaluateWithOptions"},
+	"(*RuleSet).EvaluateWithOptions": {expr: -1, opts: 2, withOptions: "EvaluateWithOptions"},
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	inspect := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+	sources := parsedSources(pass, inspect)
+
+	inspect.WithStack([]ast.Node{(*ast.CallExpr)(nil)}, func(n ast.Node, push bool, stack []ast.Node) bool {
+		if !push {
+			return true
+		}
+		call := n.(*ast.CallExpr)
+		fn, ok := typeutil.Callee(pass.TypesInfo, call).(*types.Func)
+		if !ok || fn.Pkg() == nil || fn.Pkg().Path() != pkgPath {
+			return true
+		}
+		ev, ok := evaluations[funcName(fn)]
+		if !ok || call.Ellipsis.IsValid() {
+			return true
+		}
+
+		var expr conditions.Expr
+		if ev.expr >= 0 && ev.expr < len(call.Args) {
+			expr = sources.expr(pass, call.Args[ev.expr])
+		}
+		for _, c := range changes {
+			explicit, known := setsOption(pass, call, ev, c)
+			if explicit || !known || (expr != nil && !c.affects(expr)) {
+				continue
+			}
+			report(pass, stack[0].(*ast.File), call, fn, ev, c)
+		}
+		return true
+	})
+	return nil, nil
+}
+
+// funcName returns the name of a function, qualified by its receiver type
+// for methods.
+func funcName(fn *types.Func) string {
+	sig := fn.Type().(*types.Signature)
+	if sig.Recv() == nil {
+		return fn.Name()
+	}
+	t := sig.Recv().Type()
+	ptr := ""
+	if p, ok := t.(*types.Pointer); ok {
+		t, ptr = p.Elem(), "*"
+	}
+	named, ok := t.(*types.Named)
+	if !ok {
+		return fn.Name()
+	}
+	return fmt.Sprintf("(%s%s).%s", ptr, named.Obj().Name(), fn.Name())
+}
+
+// setsOption reports whether the options of call set the field of c.
+// known is false when some options can't be inspected.
+func setsOption(pass *analysis.Pass, call *ast.CallExpr, ev evaluation, c defaultChange) (explicit, known bool) {
+	if ev.opts < 0 {
+		return false, true
+	}
+	for _, arg := range call.Args[ev.opts:] {
+		switch a := ast.Unparen(arg).(type) {
+		case *ast.CallExpr:
+			fn, ok := typeutil.Callee(pass.TypesInfo, a).(*types.Func)
+			if !ok || fn.Pkg() == nil || fn.Pkg().Path() != pkgPath || !strings.HasPrefix(fn.Name(), "With") {
+				return false, false
+			}
+			if fn.Name() == c.option {
+				explicit = true
+			}
+		case *ast.CompositeLit:
+			// An Options value replaces every setting made before it.
+			explicit = false
+			for _, elt := range a.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok {
+					return false, false
+				}
+				if key, ok := kv.Key.(*ast.Ident); ok && key.Name == c.field {
+					explicit = true
+				}
+			}
+		default:
+			return false, false
+		}
+	}
+	return explicit, true
+}
+
+// report reports call, with a fix adding the option keeping the current
+// behavior when the package can be referred to from file.
+func report(pass *analysis.Pass, file *ast.File, call *ast.CallExpr, fn *types.Func, ev evaluation, c defaultChange) {
+	d := analysis.Diagnostic{
+		Pos: call.Pos(),
+		End: call.End(),
+		Message: fmt.Sprintf("%s relies on the default %s, which changes from %s to %s: %s; pass %s(%s) to keep the current behavior",
+			fn.Name(), c.field, c.current, c.future, c.effect, c.option, c.current),
+	}
+	if q, ok := qualifier(pass, file); ok {
+		if edits, ok := fixEdits(call, ev, q, c); ok {
+			d.SuggestedFixes = []analysis.SuggestedFix{{
+				Message:   fmt.Sprintf("Add %s(%s)", c.option, c.current),
+				TextEdits: edits,
+			}}
+		}
+	}
+	pass.Report(d)
+}
+
+// fixEdits returns the edits appending the option keeping the current
+// behavior to the arguments of call, switching to the variant accepting
+// options if needed. Package members are prefixed with q.
+func fixEdits(call *ast.CallExpr, ev evaluation, q string, c defaultChange) ([]analysis.TextEdit, bool) {
+	if len(call.Args) == 0 {
+		return nil, false
+	}
+	var edits []analysis.TextEdit
+	if ev.opts < 0 {
+		var name *ast.Ident
+		switch f := ast.Unparen(call.Fun).(type) {
+		case *ast.Ident:
+			name = f
+		case *ast.SelectorExpr:
+			name = f.Sel
+		default:
+			return nil, false
+		}
+		edits = append(edits, analysis.TextEdit{Pos: name.Pos(), End: name.End(), NewText: []byte(ev.withOptions)})
+	}
+	end := call.Args[len(call.Args)-1].End()
+	opt := fmt.Sprintf(", %s%s(%s%s)", q, c.option, q, c.current)
+	return append(edits, analysis.TextEdit{Pos: end, End: end, NewText: []byte(opt)}), true
+}
+
+// qualifier returns the prefix referring to the conditions package from
+// file, ok is false when the package isn't imported by file.
+func qualifier(pass *analysis.Pass, file *ast.File) (q string, ok bool) {
+	if pass.Pkg.Path() == pkgPath {
+		return "", true
+	}
+	for _, imp := range file.Imports {
+		if path, err := strconv.Unquote(imp.Path.Value); err != nil || path != pkgPath {
+			continue
+		}
+		if imp.Name == nil {
+			return "conditions.", true
+		}
+		switch imp.Name.Name {
+		case "_":
+			return "", false
+		case ".":
+			return "", true
+		}
+		return imp.Name.Name + ".", true
+	}
+	return "", false
+}
+
+// sources records the expressions parsed from constants, by variable.
+type sources map[*types.Var]conditions.Expr
+
+// parsedSources returns the variables assigned once, by a statement like
+//
+//	expr, err := conditions.NewParser(strings.NewReader(`...`)).Parse()
+//
+// with the expression parsed from the constant. Variables assigned more
+// than once map to nil.
+func parsedSources(pass *analysis.Pass, inspect *inspector.Inspector) sources {
+	src := sources{}
+	assign := func(lhs ast.Expr, rhs ast.Expr) {
+		id, ok := lhs.(*ast.Ident)
+		if !ok {
+			return
+		}
+		v, ok := pass.TypesInfo.ObjectOf(id).(*types.Var)
+		if !ok {
+			return
+		}
+		if _, seen := src[v]; seen {
+			src[v] = nil
+			return
+		}
+		src[v] = parseConstant(pass, rhs)
+	}
+
+	inspect.Preorder([]ast.Node{(*ast.AssignStmt)(nil), (*ast.ValueSpec)(nil)}, func(n ast.Node) {
+		var lhs, rhs []ast.Expr
+		switch s := n.(type) {
+		case *ast.AssignStmt:
+			lhs, rhs = s.Lhs, s.Rhs
+		case *ast.ValueSpec:
+			for _, name := range s.Names {
+				lhs = append(lhs, name)
+			}
+			rhs = s.Values
+		}
+		for i, l := range lhs {
+			// Only the expression of expr, err := ...Parse() is known.
+			var r ast.Expr
+			if len(rhs) == 1 && len(lhs) == 2 && i == 0 {
+				r = rhs[0]
+			}
+			assign(l, r)
+		}
+	})
+	return src
+}
+
+// expr returns the expression known to be evaluated by arg, or nil.
+func (src sources) expr(pass *analysis.Pass, arg ast.Expr) conditions.Expr {
+	id, ok := ast.Unparen(arg).(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	v, ok := pass.TypesInfo.ObjectOf(id).(*types.Var)
+	if !ok {
+		return nil
+	}
+	return src[v]
+}
+
+// parseConstant returns the expression parsed by a call like
+// conditions.NewParser(strings.NewReader(`...`)).Parse(), or nil.
+func parseConstant(pass *analysis.Pass, x ast.Expr) conditions.Expr {
+	parse, ok := ast.Unparen(x).(*ast.CallExpr)
+	if !ok || !isFunc(pass, parse, pkgPath, "(*Parser).Parse") {
+		return nil
+	}
+	sel, ok := ast.Unparen(parse.Fun).(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+	newParser, ok := ast.Unparen(sel.X).(*ast.CallExpr)
+	if !ok || !isFunc(pass, newParser, pkgPath, "NewParser") || len(newParser.Args) != 1 {
+		return nil
+	}
+	reader, ok := ast.Unparen(newParser.Args[0]).(*ast.CallExpr)
+	if !ok || !isFunc(pass, reader, "strings", "NewReader") || len(reader.Args) != 1 {
+		return nil
+	}
+	tv := pass.TypesInfo.Types[reader.Args[0]]
+	if tv.Value == nil || tv.Value.Kind() != constant.String {
+		return nil
+	}
+	expr, err := conditions.NewParser(strings.NewReader(constant.StringVal(tv.Value))).Parse()
+	if err != nil {
+		return nil
+	}
+	return expr
+}
+
+// isFunc reports whether call calls the function name of the package path.
+func isFunc(pass *analysis.Pass, call *ast.CallExpr, path, name string) bool {
+	fn, ok := typeutil.Callee(pass.TypesInfo, call).(*types.Func)
+	return ok && fn.Pkg() != nil && fn.Pkg().Path() == path && funcName(fn) == name
+}
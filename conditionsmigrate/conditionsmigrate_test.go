@@ -0,0 +1,12 @@
+package conditionsmigrate_test
+
+import (
+	"testing"
+
+	"github.com/yowenter/conditions/conditionsmigrate"
+	"golang.org/x/tools/go/analysis/analysistest"
+)
+
+func TestAnalyzer(t *testing.T) {
+	analysistest.RunWithSuggestedFixes(t, analysistest.TestData(), conditionsmigrate.Analyzer, "a")
+}
@@ -0,0 +1,53 @@
+package a
+
+import (
+	"strings"
+
+	"github.com/yowenter/conditions"
+)
+
+func defaults(expr conditions.Expr, args map[string]interface{}) {
+	conditions.Evaluate(expr, args)                                                     // want `Evaluate relies on the default Equality`
+	conditions.EvaluateWithOptions(expr, args)                                          // want `EvaluateWithOptions relies on the default Equality`
+	conditions.EvaluateWithOptions(expr, args, conditions.WithCoerceStrings())          // want `EvaluateWithOptions relies on the default Equality`
+	conditions.EvaluateWithOptions(expr, args, conditions.Options{CoerceStrings: true}) // want `EvaluateWithOptions relies on the default Equality`
+
+	// An Options value resets the options before it.
+	conditions.EvaluateWithOptions(expr, args, conditions.WithEquality(conditions.EqualityLenient), conditions.Options{}) // want `EvaluateWithOptions relies on the default Equality`
+}
+
+func explicit(expr conditions.Expr, args map[string]interface{}, opts []conditions.Option, o conditions.Options) {
+	conditions.EvaluateWithOptions(expr, args, conditions.WithEquality(conditions.EqualityLenient))
+	conditions.EvaluateWithOptions(expr, args, conditions.WithEquality(conditions.EqualityStrict))
+	conditions.EvaluateWithOptions(expr, args, conditions.Options{Equality: conditions.EqualityLenient})
+	conditions.EvaluateWithOptions(expr, args, conditions.Options{}, conditions.WithEquality(conditions.EqualityLenient))
+
+	// Options which can't be inspected
+	conditions.EvaluateWithOptions(expr, args, opts...)
+	conditions.EvaluateWithOptions(expr, args, o)
+}
+
+func constants(args map[string]interface{}) {
+	scalars, _ := conditions.NewParser(strings.NewReader(`"a" == "a" AND $n > 1 AND 1 + 2 == 3`)).Parse()
+	conditions.Evaluate(scalars, args)
+
+	vars, _ := conditions.NewParser(strings.NewReader(`$tags == "a"`)).Parse()
+	conditions.Evaluate(vars, args) // want `Evaluate relies on the default Equality`
+
+	nested, err := conditions.NewParser(strings.NewReader(`$a > 1 OR ($b != 2)`)).Parse()
+	if err != nil {
+		return
+	}
+	conditions.Evaluate(nested, args) // want `Evaluate relies on the default Equality`
+
+	// Reassigned variables are not known.
+	reassigned, _ := conditions.NewParser(strings.NewReader(`$n > 1`)).Parse()
+	reassigned, _ = conditions.NewParser(strings.NewReader(`$tags == "a"`)).Parse()
+	conditions.Evaluate(reassigned, args) // want `Evaluate relies on the default Equality`
+}
+
+func rules(rs *conditions.RuleSet, args map[string]interface{}) {
+	rs.Evaluate("r", args)            // want `Evaluate relies on the default Equality`
+	rs.EvaluateWithOptions("r", args) // want `EvaluateWithOptions relies on the default Equality`
+	rs.EvaluateWithOptions("r", args, conditions.WithEquality(conditions.EqualityLenient))
+}
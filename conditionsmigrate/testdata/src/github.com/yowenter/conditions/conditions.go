@@ -0,0 +1,49 @@
+// Package conditions is a stub of the API used by the analyzer tests.
+package conditions
+
+import "io"
+
+type Expr interface{}
+
+type Parser struct{}
+
+func NewParser(r io.Reader) *Parser    { return &Parser{} }
+func (p *Parser) Parse() (Expr, error) { return nil, nil }
+
+type EqualityMode int
+
+const (
+	EqualityDefault EqualityMode = iota
+	EqualityLenient
+	EqualityStrict
+)
+
+type Options struct {
+	CoerceStrings bool
+	Equality      EqualityMode
+}
+
+type Option interface{ apply(*Options) }
+
+func (opts Options) apply(o *Options) { *o = opts }
+
+type optionFunc func(*Options)
+
+func (f optionFunc) apply(o *Options) { f(o) }
+
+func WithCoerceStrings() Option             { return optionFunc(nil) }
+func WithEquality(mode EqualityMode) Option { return optionFunc(nil) }
+
+func Evaluate(expr Expr, args interface{}) (bool, error) { return false, nil }
+
+func EvaluateWithOptions(expr Expr, args interface{}, opts ...Option) (bool, error) {
+	return false, nil
+}
+
+type RuleSet struct{}
+
+func (rs *RuleSet) Evaluate(name string, args interface{}) (bool, error) { return false, nil }
+
+func (rs *RuleSet) EvaluateWithOptions(name string, args interface{}, opts ...Option) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,197 @@
+package conditions
+
+import (
+	"fmt"
+	"math"
+	"regexp/syntax"
+)
+
+// CostHints describes the data an expression is expected to be evaluated
+// against, for EstimateCost. Variables missing from the hints are assumed
+// to have the default sizes.
+type CostHints struct {
+	// SubjectSizes is the expected length in bytes of string variables
+	// matched against regular expressions, by variable name
+	SubjectSizes map[string]int
+	// SliceLengths is the expected number of elements of slice variables
+	// used by membership operators, quantifiers and aggregates, by name
+	SliceLengths map[string]int
+}
+
+// Default sizes assumed by EstimateCost for variables without hints.
+const (
+	defaultSubjectSize = 64
+	defaultSliceLength = 16
+)
+
+// Relative costs used by EstimateCost. Only their orders of magnitude
+// matter, estimates are meant to be compared with each other.
+const (
+	// Resolving a variable from the args
+	lookupCost = 2.0
+	// Comparing two scalars, or running a builtin operator
+	compareCost = 1.0
+	// Comparing a single element of a slice
+	elemCost = 1.0
+	// Compiling and starting a regular expression match
+	regexSetupCost = 20.0
+	// Running one instruction of a regular expression program on one byte,
+	// scaled down as most instructions don't run on every byte
+	regexStepCost = 0.125
+	// Calling a custom operator or a builtin function
+	callCost = 5.0
+	// Evaluating a referenced rule, whose size is unknown
+	ruleCost = 10.0
+)
+
+// CostEstimate is the estimated cost of evaluating an expression.
+type CostEstimate struct {
+	// Total is the cost of a whole evaluation, assuming that every
+	// operand of AND and OR gets evaluated.
+	Total float64
+	// Breakdown is the cost of each node, including its operands, by node
+	// path. Paths are slash separated field names from the root "/", such
+	// as "/LHS/RHS" or "/Params/0".
+	Breakdown map[string]float64
+}
+
+// EstimateCost returns an estimate of the cost of evaluating expr against
+// data described by hints, to reject expensive rules before they are used.
+// The estimate accounts for regular expression program sizes and subject
+// lengths, membership list sizes and quantifier fan-out.
+func EstimateCost(expr Expr, hints CostHints) CostEstimate {
+	est := CostEstimate{Breakdown: map[string]float64{}}
+	est.Total = hints.cost(expr, "/", est.Breakdown)
+	return est
+}
+
+// cost returns the cost of expr, recording it and the cost of its operands
+// in breakdown.
+func (h CostHints) cost(expr Expr, path string, breakdown map[string]float64) float64 {
+	child := func(e Expr, name string) float64 {
+		if path == "/" {
+			return h.cost(e, "/"+name, breakdown)
+		}
+		return h.cost(e, path+"/"+name, breakdown)
+	}
+
+	var c float64
+	switch n := expr.(type) {
+	case *VarRef:
+		c = lookupCost
+	case *ParenExpr:
+		c = child(n.Expr, "Expr")
+	case *UnaryExpr:
+		if n.Op == EXISTS {
+			// The variable is looked up, not converted.
+			c = compareCost + lookupCost
+		} else {
+			c = compareCost + child(n.Expr, "Expr")
+		}
+	case *BinaryExpr:
+		c = child(n.LHS, "LHS") + child(n.RHS, "RHS") + h.operatorCost(n)
+	case *QuantifierExpr:
+		// The expression is evaluated once per element.
+		c = lookupCost + float64(h.sliceLength(n.Var))*child(n.Expr, "Expr")
+	case *CallExpr:
+		c = callCost
+		for i, p := range n.Params {
+			c += child(p, fmt.Sprintf("Params/%d", i))
+			if n.Name == "sum" || n.Name == "avg" {
+				c += float64(h.sliceLength(p)) * elemCost
+			}
+		}
+		if n.Name == "extract" && len(n.Params) == 2 {
+			c += regexSetupCost + float64(regexProgSize(n.Params[1])*h.subjectSize(n.Params[0]))*regexStepCost
+		}
+	case *RuleRef:
+		c = ruleCost
+	case *ConditionalExpr:
+		// Only one branch is evaluated, assume the most expensive.
+		c = child(n.Cond, "Cond") + math.Max(child(n.Then, "Then"), child(n.Else, "Else"))
+	case *RangeExpr:
+		c = child(n.Low, "Low") + child(n.High, "High")
+	case *TupleExpr:
+		for i, x := range n.Elems {
+			c += child(x, fmt.Sprintf("Elems/%d", i))
+		}
+	}
+	breakdown[path] = c
+	return c
+}
+
+// operatorCost returns the cost of applying the operator of n, operands
+// excluded.
+func (h CostHints) operatorCost(n *BinaryExpr) float64 {
+	switch n.Op {
+	case EREG, NEREG:
+		return regexSetupCost + float64(regexProgSize(n.RHS)*h.subjectSize(n.LHS))*regexStepCost
+	case LIKE, NOTLIKE:
+		pattern := n.RHS
+		if s, ok := pattern.(*StringLiteral); ok {
+			pattern = &StringLiteral{Val: likeRegexp(s.Val)}
+		}
+		return regexSetupCost + float64(regexProgSize(pattern)*h.subjectSize(n.LHS))*regexStepCost
+	case IN, NOTIN:
+		return compareCost + float64(h.sliceLength(n.RHS))*elemCost
+	case CONTAINS, NOTCONTAINS:
+		return compareCost + float64(h.sliceLength(n.LHS))*elemCost
+	case EQ, NEQ, LT, LTE, GT, GTE:
+		// Strings are compared byte by byte.
+		if s, ok := n.RHS.(*StringLiteral); ok {
+			return compareCost + float64(len(s.Val))/16
+		}
+		return compareCost
+	}
+	if lookupCustomOperator(n.Op) != nil {
+		return callCost
+	}
+	return compareCost
+}
+
+// regexProgSize returns the number of instructions of the compiled
+// regular expression of a literal pattern, 1 if it isn't a valid literal.
+func regexProgSize(pattern Expr) int {
+	s, ok := pattern.(*StringLiteral)
+	if !ok {
+		return 1
+	}
+	re, err := syntax.Parse(s.Val, syntax.Perl)
+	if err != nil {
+		return 1
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return 1
+	}
+	return len(prog.Inst)
+}
+
+// subjectSize returns the expected length of the string operand x.
+func (h CostHints) subjectSize(x Expr) int {
+	switch n := x.(type) {
+	case *StringLiteral:
+		return len(n.Val)
+	case *VarRef:
+		if size, ok := h.SubjectSizes[n.Val]; ok {
+			return size
+		}
+	}
+	return defaultSubjectSize
+}
+
+// sliceLength returns the expected number of elements of the slice
+// operand x.
+func (h CostHints) sliceLength(x Expr) int {
+	switch n := x.(type) {
+	case *SliceStringLiteral:
+		return len(n.Val)
+	case *SliceNumberLiteral:
+		return len(n.Val)
+	case *VarRef:
+		if length, ok := h.SliceLengths[n.Val]; ok {
+			return length
+		}
+	}
+	return defaultSliceLength
+}
@@ -0,0 +1,72 @@
+package conditions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateCost(t *testing.T) {
+	hints := CostHints{
+		SubjectSizes: map[string]int{"Body": 64 * 1024, "Name": 16},
+		SliceLengths: map[string]int{"Items": 1000, "Tags": 4},
+	}
+	cost := func(cond string) float64 {
+		return EstimateCost(mustParse(t, cond), hints).Total
+	}
+
+	// Curated rules, every rule of a tier must be cheaper than the rules
+	// of the following tiers.
+	tiers := [][]string{{
+		`$Enabled == true`,
+		`$Name == "admin"`,
+		`$Name == "admin" AND $Enabled == true`,
+		`$Role IN ["admin", "owner", "editor", "viewer"]`,
+	}, {
+		`$Name =~ /^adm/`,
+		`ANY $Tags == "vip"`,
+		`$Name =~ /^adm/ OR ANY $Tags == "vip"`,
+	}, {
+		`$Role IN $Items`,
+		`ANY $Items > 100`,
+		`$Body =~ /error/`,
+		`$Body =~ /(error|fatal|panic)[^\n]*code=\d{3,5}/`,
+	}}
+	for i := 1; i < len(tiers); i++ {
+		for _, cheap := range tiers[i-1] {
+			for _, expensive := range tiers[i] {
+				assert.True(t, cost(cheap) < cost(expensive),
+					"%s (%v) should be cheaper than %s (%v)", cheap, cost(cheap), expensive, cost(expensive))
+			}
+		}
+	}
+	assert.True(t, cost(`$Body =~ /error/`) < cost(`$Body =~ /(error|fatal|panic)[^\n]*code=\d{3,5}/`))
+	assert.True(t, cost(`$Body == "error"`) < cost(`$Body =~ /error/`))
+
+	// Hints change the estimate.
+	assert.True(t, cost(`$Body =~ /x+y/`) > cost(`$Name =~ /x+y/`))
+	assert.True(t, cost(`ANY $Items == 1`) > cost(`ANY $Tags == 1`))
+	assert.True(t, cost(`$Body =~ /x/`) > EstimateCost(mustParse(t, `$Body =~ /x/`), CostHints{}).Total)
+	assert.Equal(t, cost(`$Other =~ /x/`), EstimateCost(mustParse(t, `$Other =~ /x/`), CostHints{}).Total)
+	assert.True(t, cost(`sum($Items) > 1`) > cost(`sum($Tags) > 1`))
+}
+
+func TestEstimateCostBreakdown(t *testing.T) {
+	expr := mustParse(t, `($Name == "a" OR $Body =~ /x/) AND $Role IN ["a", "b"]`)
+	est := EstimateCost(expr, CostHints{})
+
+	assert.Equal(t, est.Total, est.Breakdown["/"])
+	for _, path := range []string{
+		"/LHS", "/LHS/Expr", "/LHS/Expr/LHS", "/LHS/Expr/LHS/LHS", "/LHS/Expr/LHS/RHS",
+		"/LHS/Expr/RHS", "/RHS", "/RHS/LHS", "/RHS/RHS",
+	} {
+		assert.Contains(t, est.Breakdown, path)
+	}
+	assert.InDelta(t, est.Total, est.Breakdown["/LHS"]+est.Breakdown["/RHS"]+compareCost, 1e-9)
+	assert.True(t, est.Breakdown["/LHS/Expr/RHS"] > est.Breakdown["/LHS/Expr/LHS"], "the regex dominates")
+
+	est = EstimateCost(mustParse(t, `round($x) > 1 AND @rule("r") AND EXISTS $y`), CostHints{})
+	for _, path := range []string{"/LHS/LHS/LHS/Params/0", "/LHS/RHS", "/RHS"} {
+		assert.Contains(t, est.Breakdown, path)
+	}
+}
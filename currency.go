@@ -0,0 +1,65 @@
+package conditions
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RateProvider returns the rate converting one unit of the from currency
+// into the to currency. Currency codes are upper-case, such as "USD". It
+// must return an error for unknown currencies.
+type RateProvider func(from, to string) (float64, error)
+
+var (
+	rateProviderMu sync.RWMutex
+	rateProvider   RateProvider
+)
+
+// RegisterRateProvider sets the provider consulted by the convert builtin,
+// replacing the previous one. A nil provider disables conversions.
+func RegisterRateProvider(p RateProvider) {
+	rateProviderMu.Lock()
+	defer rateProviderMu.Unlock()
+
+	rateProvider = p
+}
+
+// currentRateProvider returns the registered rate provider, if any.
+func currentRateProvider() RateProvider {
+	rateProviderMu.RLock()
+	defer rateProviderMu.RUnlock()
+
+	return rateProvider
+}
+
+// builtinConvert implements convert(amount, from, to): the amount in the
+// from currency expressed in the to currency, using the registered
+// RateProvider. Currency codes are case insensitive. The provider is
+// consulted even when both currencies are the same, so that unknown codes
+// fail.
+func builtinConvert(_ *evaluator, args []Expr) (Expr, error) {
+	amount, err := getNumber(args[0])
+	if err != nil {
+		return nil, err
+	}
+	from, err := getString(args[1])
+	if err != nil {
+		return nil, err
+	}
+	to, err := getString(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	p := currentRateProvider()
+	if p == nil {
+		return nil, fmt.Errorf("no rate provider registered")
+	}
+	rate, err := p(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &NumberLiteral{Val: amount * rate}, nil
+}
@@ -0,0 +1,297 @@
+package conditions
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// supportedTypes lists the argument types the evaluator knows how to compare.
+const supportedTypes = "bool, string, int, int32, int64, float32, float64, []string, maps with string keys and pointers to them"
+
+// ErrUnsupportedFieldType is returned when a variable referenced by an
+// expression resolves to a value of a type which can never be compared,
+// such as a func, a chan, a complex number or an unsafe.Pointer.
+type ErrUnsupportedFieldType struct {
+	// Name of the variable as written in the expression
+	Name string
+	// Type is the Go type of the value
+	Type string
+}
+
+func (e *ErrUnsupportedFieldType) Error() string {
+	return fmt.Sprintf("Argument %s has unsupported type %s (supported types: %s)", e.Name, e.Type, supportedTypes)
+}
+
+// ErrMemoryBudget is returned when an evaluation uses more memory than
+// allowed by Options.MemoryBudget. The usage is an estimate, see the
+// estimation model in budget.go.
+type ErrMemoryBudget struct {
+	// Budget is the configured budget in bytes
+	Budget int
+	// Used is the estimated usage in bytes when the evaluation was aborted
+	Used int
+}
+
+func (e *ErrMemoryBudget) Error() string {
+	return fmt.Sprintf("Memory budget of %d bytes exceeded, the evaluation used about %d bytes", e.Budget, e.Used)
+}
+
+// ErrRuleCycle is returned when adding a rule to a RuleSet would make it
+// depend on its own result.
+type ErrRuleCycle struct {
+	// Path lists the rule names of the cycle, the first one repeated last
+	Path []string
+}
+
+func (e *ErrRuleCycle) Error() string {
+	return fmt.Sprintf("Rule cycle: %s", strings.Join(e.Path, " -> "))
+}
+
+// ErrFieldNotFound is returned when a dotted variable path can't be
+// followed, because a segment is missing or crosses a nil pointer.
+type ErrFieldNotFound struct {
+	// Path is the variable path as written in the expression
+	Path string
+	// Field is the segment which failed
+	Field string
+	// Nil is set when the field exists but is a nil pointer
+	Nil bool
+}
+
+func (e *ErrFieldNotFound) Error() string {
+	if e.Nil {
+		return fmt.Sprintf("$%s: field %q is nil", e.Path, e.Field)
+	}
+	return fmt.Sprintf("$%s: field %q not found", e.Path, e.Field)
+}
+
+// ErrMissingVariable is returned when a variable is missing from the args,
+// unless Options.MissingFalse is set. A missing field of a dotted path is
+// an *ErrFieldNotFound.
+type ErrMissingVariable struct {
+	// Name of the variable as written in the expression
+	Name string
+	// Args are the args when they are a struct, printed by Error
+	Args interface{}
+}
+
+func (e *ErrMissingVariable) Error() string {
+	if e.Args != nil {
+		return fmt.Sprintf("Argument: `%v` not found in args `%v`", e.Name, e.Args)
+	}
+	return fmt.Sprintf("Argument: `%v` not found", e.Name)
+}
+
+// ErrTypeMismatch is returned when an operator is applied to operands of
+// types it doesn't handle, such as a string compared with a number.
+type ErrTypeMismatch struct {
+	// Op is the operator, ILLEGAL for the arguments of a function
+	Op Token
+	// Left and Right are the kinds of the operands, such as "string" or
+	// "slice of numbers", Right is empty for unary operators
+	Left, Right string
+	// Err describes the mismatch, if more precisely than the kinds
+	Err error
+}
+
+func (e *ErrTypeMismatch) Error() string {
+	switch {
+	case e.Err != nil:
+		return e.Err.Error()
+	case e.Right == "":
+		return fmt.Sprintf("Cannot evaluate %s %s", e.Op, e.Left)
+	}
+	return fmt.Sprintf("Cannot evaluate %s %s %s", e.Left, e.Op, e.Right)
+}
+
+// Unwrap returns the description of the mismatch.
+func (e *ErrTypeMismatch) Unwrap() error { return e.Err }
+
+// ErrEvaluation locates the failure of an operator in the evaluated
+// expression, its operands having been evaluated. Err is often an
+// *ErrTypeMismatch.
+type ErrEvaluation struct {
+	// Node is the failing binary or unary expression
+	Node Expr
+	// Err is the failure
+	Err error
+}
+
+func (e *ErrEvaluation) Error() string {
+	return fmt.Sprintf("%s in `%s`", e.Err, traceSource(e.Node))
+}
+
+// Unwrap returns the failure.
+func (e *ErrEvaluation) Unwrap() error { return e.Err }
+
+// ErrUnsupportedOperator is returned when evaluating an operator which
+// can't be applied, such as a custom operator no longer registered.
+type ErrUnsupportedOperator struct {
+	// Op is the operator
+	Op Token
+}
+
+func (e *ErrUnsupportedOperator) Error() string {
+	return fmt.Sprintf("Unsupported operator: %s", e.Op)
+}
+
+// ErrNilValue is returned when a variable resolves to nil, such as a nil
+// pointer field, unless Options.NilFalse is set.
+type ErrNilValue struct {
+	// Name of the variable as written in the expression
+	Name string
+	// Type is the Go type of the nil value, empty for an untyped nil
+	Type string
+}
+
+func (e *ErrNilValue) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("Argument %s is nil", e.Name)
+	}
+	return fmt.Sprintf("Argument %s is a nil %s", e.Name, e.Type)
+}
+
+// ErrAmbiguousField is returned when a variable names a field promoted
+// from several embedded structs at the same depth, which Go selectors
+// reject as ambiguous too.
+type ErrAmbiguousField struct {
+	// Path is the variable path as written in the expression
+	Path string
+	// Field is the ambiguous segment
+	Field string
+	// Type is the Go type of the struct
+	Type string
+	// Candidates are the dotted paths of the fields called Field
+	Candidates []string
+}
+
+func (e *ErrAmbiguousField) Error() string {
+	return fmt.Sprintf("$%s: field %q is ambiguous in %s, it could be %s", e.Path, e.Field, e.Type, strings.Join(e.Candidates, " or "))
+}
+
+// ErrShadowedField is returned by Validate when the conditions tag of a
+// field is the name of another field, which expressions can't reach under
+// that name.
+type ErrShadowedField struct {
+	// Path is the variable path as written in the expression
+	Path string
+	// Field is the Go name of the tagged field
+	Field string
+	// Shadowed is the Go name of the field it shadows
+	Shadowed string
+	// Type is the Go type of the struct
+	Type string
+}
+
+func (e *ErrShadowedField) Error() string {
+	return fmt.Sprintf("$%s: the conditions tag of field %s of %s shadows field %s", e.Path, e.Field, e.Type, e.Shadowed)
+}
+
+// ErrShadowedVariable is returned with Options.ShadowingErrors when a
+// variable is defined by several sources, one hiding the other, see
+// evaluator.lookupValue for their precedence.
+type ErrShadowedVariable struct {
+	// Name of the variable
+	Name string
+	// Site is the definition which wins, such as "layer 1"
+	Site string
+	// Shadowed is the definition it hides, such as "Options.Defaults"
+	Shadowed string
+}
+
+func (e *ErrShadowedVariable) Error() string {
+	return fmt.Sprintf("Variable $%s defined by %s shadows its definition by %s", e.Name, e.Site, e.Shadowed)
+}
+
+// ErrIndexOutOfRange is returned when a variable path indexes a slice
+// out of its bounds, as in $Goods[5] on a slice of 3 elements.
+type ErrIndexOutOfRange struct {
+	// Path is the variable path, indexes written as dotted segments
+	Path string
+	// Index is the index as written in the expression
+	Index int
+	// Length is the actual length of the slice
+	Length int
+}
+
+func (e *ErrIndexOutOfRange) Error() string {
+	return fmt.Sprintf("$%s: index %d out of range, length is %d", e.Path, e.Index, e.Length)
+}
+
+// Pos is the position of a token in a parsed expression.
+type Pos struct {
+	// Offset is the byte offset, starting at 0
+	Offset int
+	// Line is the line number, starting at 1
+	Line int
+	// Column is the character count on the line, starting at 1
+	Column int
+}
+
+// ParseError is returned by Parser.Parse when the expression is malformed.
+type ParseError struct {
+	// Msg describes the problem
+	Msg string
+	// Token is the literal of the offending token, empty at the end of input
+	Token string
+	// Pos is the position of the offending token, zero when no token is at
+	// fault, such as when the whole expression is too complex
+	Pos Pos
+	// Err is the underlying error, such as an *ErrTooComplex
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	if e.Pos.Line == 0 {
+		return e.Msg
+	}
+	if e.Token == "" {
+		return fmt.Sprintf("%s at line %d, column %d (end of input)", e.Msg, e.Pos.Line, e.Pos.Column)
+	}
+	return fmt.Sprintf("%s at line %d, column %d near %q", e.Msg, e.Pos.Line, e.Pos.Column, e.Token)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ErrPrecisionLoss is returned when an unsigned integer argument has no
+// exact float64 value, the type of numbers in expressions, so that
+// comparing it could give wrong results. Integers up to 2^53 always have
+// one, larger ones if they are multiples of a power of two large enough.
+type ErrPrecisionLoss struct {
+	// Name of the argument
+	Name string
+	// Value is the integer in decimal
+	Value string
+}
+
+func (e *ErrPrecisionLoss) Error() string {
+	return fmt.Sprintf("Argument %s is %s, which has no exact float64 value", e.Name, e.Value)
+}
+
+// ErrResolver is returned when a FallibleResolver fails to resolve a
+// variable.
+type ErrResolver struct {
+	// Name of the variable
+	Name string
+	// Err is the error returned by the resolver
+	Err error
+}
+
+func (e *ErrResolver) Error() string {
+	return fmt.Sprintf("Argument %s: %s", e.Name, e.Err)
+}
+
+// Unwrap returns the error of the resolver.
+func (e *ErrResolver) Unwrap() error { return e.Err }
+
+// isUnsupportedKind reports whether values of the kind can never be turned
+// into a literal, so there is no point in reading them.
+func isUnsupportedKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Func, reflect.Chan, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return true
+	}
+	return false
+}
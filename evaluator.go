@@ -1,153 +1,1425 @@
 package conditions
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 var (
 	falseExpr = &BooleanLiteral{Val: false}
 )
 
+// Options tunes how EvaluateWithOptions evaluates an expression.
+// The zero value gives the same behavior as Evaluate.
+type Options struct {
+	// CoerceStrings makes string operands compared against numbers be
+	// parsed as numbers. Strings which are not numbers still fail.
+	CoerceStrings bool
+	// NumberFormat sets the decimal and grouping separators used to parse
+	// strings compared against numbers. Setting it implies CoerceStrings.
+	NumberFormat *NumberFormat
+	// Location, when set, is the time zone used by time operators such as
+	// ISBUSINESSDAY instead of the location of the compared time.
+	Location *time.Location
+	// StructTag is the struct tag used to resolve variables which don't
+	// match a struct field name, json if empty and disabled if "-". Fields
+	// tagged "-" can't be resolved, not even by their name.
+	StructTag string
+	// StrictIntegers makes integer functions such as idiv fail on operands
+	// with a fractional part instead of truncating them.
+	StrictIntegers bool
+	// MemoryBudget, when positive, aborts the evaluation with an
+	// *ErrMemoryBudget once the estimated memory it used exceeds this many
+	// bytes.
+	MemoryBudget int
+	// NaN is how aggregate functions such as sum and avg handle NaN
+	// elements, propagated by default.
+	NaN NaNPolicy
+	// Clock returns the current time used by NOW(), time.Now if nil. Set
+	// it to a fixed time to make evaluations deterministic.
+	Clock func() time.Time
+	// Equality is how == and != handle operands which are not strings,
+	// numbers or booleans, such as slices or times.
+	Equality EqualityMode
+	// NilFalse makes comparisons against nil variables, such as nil
+	// pointer fields, false instead of failing with an *ErrNilValue.
+	// Comparisons with NULL, == NULL being true, are not affected.
+	NilFalse bool
+	// FloatEpsilon, when positive, makes == and != consider two numbers
+	// equal when they differ by at most this much, so that results of
+	// arithmetic like 0.1 + 0.2 == 0.3 hold.
+	FloatEpsilon float64
+	// MaxDepth limits the nesting of the evaluated nodes, and MaxNodes the
+	// number of node evaluations, see ErrTooComplex. Zero means
+	// DefaultMaxDepth and DefaultMaxNodes, a negative value no limit.
+	MaxDepth, MaxNodes int
+	// CaseInsensitiveFields makes variables which match no struct field
+	// or map key exactly match them ignoring case, so that $height finds
+	// a Height field. A name matching several of them, such as map keys
+	// differing only by case, is an *ErrAmbiguousField.
+	CaseInsensitiveFields bool
+	// MissingFalse makes comparisons with an operand referring to a
+	// variable missing from the args, or to a missing field of a dotted
+	// path, false instead of failing with an *ErrMissingVariable or an
+	// *ErrFieldNotFound. So are the negated comparisons such as != and
+	// NOT IN, IS NULL and IS NOT NULL, and ANY and ALL over a missing
+	// slice: a clause on a missing variable never matches. NOT still
+	// negates the result, so that NOT ($x == 1) is true when $x is
+	// missing.
+	MissingFalse bool
+	// OnMissing, when set, is called once per evaluation with the name of
+	// every variable MissingFalse turned a clause false for, such as to
+	// log them.
+	OnMissing func(name string)
+	// OnApply, when set, is called after every application of a binary
+	// operator other than an arithmetic one, with its evaluated operands,
+	// such as to count the comparisons made. AND and OR skipping their
+	// RHS are not applied. The operands are copies: modifying them
+	// changes neither the expression nor the evaluation.
+	OnApply func(op Token, l, r Expr, result bool, err error)
+	// OnResolve, when set, is called every time the value of a variable
+	// is resolved, with its unconverted value or the error of the lookup.
+	// The variables of EXISTS and the slices of ANY and ALL are only
+	// looked up, and not reported.
+	OnResolve func(name string, value interface{}, err error)
+	// Defaults are the values of the variables missing from args, keyed by
+	// their name as written in expressions, such as "user.score" for
+	// $user.score. They are converted like the args, and EXISTS is still
+	// false for them.
+	Defaults map[string]interface{}
+	// ShadowingErrors makes a variable defined by several sources, such
+	// as two layers of LayeredArgs, the args and Defaults, or the args and
+	// the binder of ANY/ALL ... AS, an *ErrShadowedVariable instead of
+	// resolving to the definition which wins.
+	ShadowingErrors bool
+}
+
+// EqualityMode tells == and != what to do with operands which are not
+// strings, numbers or booleans.
+type EqualityMode int
+
+const (
+	// EqualityDefault is EqualityLenient for now, and will become
+	// EqualityStrict in a future version. Set the mode explicitly to keep
+	// the current behavior across the change.
+	EqualityDefault EqualityMode = iota
+	// EqualityLenient makes both == and != false.
+	EqualityLenient
+	// EqualityStrict makes such comparisons an evaluation error.
+	EqualityStrict
+)
+
+// NaNPolicy tells aggregate functions what to do with NaN elements.
+type NaNPolicy int
+
+const (
+	// NaNPropagate makes the result NaN, as with plain float arithmetic.
+	NaNPropagate NaNPolicy = iota
+	// NaNSkip ignores NaN elements, avg divides by the remaining count.
+	NaNSkip
+	// NaNZero counts NaN elements as zero.
+	NaNZero
+	// NaNError makes NaN elements an evaluation error.
+	NaNError
+)
+
+// structTag returns the struct tag used to resolve variables.
+func (o *Options) structTag() string {
+	if o.StructTag == "" {
+		return "json"
+	}
+	return o.StructTag
+}
+
+// evaluator carries the state of a single evaluation.
+type evaluator struct {
+	args interface{}
+	opts *Options
+	// Variables bound by quantifiers to the current element, unconverted
+	bindings map[string]interface{}
+	// Estimated memory used so far, in bytes
+	used int
+	// Rule set resolving rule references, and the results of the rules
+	// evaluated so far
+	rules *RuleSet
+	memo  map[string]ruleResult
+	// Current time returned by NOW(), read from the clock on first use
+	now time.Time
+	// Nesting of the node being evaluated, and nodes evaluated so far
+	depth, nodes int
+	// Keys of the maps looked up ignoring case, by map address, see
+	// foldedKey
+	foldedKeys map[uintptr]foldedMap
+	// Variables reported to Options.OnMissing
+	missing map[string]bool
+	// Trace of the node being evaluated by EvaluateWithTrace
+	trace *Trace
+}
+
 // Evaluate takes an expr and evaluates it using given args
 func Evaluate(expr Expr, args interface{}) (bool, error) {
+	return EvaluateWithOptions(expr, args)
+}
+
+// EvaluateWithOptions takes an expr and evaluates it using given args,
+// applying the behavior tweaks described by opts, in order. Both an
+// Options value and functional options such as WithCoerceStrings are
+// accepted, see Option.
+func EvaluateWithOptions(expr Expr, args interface{}, opts ...Option) (bool, error) {
 	if expr == nil {
 		return false, fmt.Errorf("Provided expression is nil")
 	}
 
-	result, err := evaluateSubtree(expr, args)
+	e := &evaluator{args: indirectArgs(args), opts: collectOptions(opts)}
+	return e.evaluate(expr)
+}
+
+// evaluate evaluates the root expression expr, which must be a boolean.
+func (e *evaluator) evaluate(expr Expr) (bool, error) {
+	result, err := e.evaluateSubtree(expr)
+	if err != nil {
+		return false, err
+	}
+	switch n := result.(type) {
+	case *BooleanLiteral:
+		return n.Val, nil
+	}
+	return false, fmt.Errorf("Unexpected result of the root expression: %#v", result)
+}
+
+// evaluateSubtree performs given expr evaluation recursively, accounting
+// the values it produces against the memory budget.
+func (e *evaluator) evaluateSubtree(expr Expr) (Expr, error) {
+	err := e.enter()
+	defer func() { e.depth-- }()
+	if err != nil {
+		return falseExpr, err
+	}
+
+	var v Expr
+	if e.trace != nil {
+		v, err = e.traceNode(expr)
+	} else {
+		v, err = e.evaluateNode(expr)
+	}
+	if err != nil {
+		return v, err
+	}
+	if v != expr {
+		e.alloc(valueBytes(v))
+	}
+	if err := e.checkBudget(); err != nil {
+		return falseExpr, err
+	}
+	return v, nil
+}
+
+// enter accounts for the evaluation of a node one level deeper, enforcing
+// the complexity limits of the options.
+func (e *evaluator) enter() error {
+	e.depth++
+	e.nodes++
+	if max := complexityLimit(e.opts.MaxDepth, DefaultMaxDepth); max >= 0 && e.depth > max {
+		return &ErrTooComplex{Limit: "depth", Max: max}
+	}
+	if max := complexityLimit(e.opts.MaxNodes, DefaultMaxNodes); max >= 0 && e.nodes > max {
+		return &ErrTooComplex{Limit: "nodes", Max: max}
+	}
+	return nil
+}
+
+// evaluateOperand evaluates the operand x of n. An operand continuing a
+// chain of operators, see continuesChain, is at the depth of n.
+func (e *evaluator) evaluateOperand(n *BinaryExpr, x Expr) (Expr, error) {
+	if continuesChain(n, x) {
+		e.depth--
+		defer func() { e.depth++ }()
+	}
+	return e.evaluateSubtree(x)
+}
+
+// evaluateNode evaluates a single node, its operands with evaluateSubtree.
+func (e *evaluator) evaluateNode(expr Expr) (Expr, error) {
+	if expr == nil {
+		return falseExpr, fmt.Errorf("Provided expression is nil")
+	}
+
+	var (
+		err    error
+		lv, rv Expr
+	)
+
+	switch n := expr.(type) {
+	case *ParenExpr:
+		return e.evaluateSubtree(n.Expr)
+	case *ConditionalExpr:
+		cond, err := e.evaluateSubtree(n.Cond)
+		if err != nil {
+			return falseExpr, err
+		}
+		b, ok := cond.(*BooleanLiteral)
+		if !ok {
+			return falseExpr, fmt.Errorf("Condition %s is not a boolean, got: %v", n.Cond, cond)
+		}
+		// The other branch is never resolved.
+		if b.Val {
+			return e.evaluateSubtree(n.Then)
+		}
+		return e.evaluateSubtree(n.Else)
+	case *BinaryExpr:
+		lv, err = e.evaluateOperand(n, n.LHS)
+		if err != nil {
+			return e.nilComparison(n, err)
+		}
+		// AND and OR skip the RHS once the LHS decides the result.
+		if b, ok := lv.(*BooleanLiteral); ok && ((n.Op == AND && !b.Val) || (n.Op == OR && b.Val)) {
+			return &BooleanLiteral{Val: b.Val}, nil
+		}
+		rv, err = e.evaluateOperand(n, n.RHS)
+		if err != nil {
+			return e.nilComparison(n, err)
+		}
+		if n.Op.isArithmetic() {
+			lv, rv = e.coerceNumbers(lv, rv)
+			v, err := applyArithmetic(n.Op, lv, rv)
+			if err != nil {
+				return falseExpr, &ErrEvaluation{Node: n, Err: typeMismatch(n.Op, lv, rv, err)}
+			}
+			return v, nil
+		}
+		lv, rv = normalizeOperands(n, lv, rv)
+		v, err := e.applyOperator(n.Op, lv, rv)
+		if e.opts.OnApply != nil {
+			e.opts.OnApply(n.Op, copyValue(lv), copyValue(rv), err == nil && v.Val, err)
+		}
+		if err != nil {
+			return falseExpr, &ErrEvaluation{Node: n, Err: err}
+		}
+		return v, nil
+	case *UnaryExpr:
+		if n.Op == ISNULL || n.Op == ISNOTNULL {
+			// Nil variables are NULL, missing ones are still errors.
+			v, err := e.evaluateSubtree(n.Expr)
+			if _, ok := err.(*ErrNilValue); err != nil && !ok {
+				if e.missingFalse(err) {
+					return &BooleanLiteral{Val: false}, nil
+				}
+				return falseExpr, err
+			}
+			null := err != nil || isNull(v)
+			return &BooleanLiteral{Val: null == (n.Op == ISNULL)}, nil
+		}
+		if n.Op == EXISTS {
+			// The variable is only looked up, not converted.
+			exists, err := e.varExists(n.Expr.(*VarRef))
+			if err != nil {
+				return falseExpr, err
+			}
+			return &BooleanLiteral{Val: exists}, nil
+		}
+		v, err := e.evaluateSubtree(n.Expr)
+		if err != nil {
+			return falseExpr, err
+		}
+		result, err := e.applyUnaryOperator(n.Op, v)
+		if err != nil {
+			return falseExpr, &ErrEvaluation{Node: n, Err: typeMismatch(n.Op, v, nil, err)}
+		}
+		return result, nil
+	case *RangeExpr:
+		low, err := e.evaluateSubtree(n.Low)
+		if err != nil {
+			return falseExpr, err
+		}
+		high, err := e.evaluateSubtree(n.High)
+		if err != nil {
+			return falseExpr, err
+		}
+		return &RangeExpr{Low: low, High: high}, nil
+	case *TupleExpr:
+		tuple := &TupleExpr{Elems: make([]Expr, len(n.Elems))}
+		for i, x := range n.Elems {
+			if tuple.Elems[i], err = e.evaluateSubtree(x); err != nil {
+				return falseExpr, err
+			}
+		}
+		return tuple, nil
+	case *QuantifierExpr:
+		return e.evaluateQuantifier(n)
+	case *CallExpr:
+		return e.evaluateCall(n)
+	case *VarRef:
+		return e.resolveVar(n)
+	case *RuleRef:
+		if e.rules == nil {
+			return falseExpr, fmt.Errorf("%s can only be evaluated by a RuleSet", n)
+		}
+		r, err := e.evaluateRule(n.Name)
+		if err != nil {
+			return falseExpr, err
+		}
+		return &BooleanLiteral{Val: r}, nil
+	}
+
+	return expr, nil
+}
+
+// resolveVar returns the value of a variable, see lookupValue.
+func (e *evaluator) resolveVar(n *VarRef) (Expr, error) {
+	val, found, err := e.lookupValue(n)
+	if err == nil && !found {
+		err = e.notFound(n)
+	}
+	if e.opts.OnResolve != nil {
+		e.opts.OnResolve(n.Val, val, err)
+	}
+	if err != nil {
+		return falseExpr, err
+	}
+
+	if val == nil {
+		return falseExpr, &ErrNilValue{Name: n.Val}
+	}
+	// Optional fields are often pointers, such as *string or *time.Time.
+	if v := reflect.ValueOf(val); v.Kind() == reflect.Ptr {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return falseExpr, &ErrNilValue{Name: n.Val, Type: v.Type().String()}
+			}
+			v = v.Elem()
+		}
+		val = v.Interface()
+	}
+	if t, ok := val.(time.Time); ok {
+		return &TimeLiteral{Val: t}, nil
+	}
+	// Durations are int64 underneath, but are not compared to numbers.
+	if d, ok := val.(time.Duration); ok {
+		return &DurationLiteral{Val: d}, nil
+	}
+	// Numbers decoded by a json.Decoder with UseNumber are strings
+	// underneath. Like other numbers they are compared as float64, exact
+	// beyond 2^53 only for the integers a float64 represents.
+	if num, ok := val.(json.Number); ok {
+		f, err := num.Float64()
+		if err != nil {
+			return falseExpr, fmt.Errorf("Argument %s is an invalid json.Number %q", n.Val, num)
+		}
+		return &NumberLiteral{Val: f}, nil
+	}
+
+	kind := reflect.TypeOf(val).Kind()
+	if isUnsupportedKind(kind) {
+		return falseExpr, &ErrUnsupportedFieldType{Name: n.Val, Type: reflect.TypeOf(val).String()}
+	}
+	// Values are read by kind, so that named types such as a
+	// type Port uint16 work too.
+	v := reflect.ValueOf(val)
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		f, err := numberValue(n.Val, v)
+		if err != nil {
+			return falseExpr, err
+		}
+		return &NumberLiteral{Val: f}, nil
+	case reflect.String:
+		return &StringLiteral{Val: v.String()}, nil
+	case reflect.Bool:
+		return &BooleanLiteral{Val: v.Bool()}, nil
+	case reflect.Slice:
+		switch s := val.(type) {
+		case []string:
+			return &SliceStringLiteral{Val: s}, nil
+		case []float64:
+			return &SliceNumberLiteral{Val: s}, nil
+		case []interface{}:
+			return sliceLiteral(n.Val, s)
+		}
+		return reflectSliceLiteral(n.Val, v)
+	case reflect.Map:
+		return toMapLiteral(n.Val, val)
+	}
+	return falseExpr, fmt.Errorf("Unsupported argument %s type: %s", n.Val, kind)
+}
+
+// nilComparison returns the result of the comparison n whose operand
+// failed to evaluate with err. When the options allow it, a nil operand
+// is equal to NULL and makes other comparisons false. The error is
+// returned otherwise.
+func (e *evaluator) nilComparison(n *BinaryExpr, err error) (Expr, error) {
+	if n.Op.Precedence() == EQ.Precedence() && e.missingFalse(err) {
+		return &BooleanLiteral{Val: false}, nil
+	}
+	if _, ok := err.(*ErrNilValue); !ok || n.Op.Precedence() != EQ.Precedence() {
+		return falseExpr, err
+	}
+	if isNull(n.LHS) || isNull(n.RHS) {
+		switch n.Op {
+		case EQ:
+			return &BooleanLiteral{Val: true}, nil
+		case NEQ:
+			return &BooleanLiteral{Val: false}, nil
+		case LT, LTE, GT, GTE:
+			return falseExpr, nullOrdering(n.Op)
+		}
+	}
+	if e.opts.NilFalse {
+		return &BooleanLiteral{Val: false}, nil
+	}
+	return falseExpr, err
+}
+
+// missingFalse reports whether err is about a missing variable which
+// Options.MissingFalse turns into a false clause, and reports the
+// variable to Options.OnMissing.
+func (e *evaluator) missingFalse(err error) bool {
+	if !e.opts.MissingFalse {
+		return false
+	}
+	var name string
+	switch x := err.(type) {
+	case *ErrMissingVariable:
+		name = x.Name
+	case *ErrFieldNotFound:
+		if x.Nil {
+			return false
+		}
+		name = x.Path
+	default:
+		return false
+	}
+	if e.opts.OnMissing != nil && !e.missing[name] {
+		if e.missing == nil {
+			e.missing = map[string]bool{}
+		}
+		e.missing[name] = true
+		e.opts.OnMissing(name)
+	}
+	return true
+}
+
+// mismatch returns an *ErrTypeMismatch described by the format, whose
+// operator and operands are set by typeMismatch.
+func mismatch(format string, a ...interface{}) error {
+	return &ErrTypeMismatch{Err: fmt.Errorf(format, a...)}
+}
+
+// typeMismatch sets the operator op and the kinds of the operands l and r,
+// r being nil for unary operators, of the mismatch err if they aren't set.
+// Other errors are returned untouched.
+func typeMismatch(op Token, l, r Expr, err error) error {
+	m, ok := err.(*ErrTypeMismatch)
+	if !ok || m.Op != ILLEGAL {
+		return err
+	}
+	m = &ErrTypeMismatch{Op: op, Left: operandKind(l), Err: m.Err}
+	if r != nil {
+		m.Right = operandKind(r)
+	}
+	return m
+}
+
+// nullOrdering returns the error of the ordering comparison op on NULL.
+func nullOrdering(op Token) error {
+	return fmt.Errorf("Cannot evaluate %s on NULL, use IS NULL or == NULL", op)
+}
+
+// isNull reports whether x is the NULL literal.
+func isNull(x Expr) bool {
+	_, ok := x.(*NullLiteral)
+	return ok
+}
+
+// lookupVar returns the unconverted value of a variable from the
+// elements bound by quantifiers, or else from the args, see lookupValue.
+func (e *evaluator) lookupVar(n *VarRef) (val interface{}, found bool, err error) {
+	if val, found, err = e.lookupBinding(n); found {
+		return val, found, err
+	}
+	return e.lookupArg(n)
+}
+
+// lookupBinding returns the unconverted element bound to the variable n,
+// or to the first segment of its path, by an enclosing ANY/ALL.
+func (e *evaluator) lookupBinding(n *VarRef) (val interface{}, found bool, err error) {
+	if v, ok := e.bindings[n.Val]; ok {
+		return v, true, nil
+	}
+	if i := strings.IndexByte(n.Val, '.'); i > 0 && !n.Literal {
+		if v, ok := e.bindings[n.Val[:i]]; ok {
+			val, err := e.lookupPath(map[string]interface{}{n.Val[:i]: v}, n.Val)
+			return val, err == nil, err
+		}
+	}
+	return nil, false, nil
+}
+
+// lookupValue returns the unconverted value of the variable n from the
+// first source defining it, every feature reading variables going
+// through it. The sources are, by precedence:
+//
+//  1. the elements bound by the enclosing ANY/ALL quantifiers, innermost
+//     first, and paths into them
+//  2. the args, or the layers of LayeredArgs in order, the first segment
+//     of a dotted path deciding the layer
+//  3. Options.Defaults, for variables missing from the args. A nil value
+//     along a path is not missing.
+//
+// EXISTS only looks the first two up, see varExists. With
+// Options.ShadowingErrors, a variable defined by several sources is an
+// *ErrShadowedVariable, see shadowing and bind.
+func (e *evaluator) lookupValue(n *VarRef) (val interface{}, found bool, err error) {
+	if val, found, err = e.lookupBinding(n); found {
+		return val, found, err
+	}
+	val, found, err = e.lookupArg(n)
+	if found && err == nil && e.opts.ShadowingErrors {
+		if err = e.shadowing(n); err != nil {
+			return nil, false, err
+		}
+	}
+	if found || e.opts.Defaults == nil {
+		return val, found, err
+	}
+	if f, ok := err.(*ErrFieldNotFound); err != nil && (!ok || f.Nil) {
+		return val, found, err
+	}
+	if v, ok := e.opts.Defaults[n.Val]; ok {
+		return v, true, nil
+	}
+	return val, found, err
+}
+
+// definitions returns the sources after the quantifier bindings defining
+// the variable n, in the order of precedence of lookupValue: "args" or
+// "layer 1", "layer 2" and so on, then "Options.Defaults".
+func (e *evaluator) definitions(n *VarRef) []string {
+	var sites []string
+	if layers, ok := e.args.(LayeredArgs); ok {
+		for i, args := range layers {
+			if e.defines(args, n) {
+				sites = append(sites, fmt.Sprintf("layer %d", i+1))
+			}
+		}
+	} else if e.args != nil && e.defines(e.args, n) {
+		sites = append(sites, "args")
+	}
+	if _, ok := e.opts.Defaults[n.Val]; ok {
+		sites = append(sites, "Options.Defaults")
+	}
+	return sites
+}
+
+// defines reports whether args define the variable n, or the first
+// segment of its path.
+func (e *evaluator) defines(args interface{}, n *VarRef) bool {
+	defer func(prev interface{}) { e.args = prev }(e.args)
+	e.args = args
+	if _, found, _ := e.lookupName(n.Val); found {
+		return true
+	}
+	first, _, dotted := strings.Cut(n.Val, ".")
+	if !dotted || n.Literal {
+		return false
+	}
+	_, found, _ := e.lookupName(first)
+	return found
+}
+
+// shadowing returns an *ErrShadowedVariable if the variable n, found in
+// the args, is defined by several of the sources after the bindings.
+func (e *evaluator) shadowing(n *VarRef) error {
+	if sites := e.definitions(n); len(sites) > 1 {
+		return &ErrShadowedVariable{Name: n.Val, Site: sites[0], Shadowed: sites[1]}
+	}
+	return nil
+}
+
+// bind checks, with Options.ShadowingErrors, that the binder of the
+// quantifier n hides no other definition. The implicit binder of
+// ANY $list == "x" rebinds the slice variable on purpose and is not
+// checked.
+func (e *evaluator) bind(n *QuantifierExpr) error {
+	if !e.opts.ShadowingErrors || n.Binder == "" {
+		return nil
+	}
+	site := fmt.Sprintf("the binder of %s $%s", n.Op, n.Var.Val)
+	if _, ok := e.bindings[n.Binder]; ok {
+		return &ErrShadowedVariable{Name: n.Binder, Site: site, Shadowed: "an enclosing quantifier"}
+	}
+	if sites := e.definitions(&VarRef{Val: n.Binder}); len(sites) > 0 {
+		return &ErrShadowedVariable{Name: n.Binder, Site: site, Shadowed: sites[0]}
+	}
+	return nil
+}
+
+// notFound returns the error for a variable missing from every source.
+func (e *evaluator) notFound(n *VarRef) error {
+	if e.args != nil && reflect.TypeOf(e.args).Kind() == reflect.Struct {
+		return &ErrMissingVariable{Name: n.Val, Args: e.args}
+	}
+	return &ErrMissingVariable{Name: n.Val}
+}
+
+// lookupArg returns the unconverted value of the variable n. found is
+// false if args don't define it. A struct field of a type which can never
+// be compared is found, with an *ErrUnsupportedFieldType error.
+// Besides maps and structs, args can be a Resolver, a FallibleResolver,
+// LayeredArgs or a dynamic message such as a *structpb.Struct, see
+// dynamicFields. A dotted name which is not itself a key or field of args
+// is a path through nested values, see lookupPath.
+func (e *evaluator) lookupArg(n *VarRef) (val interface{}, found bool, err error) {
+	val, found, err = e.lookupName(n.Val)
+	if found || err != nil || n.Literal || !strings.Contains(n.Val, ".") {
+		return val, found, err
+	}
+	args := e.args
+	_, layered := args.(LayeredArgs)
+	if _, ok := resolverOf(args); ok || layered {
+		// The path starts from the value of its first segment.
+		first, _, _ := strings.Cut(n.Val, ".")
+		v, ok, err := e.lookupName(first)
+		if !ok || err != nil {
+			return nil, false, err
+		}
+		args = map[string]interface{}{first: v}
+	}
+	if val, err = e.lookupPath(args, n.Val); err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+// lookupName returns the unconverted value of the argument called name.
+func (e *evaluator) lookupName(name string) (val interface{}, found bool, err error) {
+	args := e.args
+	if args == nil {
+		return nil, false, nil
+	}
+	if r, ok := resolverOf(args); ok {
+		return resolveName(r, name)
+	}
+	if layers, ok := args.(LayeredArgs); ok {
+		return e.lookupLayers(layers, name)
+	}
+	if fields, ok := dynamicFields(args); ok {
+		return dynamicField(fields, name)
+	}
+
+	switch reflect.TypeOf(args).Kind() {
+	case reflect.Map:
+		if argsMap, ok := args.(map[string]interface{}); ok && !e.opts.CaseInsensitiveFields {
+			val, found = argsMap[name]
+			return val, found, nil
+		}
+		// Other map types, such as map[string]string, are read by
+		// reflection.
+		m := reflect.ValueOf(args)
+		if m.Type().Key().Kind() != reflect.String {
+			return nil, false, fmt.Errorf("Args: `%v` is a %s, map keys must be strings", args, m.Type())
+		}
+		key := reflect.ValueOf(name).Convert(m.Type().Key())
+		if e.opts.CaseInsensitiveFields && !m.MapIndex(key).IsValid() {
+			folded, err := e.foldedKey(m, name, name)
+			if err != nil || !folded.IsValid() {
+				return nil, false, err
+			}
+			key = folded
+		}
+		v := m.MapIndex(key)
+		if !v.IsValid() {
+			return nil, false, nil
+		}
+		return v.Interface(), true, nil
+	case reflect.Struct:
+		fval, err := e.structField(reflect.ValueOf(args), name, name)
+		if err != nil {
+			return nil, false, err
+		}
+		if !fval.IsValid() {
+			return nil, false, nil
+		}
+		if isUnsupportedKind(fval.Kind()) {
+			return nil, true, &ErrUnsupportedFieldType{Name: name, Type: fval.Type().String()}
+		}
+		return fval.Interface(), true, nil
+	}
+	return nil, false, fmt.Errorf("Args: `%v` is not map or struct", args)
+}
+
+// varExists reports whether a variable is defined, whatever its value.
+func (e *evaluator) varExists(n *VarRef) (bool, error) {
+	_, found, err := e.lookupVar(n)
+	if found {
+		return true, nil
+	}
+	switch err.(type) {
+	case *ErrFieldNotFound, *ErrIndexOutOfRange:
+		return false, nil
+	}
+	return false, err
+}
+
+// evaluateQuantifier evaluates the expression of an ANY/ALL quantifier
+// once per element of the slice, with the binder bound to the element.
+func (e *evaluator) evaluateQuantifier(n *QuantifierExpr) (Expr, error) {
+	val, found, err := e.lookupValue(n.Var)
+	if !found && err == nil {
+		err = e.notFound(n.Var)
+	}
+	if err != nil {
+		if e.missingFalse(err) {
+			return &BooleanLiteral{Val: false}, nil
+		}
+		return falseExpr, err
+	}
+	s := reflect.ValueOf(val)
+	if s.Kind() != reflect.Slice && s.Kind() != reflect.Array {
+		return falseExpr, fmt.Errorf("%s expects %s to be a slice, got: %v", n.Op, n.Var, val)
+	}
+	e.alloc(literalBytes * s.Len())
+	if err := e.checkBudget(); err != nil {
+		return falseExpr, err
+	}
+	if err := e.bind(n); err != nil {
+		return falseExpr, err
+	}
+
+	binder := n.Binder
+	if binder == "" {
+		binder = n.Var.Val
+	}
+	prev, bound := e.bindings[binder]
+	defer func() {
+		if bound {
+			e.bindings[binder] = prev
+		} else {
+			delete(e.bindings, binder)
+		}
+	}()
+	if e.bindings == nil {
+		e.bindings = map[string]interface{}{}
+	}
+
+	// ANY is decided by the first true element, ALL by the first false one.
+	decisive := n.Op == ANY
+	for i := 0; i < s.Len(); i++ {
+		e.bindings[binder] = s.Index(i).Interface()
+		r, err := e.evaluateSubtree(n.Expr)
+		if err != nil {
+			return falseExpr, err
+		}
+		b, err := getBoolean(r)
+		if err != nil {
+			return falseExpr, err
+		}
+		if b == decisive {
+			return &BooleanLiteral{Val: decisive}, nil
+		}
+	}
+	return &BooleanLiteral{Val: !decisive}, nil
+}
+
+// copyValue returns a copy of the evaluated value x, which may be a node
+// of the expression itself, such as a literal operand.
+func copyValue(x Expr) Expr {
+	switch v := x.(type) {
+	case *NumberLiteral:
+		c := *v
+		return &c
+	case *StringLiteral:
+		c := *v
+		return &c
+	case *BooleanLiteral:
+		c := *v
+		return &c
+	case *TimeLiteral:
+		c := *v
+		return &c
+	case *DurationLiteral:
+		c := *v
+		return &c
+	case *SliceStringLiteral:
+		return &SliceStringLiteral{Val: append([]string(nil), v.Val...)}
+	case *SliceNumberLiteral:
+		return &SliceNumberLiteral{Val: append([]float64(nil), v.Val...)}
+	case *MapLiteral:
+		m := make(map[string]interface{}, len(v.Val))
+		for k, val := range v.Val {
+			m[k] = val
+		}
+		return &MapLiteral{Val: m}
+	case *RangeExpr:
+		return &RangeExpr{Low: copyValue(v.Low), High: copyValue(v.High)}
+	case *TupleExpr:
+		t := &TupleExpr{Elems: make([]Expr, len(v.Elems))}
+		for i, x := range v.Elems {
+			t.Elems[i] = copyValue(x)
+		}
+		return t
+	}
+	return x
+}
+
+// applyOperator coerces the operands according to the evaluation options
+// and then dispatches to the operator implementation.
+func (e *evaluator) applyOperator(op Token, l, r Expr) (*BooleanLiteral, error) {
+	if op == BETWEEN {
+		return e.applyBETWEEN(l, r)
+	}
+	switch op {
+	case EQ, NEQ, LT, LTE, GT, GTE:
+		var err error
+		if l, r, err = coerceDurations(l, r); err != nil {
+			return nil, err
+		}
+	}
+	// Values which are not nil differ from NULL, and are not ordered.
+	if isNull(l) || isNull(r) {
+		switch op {
+		case EQ, NEQ:
+			return &BooleanLiteral{Val: isNull(l) == isNull(r) == (op == EQ)}, nil
+		case LT, LTE, GT, GTE:
+			return nil, nullOrdering(op)
+		}
+	}
+	// Booleans would otherwise fail as non-numbers.
+	switch op {
+	case LT, LTE, GT, GTE:
+		_, lb := l.(*BooleanLiteral)
+		_, rb := r.(*BooleanLiteral)
+		if lb || rb {
+			return nil, &ErrTypeMismatch{Op: op, Left: operandKind(l), Right: operandKind(r),
+				Err: fmt.Errorf("Cannot order booleans with %s, compare them with == or !=", op)}
+		}
+	}
+	// Either operand may be the one which is not a scalar.
+	if (op == EQ || op == NEQ) && (!isScalar(l) || !isScalar(r)) {
+		_, slices := slicesEqual(l, r)
+		_, durations := compareDurations(l, r)
+		if !slices && !durations {
+			if e.opts.Equality == EqualityStrict {
+				return nil, &ErrTypeMismatch{Op: op, Left: operandKind(l), Right: operandKind(r), Err: fmt.Errorf("Cannot compare %s with %s", l, r)}
+			}
+			return &BooleanLiteral{Val: false}, nil
+		}
+	}
+	switch op {
+	case EQ, NEQ, LT, LTE, GT, GTE, NEARINT:
+		l, r = e.coerceNumbers(l, r)
+	case BEFORE, AFTER:
+		// $t BEFORE 48h is older than 48 hours, $t AFTER 48h more recent.
+		// A number is a count of days, $t BEFORE 2 being $t BEFORE 48h.
+		switch x := r.(type) {
+		case *DurationLiteral:
+			r = &TimeLiteral{Val: e.currentTime().Add(-x.Val)}
+		case *NumberLiteral:
+			r = &TimeLiteral{Val: e.currentTime().Add(-dayCount(x.Val).Val)}
+		}
+		var err error
+		if l, r, err = coerceTimes(l, r); err != nil {
+			return nil, err
+		}
+	case ISNTHWEEKDAY:
+		var err error
+		if l, err = parseTimeLiteral(l); err != nil {
+			return nil, err
+		}
+		l = e.inLocation(l)
+	case EREG, NEREG, LIKE, NOTLIKE:
+		if p, ok := r.(*StringLiteral); ok {
+			e.alloc(regexBytes * len(p.Val))
+		}
+		if s, ok := l.(*StringLiteral); ok {
+			e.alloc(len(s.Val))
+		}
+	}
+	if op == EQ || op == NEQ {
+		if eq, ok := e.numbersNear(l, r); ok {
+			return &BooleanLiteral{Val: eq == (op == EQ)}, nil
+		}
+	}
+	v, err := applyOperator(op, l, r)
+	if err != nil {
+		return nil, typeMismatch(op, l, r, err)
+	}
+	return v, nil
+}
+
+// numbersNear reports whether the numbers l and r are within the float
+// epsilon of the options. ok is false unless an epsilon is set and both
+// operands are numbers.
+func (e *evaluator) numbersNear(l, r Expr) (near, ok bool) {
+	if e.opts.FloatEpsilon <= 0 {
+		return false, false
+	}
+	a, err := getNumber(l)
+	if err != nil {
+		return false, false
+	}
+	b, err := getNumber(r)
+	if err != nil {
+		return false, false
+	}
+	// Infinities are only equal to themselves.
+	return a == b || math.Abs(a-b) <= e.opts.FloatEpsilon, true
+}
+
+// coerceTimes converts a string operand compared against a time into a
+// time. Such strings must be RFC 3339 timestamps like
+// "2023-01-01T00:00:00Z", with an optional fractional second.
+func coerceTimes(l, r Expr) (Expr, Expr, error) {
+	var err error
+	if _, ok := l.(*TimeLiteral); ok {
+		r, err = parseTimeLiteral(r)
+	} else if _, ok := r.(*TimeLiteral); ok {
+		l, err = parseTimeLiteral(l)
+	}
+	return l, r, err
+}
+
+// coerceDurations converts a string operand compared against a duration
+// into a duration, such as "5s" or "1h30m".
+func coerceDurations(l, r Expr) (Expr, Expr, error) {
+	var err error
+	if _, ok := l.(*DurationLiteral); ok {
+		r, err = parseDurationLiteral(r)
+	} else if _, ok := r.(*DurationLiteral); ok {
+		l, err = parseDurationLiteral(l)
+	}
+	return l, r, err
+}
+
+// parseDurationLiteral returns the duration of a string literal. Other
+// expressions are returned untouched.
+func parseDurationLiteral(x Expr) (Expr, error) {
+	s, ok := x.(*StringLiteral)
+	if !ok {
+		return x, nil
+	}
+	d, err := parseDuration(s.Val)
+	if err != nil {
+		return nil, err
+	}
+	return &DurationLiteral{Val: d}, nil
+}
+
+// parseTimeLiteral returns the time of an RFC 3339 string literal. Other
+// expressions are returned untouched.
+func parseTimeLiteral(x Expr) (Expr, error) {
+	s, ok := x.(*StringLiteral)
+	if !ok {
+		return x, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s.Val)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid time %s, expected an RFC 3339 time like \"2006-01-02T15:04:05Z\": %s", s, err)
+	}
+	return &TimeLiteral{Val: t}, nil
+}
+
+// coerceNumbers converts a string operand compared against a number into a
+// number when the evaluation options allow it. Operands which can not be
+// converted are returned untouched so the operator reports the mismatch.
+func (e *evaluator) coerceNumbers(l, r Expr) (Expr, Expr) {
+	if !e.opts.CoerceStrings && e.opts.NumberFormat == nil {
+		return l, r
+	}
+	if _, ok := l.(*NumberLiteral); ok {
+		return l, e.coerceNumber(r)
+	}
+	if _, ok := r.(*NumberLiteral); ok {
+		return e.coerceNumber(l), r
+	}
+	return l, r
+}
+
+// coerceNumber parses a string literal into a number literal, returning
+// the original expression if it is not a string or can not be parsed.
+func (e *evaluator) coerceNumber(x Expr) Expr {
+	s, ok := x.(*StringLiteral)
+	if !ok {
+		return x
+	}
+	var (
+		v   float64
+		err error
+	)
+	if e.opts.NumberFormat != nil {
+		v, err = e.opts.NumberFormat.ParseFloat(s.Val)
+	} else {
+		v, err = strconv.ParseFloat(strings.TrimSpace(s.Val), 64)
+	}
+	if err != nil {
+		return x
+	}
+	e.alloc(literalBytes)
+	return &NumberLiteral{Val: v}
+}
+
+// applyOperator is a dispatcher of the evaluation according to operator
+func applyOperator(op Token, l, r Expr) (*BooleanLiteral, error) {
+	switch op {
+	case AND:
+		return applyAND(l, r)
+	case OR:
+		return applyOR(l, r)
+	case EQ:
+		return applyEQ(l, r)
+	case NEQ:
+		return applyNQ(l, r)
+	case GT:
+		return applyGT(l, r)
+	case GTE:
+		return applyGTE(l, r)
+	case LT:
+		return applyLT(l, r)
+	case LTE:
+		return applyLTE(l, r)
+	case XOR:
+		return applyXOR(l, r)
+	case NAND:
+		return applyNAND(l, r)
+	case IN:
+		return applyIN(l, r)
+	case CONTAINS:
+		return applyContains(l, r)
+	case NOTIN:
+		return applyNOTIN(l, r)
+	case NOTCONTAINS:
+		return applyNOTCONTAINS(l, r)
+	case INKEYS:
+		return applyINKEYS(l, r)
+	case PHONEEQ:
+		return applyPHONEEQ(l, r)
+	case NEARINT:
+		return applyNEARINT(l, r)
+	case BEFORE:
+		return applyBEFORE(l, r)
+	case AFTER:
+		return applyAFTER(l, r)
+	case SIZEBETWEEN:
+		return applySIZEBETWEEN(l, r)
+	case ISNTHWEEKDAY:
+		return applyISNTHWEEKDAY(l, r)
+	case EREG:
+		return applyEREG(l, r)
+	case NEREG:
+		return applyNEREG(l, r)
+	case LIKE:
+		return applyLIKE(l, r)
+	case NOTLIKE:
+		return applyNOTLIKE(l, r)
+	}
+	if op := lookupCustomOperator(op); op != nil {
+		return op.fn(l, r)
+	}
+	return &BooleanLiteral{Val: false}, &ErrUnsupportedOperator{Op: op}
+}
+
+// applyArithmetic applies an arithmetic operator to number operands.
+// Division always gives a float, use idiv for an integer quotient.
+func applyArithmetic(op Token, l, r Expr) (*NumberLiteral, error) {
+	switch op {
+	case BAND, BOR, BXOR:
+		return applyBitwise(op, l, r)
+	}
+
+	a, err := getNumber(l)
+	if err != nil {
+		return nil, err
+	}
+	b, err := getNumber(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case ADD:
+		return &NumberLiteral{Val: a + b}, nil
+	case SUB:
+		return &NumberLiteral{Val: a - b}, nil
+	case MUL:
+		return &NumberLiteral{Val: a * b}, nil
+	case DIV:
+		if b == 0 {
+			return nil, fmt.Errorf("Division by zero")
+		}
+		return &NumberLiteral{Val: a / b}, nil
+	}
+	return nil, &ErrUnsupportedOperator{Op: op}
+}
+
+// applyBitwise applies a bitwise operator to integer operands.
+func applyBitwise(op Token, l, r Expr) (*NumberLiteral, error) {
+	a, err := getInt(l)
+	if err != nil {
+		return nil, err
+	}
+	b, err := getInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case BAND:
+		return &NumberLiteral{Val: float64(a & b)}, nil
+	case BOR:
+		return &NumberLiteral{Val: float64(a | b)}, nil
+	case BXOR:
+		return &NumberLiteral{Val: float64(a ^ b)}, nil
+	}
+	return nil, &ErrUnsupportedOperator{Op: op}
+}
+
+// applyUnaryOperator is a dispatcher of the evaluation of unary operators
+func (e *evaluator) applyUnaryOperator(op Token, v Expr) (Expr, error) {
+	switch op {
+	case NOT:
+		return applyNOT(v)
+	case ISBUSINESSDAY:
+		return applyISBUSINESSDAY(e.inLocation(v))
+	case ENTROPY:
+		if s, ok := v.(*StringLiteral); ok {
+			e.alloc(elemBytes * len(s.Val))
+		}
+		return applyENTROPY(v)
+	case ISPOWEROFTWO:
+		return applyISPOWEROFTWO(v)
+	}
+	return falseExpr, &ErrUnsupportedOperator{Op: op}
+}
+
+// applyNOT applies NOT operation to the operand
+func applyNOT(v Expr) (*BooleanLiteral, error) {
+	a, err := getBoolean(v)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: !a}, nil
+}
+
+// applyNEARINT applies NEARINT to l/r operands: whether the number l is
+// within the tolerance r of the nearest integer, abs(l - round(l)) <= r.
+// The difference is computed in floating point, a value like 1.01 is not
+// within 0.01 of 1.
+func applyNEARINT(l, r Expr) (*BooleanLiteral, error) {
+	x, err := getNumber(l)
+	if err != nil {
+		return nil, err
+	}
+	tol, err := getNumber(r)
+	if err != nil {
+		return nil, err
+	}
+	if tol < 0 || math.IsNaN(tol) {
+		return nil, fmt.Errorf("NEARINT tolerance must not be negative, got %v", tol)
+	}
+	return &BooleanLiteral{Val: math.Abs(x-math.Round(x)) <= tol}, nil
+}
+
+// applySIZEBETWEEN applies SIZEBETWEEN to l/r operands: whether the
+// length of the slice, map or string l is within the bounds of the range r,
+// bounds included. Strings are measured in characters.
+func applySIZEBETWEEN(l, r Expr) (*BooleanLiteral, error) {
+	var size int
+	switch v := l.(type) {
+	case *StringLiteral:
+		size = utf8.RuneCountInString(v.Val)
+	case *SliceStringLiteral:
+		size = len(v.Val)
+	case *SliceNumberLiteral:
+		size = len(v.Val)
+	case *MapLiteral:
+		size = len(v.Val)
+	default:
+		return nil, mismatch("SIZEBETWEEN expects a slice, map or string, got: %v", l)
+	}
+	rng, ok := r.(*RangeExpr)
+	if !ok {
+		return nil, mismatch("SIZEBETWEEN expects a range, got: %v", r)
+	}
+	low, err := getNumber(rng.Low)
+	if err != nil {
+		return nil, err
+	}
+	high, err := getNumber(rng.High)
+	if err != nil {
+		return nil, err
+	}
+	n := float64(size)
+	return &BooleanLiteral{Val: n >= low && n <= high}, nil
+}
+
+// applyBETWEEN applies BETWEEN to l/r operands: whether l is within the
+// bounds of the range r, bounds included, as compared by >= and <=. So
+// strings are ordered byte-wise, and "B" BETWEEN "A" AND "F".
+func (e *evaluator) applyBETWEEN(l, r Expr) (*BooleanLiteral, error) {
+	rng, ok := r.(*RangeExpr)
+	if !ok {
+		return nil, mismatch("BETWEEN expects a range, got: %v", r)
+	}
+	// Both bounds are compared, so that a bound of the wrong type fails
+	// even when the other one is enough to tell l is out of range.
+	low, err := e.applyOperator(GTE, l, rng.Low)
+	if err != nil {
+		return nil, err
+	}
+	high, err := e.applyOperator(LTE, l, rng.High)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: low.Val && high.Val}, nil
+}
+
+// applyBEFORE applies BEFORE to l/r operands: whether the time l is
+// strictly before the time r.
+func applyBEFORE(l, r Expr) (*BooleanLiteral, error) {
+	a, err := getTime(l)
+	if err != nil {
+		return nil, err
+	}
+	b, err := getTime(r)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: a.Before(b)}, nil
+}
+
+// applyAFTER applies AFTER to l/r operands: whether the time l is strictly
+// after the time r.
+func applyAFTER(l, r Expr) (*BooleanLiteral, error) {
+	a, err := getTime(l)
+	if err != nil {
+		return nil, err
+	}
+	b, err := getTime(r)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: a.After(b)}, nil
+}
+
+// applyISBUSINESSDAY applies ISBUSINESSDAY operation to the operand
+func applyISBUSINESSDAY(v Expr) (*BooleanLiteral, error) {
+	t, err := getTime(v)
+	if err != nil {
+		return nil, err
+	}
+	wd := t.Weekday()
+	return &BooleanLiteral{Val: wd != time.Saturday && wd != time.Sunday}, nil
+}
+
+// applyISNTHWEEKDAY applies ISNTHWEEKDAY to l/r operands: whether the
+// time l falls on the weekday of r, whose elements are an ordinal and a
+// weekday name, and is its nth occurrence in the month. Negative ordinals
+// count from the end of the month, -1 being the last occurrence.
+func applyISNTHWEEKDAY(l, r Expr) (*BooleanLiteral, error) {
+	t, err := getTime(l)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	switch n := result.(type) {
-	case *BooleanLiteral:
-		return n.Val, nil
+	tuple, ok := r.(*TupleExpr)
+	if !ok || len(tuple.Elems) != 2 {
+		return nil, mismatch("ISNTHWEEKDAY expects an ordinal and a weekday, got: %v", r)
 	}
-	return false, fmt.Errorf("Unexpected result of the root expression: %#v", result)
+	n, err := getInt(tuple.Elems[0])
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n < -5 || n > 5 {
+		return nil, fmt.Errorf("ISNTHWEEKDAY ordinal must be between 1 and 5, or -5 and -1 from the end of the month, got %d", n)
+	}
+	name, err := getString(tuple.Elems[1])
+	if err != nil {
+		return nil, err
+	}
+	wd, err := parseWeekday(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Weekday() != wd {
+		return &BooleanLiteral{Val: false}, nil
+	}
+	day := t.Day()
+	if n > 0 {
+		return &BooleanLiteral{Val: int64((day-1)/7+1) == n}, nil
+	}
+	// The day 0 of the next month is the last day of this one.
+	last := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	return &BooleanLiteral{Val: int64((last-day)/7+1) == -n}, nil
 }
 
-// evaluateSubtree performs given expr evaluation recursively
-func evaluateSubtree(expr Expr, args interface{}) (Expr, error) {
-	if expr == nil {
-		return falseExpr, fmt.Errorf("Provided expression is nil")
+// parseWeekday returns the weekday named by its English name or its three
+// letter abbreviation, case insensitive.
+func parseWeekday(name string) (time.Weekday, error) {
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		full := wd.String()
+		if strings.EqualFold(name, full) || strings.EqualFold(name, full[:3]) {
+			return wd, nil
+		}
 	}
+	return 0, fmt.Errorf("Unknown weekday %q", name)
+}
 
-	var (
-		err    error
-		lv, rv Expr
-	)
+// applyISPOWEROFTWO applies ISPOWEROFTWO operation to the operand, which
+// must be an integer. Zero and negative numbers are not powers of two.
+func applyISPOWEROFTWO(v Expr) (*BooleanLiteral, error) {
+	n, err := getInt(v)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: n > 0 && n&(n-1) == 0}, nil
+}
 
-	switch n := expr.(type) {
-	case *ParenExpr:
-		return evaluateSubtree(n.Expr, args)
-	case *BinaryExpr:
-		lv, err = evaluateSubtree(n.LHS, args)
-		if err != nil {
-			return falseExpr, err
-		}
-		rv, err = evaluateSubtree(n.RHS, args)
-		if err != nil {
-			return falseExpr, err
-		}
-		return applyOperator(n.Op, lv, rv)
-	case *VarRef:
-		//index, err := strconv.Atoi(strings.Replace(n.Val, "$", "", -1))
-		index := n.Val
-		if err != nil {
-			return falseExpr, fmt.Errorf("Failed to resolve argument index %s: %s", n.Val, err.Error())
-		}
-		argsKind := reflect.TypeOf(args).Kind()
-		var val interface{}
+// applyENTROPY computes the Shannon entropy, in bits per character, of the
+// string operand
+func applyENTROPY(v Expr) (*NumberLiteral, error) {
+	s, err := getString(v)
+	if err != nil {
+		return nil, err
+	}
 
-		switch argsKind {
-		case reflect.Map:
-			argsMap, ok := args.(map[string]interface{})
-			if !ok {
-				return falseExpr, fmt.Errorf("Args: `%v` convert to map not ok", args)
-			}
-			if _, ok := argsMap[index]; !ok {
-				return falseExpr, fmt.Errorf("Argument: `%v` not found", index)
-			}
-			val, _ = argsMap[index]
-		case reflect.Struct:
-			ps := reflect.ValueOf(args)
-			fval := ps.FieldByName(index)
-			if !fval.IsValid() {
-				return falseExpr, fmt.Errorf("Argument: `%v` not found in args `%v`", index, args)
-			}
-			val = fval.Interface()
-		default:
-			return falseExpr, fmt.Errorf("Args: `%v` is not map or struct", args)
-		}
-
-		kind := reflect.TypeOf(val).Kind()
-		switch kind {
-		case reflect.Int:
-			return &NumberLiteral{Val: float64(val.(int))}, nil
-		case reflect.Int32:
-			return &NumberLiteral{Val: float64(val.(int32))}, nil
-		case reflect.Int64:
-			return &NumberLiteral{Val: float64(val.(int64))}, nil
-		case reflect.Float32:
-			return &NumberLiteral{Val: float64(val.(float32))}, nil
-		case reflect.Float64:
-			return &NumberLiteral{Val: float64(val.(float64))}, nil
-		case reflect.String:
-			return &StringLiteral{Val: val.(string)}, nil
-		case reflect.Bool:
-			return &BooleanLiteral{Val: val.(bool)}, nil
-		case reflect.Slice:
-			return &SliceStringLiteral{Val: val.([]string)}, nil
-		}
-		return falseExpr, fmt.Errorf("Unsupported argument %s type: %s", n.Val, kind)
+	counts := map[rune]int{}
+	n := 0
+	for _, c := range s {
+		counts[c]++
+		n++
 	}
 
-	return expr, nil
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return &NumberLiteral{Val: entropy}, nil
 }
 
-// applyOperator is a dispatcher of the evaluation according to operator
-func applyOperator(op Token, l, r Expr) (*BooleanLiteral, error) {
-	switch op {
-	case AND:
-		return applyAND(l, r)
-	case OR:
-		return applyOR(l, r)
-	case EQ:
-		return applyEQ(l, r)
-	case NEQ:
-		return applyNQ(l, r)
-	case GT:
-		return applyGT(l, r)
-	case GTE:
-		return applyGTE(l, r)
-	case LT:
-		return applyLT(l, r)
-	case LTE:
-		return applyLTE(l, r)
-	case XOR:
-		return applyXOR(l, r)
-	case NAND:
-		return applyNAND(l, r)
-	case IN:
-		return applyIN(l, r)
-	case CONTAINS:
-		return applyContains(l, r)
-	case NOTIN:
-		return applyNOTIN(l, r)
-	case EREG:
-		return applyEREG(l, r)
-	case NEREG:
-		return applyNEREG(l, r)
+// inLocation moves a time literal into the location of the options.
+func (e *evaluator) inLocation(v Expr) Expr {
+	if t, ok := v.(*TimeLiteral); ok && e.opts.Location != nil {
+		return &TimeLiteral{Val: t.Val.In(e.opts.Location)}
 	}
-	return &BooleanLiteral{Val: false}, fmt.Errorf("Unsupported operator: %s", op)
+	return v
 }
 
-// applyEREG applies EREG operation to l/r operands
+// applyNEREG applies NEREG operation to l/r operands
 func applyNEREG(l, r Expr) (*BooleanLiteral, error) {
 	result, err := applyEREG(l, r)
-	result.Val = !result.Val
-	return result, err
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: !result.Val}, nil
 }
 
 // applyEREG applies EREG operation to l/r operands
@@ -174,65 +1446,158 @@ func applyEREG(l, r Expr) (*BooleanLiteral, error) {
 	return &BooleanLiteral{Val: match}, err
 }
 
+// applyNOTLIKE applies NOT LIKE operation to l/r operands
+func applyNOTLIKE(l, r Expr) (*BooleanLiteral, error) {
+	result, err := applyLIKE(l, r)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: !result.Val}, nil
+}
+
+// applyLIKE applies LIKE operation to l/r operands: whether the string l
+// matches the whole SQL pattern r, see likeRegexp.
+func applyLIKE(l, r Expr) (*BooleanLiteral, error) {
+	a, err := getString(l)
+	if err != nil {
+		return nil, err
+	}
+	b, err := getString(r)
+	if err != nil {
+		return nil, err
+	}
+	match, err := regexp.MatchString(likeRegexp(b), a)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: match}, nil
+}
+
+// likeRegexp translates the LIKE pattern into an anchored regular
+// expression: % matches any sequence of characters and _ any single
+// character. A backslash makes the next character literal, as in 100\%.
+func likeRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	// A trailing backslash stands for itself.
+	if escaped {
+		b.WriteString(`\\`)
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
 // applyNOTIN applies NOT IN operation to l/r operands
 func applyNOTIN(l, r Expr) (*BooleanLiteral, error) {
 	result, err := applyIN(l, r)
-	result.Val = !result.Val
-	return result, err
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: !result.Val}, nil
+}
+
+// applyINKEYS applies INKEYS operation to l/r operands
+func applyINKEYS(l, r Expr) (*BooleanLiteral, error) {
+	a, err := getString(l)
+	if err != nil {
+		return nil, err
+	}
+	m, err := getMap(r)
+	if err != nil {
+		return nil, err
+	}
+	_, found := m[a]
+	return &BooleanLiteral{Val: found}, nil
+}
+
+// applyNOTCONTAINS applies NOT CONTAINS operation to l/r operands
+func applyNOTCONTAINS(l, r Expr) (*BooleanLiteral, error) {
+	result, err := applyContains(l, r)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: !result.Val}, nil
 }
 
-// applyContains applies CONTAINS to l/r operations
+// applyContains applies CONTAINS to l/r operations: a string contains a
+// substring, a slice contains an element. A number is searched in a
+// string by its shortest decimal form, "abc123" CONTAINS 12 is true and
+// "v1.50" CONTAINS 1.5 too. Other combinations are an error.
 func applyContains(l, r Expr) (*BooleanLiteral, error) {
-	var (
-		err error
-		in  bool
-	)
 	switch t := r.(type) {
 	case *StringLiteral:
-		var a string
-		var b []string
-		a, err = getString(r)
-		if err != nil {
-			return nil, err
-		}
-
-		b, err = getSliceString(l)
-
-		if err != nil {
-			return nil, err
-		}
-
-		in = false
-		for _, e := range b {
-			if a == e {
-				in = true
+		switch s := l.(type) {
+		case *StringLiteral:
+			return &BooleanLiteral{Val: strings.Contains(s.Val, t.Val)}, nil
+		case *SliceStringLiteral:
+			in := false
+			for _, e := range s.Val {
+				if e == t.Val {
+					in = true
+					break
+				}
 			}
+			return &BooleanLiteral{Val: in}, nil
 		}
 	case *NumberLiteral:
-		var a float64
-		var b []float64
-		a, err = getNumber(r)
-		if err != nil {
-			return nil, err
-		}
-
-		b, err = getSliceNumber(l)
-
-		if err != nil {
-			return nil, err
-		}
-
-		in = false
-		for _, e := range b {
-			if a == e {
-				in = true
+		switch s := l.(type) {
+		case *StringLiteral:
+			return &BooleanLiteral{Val: strings.Contains(s.Val, strconv.FormatFloat(t.Val, 'f', -1, 64))}, nil
+		case *SliceNumberLiteral:
+			in := false
+			for _, e := range s.Val {
+				if e == t.Val {
+					in = true
+					break
+				}
 			}
+			return &BooleanLiteral{Val: in}, nil
 		}
-	default:
-		return nil, fmt.Errorf("Can not evaluate Literal of unknow type %s %T", t, t)
 	}
+	return nil, mismatch("Cannot evaluate %s CONTAINS %s", operandKind(l), operandKind(r))
+}
 
-	return &BooleanLiteral{Val: in}, nil
+// operandKind describes the type of the evaluated operand x in errors.
+func operandKind(x Expr) string {
+	switch x.(type) {
+	case *StringLiteral:
+		return "string"
+	case *NumberLiteral:
+		return "number"
+	case *BooleanLiteral:
+		return "boolean"
+	case *SliceStringLiteral:
+		return "slice of strings"
+	case *SliceNumberLiteral:
+		return "slice of numbers"
+	case *MapLiteral:
+		return "map"
+	case *TimeLiteral:
+		return "time"
+	case *DurationLiteral:
+		return "duration"
+	case *NullLiteral:
+		return "null"
+	case *RangeExpr:
+		return "range"
+	}
+	return fmt.Sprintf("%T", x)
 }
 
 // applyIN applies IN operation to l/r operands
@@ -284,7 +1649,7 @@ func applyIN(l, r Expr) (*BooleanLiteral, error) {
 			}
 		}
 	default:
-		return nil, fmt.Errorf("Can not evaluate Literal of unknow type %s %T", t, t)
+		return nil, mismatch("Can not evaluate Literal of unknow type %s %T", t, t)
 	}
 
 	return &BooleanLiteral{Val: found}, nil
@@ -366,11 +1731,17 @@ func applyEQ(l, r Expr) (*BooleanLiteral, error) {
 		ab, bb bool
 		err    error
 	)
+	if eq, ok := slicesEqual(l, r); ok {
+		return &BooleanLiteral{Val: eq}, nil
+	}
+	if c, ok := compareDurations(l, r); ok {
+		return &BooleanLiteral{Val: c == 0}, nil
+	}
 	as, err = getString(l)
 	if err == nil {
 		bs, err = getString(r)
 		if err != nil {
-			return falseExpr, fmt.Errorf("Cannot compare string with non-string")
+			return falseExpr, mismatch("Cannot compare string with non-string")
 		}
 		return &BooleanLiteral{Val: (as == bs)}, nil
 	}
@@ -378,7 +1749,7 @@ func applyEQ(l, r Expr) (*BooleanLiteral, error) {
 	if err == nil {
 		bn, err = getNumber(r)
 		if err != nil {
-			return falseExpr, fmt.Errorf("Cannot compare number with non-number")
+			return falseExpr, mismatch("Cannot compare number with non-number")
 		}
 		return &BooleanLiteral{Val: (an == bn)}, nil
 	}
@@ -386,7 +1757,7 @@ func applyEQ(l, r Expr) (*BooleanLiteral, error) {
 	if err == nil {
 		bb, err = getBoolean(r)
 		if err != nil {
-			return falseExpr, fmt.Errorf("Cannot compare boolean with non-boolean")
+			return falseExpr, mismatch("Cannot compare boolean with non-boolean")
 		}
 		return &BooleanLiteral{Val: (ab == bb)}, nil
 	}
@@ -401,11 +1772,17 @@ func applyNQ(l, r Expr) (*BooleanLiteral, error) {
 		ab, bb bool
 		err    error
 	)
+	if eq, ok := slicesEqual(l, r); ok {
+		return &BooleanLiteral{Val: !eq}, nil
+	}
+	if c, ok := compareDurations(l, r); ok {
+		return &BooleanLiteral{Val: c != 0}, nil
+	}
 	as, err = getString(l)
 	if err == nil {
 		bs, err = getString(r)
 		if err != nil {
-			return falseExpr, fmt.Errorf("Cannot compare string with non-string")
+			return falseExpr, mismatch("Cannot compare string with non-string")
 		}
 		return &BooleanLiteral{Val: (as != bs)}, nil
 	}
@@ -413,7 +1790,7 @@ func applyNQ(l, r Expr) (*BooleanLiteral, error) {
 	if err == nil {
 		bn, err = getNumber(r)
 		if err != nil {
-			return falseExpr, fmt.Errorf("Cannot compare number with non-number")
+			return falseExpr, mismatch("Cannot compare number with non-number")
 		}
 		return &BooleanLiteral{Val: (an != bn)}, nil
 	}
@@ -421,15 +1798,73 @@ func applyNQ(l, r Expr) (*BooleanLiteral, error) {
 	if err == nil {
 		bb, err = getBoolean(r)
 		if err != nil {
-			return falseExpr, fmt.Errorf("Cannot compare boolean with non-boolean")
+			return falseExpr, mismatch("Cannot compare boolean with non-boolean")
 		}
 		return &BooleanLiteral{Val: (ab != bb)}, nil
 	}
 	return falseExpr, nil
 }
 
+// slicesEqual compares the slices l and r element by element, in order.
+// ok is false unless both are slices of strings or both slices of numbers,
+// an empty slice being comparable to both.
+func slicesEqual(l, r Expr) (equal, ok bool) {
+	ln, lok := sliceLen(l)
+	rn, rok := sliceLen(r)
+	if !lok || !rok {
+		return false, false
+	}
+	if ln == 0 || rn == 0 {
+		return ln == rn, true
+	}
+	switch a := l.(type) {
+	case *SliceStringLiteral:
+		b, ok := r.(*SliceStringLiteral)
+		if !ok {
+			return false, false
+		}
+		if len(a.Val) != len(b.Val) {
+			return false, true
+		}
+		for i := range a.Val {
+			if a.Val[i] != b.Val[i] {
+				return false, true
+			}
+		}
+	case *SliceNumberLiteral:
+		b, ok := r.(*SliceNumberLiteral)
+		if !ok {
+			return false, false
+		}
+		if len(a.Val) != len(b.Val) {
+			return false, true
+		}
+		for i := range a.Val {
+			if a.Val[i] != b.Val[i] {
+				return false, true
+			}
+		}
+	}
+	return true, true
+}
+
+// sliceLen returns the length of a slice literal, and false for other
+// expressions.
+func sliceLen(x Expr) (int, bool) {
+	switch s := x.(type) {
+	case *SliceStringLiteral:
+		return len(s.Val), true
+	case *SliceNumberLiteral:
+		return len(s.Val), true
+	}
+	return 0, false
+}
+
 // applyGT applies > operation to l/r operands
 func applyGT(l, r Expr) (*BooleanLiteral, error) {
+	if c, ok := compareOrdered(l, r); ok {
+		return &BooleanLiteral{Val: c > 0}, nil
+	}
 	var (
 		a, b float64
 		err  error
@@ -447,6 +1882,9 @@ func applyGT(l, r Expr) (*BooleanLiteral, error) {
 
 // applyGTE applies >= operation to l/r operands
 func applyGTE(l, r Expr) (*BooleanLiteral, error) {
+	if c, ok := compareOrdered(l, r); ok {
+		return &BooleanLiteral{Val: c >= 0}, nil
+	}
 	var (
 		a, b float64
 		err  error
@@ -464,6 +1902,9 @@ func applyGTE(l, r Expr) (*BooleanLiteral, error) {
 
 // applyLT applies < operation to l/r operands
 func applyLT(l, r Expr) (*BooleanLiteral, error) {
+	if c, ok := compareOrdered(l, r); ok {
+		return &BooleanLiteral{Val: c < 0}, nil
+	}
 	var (
 		a, b float64
 		err  error
@@ -481,6 +1922,9 @@ func applyLT(l, r Expr) (*BooleanLiteral, error) {
 
 // applyLTE applies <= operation to l/r operands
 func applyLTE(l, r Expr) (*BooleanLiteral, error) {
+	if c, ok := compareOrdered(l, r); ok {
+		return &BooleanLiteral{Val: c <= 0}, nil
+	}
 	var (
 		a, b float64
 		err  error
@@ -502,7 +1946,7 @@ func getBoolean(e Expr) (bool, error) {
 	case *BooleanLiteral:
 		return n.Val, nil
 	default:
-		return false, fmt.Errorf("Literal is not a boolean: %v", n)
+		return false, mismatch("Literal is not a boolean: %v", n)
 	}
 }
 
@@ -512,7 +1956,7 @@ func getString(e Expr) (string, error) {
 	case *StringLiteral:
 		return n.Val, nil
 	default:
-		return "", fmt.Errorf("Literal is not a string: %v", n)
+		return "", mismatch("Literal is not a string: %v", n)
 	}
 }
 
@@ -522,7 +1966,7 @@ func getSliceNumber(e Expr) ([]float64, error) {
 	case *SliceNumberLiteral:
 		return n.Val, nil
 	default:
-		return []float64{}, fmt.Errorf("Literal is not a slice of float64: %v", n)
+		return []float64{}, mismatch("Literal is not a slice of float64: %v", n)
 	}
 }
 
@@ -532,7 +1976,209 @@ func getSliceString(e Expr) ([]string, error) {
 	case *SliceStringLiteral:
 		return n.Val, nil
 	default:
-		return []string{}, fmt.Errorf("Literal is not a slice of string: %v", n)
+		return []string{}, mismatch("Literal is not a slice of string: %v", n)
+	}
+}
+
+// getMap performs type assertion and returns map value or error
+func getMap(e Expr) (map[string]interface{}, error) {
+	switch n := e.(type) {
+	case *MapLiteral:
+		return n.Val, nil
+	default:
+		return nil, mismatch("Literal is not a map: %v", n)
+	}
+}
+
+// sliceLiteral converts a slice of interface{}, such as a JSON array, into
+// a SliceStringLiteral if all its elements are strings and into a
+// SliceNumberLiteral if all are numbers, json.Number included. An empty
+// slice is an empty SliceStringLiteral, in which nothing is found.
+func sliceLiteral(name string, s []interface{}) (Expr, error) {
+	var (
+		strs  []string
+		nums  []float64
+		kinds []string
+	)
+	for _, elem := range s {
+		kind := "number"
+		switch x := elem.(type) {
+		case string:
+			strs, kind = append(strs, x), "string"
+		case float64:
+			nums = append(nums, x)
+		case int:
+			nums = append(nums, float64(x))
+		case int64:
+			nums = append(nums, float64(x))
+		case json.Number:
+			f, err := x.Float64()
+			if err != nil {
+				return falseExpr, fmt.Errorf("Argument %s holds an invalid json.Number %q", name, x)
+			}
+			nums = append(nums, f)
+		default:
+			kind = fmt.Sprintf("%T", elem)
+		}
+		kinds = appendKind(kinds, kind)
+	}
+	switch {
+	case len(kinds) == 0:
+		return &SliceStringLiteral{Val: []string{}}, nil
+	case len(kinds) == 1 && kinds[0] == "string":
+		return &SliceStringLiteral{Val: strs}, nil
+	case len(kinds) == 1 && kinds[0] == "number":
+		return &SliceNumberLiteral{Val: nums}, nil
+	}
+	return falseExpr, fmt.Errorf("Unsupported argument %s: slice elements must be all strings or all numbers, found %s", name, strings.Join(kinds, ", "))
+}
+
+// reflectSliceLiteral converts a slice of any string or numeric element
+// type, such as []int or []Port, into a SliceStringLiteral or a
+// SliceNumberLiteral.
+func reflectSliceLiteral(name string, v reflect.Value) (Expr, error) {
+	switch v.Type().Elem().Kind() {
+	case reflect.String:
+		strs := make([]string, v.Len())
+		for i := range strs {
+			strs[i] = v.Index(i).String()
+		}
+		return &SliceStringLiteral{Val: strs}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		nums := make([]float64, v.Len())
+		for i := range nums {
+			f, err := numberValue(fmt.Sprintf("%s[%d]", name, i), v.Index(i))
+			if err != nil {
+				return falseExpr, err
+			}
+			nums[i] = f
+		}
+		return &SliceNumberLiteral{Val: nums}, nil
+	}
+	return falseExpr, fmt.Errorf("Unsupported argument %s type: %s, slice elements must be strings or numbers", name, v.Type())
+}
+
+// numberValue returns the integer or float v as a float64. Unsigned
+// integers a float64 cannot represent exactly are an *ErrPrecisionLoss,
+// signed ones are rounded as they always were, so that args such as
+// nanosecond timestamps keep working.
+func numberValue(name string, v reflect.Value) (float64, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if f := float64(u); f >= math.MaxUint64 || uint64(f) != u {
+			return 0, &ErrPrecisionLoss{Name: name, Value: strconv.FormatUint(u, 10)}
+		}
+		return float64(u), nil
+	}
+	return v.Float(), nil
+}
+
+// appendKind appends kind to kinds unless already there.
+func appendKind(kinds []string, kind string) []string {
+	for _, seen := range kinds {
+		if seen == kind {
+			return kinds
+		}
+	}
+	return append(kinds, kind)
+}
+
+// toMapLiteral converts a map with string keys into a MapLiteral
+func toMapLiteral(name string, val interface{}) (Expr, error) {
+	mv := reflect.ValueOf(val)
+	if mv.Type().Key().Kind() != reflect.String {
+		return falseExpr, fmt.Errorf("Unsupported argument %s map key type: %s", name, mv.Type().Key())
+	}
+	m := make(map[string]interface{}, mv.Len())
+	iter := mv.MapRange()
+	for iter.Next() {
+		m[iter.Key().String()] = iter.Value().Interface()
+	}
+	return &MapLiteral{Val: m}, nil
+}
+
+// compareTimes returns -1, 0 or 1 as the time l is before, equal to or
+// after the time r. ok is false unless both operands are times.
+func compareTimes(l, r Expr) (c int, ok bool) {
+	a, err := getTime(l)
+	if err != nil {
+		return 0, false
+	}
+	b, err := getTime(r)
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case a.Before(b):
+		return -1, true
+	case a.After(b):
+		return 1, true
+	}
+	return 0, true
+}
+
+// compareDurations returns -1, 0 or 1 as the duration l is shorter than,
+// equal to or longer than the duration r. ok is false unless both operands
+// are durations.
+func compareDurations(l, r Expr) (c int, ok bool) {
+	a, ok := l.(*DurationLiteral)
+	if !ok {
+		return 0, false
+	}
+	b, ok := r.(*DurationLiteral)
+	if !ok {
+		return 0, false
+	}
+	switch {
+	case a.Val < b.Val:
+		return -1, true
+	case a.Val > b.Val:
+		return 1, true
+	}
+	return 0, true
+}
+
+// compareOrdered compares two times, see compareTimes, two durations, see
+// compareDurations, or two strings byte-wise, as Go does.
+func compareOrdered(l, r Expr) (c int, ok bool) {
+	if c, ok := compareTimes(l, r); ok {
+		return c, true
+	}
+	if c, ok := compareDurations(l, r); ok {
+		return c, true
+	}
+	a, ok := l.(*StringLiteral)
+	if !ok {
+		return 0, false
+	}
+	b, ok := r.(*StringLiteral)
+	if !ok {
+		return 0, false
+	}
+	return strings.Compare(a.Val, b.Val), true
+}
+
+// isScalar returns true for string, number and boolean literals.
+func isScalar(x Expr) bool {
+	switch x.(type) {
+	case *StringLiteral, *NumberLiteral, *BooleanLiteral:
+		return true
+	}
+	return false
+}
+
+// getTime performs type assertion and returns time.Time value or error
+func getTime(e Expr) (time.Time, error) {
+	switch n := e.(type) {
+	case *TimeLiteral:
+		return n.Val, nil
+	default:
+		return time.Time{}, mismatch("Literal is not a time: %v", n)
 	}
 }
 
@@ -542,6 +2188,6 @@ func getNumber(e Expr) (float64, error) {
 	case *NumberLiteral:
 		return n.Val, nil
 	default:
-		return 0, fmt.Errorf("Literal is not a number: %v", n)
+		return 0, mismatch("Literal is not a number: %v", n)
 	}
 }
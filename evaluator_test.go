@@ -0,0 +1,3233 @@
+package conditions
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParse(t *testing.T, s string) Expr {
+	t.Helper()
+	expr, err := NewParser(strings.NewReader(s)).Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error parsing %q: %s", s, err)
+	}
+	return expr
+}
+
+func TestNumberFormatParseFloat(t *testing.T) {
+	european := NumberFormat{Decimal: ',', Grouping: '.'}
+	for _, td := range []struct {
+		in    string
+		out   float64
+		isErr bool
+	}{
+		{"3,14", 3.14, false},
+		{"-3,14", -3.14, false},
+		{"1.234,5", 1234.5, false},
+		{"12.345.678", 12345678, false},
+		{"42", 42, false},
+		{"3.14", 0, true},
+		{"1.23,4", 0, true},
+		{"1,2,3", 0, true},
+		{"abc", 0, true},
+		{"", 0, true},
+	} {
+		v, err := european.ParseFloat(td.in)
+		if td.isErr {
+			assert.Error(t, err, td.in)
+			continue
+		}
+		assert.NoError(t, err, td.in)
+		assert.InDelta(t, td.out, v, 1e-9, td.in)
+	}
+
+	v, err := NumberFormat{}.ParseFloat("3.14")
+	assert.NoError(t, err)
+	assert.InDelta(t, 3.14, v, 1e-9)
+}
+
+func TestEvaluateWithNumberFormat(t *testing.T) {
+	expr := mustParse(t, "$Price > 3 AND $Price < 3.5")
+	args := map[string]interface{}{"Price": "3,14"}
+
+	_, err := Evaluate(expr, args)
+	assert.Error(t, err)
+
+	r, err := EvaluateWithOptions(expr, args, Options{NumberFormat: &NumberFormat{Decimal: ',', Grouping: '.'}})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	expr = mustParse(t, "$Price == 1234.5")
+	r, err = EvaluateWithOptions(expr, map[string]interface{}{"Price": "1.234,5"}, Options{NumberFormat: &NumberFormat{Decimal: ',', Grouping: '.'}})
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestINKEYS(t *testing.T) {
+	expr := mustParse(t, `"darkmode" INKEYS $flags`)
+
+	for _, td := range []struct {
+		flags  interface{}
+		result bool
+	}{
+		{map[string]bool{"darkmode": true, "beta": false}, true},
+		{map[string]interface{}{"darkmode": nil}, true},
+		{map[string]bool{"beta": true}, false},
+		{map[string]int{}, false},
+	} {
+		r, err := Evaluate(expr, map[string]interface{}{"flags": td.flags})
+		assert.NoError(t, err)
+		assert.Equal(t, td.result, r, "%v", td.flags)
+	}
+
+	type user struct {
+		Flags map[string]string
+	}
+	r, err := Evaluate(mustParse(t, `$Flags INKEYS $Flags`), user{})
+	assert.Error(t, err)
+	assert.False(t, r)
+
+	r, err = Evaluate(mustParse(t, `"darkmode" INKEYS $Flags`), user{Flags: map[string]string{"darkmode": "on"}})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	_, err = Evaluate(expr, map[string]interface{}{"flags": map[int]bool{1: true}})
+	assert.Error(t, err)
+
+	_, err = Evaluate(expr, map[string]interface{}{"flags": []string{"darkmode"}})
+	assert.Error(t, err)
+}
+
+func TestEvaluateCoerceStrings(t *testing.T) {
+	for _, td := range []struct {
+		cond   string
+		args   map[string]interface{}
+		result bool
+	}{
+		{`$Height > 100`, map[string]interface{}{"Height": "180"}, true},
+		{`$Height <= 100`, map[string]interface{}{"Height": " 99.5 "}, true},
+		{`"180" > 100`, nil, true},
+		{`100 == $Height`, map[string]interface{}{"Height": "100"}, true},
+		{`$Height != 100`, map[string]interface{}{"Height": "1e2"}, false},
+	} {
+		expr := mustParse(t, td.cond)
+
+		_, err := Evaluate(expr, td.args)
+		assert.Error(t, err, "%s without coercion", td.cond)
+
+		r, err := EvaluateWithOptions(expr, td.args, Options{CoerceStrings: true})
+		assert.NoError(t, err, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+	}
+
+	_, err := EvaluateWithOptions(mustParse(t, `$Height > 100`), map[string]interface{}{"Height": "tall"}, Options{CoerceStrings: true})
+	assert.Error(t, err)
+
+	_, err = EvaluateWithOptions(mustParse(t, `$Height == 100`), map[string]interface{}{"Height": "tall"}, Options{CoerceStrings: true})
+	assert.Error(t, err)
+
+	r, err := EvaluateWithOptions(mustParse(t, `$Name == "180"`), map[string]interface{}{"Name": "180"}, Options{CoerceStrings: true})
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestFunctionalOptions(t *testing.T) {
+	expr := mustParse(t, `$Height > 100`)
+	args := map[string]interface{}{"Height": "180"}
+	for name, opts := range map[string][]Option{
+		"functional":       {WithCoerceStrings()},
+		"struct":           {Options{CoerceStrings: true}},
+		"struct then func": {Options{Location: time.UTC}, WithCoerceStrings()},
+		"func then func":   {WithStructTag("json"), WithCoerceStrings()},
+	} {
+		r, err := EvaluateWithOptions(expr, args, opts...)
+		assert.NoError(t, err, name)
+		assert.True(t, r, name)
+	}
+
+	// An Options value replaces the settings of the options before it.
+	_, err := EvaluateWithOptions(expr, args, WithCoerceStrings(), Options{})
+	assert.Error(t, err)
+
+	r, err := EvaluateWithOptions(mustParse(t, `$n == 1`), map[string]interface{}{"n": 1})
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestEqualityMode(t *testing.T) {
+	args := map[string]interface{}{
+		"tags": []string{"a"},
+		"at":   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		"n":    1,
+	}
+	for _, cond := range []string{`$tags == "a"`, `$tags != "a"`, `$at == $at`, `$at == 1`, `"a" == $tags`, `"a" != $tags`, `1 == $at`, `$n != $at`} {
+		expr := mustParse(t, cond)
+		for _, mode := range []EqualityMode{EqualityDefault, EqualityLenient} {
+			r, err := EvaluateWithOptions(expr, args, WithEquality(mode))
+			assert.NoError(t, err, cond)
+			assert.False(t, r, cond)
+		}
+		_, err := EvaluateWithOptions(expr, args, WithEquality(EqualityStrict))
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), "Cannot compare", cond)
+		}
+	}
+
+	r, err := EvaluateWithOptions(mustParse(t, `$n == 1 AND "a" != "b"`), args, Options{Equality: EqualityStrict})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	// Strings, numbers and booleans of different types are never equal:
+	// comparing them is an error in every mode, unless strings are
+	// coerced to numbers.
+	args["code"] = "42"
+	for _, cond := range []string{`$code == 42`, `$code != 42`, `42 == $code`, `$n == true`} {
+		expr := mustParse(t, cond)
+		for _, mode := range []EqualityMode{EqualityDefault, EqualityLenient, EqualityStrict} {
+			_, err := EvaluateWithOptions(expr, args, WithEquality(mode))
+			var m *ErrTypeMismatch
+			assert.True(t, errors.As(err, &m), "%s in mode %d: %v", cond, mode, err)
+		}
+	}
+	for _, mode := range []EqualityMode{EqualityLenient, EqualityStrict} {
+		r, err := EvaluateWithOptions(mustParse(t, `$code == 42 AND $code != 41`), args, WithEquality(mode), WithCoerceStrings())
+		assert.NoError(t, err)
+		assert.True(t, r)
+	}
+}
+
+func TestSliceEquality(t *testing.T) {
+	args := map[string]interface{}{
+		"tags":  []string{"a", "b"},
+		"same":  []string{"a", "b"},
+		"sizes": []float64{1, 2.5},
+		"none":  []interface{}{},
+		"one":   []string{"a"},
+	}
+	for cond, result := range map[string]bool{
+		`$tags == ["a", "b"]`:      true,
+		`$tags != ["a", "b"]`:      false,
+		`$tags == $same`:           true,
+		`$tags == ["b", "a"]`:      false,
+		`$tags != ["b", "a"]`:      true,
+		`$tags == $one`:            false,
+		`$tags == ["a", "b", "c"]`: false,
+		`$tags != $one`:            true,
+		`$sizes == [1, 2.5]`:       true,
+		`$sizes == [2.5, 1]`:       false,
+		`$sizes == [1, 2.5, 4]`:    false,
+		`["a", "b"] == $tags`:      true,
+		`$tags == [1, 2]`:          false,
+		`$none == $none`:           true,
+		`$none == $tags`:           false,
+		`$none != $sizes`:          true,
+	} {
+		expr := mustParse(t, cond)
+		r, err := Evaluate(expr, args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+
+		// Slices of the same kind compare in every equality mode.
+		r, err = EvaluateWithOptions(expr, args, WithEquality(EqualityStrict))
+		if cond == `$tags == [1, 2]` {
+			assert.Error(t, err, cond)
+			continue
+		}
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+}
+
+func TestFloatEpsilon(t *testing.T) {
+	args := map[string]interface{}{"a": 0.1, "b": 0.2, "total": "0.3"}
+	for _, td := range []struct {
+		cond          string
+		exact, within bool
+	}{
+		{`0.1 + 0.2 == 0.3`, false, true},
+		{`0.1 + 0.2 != 0.3`, true, false},
+		{`$a + $b == 0.3`, false, true},
+		{`$a * 3 == 0.3`, false, true},
+		{`$a + $b == $total`, false, true},
+		{`$a == 0.1`, true, true},
+		{`$a + $b == 0.31`, false, false},
+		{`$a + $b != 0.31`, true, true},
+		{`"0.1" == "0.10"`, false, false},
+	} {
+		expr := mustParse(t, td.cond)
+		r, err := EvaluateWithOptions(expr, args, WithCoerceStrings())
+		assert.NoError(t, err, td.cond)
+		assert.Equal(t, td.exact, r, td.cond)
+
+		r, err = EvaluateWithOptions(expr, args, Options{CoerceStrings: true, FloatEpsilon: 1e-9})
+		assert.NoError(t, err, td.cond)
+		assert.Equal(t, td.within, r, td.cond)
+	}
+
+	inf := map[string]interface{}{"x": math.Inf(1), "y": math.Inf(-1), "nan": math.NaN()}
+	for cond, result := range map[string]bool{
+		`$x == $x`:     true,
+		`$x == $y`:     false,
+		`$nan == $nan`: false,
+		`$nan != $nan`: true,
+	} {
+		r, err := EvaluateWithOptions(mustParse(t, cond), inf, WithFloatEpsilon(1e-9))
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+	_, err := EvaluateWithOptions(mustParse(t, `0.1 + 0.2 == "x"`), nil, WithFloatEpsilon(1e-9))
+	assert.Error(t, err)
+}
+
+func TestUnsupportedFieldType(t *testing.T) {
+	type event struct {
+		Name     string
+		Callback func() bool
+		Done     chan struct{}
+		Phase    complex128
+		Raw      unsafe.Pointer
+	}
+	ev := event{Name: "test", Callback: func() bool { return true }, Done: make(chan struct{}), Phase: 1 + 2i}
+
+	// Unreferenced fields of unsupported types are fine.
+	expr := mustParse(t, `$Name == "test"`)
+	r, err := Evaluate(expr, ev)
+	assert.NoError(t, err)
+	assert.True(t, r)
+	assert.NoError(t, Validate(expr, ev))
+	assert.NoError(t, Validate(expr, &ev))
+
+	for field, typ := range map[string]string{
+		"Callback": "func() bool",
+		"Done":     "chan struct {}",
+		"Phase":    "complex128",
+		"Raw":      "unsafe.Pointer",
+	} {
+		expr := mustParse(t, `$Name == "test" AND $`+field+` == true`)
+
+		_, err := Evaluate(expr, ev)
+		var unsupported *ErrUnsupportedFieldType
+		if assert.True(t, errors.As(err, &unsupported), field) {
+			assert.Equal(t, field, unsupported.Name)
+			assert.Equal(t, typ, unsupported.Type)
+			assert.Contains(t, err.Error(), "supported types")
+		}
+
+		err = Validate(expr, reflect.TypeOf(ev))
+		if assert.True(t, errors.As(err, &unsupported), field) {
+			assert.Equal(t, field, unsupported.Name)
+			assert.Equal(t, typ, unsupported.Type)
+		}
+	}
+
+	_, err = Evaluate(mustParse(t, `$Callback == true`), map[string]interface{}{"Callback": func() {}})
+	var unsupported *ErrUnsupportedFieldType
+	assert.True(t, errors.As(err, &unsupported))
+
+	assert.Error(t, Validate(mustParse(t, `$Missing == 1`), ev))
+	assert.Error(t, Validate(expr, map[string]interface{}{}))
+}
+
+// semverGT compares two dotted version strings numerically.
+func semverGT(l, r Expr) (*BooleanLiteral, error) {
+	a, err := getString(l)
+	if err != nil {
+		return nil, err
+	}
+	b, err := getString(r)
+	if err != nil {
+		return nil, err
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, err := strconv.Atoi(as[i])
+		if err != nil {
+			return nil, err
+		}
+		y, err := strconv.Atoi(bs[i])
+		if err != nil {
+			return nil, err
+		}
+		if x != y {
+			return &BooleanLiteral{Val: x > y}, nil
+		}
+	}
+	return &BooleanLiteral{Val: len(as) > len(bs)}, nil
+}
+
+func TestRegisterOperator(t *testing.T) {
+	RegisterOperator("SEMVER_GT", semverGT)
+
+	expr := mustParse(t, `$Version semver_gt "1.9.0" AND $Name == "app" OR $Force`)
+	assert.Equal(t, `Version SEMVER_GT "1.9.0" AND Name == "app" OR Force`, expr.String())
+
+	for _, td := range []struct {
+		args   map[string]interface{}
+		result bool
+	}{
+		{map[string]interface{}{"Version": "1.10.0", "Name": "app", "Force": false}, true},
+		{map[string]interface{}{"Version": "1.8.3", "Name": "app", "Force": false}, false},
+		{map[string]interface{}{"Version": "1.8.3", "Name": "app", "Force": true}, true},
+		{map[string]interface{}{"Version": "2.0", "Name": "other", "Force": false}, false},
+	} {
+		r, err := Evaluate(expr, td.args)
+		assert.NoError(t, err)
+		assert.Equal(t, td.result, r, "%v", td.args)
+	}
+
+	_, err := Evaluate(expr, map[string]interface{}{"Version": 2, "Name": "app", "Force": false})
+	assert.Error(t, err)
+
+	// Registering again replaces the implementation.
+	RegisterOperator("SEMVER_GT", func(l, r Expr) (*BooleanLiteral, error) { return &BooleanLiteral{Val: true}, nil })
+	r, err := Evaluate(mustParse(t, `"1.0" SEMVER_GT "2.0"`), nil)
+	assert.NoError(t, err)
+	assert.True(t, r)
+	RegisterOperator("SEMVER_GT", semverGT)
+
+	assert.Panics(t, func() { RegisterOperator("and", semverGT) })
+	assert.Panics(t, func() { RegisterOperator("SEMVER-GT", semverGT) })
+	assert.Panics(t, func() { RegisterOperator("X", nil) })
+}
+
+func TestEvaluateWithLocation(t *testing.T) {
+	tokyo := time.FixedZone("Asia/Tokyo", 9*60*60)
+	newYork := time.FixedZone("America/New_York", -5*60*60)
+
+	// Friday 23:30 in UTC is already Saturday in Tokyo.
+	friday := map[string]interface{}{"At": time.Date(2024, 1, 5, 23, 30, 0, 0, time.UTC)}
+	// Monday 02:00 in UTC is still Sunday in New York.
+	monday := map[string]interface{}{"At": time.Date(2024, 1, 8, 2, 0, 0, 0, time.UTC)}
+
+	expr := mustParse(t, `$At ISBUSINESSDAY`)
+	for _, td := range []struct {
+		args   map[string]interface{}
+		loc    *time.Location
+		result bool
+	}{
+		{friday, nil, true},
+		{friday, time.UTC, true},
+		{friday, tokyo, false},
+		{friday, newYork, true},
+		{monday, nil, true},
+		{monday, tokyo, true},
+		{monday, newYork, false},
+	} {
+		r, err := EvaluateWithOptions(expr, td.args, Options{Location: td.loc})
+		assert.NoError(t, err)
+		assert.Equal(t, td.result, r, "%v in %v", td.args["At"], td.loc)
+	}
+
+	r, err := EvaluateWithOptions(mustParse(t, `NOT $At ISBUSINESSDAY AND $Open`), map[string]interface{}{"At": friday["At"], "Open": true}, Options{Location: tokyo})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	_, err = Evaluate(expr, map[string]interface{}{"At": "2024-01-05"})
+	assert.Error(t, err)
+}
+
+func TestIsNthWeekday(t *testing.T) {
+	// Fridays of March 2024 fall on the 1st, 8th, 15th, 22nd and 29th.
+	day := func(d int) map[string]interface{} {
+		return map[string]interface{}{"date": time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC), "n": 2}
+	}
+	for _, td := range []struct {
+		cond   string
+		day    int
+		result bool
+	}{
+		// first
+		{`$date ISNTHWEEKDAY 1 "Fri"`, 1, true},
+		{`$date ISNTHWEEKDAY 1 "Fri"`, 8, false},
+		{`$date ISNTHWEEKDAY 1 "Thu"`, 7, true},
+		// second
+		{`$date ISNTHWEEKDAY 2 "Fri"`, 8, true},
+		{`$date ISNTHWEEKDAY 2 "friday"`, 8, true},
+		{`$date ISNTHWEEKDAY $n "FRI"`, 8, true},
+		{`$date ISNTHWEEKDAY 2 "Fri"`, 15, false},
+		{`$date ISNTHWEEKDAY 2 "Sat"`, 8, false},
+		// last, and second to last
+		{`$date ISNTHWEEKDAY -1 "Fri"`, 29, true},
+		{`$date ISNTHWEEKDAY -1 "Fri"`, 22, false},
+		{`$date ISNTHWEEKDAY -2 "Fri"`, 22, true},
+		{`$date ISNTHWEEKDAY 5 "Fri"`, 29, true},
+		{`$date ISNTHWEEKDAY -1 "Sun"`, 31, true},
+		{`$date ISNTHWEEKDAY 4 "Sun"`, 31, false},
+		{`$date ISNTHWEEKDAY 2 "Fri" AND $n == 2`, 8, true},
+	} {
+		r, err := Evaluate(mustParse(t, td.cond), day(td.day))
+		assert.NoError(t, err, "%s on the %d", td.cond, td.day)
+		assert.Equal(t, td.result, r, "%s on the %d", td.cond, td.day)
+	}
+
+	// Friday 1st 23:30 UTC is Saturday 2nd in Tokyo.
+	late := map[string]interface{}{"date": time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)}
+	tokyo := time.FixedZone("Asia/Tokyo", 9*60*60)
+	r, err := EvaluateWithOptions(mustParse(t, `$date ISNTHWEEKDAY 1 "Sat"`), late, Options{Location: tokyo})
+	assert.NoError(t, err)
+	assert.True(t, r)
+	r, err = Evaluate(mustParse(t, `$date ISNTHWEEKDAY 1 "Sat"`), late)
+	assert.NoError(t, err)
+	assert.False(t, r)
+
+	r, err = Evaluate(mustParse(t, `"2024-03-08T10:00:00Z" ISNTHWEEKDAY 2 "Fri"`), nil)
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	assert.Equal(t, `date ISNTHWEEKDAY -1.000 "Fri"`, mustParse(t, `$date isnthweekday -1 "Fri"`).String())
+	for _, cond := range []string{
+		`$date ISNTHWEEKDAY 0 "Fri"`,
+		`$date ISNTHWEEKDAY 6 "Fri"`,
+		`$date ISNTHWEEKDAY 1.5 "Fri"`,
+		`$date ISNTHWEEKDAY 1 "Fryday"`,
+		`$n ISNTHWEEKDAY 1 "Fri"`,
+	} {
+		_, err := Evaluate(mustParse(t, cond), day(1))
+		assert.Error(t, err, cond)
+	}
+	_, err = NewParser(strings.NewReader(`$date ISNTHWEEKDAY 1`)).Parse()
+	assert.Error(t, err)
+}
+
+func TestQuantifiers(t *testing.T) {
+	for _, td := range []struct {
+		cond   string
+		args   map[string]interface{}
+		result bool
+	}{
+		{`ANY $Scores > 90`, map[string]interface{}{"Scores": []float64{50, 95, 60}}, true},
+		{`ANY $Scores > 90`, map[string]interface{}{"Scores": []float64{50, 85, 60}}, false},
+		{`ALL $Scores > 50`, map[string]interface{}{"Scores": []float64{51, 95, 60}}, true},
+		{`ALL $Scores > 50`, map[string]interface{}{"Scores": []float64{51, 50, 60}}, false},
+		{`ANY $Tags == "urgent"`, map[string]interface{}{"Tags": []string{"new", "urgent"}}, true},
+		{`ALL $Tags != "spam" AND $Open`, map[string]interface{}{"Tags": []string{"new", "urgent"}, "Open": true}, true},
+		{`ALL $Tags =~ /^u/`, map[string]interface{}{"Tags": []string{"new", "urgent"}}, false},
+		{`ANY $Scores > $Min`, map[string]interface{}{"Scores": []float64{1, 2}, "Min": 1}, true},
+		{`NOT ANY $Scores > 1`, map[string]interface{}{"Scores": []float64{1, 0}}, true},
+
+		// Empty slices
+		{`ANY $Scores > 90`, map[string]interface{}{"Scores": []float64{}}, false},
+		{`ALL $Scores > 90`, map[string]interface{}{"Scores": []float64{}}, true},
+		{`ANY $Tags == "x"`, map[string]interface{}{"Tags": []string{}}, false},
+		{`ALL $Tags == "x"`, map[string]interface{}{"Tags": []string(nil)}, true},
+	} {
+		expr := mustParse(t, td.cond)
+		r, err := Evaluate(expr, td.args)
+		assert.NoError(t, err, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+	}
+
+	assert.Equal(t, `ANY Scores > 90.000 AND Open`, mustParse(t, `ANY $Scores > 90 AND $Open`).String())
+	assert.Equal(t, []string{"Scores", "Min"}, Variables(mustParse(t, `ANY $Scores > $Min`)))
+
+	_, err := Evaluate(mustParse(t, `ANY $Scores > 1`), map[string]interface{}{"Scores": 3})
+	assert.Error(t, err)
+	_, err = NewParser(strings.NewReader(`ANY 3 > 1`)).Parse()
+	assert.Error(t, err)
+}
+
+func TestQuantifiersOverStructs(t *testing.T) {
+	type item struct {
+		Price    float64
+		Category string
+		Tags     []string
+	}
+	type order struct {
+		Items []item
+		Lines []map[string]interface{}
+		Min   float64
+	}
+	args := order{
+		Items: []item{
+			{Price: 20, Category: "books", Tags: []string{"sale"}},
+			{Price: 150, Category: "electronics", Tags: []string{"new"}},
+		},
+		Lines: []map[string]interface{}{
+			{"sku": "a", "qty": 1},
+			{"sku": "b", "qty": 3},
+		},
+		Min: 10,
+	}
+
+	for cond, result := range map[string]bool{
+		`ANY $Items SATISFIES ($_.Price > 100 AND $_.Category == "electronics")`: true,
+		`ANY $Items SATISFIES ($_.Price > 100 AND $_.Category == "books")`:       false,
+		`ALL $Items SATISFIES $_.Price > $Min`:                                   true,
+		`ALL $Items SATISFIES $_.Price > 100`:                                    false,
+		`ANY $Items AS $item SATISFIES $item.Category == "books"`:                true,
+		`ALL $Items AS $item SATISFIES $item.Category == "books"`:                false,
+		`ANY $Lines SATISFIES ($_.qty > 2 AND $_.sku == "b")`:                    true,
+		`ALL $Lines AS $l SATISFIES $l.qty >= 1`:                                 true,
+		`ANY $Items SATISFIES "new" IN $_.Tags`:                                  true,
+		`ANY $Items SATISFIES $_.Tags[0] == "sale"`:                              true,
+		`NOT ANY $Items SATISFIES $_.Price > 1000`:                               true,
+		// Nested quantifiers, each with its own binder.
+		`ANY $Items AS $i SATISFIES ANY $i.Tags AS $t SATISFIES $t == "new"`: true,
+		`ALL $Items AS $i SATISFIES ANY $i.Tags AS $t SATISFIES $t == "new"`: false,
+		// The binder shadows args only inside the quantifier.
+		`ANY $Items AS $Min SATISFIES $Min.Price > 100 AND $Min == 10`: true,
+		// Legacy form, the element is bound to the slice variable.
+		`ANY $Items[0].Tags == "sale"`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// Empty slices
+	empty := map[string]interface{}{"Items": []item{}}
+	for cond, result := range map[string]bool{
+		`ANY $Items SATISFIES $_.Price > 0`: false,
+		`ALL $Items SATISFIES $_.Price > 0`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), empty)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// Evaluation stops at the first decisive element.
+	calls := 0
+	RegisterOperator("PROBE_GT", func(l, r Expr) (*BooleanLiteral, error) {
+		calls++
+		return applyGT(l, r)
+	})
+	for cond, want := range map[string]int{
+		`ANY $Items SATISFIES $_.Price PROBE_GT 10`:  1,
+		`ANY $Items SATISFIES $_.Price PROBE_GT 100`: 2,
+		`ALL $Items SATISFIES $_.Price PROBE_GT 100`: 1,
+		`ALL $Items SATISFIES $_.Price PROBE_GT 10`:  2,
+	} {
+		calls = 0
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, want, calls, cond)
+	}
+
+	expr := mustParse(t, `ANY $Items SATISFIES ($_.Price > $Min AND $_.Category == "books")`)
+	assert.Equal(t, `ANY Items SATISFIES (_.Price > Min AND _.Category == "books")`, expr.String())
+	assert.Equal(t, []string{"Items", "Min"}, Variables(expr))
+	expr = mustParse(t, `ALL $Items AS $item SATISFIES $item.Price > 1`)
+	assert.Equal(t, `ALL Items AS item SATISFIES item.Price > 1.000`, expr.String())
+	assert.Equal(t, []string{"Items"}, Variables(expr))
+
+	for _, cond := range []string{
+		`ANY $Items SATISFIES $_.Missing > 1`,
+		`ANY $Min SATISFIES $_ > 1`,
+		`ANY $Nope SATISFIES $_ > 1`,
+		// The body binds like a comparison, $_ is unbound after AND.
+		`ANY $Items SATISFIES $_.Price > 1 AND $_.Price < 1000`,
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+	for _, cond := range []string{
+		`ANY $Items SATISFIES`,
+		`ANY $Items AS SATISFIES $_ > 1`,
+		`ANY $Items AS $x $x > 1`,
+		`ANY $Items AS $x`,
+	} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	expr := mustParse(t, `$value ENTROPY > 3.5`)
+	assert.Equal(t, `value ENTROPY > 3.500`, expr.String())
+
+	for value, result := range map[string]bool{
+		"aaaa":                             false,
+		"":                                 false,
+		"password":                         false,
+		"hello world":                      false,
+		"kR9#vT2qLm8$Xw4zPb7N":             true,
+		"AKIAIOSFODNN7EXAMPLEwJalrXUtnFEM": true,
+	} {
+		r, err := Evaluate(expr, map[string]interface{}{"value": value})
+		assert.NoError(t, err, value)
+		assert.Equal(t, result, r, value)
+	}
+
+	for value, entropy := range map[string]float64{"aaaa": 0, "ab": 1, "abcd": 2, "aabb": 1, "": 0} {
+		v, err := applyENTROPY(&StringLiteral{Val: value})
+		assert.NoError(t, err)
+		assert.InDelta(t, entropy, v.Val, 1e-9, value)
+	}
+
+	r, err := Evaluate(mustParse(t, `$value ENTROPY == 0 AND $value == "aaaa"`), map[string]interface{}{"value": "aaaa"})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	_, err = Evaluate(expr, map[string]interface{}{"value": 12})
+	assert.Error(t, err)
+}
+
+func TestIsPowerOfTwo(t *testing.T) {
+	expr := mustParse(t, `$size ISPOWEROFTWO`)
+	assert.Equal(t, `size ISPOWEROFTWO`, expr.String())
+
+	for size, result := range map[interface{}]bool{
+		1:       true,
+		2:       true,
+		8:       true,
+		1024:    true,
+		1 << 62: true,
+		8.0:     true,
+		0:       false,
+		3:       false,
+		6:       false,
+		1000:    false,
+		-8:      false,
+	} {
+		r, err := Evaluate(expr, map[string]interface{}{"size": size})
+		assert.NoError(t, err, size)
+		assert.Equal(t, result, r, size)
+	}
+
+	r, err := Evaluate(mustParse(t, `$size ISPOWEROFTWO AND $size >= 512`), map[string]interface{}{"size": 1024})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	for _, size := range []interface{}{1.5, "8", true, 1e300} {
+		_, err := Evaluate(expr, map[string]interface{}{"size": size})
+		assert.Error(t, err, size)
+	}
+}
+
+func TestNumericKinds(t *testing.T) {
+	type port uint16
+	type level int8
+	type flag bool
+	type status string
+	type server struct {
+		Port    port
+		Level   level
+		Weight  uint
+		Mask    uint8
+		Shard   int16
+		Region  uint32
+		Serial  uint64
+		Handle  uintptr
+		Ratio   float32
+		Enabled flag
+		Status  status
+	}
+	srv := server{Port: 8080, Level: -3, Weight: 10, Mask: 255, Shard: -300, Region: 70000, Serial: 1 << 40, Handle: 7, Ratio: 0.5, Enabled: true, Status: "up"}
+	for _, cond := range []string{
+		`$Port == 8080 AND $Port > 1024`,
+		`$Level < 0 AND $Level == -3`,
+		`$Weight + $Mask == 265`,
+		`$Shard == -300 AND $Region == 70000`,
+		`$Serial == 1099511627776 AND $Handle == 7`,
+		`$Ratio == 0.5 AND $Enabled AND $Status == "up"`,
+	} {
+		r, err := Evaluate(mustParse(t, cond), srv)
+		assert.NoError(t, err, cond)
+		assert.True(t, r, cond)
+	}
+
+	// Unsigned integers are exact as long as a float64 represents them.
+	for _, value := range []interface{}{uint64(1) << 63, uint64(1<<53 + 2), uint(1 << 40)} {
+		r, err := Evaluate(mustParse(t, `$n > 0`), map[string]interface{}{"n": value})
+		assert.NoError(t, err, value)
+		assert.True(t, r, value)
+	}
+	for _, value := range []interface{}{uint64(math.MaxUint64), uint64(1<<63 + 1), uint64(1<<53 + 1)} {
+		_, err := Evaluate(mustParse(t, `$n > 0`), map[string]interface{}{"n": value})
+		var loss *ErrPrecisionLoss
+		assert.ErrorAs(t, err, &loss, value)
+	}
+	_, err := Evaluate(mustParse(t, `$Serial == 1`), server{Serial: 1<<53 + 1})
+	assert.EqualError(t, err, "Argument Serial is 9007199254740993, which has no exact float64 value")
+
+	// Signed integers are rounded, such as nanosecond timestamps and
+	// snowflake IDs.
+	for _, value := range []interface{}{int64(1) << 53, int64(-1) << 62, int64(1<<53 + 1), int64(math.MaxInt64), int64(1700000000123456789)} {
+		r, err := Evaluate(mustParse(t, `$n > 0 OR $n < 0`), map[string]interface{}{"n": value})
+		assert.NoError(t, err, value)
+		assert.True(t, r, value)
+	}
+	r, err := Evaluate(mustParse(t, `$ts > 1600000000000000000`), map[string]interface{}{"ts": time.Now().UnixNano()})
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestNumericSlices(t *testing.T) {
+	type port uint16
+	type tier string
+	type rule struct {
+		Port         int
+		AllowedPorts []int
+		Blocked      []port
+		IDs          []int64
+		Weights      []float32
+		Scores       []float64
+		Tiers        []tier
+		Flags        []bool
+	}
+	args := rule{
+		Port:         443,
+		AllowedPorts: []int{80, 443},
+		Blocked:      []port{23},
+		IDs:          []int64{-1, 1 << 40},
+		Weights:      []float32{0.5},
+		Scores:       []float64{1.5},
+		Tiers:        []tier{"gold"},
+		Flags:        []bool{true},
+	}
+	for _, cond := range []string{
+		`$Port IN $AllowedPorts`,
+		`23 IN $Blocked AND $Port NOT IN $Blocked`,
+		`-1 IN $IDs AND 1099511627776 IN $IDs`,
+		`0.5 IN $Weights AND 1.5 IN $Scores`,
+		`"gold" IN $Tiers`,
+		`$AllowedPorts == [80, 443]`,
+	} {
+		// Slices other than []string used to panic.
+		assert.NotPanics(t, func() {
+			r, err := Evaluate(mustParse(t, cond), args)
+			assert.NoError(t, err, cond)
+			assert.True(t, r, cond)
+		}, cond)
+	}
+
+	_, err := Evaluate(mustParse(t, `true IN $Flags`), args)
+	assert.EqualError(t, err, "Unsupported argument Flags type: []bool, slice elements must be strings or numbers")
+	_, err = Evaluate(mustParse(t, `1 IN $IDs`), map[string]interface{}{"IDs": []uint64{1, 1<<53 + 1}})
+	assert.EqualError(t, err, "Argument IDs[1] is 9007199254740993, which has no exact float64 value")
+	r, err := Evaluate(mustParse(t, `1 IN $IDs`), rule{IDs: []int64{1, 1<<53 + 1}})
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+type person struct {
+	First, Last string
+	Born        int
+}
+
+func (p person) FullName() string             { return p.First + " " + p.Last }
+func (p *person) Age() int                    { return 2024 - p.Born }
+func (p person) Greet(greeting string) string { return greeting + " " + p.First }
+func (p person) Split() (string, string)      { return p.First, p.Last }
+
+type badge struct{ Name string }
+
+func (b badge) Label() string { return "#" + b.Name }
+
+// member promotes the methods of its badge, which may be nil.
+type member struct {
+	*badge
+}
+
+type staff struct {
+	member
+}
+
+func TestStructMethods(t *testing.T) {
+	type team struct {
+		Lead person
+	}
+	ann := person{First: "Ann", Last: "Lee", Born: 1990}
+	for _, args := range []interface{}{ann, &ann} {
+		for _, cond := range []string{
+			`$FullName == "Ann Lee"`,
+			`$Age == 34 AND $First == "Ann"`,
+			`EXISTS $FullName`,
+		} {
+			r, err := Evaluate(mustParse(t, cond), args)
+			assert.NoError(t, err, cond)
+			assert.True(t, r, cond)
+		}
+	}
+	r, err := Evaluate(mustParse(t, `$Lead.FullName == "Ann Lee" AND $Lead.Age > 30`), team{Lead: ann})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	for cond, msg := range map[string]string{
+		`$Greet == "hi Ann"`: "$Greet: method Greet of conditions.person must take no arguments and return a single value",
+		`$Split == "Ann"`:    "$Split: method Split of conditions.person must take no arguments and return a single value",
+		`$Nick == "A"`:       "Argument: `Nick` not found",
+	} {
+		_, err := Evaluate(mustParse(t, cond), ann)
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), msg, cond)
+		}
+	}
+
+	// Methods promoted through a nil embedded pointer are missing, as
+	// fields are.
+	for _, args := range []interface{}{member{}, &member{}, staff{}} {
+		_, err = Evaluate(mustParse(t, `$Label == "#a"`), args)
+		if assert.Error(t, err, "%T", args) {
+			assert.Contains(t, err.Error(), "Argument: `Label` not found", "%T", args)
+		}
+	}
+	for _, args := range []interface{}{member{&badge{"a"}}, staff{member{&badge{"a"}}}} {
+		r, err = Evaluate(mustParse(t, `$Label == "#a"`), args)
+		assert.NoError(t, err, "%T", args)
+		assert.True(t, r, "%T", args)
+	}
+
+	assert.NoError(t, Validate(mustParse(t, `$FullName == "Ann Lee" AND $Age > 30`), person{}))
+	assert.NoError(t, Validate(mustParse(t, `$Lead.FullName == "x"`), team{}))
+	assert.Error(t, Validate(mustParse(t, `$Greet == "x"`), person{}))
+}
+
+func TestStructTags(t *testing.T) {
+	type address struct {
+		City    string `json:"city,omitempty"`
+		Zip     int    `json:"zip" db:"postal_code"`
+		Country string `json:"COUNTRY"`
+		Region  string `json:"region"`
+		Area    string `json:"REGION"`
+		Secret  string `json:"-"`
+		Dash    string `json:"-,"`
+	}
+	addr := address{City: "Berlin", Zip: 10115, Country: "DE", Region: "lower", Area: "upper", Secret: "s", Dash: "d"}
+
+	for _, td := range []struct {
+		cond string
+		opts Options
+	}{
+		{`$city == "Berlin"`, Options{}},
+		{`$City == "Berlin"`, Options{}},
+		{`$zip == 10115 AND $city == "Berlin"`, Options{}},
+		{`$country == "DE"`, Options{}},
+		{`$region == "lower"`, Options{}},
+		{`$REGION == "upper"`, Options{}},
+		{`$Region == "lower"`, Options{}},
+		{`$rEgion == "lower"`, Options{}},
+		{`$postal_code == 10115`, Options{StructTag: "db"}},
+		{`$Secret == "s"`, Options{StructTag: "-"}},
+		{`$Secret == "s"`, Options{StructTag: "db"}},
+		{`$Dash == "d"`, Options{}},
+		{`${-} == "d"`, Options{}},
+	} {
+		r, err := EvaluateWithOptions(mustParse(t, td.cond), addr, td.opts)
+		assert.NoError(t, err, td.cond)
+		assert.True(t, r, td.cond)
+		// Validate agrees with the evaluation.
+		assert.NoError(t, Validate(mustParse(t, td.cond), addr, td.opts), td.cond)
+	}
+
+	for _, td := range []struct {
+		cond string
+		opts Options
+	}{
+		{`$postal_code == 10115`, Options{}},
+		{`$city == "Berlin"`, Options{StructTag: "db"}},
+		{`$city == "Berlin"`, Options{StructTag: "-"}},
+		{`$Secret == "s"`, Options{}},
+		{`$secret == "s"`, Options{}},
+	} {
+		_, err := EvaluateWithOptions(mustParse(t, td.cond), addr, td.opts)
+		assert.Error(t, err, td.cond)
+		assert.Error(t, Validate(mustParse(t, td.cond), addr, td.opts), td.cond)
+	}
+
+	// Go names win over tags matching them only when ignoring case.
+	type zone struct {
+		Area   string `json:"REGION"`
+		Region string `json:"region_code"`
+	}
+	z := zone{Area: "area", Region: "region"}
+	for cond, result := range map[string]bool{
+		`$Region == "region"`:      true,
+		`$REGION == "area"`:        true,
+		`$region == "area"`:        true,
+		`$region_code == "region"`: true,
+		`$Area == "area"`:          true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), z)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+		assert.NoError(t, Validate(mustParse(t, cond), z), cond)
+	}
+
+	// A wire name which is not an identifier is written with ${...}.
+	_, err := NewParser(strings.NewReader(`$- == "d"`)).Parse()
+	assert.Error(t, err)
+
+	// Wire names resolve through nested structs, the mapping of a type
+	// being computed once.
+	type user struct {
+		UserID    int       `json:"user_id"`
+		CreatedAt time.Time `json:"created_at,omitempty"`
+		Address   *address  `json:"address"`
+	}
+	u := user{UserID: 42, CreatedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), Address: &addr}
+	expr := mustParse(t, `$user_id == 42 AND $created_at AFTER "2024-01-01T00:00:00Z" AND $address.city == "Berlin"`)
+	for i := 0; i < 2; i++ {
+		r, err := Evaluate(expr, u)
+		assert.NoError(t, err)
+		assert.True(t, r)
+	}
+	assert.NoError(t, Validate(expr, u))
+	assert.NoError(t, Validate(mustParse(t, `$UserID == 42 AND $address.City == ""`), u))
+	assert.Error(t, Validate(mustParse(t, `$user_id == 42`), u, WithStructTag("db")))
+	assert.NoError(t, Validate(mustParse(t, `$userid == 42`), u, WithCaseInsensitiveFields()))
+	idx, ok := tagIndexes.Load(tagKey{t: reflect.TypeOf(u), tag: "json"})
+	if assert.True(t, ok) {
+		assert.Equal(t, map[string]int{"user_id": 0, "created_at": 1, "address": 2}, idx.(*tagIndex).exact)
+	}
+}
+
+func TestConditionsTag(t *testing.T) {
+	type person struct {
+		Height   int32  `conditions:"height_cm" json:"height"`
+		Weight   int    `json:"weight"`
+		Nickname string `conditions:"Name"`
+		Name     string `json:"name"`
+		Password string `conditions:"-" json:"password"`
+	}
+	p := person{Height: 180, Weight: 75, Nickname: "al", Name: "Albert", Password: "hunter2"}
+
+	for cond, result := range map[string]bool{
+		`$height_cm == 180`: true,
+		`$height == 180`:    true,
+		`$Height == 180`:    true,
+		`$weight == 75`:     true,
+		// The tag wins over the field it collides with.
+		`$Name == "al"`:     true,
+		`$name == "Albert"`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), p)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+	r, err := EvaluateWithOptions(mustParse(t, `$Name == "al" AND $height_cm == 180`), p, WithStructTag("-"))
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	// Secrets can't be reached by any name.
+	for _, cond := range []string{`$Password == "hunter2"`, `$password == "hunter2"`} {
+		_, err := Evaluate(mustParse(t, cond), p)
+		assert.Error(t, err, cond)
+	}
+	r, err = Evaluate(mustParse(t, `EXISTS $Password`), p)
+	assert.NoError(t, err)
+	assert.False(t, r)
+	_, err = Evaluate(mustParse(t, `$User.Password == "hunter2"`), map[string]interface{}{"User": &p})
+	assert.EqualError(t, err, `$User.Password: field "Password" not found`)
+
+	assert.NoError(t, Validate(mustParse(t, `$height_cm > 100 AND $Weight > 50`), p))
+	assert.Error(t, Validate(mustParse(t, `$Password == ""`), p))
+	var shadowed *ErrShadowedField
+	err = Validate(mustParse(t, `$Name == "al"`), p)
+	if assert.ErrorAs(t, err, &shadowed) {
+		assert.Equal(t, "Nickname", shadowed.Field)
+		assert.Equal(t, "Name", shadowed.Shadowed)
+	}
+	assert.EqualError(t, Validate(mustParse(t, `$Owner.Name == "al"`), struct{ Owner *person }{}),
+		"$Owner.Name: the conditions tag of field Nickname of conditions.person shadows field Name")
+}
+
+func TestCaseInsensitiveFields(t *testing.T) {
+	type profile struct {
+		Name    string
+		Height  int
+		HomeURL string `json:"home"`
+		Secret  string `conditions:"-"`
+		embeddedBase
+	}
+	p := profile{Name: "Ann", Height: 170, HomeURL: "x.org", Secret: "s", embeddedBase: embeddedBase{ID: 3}}
+	args := map[string]interface{}{
+		"Profile": p,
+		"Region":  "eu",
+		"Tags":    map[string]interface{}{"Team": "core"},
+		"Limits":  map[string]int{"MAX": 10},
+	}
+
+	for _, cond := range []string{
+		`$name == "Ann" AND $height > 160`,
+		`$NAME == "Ann" AND $homeurl == "x.org" AND $HOME == "x.org"`,
+		`$id == 3`,
+	} {
+		_, err := Evaluate(mustParse(t, cond), p)
+		assert.Error(t, err, "case sensitive by default: %s", cond)
+		r, err := EvaluateWithOptions(mustParse(t, cond), p, WithCaseInsensitiveFields())
+		assert.NoError(t, err, cond)
+		assert.True(t, r, cond)
+	}
+	for _, cond := range []string{
+		`$region == "eu"`,
+		`$profile.name == "Ann" AND $Profile.HEIGHT == 170`,
+		`$tags.team == "core" AND $limits.max == 10`,
+		`EXISTS $REGION AND NOT EXISTS $zone`,
+	} {
+		r, err := EvaluateWithOptions(mustParse(t, cond), args, WithCaseInsensitiveFields())
+		assert.NoError(t, err, cond)
+		assert.True(t, r, cond)
+	}
+
+	// Exact matches win, hidden fields stay hidden.
+	r, err := EvaluateWithOptions(mustParse(t, `$name == "exact"`), map[string]interface{}{"name": "exact", "NAME": "upper"}, WithCaseInsensitiveFields())
+	assert.NoError(t, err)
+	assert.True(t, r)
+	_, err = EvaluateWithOptions(mustParse(t, `$secret == "s"`), p, WithCaseInsensitiveFields())
+	assert.Error(t, err)
+
+	_, err = EvaluateWithOptions(mustParse(t, `$Name == "x"`), map[string]interface{}{"name": 1, "NAME": 2}, WithCaseInsensitiveFields())
+	assert.EqualError(t, err, `$Name: field "Name" is ambiguous in map[string]interface {}, it could be NAME or name`)
+	_, err = EvaluateWithOptions(mustParse(t, `$m.Key == 1`), map[string]interface{}{"m": map[string]int{"key": 1, "KEY": 2}}, WithCaseInsensitiveFields())
+	var amb *ErrAmbiguousField
+	if assert.ErrorAs(t, err, &amb) {
+		assert.Equal(t, []string{"KEY", "key"}, amb.Candidates)
+	}
+	type clash struct{ URL, Url string }
+	_, err = EvaluateWithOptions(mustParse(t, `$url == ""`), clash{}, WithCaseInsensitiveFields())
+	assert.EqualError(t, err, `$url: field "url" is ambiguous in conditions.clash, it could be URL or Url`)
+}
+
+// freshValue is a dynamicValue returning a new copy of its map on every
+// call, which the evaluation holds no reference to once looked up.
+type freshValue map[string]interface{}
+
+func (v freshValue) AsInterface() interface{} {
+	runtime.GC()
+	m := make(map[string]interface{}, len(v))
+	for k, x := range v {
+		m[k] = x
+	}
+	return m
+}
+
+func TestCaseInsensitiveTemporaryMaps(t *testing.T) {
+	msg := plainFields{
+		"a": freshValue{"keyA": 1},
+		"b": freshValue{"keyB": 1},
+	}
+	for i := 0; i < 20; i++ {
+		r, err := EvaluateWithOptions(mustParse(t, `$a.KEYA == 1 AND $b.KEYB == 1 AND $a.keya == 1`), msg, WithCaseInsensitiveFields())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, r)
+	}
+}
+
+func TestConcreteMapArgs(t *testing.T) {
+	type label string
+	type Args map[string]interface{}
+	plain := map[string]interface{}{"env": "prod"}
+	for _, td := range []struct {
+		cond string
+		args interface{}
+	}{
+		{`$env == "prod" AND $region != "us"`, map[string]string{"env": "prod", "region": "eu"}},
+		{`$retries < 3 AND $retries + $delay == 12`, map[string]int{"retries": 2, "delay": 10}},
+		{`$ratio > 0.5`, map[string]float64{"ratio": 0.75}},
+		{`$enabled AND NOT $beta`, map[string]bool{"enabled": true, "beta": false}},
+		{`"admin" IN $roles AND $roles CONTAINS "dev"`, map[string][]string{"roles": {"dev", "admin"}}},
+		{`$env == "prod"`, map[label]string{"env": "prod"}},
+		{`$env.name == "prod"`, map[string]map[string]string{"env": {"name": "prod"}}},
+		{`EXISTS $env AND NOT EXISTS $zone`, map[string]string{"env": ""}},
+		// Defined map types and pointers to maps.
+		{`$env == "prod" AND $retries == 2`, Args{"env": "prod", "retries": 2}},
+		{`$env == "prod"`, &Args{"env": "prod"}},
+		{`$env == "prod"`, &plain},
+		{`$env.name == "prod" AND NOT EXISTS $zone`, Args{"env": Args{"name": "prod"}}},
+		{`$env.name == "prod"`, map[string]interface{}{"env": &Args{"name": "prod"}}},
+	} {
+		r, err := Evaluate(mustParse(t, td.cond), td.args)
+		assert.NoError(t, err, td.cond)
+		assert.True(t, r, td.cond)
+	}
+
+	_, err := Evaluate(mustParse(t, `$zone == "x"`), map[string]string{"env": "prod"})
+	assert.EqualError(t, err, "Argument: `zone` not found")
+	_, err = Evaluate(mustParse(t, `$a == "x"`), map[int]string{1: "x"})
+	assert.EqualError(t, err, "Args: `map[1:x]` is a map[int]string, map keys must be strings")
+}
+
+func TestContainsOperands(t *testing.T) {
+	args := map[string]interface{}{
+		"sku":    "abc123",
+		"price":  "9.90",
+		"tags":   []string{"1", "new"},
+		"sizes":  []float64{38, 42.5},
+		"qty":    12,
+		"flag":   true,
+		"labels": map[string]interface{}{"a": 1},
+	}
+	for cond, result := range map[string]bool{
+		`$sku CONTAINS 12`:     true,
+		`$sku CONTAINS 1234`:   false,
+		`$sku CONTAINS "c1"`:   true,
+		`$price CONTAINS 9.9`:  true,
+		`$price CONTAINS 9.90`: true,
+		`$sizes CONTAINS 42.5`: true,
+		`$tags CONTAINS "1"`:   true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for cond, msg := range map[string]string{
+		`$tags CONTAINS 1`:       "Cannot evaluate slice of strings CONTAINS number in `$tags CONTAINS 1`",
+		`$sizes CONTAINS "38"`:   "Cannot evaluate slice of numbers CONTAINS string in `$sizes CONTAINS \"38\"`",
+		`$qty CONTAINS 1`:        "Cannot evaluate number CONTAINS number in `$qty CONTAINS 1`",
+		`$flag CONTAINS "t"`:     "Cannot evaluate boolean CONTAINS string in `$flag CONTAINS \"t\"`",
+		`$labels CONTAINS "a"`:   "Cannot evaluate map CONTAINS string in `$labels CONTAINS \"a\"`",
+		`$sku CONTAINS $tags`:    "Cannot evaluate string CONTAINS slice of strings in `$sku CONTAINS $tags`",
+		`$sku NOT CONTAINS true`: "Cannot evaluate string CONTAINS boolean in `$sku NOT CONTAINS true`",
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.EqualError(t, err, msg, cond)
+	}
+}
+
+func TestNilArgs(t *testing.T) {
+	args := map[string]interface{}{"x": nil, "n": 5}
+	for _, cond := range []string{
+		`$x == 1`,
+		`$x != "a"`,
+		`$x`,
+		`NOT $x`,
+		`$x + 1 == 2`,
+		`$x IN [1, 2]`,
+		`1 NOT IN $x`,
+		`$x CONTAINS 1`,
+		`$x ? 1 : 2`,
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.EqualError(t, err, "Argument x is nil", cond)
+	}
+
+	// Operand type errors don't panic either.
+	for _, cond := range []string{`"a" NOT IN $n`, `$n NOT CONTAINS 1`, `ANY $x == 1`} {
+		assert.NotPanics(t, func() {
+			_, err := Evaluate(mustParse(t, cond), args)
+			assert.Error(t, err, cond)
+		}, cond)
+	}
+
+	r, err := Evaluate(mustParse(t, `EXISTS $x AND $n == 5`), args)
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestNullLiteral(t *testing.T) {
+	var name *string
+	city := "Paris"
+	args := map[string]interface{}{"x": nil, "name": name, "city": &city, "n": 5}
+
+	// Nil values, typed or not, never panic.
+	for _, cond := range []string{`$x == 1`, `$x > 1`, `$name == "a"`} {
+		assert.NotPanics(t, func() {
+			_, err := Evaluate(mustParse(t, cond), args)
+			var nilErr *ErrNilValue
+			assert.ErrorAs(t, err, &nilErr, cond)
+		}, cond)
+	}
+
+	for cond, result := range map[string]bool{
+		`$x == NULL`:            true,
+		`NULL == $name`:         true,
+		`$x != NULL`:            false,
+		`$x == 1 OR $x > 1`:     false,
+		`$name != "a"`:          false,
+		`$city == NULL`:         false,
+		`$city != null`:         true,
+		`$n != NULL AND $n > 1`: true,
+		`NULL == NULL`:          true,
+	} {
+		r, err := EvaluateWithOptions(mustParse(t, cond), args, WithNilFalse(), WithEquality(EqualityStrict))
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	_, err := Evaluate(mustParse(t, `$n > NULL`), args)
+	assert.Error(t, err)
+	assert.Equal(t, "n == NULL", mustParse(t, `$n == null`).String())
+}
+
+func TestIsNull(t *testing.T) {
+	var middle *string
+	last := "Doe"
+	args := map[string]interface{}{"x": nil, "MiddleName": middle, "LastName": &last, "empty": ""}
+
+	for cond, result := range map[string]bool{
+		`$x IS NULL`:     true,
+		`$x is not null`: false,
+		`$MiddleName IS NULL OR $MiddleName == ""`:     true,
+		`$LastName IS NOT NULL AND $LastName == "Doe"`: true,
+		`$LastName IS NULL`:                            false,
+		`$empty IS NULL`:                               false,
+		`NOT $x IS NULL`:                               false,
+		// == NULL is IS NULL, without NilFalse too.
+		`$x == NULL`:          true,
+		`NULL != $MiddleName`: false,
+		`$LastName != NULL`:   true,
+		`NULL IS NULL`:        true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// Missing variables are not NULL, and NULL is not ordered.
+	for cond, msg := range map[string]string{
+		`$missing IS NULL`:  "not found",
+		`$x > NULL`:         "Cannot evaluate > on NULL",
+		`NULL <= $LastName`: "Cannot evaluate <= on NULL",
+	} {
+		_, err := EvaluateWithOptions(mustParse(t, cond), args, WithNilFalse())
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), msg, cond)
+		}
+	}
+
+	for _, cond := range []string{`$x IS`, `$x IS 5`, `$x IS NOT 5`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+	assert.Equal(t, "x IS NOT NULL", mustParse(t, `$x is not null`).String())
+}
+
+func TestBuiltinPart(t *testing.T) {
+	args := map[string]interface{}{"path": "/api/users/42"}
+	for cond, result := range map[string]bool{
+		`part($path, "/", 2) == "users"`:                    true,
+		`part($path, "/", 3) == "42"`:                       true,
+		`part($path, "/", 0) == ""`:                         true,
+		`PART($path, "/", 1) == "api" AND $path =~ /users/`: true,
+		`part("a,b", ",", 1) == "b"`:                        true,
+		`part($path, "/", 1) == "users"`:                    false,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for _, cond := range []string{
+		`part($path, "/", 4) == "x"`,
+		`part($path, "/", -1) == "x"`,
+		`part($path, "/", 1.5) == "x"`,
+		`part($path, 1, 1) == "x"`,
+		`part($path, "/") == "x"`,
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+
+	expr := mustParse(t, `part($path, "/", 2) == "users"`)
+	assert.Equal(t, `part(path, "/", 2.000) == "users"`, expr.String())
+	assert.Equal(t, []string{"path"}, Variables(expr))
+
+	for _, cond := range []string{`nope($path) == 1`, `part($path, "/" 2) == "x"`, `part($path, "/", 2 == "x"`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestBuiltinOverlaps(t *testing.T) {
+	at := func(h int) time.Time { return time.Date(2024, 3, 1, h, 0, 0, 0, time.UTC) }
+	args := map[string]interface{}{
+		"s9": at(9), "s10": at(10), "s11": at(11), "s12": at(12), "s13": at(13),
+	}
+	for cond, result := range map[string]bool{
+		// overlapping
+		`overlaps($s9, $s11, $s10, $s12)`: true,
+		`overlaps($s10, $s12, $s9, $s11)`: true,
+		`overlaps($s9, $s13, $s10, $s11)`: true,
+		`OVERLAPS($s9, $s11, $s9, $s11)`:  true,
+		`overlaps($s9, $s11, $s10, $s10)`: false,
+		// adjacent: the end is excluded
+		`overlaps($s9, $s10, $s10, $s11)`: false,
+		`overlaps($s10, $s11, $s9, $s10)`: false,
+		// disjoint
+		`overlaps($s9, $s10, $s12, $s13)`:                                         false,
+		`overlaps($s12, $s13, $s9, $s10)`:                                         false,
+		`overlaps($s9, $s11, $s10, $s12) AND NOT overlaps($s9, $s10, $s11, $s12)`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for _, cond := range []string{
+		`overlaps($s11, $s9, $s10, $s12)`,
+		`overlaps($s9, $s11, $s12, $s10)`,
+		`overlaps($s9, $s11, $s10, 12)`,
+		`overlaps($s9, $s11, $s10)`,
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestBuiltinNow(t *testing.T) {
+	type task struct {
+		Deadline time.Time
+		Created  time.Time
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	args := task{Deadline: now.Add(time.Hour), Created: now.Add(-time.Hour)}
+	opts := Options{Clock: func() time.Time { return now }}
+
+	for cond, result := range map[string]bool{
+		`$Deadline > NOW()`:  true,
+		`$Deadline <= now()`: false,
+		`$Created < NOW()`:   true,
+		`$Created >= NOW()`:  false,
+		`NOW() >= NOW()`:     true,
+		`$Deadline AFTER NOW() AND $Created BEFORE NOW()`: true,
+		`NOW() AFTER "2024-03-01T11:59:59Z"`:              true,
+	} {
+		r, err := EvaluateWithOptions(mustParse(t, cond), args, opts)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// The clock is read once per evaluation.
+	calls := 0
+	counting := Options{Clock: func() time.Time {
+		calls++
+		return now.Add(time.Duration(calls) * time.Hour)
+	}}
+	r, err := EvaluateWithOptions(mustParse(t, `NOW() >= NOW() AND NOW() <= NOW()`), args, counting)
+	assert.NoError(t, err)
+	assert.True(t, r)
+	assert.Equal(t, 1, calls)
+
+	// Without a clock, the current time is used.
+	r, err = Evaluate(mustParse(t, `$Created < NOW()`), args)
+	assert.NoError(t, err)
+	assert.True(t, r)
+	r, err = Evaluate(mustParse(t, `$Deadline > NOW()`), task{Deadline: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	assert.Equal(t, `Deadline > now()`, mustParse(t, `$Deadline > NOW()`).String())
+	_, err = EvaluateWithOptions(mustParse(t, `NOW() > 5`), args, opts)
+	assert.Error(t, err)
+	_, err = EvaluateWithOptions(mustParse(t, `NOW(1) > $Created`), args, opts)
+	assert.Error(t, err)
+}
+
+func TestBuiltinConvert(t *testing.T) {
+	// Units of each currency per USD
+	table := map[string]float64{"USD": 1, "EUR": 0.5, "JPY": 150}
+	RegisterRateProvider(func(from, to string) (float64, error) {
+		f, ok := table[from]
+		if !ok {
+			return 0, fmt.Errorf("unknown currency %s", from)
+		}
+		r, ok := table[to]
+		if !ok {
+			return 0, fmt.Errorf("unknown currency %s", to)
+		}
+		return r / f, nil
+	})
+	defer RegisterRateProvider(nil)
+
+	args := map[string]interface{}{"amount": 60, "currency": "EUR", "bad": "XXX"}
+	for cond, result := range map[string]bool{
+		`convert($amount, $currency, "USD") > 100`:                       true,
+		`convert($amount, $currency, "USD") == 120`:                      true,
+		`convert($amount, "usd", "jpy") == 9000`:                         true,
+		`convert($amount, "USD", "USD") == 60`:                           true,
+		`convert($amount, $currency, "USD") > 200 OR $currency == "EUR"`: true,
+		`convert(150, "JPY", $currency) < 1`:                             true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for _, cond := range []string{
+		`convert($amount, $bad, "USD") > 100`,
+		`convert($amount, "USD", "GBP") > 100`,
+		`convert($amount, $bad, $bad) > 100`,
+		`convert($currency, "EUR", "USD") > 100`,
+		`convert($amount, "EUR") > 100`,
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+	_, err := Evaluate(mustParse(t, `convert($amount, $bad, "USD") > 100`), args)
+	assert.Contains(t, err.Error(), "unknown currency XXX")
+
+	RegisterRateProvider(nil)
+	_, err = Evaluate(mustParse(t, `convert($amount, $currency, "USD") > 100`), args)
+	assert.Contains(t, err.Error(), "no rate provider")
+	_, err = Evaluate(mustParse(t, `convert($amount, "USD", "USD") == 60`), args)
+	assert.Contains(t, err.Error(), "no rate provider")
+}
+
+func TestArithmetic(t *testing.T) {
+	args := map[string]interface{}{"Spend": 2500, "Price": 9.99, "Qty": 3, "Zero": 0}
+	for cond, result := range map[string]bool{
+		`$Qty + 1 == 4`:                         true,
+		`$Qty - 5 == -2`:                        true,
+		`$Qty-1 == 2`:                           true,
+		`$Qty - -1 == 4`:                        true,
+		`$Price * $Qty > 29`:                    true,
+		`$Spend / 1000 == 2.5`:                  true,
+		`$Qty / 2 == 1.5`:                       true,
+		`1 + 2 * 3 == 7`:                        true,
+		`(1 + 2) * 3 == 9`:                      true,
+		`10 - 4 - 3 == 3`:                       true,
+		`8 / 4 / 2 == 1`:                        true,
+		`$Qty * 2 > 5 AND $Spend - 500 >= 2000`: true,
+		`$Spend / 1000 > 3 OR $Qty + 1 > 3`:     true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	assert.Equal(t, `1.000 + 2.000 * 3.000 == 7.000`, mustParse(t, `1 + 2 * 3 == 7`).String())
+
+	for _, cond := range []string{`$Qty / $Zero > 1`, `$Qty + "1" > 1`, `"a" + "b" == "ab"`, `$Qty + 1`} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+
+	r, err := EvaluateWithOptions(mustParse(t, `$Qty + $n == 5`), map[string]interface{}{"Qty": 3, "n": "2"}, Options{CoerceStrings: true})
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestRoundingBuiltins(t *testing.T) {
+	for cond, result := range map[string]float64{
+		`floor(2.5)`:              2,
+		`ceil(2.5)`:               3,
+		`round(2.5)`:              3,
+		`trunc(2.5)`:              2,
+		`floor(-2.5)`:             -3,
+		`ceil(-2.5)`:              -2,
+		`round(-2.5)`:             -3,
+		`trunc(-2.5)`:             -2,
+		`round(0.5)`:              1,
+		`round(1.5)`:              2,
+		`round(-0.5)`:             -1,
+		`round(2.49)`:             2,
+		`floor(-7 / 2)`:           -4,
+		`trunc(-7 / 2)`:           -3,
+		`idiv(7, 2)`:              3,
+		`idiv(-7, 2)`:             -3,
+		`idiv(7, -2)`:             -3,
+		`idiv(7.9, 2)`:            3,
+		`floor($Spend / 1000)`:    2,
+		`abs(-2.5)`:               2.5,
+		`abs(3)`:                  3,
+		`abs(0)`:                  0,
+		`abs(-7 / 2)`:             3.5,
+		`floor(abs($Delta) / 10)`: 4,
+		`ceil($Delta / 10)`:       -4,
+		`round($Delta / 10)`:      -5,
+	} {
+		expr := mustParse(t, cond+` == $want`)
+		r, err := Evaluate(expr, map[string]interface{}{"want": result, "Spend": 2999, "Delta": -45})
+		assert.NoError(t, err, cond)
+		assert.True(t, r, cond)
+	}
+
+	strict := Options{StrictIntegers: true}
+	r, err := EvaluateWithOptions(mustParse(t, `idiv(9, 2) == 4`), nil, strict)
+	assert.NoError(t, err)
+	assert.True(t, r)
+	for _, cond := range []string{`idiv(7.5, 2) == 3`, `idiv(7, 2.5) == 2`} {
+		_, err := EvaluateWithOptions(mustParse(t, cond), nil, strict)
+		assert.Error(t, err, cond)
+	}
+
+	for _, cond := range []string{`idiv(7, 0) == 1`, `idiv(7, 0.5) == 1`, `floor("2") == 2`, `round(1, 2) == 1`, `abs("-1") == 1`, `abs() == 1`} {
+		_, err := Evaluate(mustParse(t, cond), nil)
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	const (
+		read  = 1
+		write = 2
+		exec  = 4
+	)
+	args := map[string]interface{}{"Flags": read | exec, "Mask": 0xF0}
+	for cond, result := range map[string]bool{
+		`$Flags BAND 4 == 4`:                        true,
+		`$Flags BAND 2 == 2`:                        false,
+		`$Flags BAND 2 == 0 AND $Flags BAND 1 == 1`: true,
+		`$Flags band 5 == 5`:                        true,
+		`$Flags BOR 2 == 7`:                         true,
+		`$Flags BXOR 5 == 0`:                        true,
+		`$Flags BXOR 1 == 4`:                        true,
+		`$Flags BAND 0b100 == 0o4`:                  true,
+		`$Mask BAND 0x30 == 48`:                     true,
+		`$Flags BOR 8 BAND 8 == 13`:                 true,
+		`($Flags BOR 8) BAND 8 == 8`:                true,
+		`$Flags BAND 1 + 3 == 5`:                    false,
+		`$Flags BAND 4 != 0 OR $Flags BAND 2 != 0`:  true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	assert.Equal(t, `Flags BOR 8.000 BAND 8.000 == 13.000`, mustParse(t, `$Flags BOR 8 BAND 8 == 13`).String())
+
+	for _, cond := range []string{`$Flags BAND 1.5 == 1`, `$Flags BOR "1" == 1`, `true BAND $Flags == 1`, `$Flags BXOR 1e300 == 1`} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	list := make([]string, 5000)
+	nums := make([]float64, 5000)
+	for i := range list {
+		list[i] = "item-" + strconv.Itoa(i)
+		nums[i] = float64(i)
+	}
+	long := strings.Repeat("a,", 20000) + "b"
+	keys := map[string]interface{}{}
+	for i := 0; i < 5000; i++ {
+		keys["key-"+strconv.Itoa(i)] = i
+	}
+	args := map[string]interface{}{"list": list, "nums": nums, "long": long, "keys": keys, "n": "42"}
+
+	for _, cond := range []string{
+		// A large slice argument referenced by IN, then by ANY
+		`"item-4999" IN $list AND ANY $list == "item-1"`,
+		// ANY binding each element and matching it against a regular expression
+		`ANY $nums > 4998 AND ALL $list =~ /^item-\d+$/`,
+		// Splitting a long string with part and scanning it with ENTROPY
+		`part($long, ",", 19999) == "a" AND $long ENTROPY > 0`,
+		// A large map argument checked with INKEYS several times
+		`"key-1" INKEYS $keys AND "key-2" INKEYS $keys AND "key-3" INKEYS $keys`,
+		// A regular expression on a long subject combined with coercion
+		`$n > 1 AND $long =~ /b$/ AND $long !~ /^b/`,
+	} {
+		expr := mustParse(t, cond)
+
+		r, err := EvaluateWithOptions(expr, args, Options{CoerceStrings: true})
+		assert.NoError(t, err, cond)
+		assert.True(t, r, cond)
+		r, err = EvaluateWithOptions(expr, args, Options{CoerceStrings: true, MemoryBudget: 100 << 20})
+		assert.NoError(t, err, cond)
+		assert.True(t, r, cond)
+
+		_, err = EvaluateWithOptions(expr, args, Options{CoerceStrings: true, MemoryBudget: 64 << 10})
+		var budgetErr *ErrMemoryBudget
+		if assert.True(t, errors.As(err, &budgetErr), "%s: %v", cond, err) {
+			assert.Equal(t, 64<<10, budgetErr.Budget)
+			assert.Greater(t, budgetErr.Used, budgetErr.Budget, cond)
+		}
+	}
+
+	// Small evaluations fit in a small budget.
+	r, err := EvaluateWithOptions(mustParse(t, `$n == "42" AND $n =~ /^4/`), args, WithMemoryBudget(1<<10))
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestAggregateNaN(t *testing.T) {
+	args := map[string]interface{}{
+		"values": []float64{1, math.NaN(), 5},
+		"nans":   []float64{math.NaN()},
+		"empty":  []float64{},
+	}
+	sum, avg := mustParse(t, `sum($values) == $want`), mustParse(t, `avg($values) == $want`)
+
+	for _, td := range []struct {
+		policy   NaNPolicy
+		sum, avg float64
+	}{
+		{NaNSkip, 6, 3},
+		{NaNZero, 6, 2},
+	} {
+		args["want"] = td.sum
+		r, err := EvaluateWithOptions(sum, args, Options{NaN: td.policy})
+		assert.NoError(t, err)
+		assert.True(t, r, "sum with policy %d", td.policy)
+
+		args["want"] = td.avg
+		r, err = EvaluateWithOptions(avg, args, Options{NaN: td.policy})
+		assert.NoError(t, err)
+		assert.True(t, r, "avg with policy %d", td.policy)
+	}
+
+	// NaN propagates by default and compares unequal to everything.
+	for _, cond := range []string{`sum($values) != sum($values)`, `avg($values) != avg($values)`, `NOT sum($values) > 0`} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.True(t, r, cond)
+	}
+
+	for _, cond := range []string{`sum($values) > 0`, `avg($values) > 0`} {
+		_, err := EvaluateWithOptions(mustParse(t, cond), args, Options{NaN: NaNError})
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), "element 1 is NaN")
+		}
+	}
+
+	r, err := EvaluateWithOptions(mustParse(t, `sum($nans) == 0 AND sum($empty) == 0`), args, Options{NaN: NaNSkip})
+	assert.NoError(t, err)
+	assert.True(t, r)
+	for _, cond := range []string{`avg($nans) == 0`, `avg($empty) == 0`, `sum("1") == 1`} {
+		_, err := EvaluateWithOptions(mustParse(t, cond), args, Options{NaN: NaNSkip})
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestExists(t *testing.T) {
+	args := map[string]interface{}{"user.email": "", "user.name": "Ann", "nothing": nil}
+	for cond, result := range map[string]bool{
+		`EXISTS $user.email`:                        true,
+		`EXISTS [user][email]`:                      true,
+		`EXISTS $user.email AND $user.email == ""`:  true,
+		`EXISTS $user.phone`:                        false,
+		`NOT EXISTS $user.phone`:                    true,
+		`exists $nothing`:                           true,
+		`EXISTS $user.phone OR $user.name == "Ann"`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	type account struct {
+		Email string
+		Phone *string `json:"phone"`
+		Hook  func()
+	}
+	for cond, result := range map[string]bool{
+		`EXISTS $Email`:   true,
+		`EXISTS $phone`:   true,
+		`EXISTS $Hook`:    true,
+		`EXISTS $Address`: false,
+	} {
+		r, err := Evaluate(mustParse(t, cond), account{})
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	r, err := Evaluate(mustParse(t, `EXISTS $x`), nil)
+	assert.NoError(t, err)
+	assert.False(t, r)
+	_, err = Evaluate(mustParse(t, `EXISTS $x`), 42)
+	assert.Error(t, err)
+
+	assert.Equal(t, `EXISTS user.email`, mustParse(t, `EXISTS $user.email`).String())
+	for _, cond := range []string{`EXISTS "x"`, `EXISTS`, `EXISTS ($x)`, `$user.`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestNormalizers(t *testing.T) {
+	args := map[string]interface{}{
+		"city":   " São Paulo ",
+		"other":  " São Paulo ",
+		"cities": []string{"Zürich", " MÜNCHEN"},
+		"target": "munchen",
+	}
+	for _, td := range []struct {
+		cond           string
+		plain, matched bool
+	}{
+		{`$city == "sao paulo"`, false, true},
+		{`"SAO PAULO" == $city`, false, true},
+		{`$city != "sao paulo"`, true, false},
+		{`$city IN ["lima", "são paulo"]`, false, true},
+		{`$city NOT IN ["lima", "são paulo"]`, true, false},
+		{`$cities CONTAINS "zurich"`, false, true},
+		{`$target IN $cities`, false, true},
+		{`$city == "sao paulo" AND $target == "munchen"`, false, true},
+		// Only comparisons with a registered variable operand are normalized.
+		{`$other == "sao paulo"`, false, false},
+		{`$city =~ /^s/`, false, false},
+	} {
+		r, err := Evaluate(mustParse(t, td.cond), args)
+		assert.NoError(t, err, td.cond)
+		assert.Equal(t, td.plain, r, td.cond)
+
+		RegisterNormalizer("city", strings.TrimSpace, strings.ToLower, Unaccent)
+		RegisterNormalizer("cities", strings.TrimSpace, strings.ToLower, Unaccent)
+		r, err = Evaluate(mustParse(t, td.cond), args)
+		RegisterNormalizer("city")
+		RegisterNormalizer("cities")
+		assert.NoError(t, err, td.cond)
+		assert.Equal(t, td.matched, r, td.cond)
+	}
+
+	// Registering no steps removes the pipeline.
+	RegisterNormalizer("city", strings.ToLower)
+	RegisterNormalizer("city")
+	r, err := Evaluate(mustParse(t, `$city == "sao paulo"`), args)
+	assert.NoError(t, err)
+	assert.False(t, r)
+
+	assert.Equal(t, "Creme brulee a Lodz", Unaccent("Crème brûlée à Łódź"))
+	assert.Equal(t, "strasse", Unaccent("straße"))
+}
+
+func TestPhoneEq(t *testing.T) {
+	args := map[string]interface{}{"phone": "(555) 123-4567", "intl": "+44 20 7946 0958", "empty": ""}
+	for cond, result := range map[string]bool{
+		`$phone PHONEEQ "555.123.4567"`:        true,
+		`$phone PHONEEQ "555 123 4567"`:        true,
+		`$phone PHONEEQ "+1 555 123 4567"`:     true,
+		`$phone PHONEEQ "+1 (555) 123-4567"`:   true,
+		`$phone PHONEEQ "001 555 123 4567"`:    true,
+		`"+1-555-123-4567" phoneeq $phone`:     true,
+		`$intl PHONEEQ "0044 20 7946 0958"`:    true,
+		`$intl PHONEEQ "20 7946 0958"`:         true,
+		`$phone PHONEEQ "555 123 4568"`:        false,
+		`$phone PHONEEQ "1 555 123 4567"`:      false,
+		`$phone PHONEEQ "+1234 555 123 4567"`:  false,
+		`$phone PHONEEQ "4567"`:                false,
+		`$phone PHONEEQ "+1 4567"`:             false,
+		`$empty PHONEEQ ""`:                    false,
+		`$phone PHONEEQ "5551234567" AND true`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	_, err := Evaluate(mustParse(t, `$phone PHONEEQ 5551234567`), args)
+	assert.Error(t, err)
+}
+
+func TestShortCircuit(t *testing.T) {
+	calls := 0
+	RegisterOperator("PROBE_EQ", func(l, r Expr) (*BooleanLiteral, error) {
+		calls++
+		return applyEQ(l, r)
+	})
+
+	args := map[string]interface{}{"a": 1, "x": 5}
+	for _, td := range []struct {
+		cond   string
+		result bool
+		calls  int
+	}{
+		{`$a == 2 AND $a PROBE_EQ 1`, false, 0},
+		{`$a == 1 AND $a PROBE_EQ 1`, true, 1},
+		{`$a == 1 OR $a PROBE_EQ 1`, true, 0},
+		{`$a == 2 OR $a PROBE_EQ 1`, true, 1},
+		{`($a == 2 AND $a PROBE_EQ 1) OR ($a == 1 OR $a PROBE_EQ 1)`, true, 0},
+		{`$a PROBE_EQ 2 AND $a PROBE_EQ 1 AND $a PROBE_EQ 1`, false, 1},
+		// Other operators still evaluate both sides.
+		{`$a == 2 XOR $a PROBE_EQ 1`, true, 1},
+		{`$a == 2 NAND $a PROBE_EQ 1`, true, 1},
+	} {
+		calls = 0
+		r, err := Evaluate(mustParse(t, td.cond), args)
+		assert.NoError(t, err, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+		assert.Equal(t, td.calls, calls, td.cond)
+	}
+
+	// Skipped operands may fail to evaluate.
+	for cond, result := range map[string]bool{
+		`false AND $missing > 0`:              false,
+		`true OR $missing > 0`:                true,
+		`EXISTS $missing AND $missing > 0`:    false,
+		`EXISTS $x AND $x > 0`:                true,
+		`NOT EXISTS $missing OR $missing > 0`: true,
+		`$x < 0 AND $x / 0 > 1`:               false,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for _, cond := range []string{`true AND $missing > 0`, `false OR $missing > 0`, `$x AND true`, `$a == 1 AND 2`} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestBuiltinSample(t *testing.T) {
+	// Buckets are pinned, changing them would move users between rollout
+	// groups on upgrade.
+	for _, td := range []struct {
+		key, salt string
+		bucket    uint64
+	}{
+		{"user-1", "", 77},
+		{"user-2", "", 35},
+		{"user-3", "", 36},
+		{"42", "", 76},
+		{"", "", 42},
+		{"user-1", "exp-42", 41},
+		{"user-2", "exp-42", 73},
+		{"42", "exp-42", 73},
+	} {
+		assert.Equal(t, td.bucket, sampleBucket(td.key, td.salt), "%q %q", td.key, td.salt)
+	}
+
+	args := map[string]interface{}{"User": "user-2", "ID": 42}
+	for cond, result := range map[string]bool{
+		`sample($User, 35)`:                false,
+		`sample($User, 36)`:                true,
+		`sample($User, 35.5)`:              true,
+		`sample($User, 0)`:                 false,
+		`sample($User, 100)`:               true,
+		`SAMPLE($ID, 77)`:                  true,
+		`sample($ID, 76)`:                  false,
+		`sample($User, 74, "exp-42")`:      true,
+		`sample($User, 73, "exp-42")`:      false,
+		`NOT sample("user-1", 50) == true`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// About the requested share of keys is sampled, independently of
+	// other salts.
+	var a, b, both int
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		inA, inB := sampleBucket(key, "") < 10, sampleBucket(key, "exp-42") < 10
+		if inA {
+			a++
+		}
+		if inB {
+			b++
+		}
+		if inA && inB {
+			both++
+		}
+	}
+	assert.InDelta(t, 1000, a, 100)
+	assert.InDelta(t, 1000, b, 100)
+	assert.InDelta(t, 100, both, 50)
+
+	for _, cond := range []string{`sample($User, 101)`, `sample($User, -1)`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+	_, err := NewParser(strings.NewReader(`sample($User, 101)`)).Parse()
+	assert.Contains(t, err.Error(), "between 0 and 100")
+
+	args["Percent"] = 150
+	for _, cond := range []string{`sample($User, $Percent)`, `sample(true, 10)`, `sample($User, "10")`, `sample($User, 10, 1)`, `sample($User, 10, "x", 1)`, `sample($User, 1e3 / 1)`} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestBuiltinExtract(t *testing.T) {
+	args := map[string]interface{}{"Path": "/users/42/orders/7", "Version": "v1.2.3"}
+	for cond, result := range map[string]bool{
+		`extract($Path, "/users/(\\d+)") == "42"`:            true,
+		`extract($Path, "/orders/(\\d+)") == "7"`:            true,
+		`extract($Path, "/users/\\d+") == "/users/42"`:       true,
+		`extract($Path, "/teams/(\\d+)") == ""`:              true,
+		`extract($Path, "/(users|teams)/(\\d+)") == "users"`: true,
+		`extract($Path, "(x)?/users") == ""`:                 true,
+		`EXTRACT($Version, "^v(\\d+)") IN ["1", "2"]`:        true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	_, err := NewParser(strings.NewReader(`extract($Path, "(")`)).Parse()
+	assert.Error(t, err)
+	args["Pattern"] = "("
+	for _, cond := range []string{`extract($Path, $Pattern) == ""`, `extract(1, "x") == ""`, `extract($Path) == ""`} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestPointerFields(t *testing.T) {
+	type profile struct {
+		Nickname *string
+		Age      *int64
+		Birthday *time.Time
+		Verified *bool
+		Missing  *string
+		Twice    **float64
+	}
+	nick, age, verified, score := "ann", int64(42), true, 4.5
+	birthday := time.Date(1990, 5, 1, 0, 0, 0, 0, time.UTC)
+	pscore := &score
+	p := profile{Nickname: &nick, Age: &age, Birthday: &birthday, Verified: &verified, Twice: &pscore}
+
+	for cond, result := range map[string]bool{
+		`$Nickname == "ann"`:                         true,
+		`$Age > 40 AND $Age < 50`:                    true,
+		`$Birthday BEFORE "2000-01-01T00:00:00Z"`:    true,
+		`$Verified`:                                  true,
+		`$Twice == 4.5`:                              true,
+		`EXISTS $Missing`:                            true,
+		`$Nickname IN ["bob", "ann"] AND $Age != 41`: true,
+	} {
+		// Both a struct and a pointer to it are accepted as args.
+		for _, args := range []interface{}{p, &p} {
+			r, err := Evaluate(mustParse(t, cond), args)
+			assert.NoError(t, err, cond)
+			assert.Equal(t, result, r, cond)
+		}
+	}
+
+	_, err := Evaluate(mustParse(t, `$Missing == "x"`), &p)
+	if assert.IsType(t, &ErrNilValue{}, err) {
+		assert.Equal(t, "Argument Missing is a nil *string", err.Error())
+	}
+	_, err = Evaluate(mustParse(t, `$n == 1`), map[string]interface{}{"n": nil})
+	if assert.IsType(t, &ErrNilValue{}, err) {
+		assert.Equal(t, "Argument n is nil", err.Error())
+	}
+
+	// With NilFalse, comparisons against nil are false.
+	for cond, result := range map[string]bool{
+		`$Missing == "x"`:               false,
+		`$Missing != "x"`:               false,
+		`"x" =~ $Missing`:               false,
+		`$Missing == "x" OR $Age == 42`: true,
+		`NOT $Missing == "x"`:           true,
+		`$Nickname == "ann"`:            true,
+		`$Missing == "x" AND $Verified`: false,
+		// Arithmetic on nil makes the comparison false too.
+		`$Missing + 1 > 0`: false,
+	} {
+		r, err := EvaluateWithOptions(mustParse(t, cond), &p, WithNilFalse())
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+	// Other uses of nil values still fail.
+	for _, cond := range []string{`$Missing`, `$Verified AND $Missing`, `$Missing ? true : false`} {
+		_, err := EvaluateWithOptions(mustParse(t, cond), &p, WithNilFalse())
+		assert.Error(t, err, cond)
+	}
+
+	assert.NoError(t, Validate(mustParse(t, `$Nickname == "ann" AND $Twice > 1`), &p))
+	var nilArgs *profile
+	_, err = Evaluate(mustParse(t, `$Nickname == "ann"`), nilArgs)
+	assert.Error(t, err)
+}
+
+func TestNestedStructFields(t *testing.T) {
+	type geo struct {
+		Lat float64
+	}
+	type address struct {
+		City string `json:"city"`
+		Geo  *geo
+	}
+	type user struct {
+		Name    string
+		Address address
+		Billing *address `json:"billing"`
+		Tags    []string
+		secret  string
+	}
+	type order struct {
+		User  *user
+		Total float64
+	}
+
+	o := order{
+		User: &user{
+			Name:    "Ann",
+			Address: address{City: "Berlin", Geo: &geo{Lat: 52.5}},
+			Billing: &address{City: "Paris"},
+			Tags:    []string{"vip"},
+			secret:  "x",
+		},
+		Total: 10,
+	}
+	for cond, result := range map[string]bool{
+		`$User.Address.City == "Berlin"`:     true,
+		`$User.Address.city == "Berlin"`:     true,
+		`[User][Address][City] == "Berlin"`:  true,
+		`$User.Address.Geo.Lat > 52`:         true,
+		`$User.billing.City == "Paris"`:      true,
+		`"vip" IN $User.Tags AND $Total > 5`: true,
+		`EXISTS $User.Address.City`:          true,
+		`EXISTS $User.Address.Street`:        false,
+		`EXISTS $User.Billing.Geo.Lat`:       false,
+		// The RHS is skipped when the field is missing.
+		`EXISTS $User.Billing.Geo.Lat AND $User.Billing.Geo.Lat > 5`:    false,
+		`NOT EXISTS $User.Address.Street OR $User.Address.Street == ""`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), o)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for _, td := range []struct {
+		cond, field string
+		isNil       bool
+	}{
+		{`$User.Adress.City == "Berlin"`, "Adress", false},
+		{`$User.Address.Street == ""`, "Street", false},
+		{`$User.Billing.Geo.Lat > 1`, "Geo", true},
+		{`$User.secret == "x"`, "secret", false},
+	} {
+		_, err := Evaluate(mustParse(t, td.cond), o)
+		var notFound *ErrFieldNotFound
+		if assert.True(t, errors.As(err, &notFound), "%s: %v", td.cond, err) {
+			assert.Equal(t, td.field, notFound.Field, td.cond)
+			assert.Equal(t, td.isNil, notFound.Nil, td.cond)
+		}
+	}
+	_, err := Evaluate(mustParse(t, `$User.Adress.City == "Berlin"`), o)
+	assert.EqualError(t, err, `$User.Adress.City: field "Adress" not found`)
+	_, err = Evaluate(mustParse(t, `$User.Billing.Geo.Lat > 1`), o)
+	assert.EqualError(t, err, `$User.Billing.Geo.Lat: field "Geo" is nil`)
+	_, err = Evaluate(mustParse(t, `$User.Name.First == "A"`), o)
+	assert.EqualError(t, err, `$User.Name.First: field "Name" is a string, not a map, struct or slice`)
+	_, err = Evaluate(mustParse(t, `$User.Address.City == "Berlin"`), order{})
+	assert.EqualError(t, err, `$User.Address.City: field "User" is nil`)
+
+	assert.NoError(t, Validate(mustParse(t, `$User.Address.Geo.Lat > 1 AND $User.Billing.City == ""`), o))
+	assert.Error(t, Validate(mustParse(t, `$User.Address.Street == ""`), o))
+	assert.Error(t, Validate(mustParse(t, `$User.Name.First == ""`), o))
+}
+
+// fakeValue mimics *structpb.Value.
+type fakeValue struct {
+	v interface{}
+}
+
+func (v *fakeValue) AsInterface() interface{} { return v.v }
+
+// fakeStruct mimics *structpb.Struct.
+type fakeStruct struct {
+	fields map[string]*fakeValue
+}
+
+func (s *fakeStruct) GetFields() map[string]*fakeValue {
+	if s == nil {
+		return nil
+	}
+	return s.fields
+}
+
+func TestDynamicMessages(t *testing.T) {
+	msg := &fakeStruct{fields: map[string]*fakeValue{
+		"name":   {"Ann"},
+		"age":    {float64(42)},
+		"admin":  {true},
+		"labels": {map[string]interface{}{"team": "core"}},
+		"none":   {nil},
+		"unset":  nil,
+	}}
+	for cond, result := range map[string]bool{
+		`$name == "Ann" AND $age > 40`:   true,
+		`$admin == true`:                 true,
+		`"team" INKEYS $labels`:          true,
+		`$age BAND 2 == 2`:               true,
+		`EXISTS $none AND EXISTS $unset`: true,
+		`EXISTS $missing`:                false,
+	} {
+		r, err := Evaluate(mustParse(t, cond), msg)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for _, cond := range []string{`$missing == 1`, `$none == 1`, `$unset == 1`} {
+		_, err := Evaluate(mustParse(t, cond), msg)
+		assert.Error(t, err, cond)
+	}
+	_, err := Evaluate(mustParse(t, `$name == "Ann"`), (*fakeStruct)(nil))
+	assert.Error(t, err)
+
+	// Unwrapped field values work too.
+	r, err := Evaluate(mustParse(t, `$name == "Ann"`), plainFields{"name": "Ann"})
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+type plainFields map[string]interface{}
+
+func (f plainFields) GetFields() map[string]interface{} { return f }
+
+// countingResolver counts the lookups made through it.
+type countingResolver struct {
+	vars  map[string]interface{}
+	calls int
+}
+
+func (r *countingResolver) Resolve(name string) (interface{}, bool) {
+	r.calls++
+	val, ok := r.vars[name]
+	return val, ok
+}
+
+func TestResolverChain(t *testing.T) {
+	request := ResolverFunc(func(name string) (interface{}, bool) {
+		switch name {
+		case "lang":
+			return "fr", true
+		case "path":
+			return "/checkout", true
+		}
+		return nil, false
+	})
+	session := &countingResolver{vars: map[string]interface{}{
+		"lang": "de",
+		"user": map[string]interface{}{"id": 7, "roles": []string{"admin"}},
+		"cart": 3,
+	}}
+	global := ResolverFunc(func(name string) (interface{}, bool) {
+		val, ok := map[string]interface{}{"lang": "en", "cart": 0, "maxCart": 10, "beta": false}[name]
+		return val, ok
+	})
+	chain := ResolverChain{request, session, global}
+
+	for cond, result := range map[string]bool{
+		// Each layer supplies its own variables.
+		`$path == "/checkout"`:              true,
+		`$user.id == 7`:                     true,
+		`"admin" IN $user.roles`:            true,
+		`$maxCart == 10 AND $beta == false`: true,
+		// Earlier layers take precedence.
+		`$lang == "fr"`:    true,
+		`$cart == 3`:       true,
+		`$cart < $maxCart`: true,
+		`EXISTS $lang`:     true,
+		`EXISTS $missing`:  false,
+	} {
+		r, err := Evaluate(mustParse(t, cond), chain)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	r, err := Evaluate(mustParse(t, `$lang == "de"`), ResolverChain{session, global})
+	assert.NoError(t, err)
+	assert.True(t, r)
+	r, err = Evaluate(mustParse(t, `$lang == "en" AND $cart == 0`), ResolverChain{global, session, request})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	// Lookups stop at the first layer defining the variable.
+	session.calls = 0
+	_, err = Evaluate(mustParse(t, `$path == "/" OR $lang == "x"`), chain)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, session.calls)
+
+	for _, cond := range []string{`$missing == 1`, `$user.name == "ann"`, `$nope.id == 1`} {
+		_, err := Evaluate(mustParse(t, cond), chain)
+		assert.Error(t, err, cond)
+	}
+	_, err = Evaluate(mustParse(t, `$lang == "fr"`), ResolverChain{})
+	assert.EqualError(t, err, "Argument: `lang` not found")
+
+	// A single pointer resolver is not dereferenced.
+	r, err = Evaluate(mustParse(t, `$cart == 3`), session)
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestLayers(t *testing.T) {
+	type session struct {
+		Lang string `json:"lang"`
+		Cart int    `json:"cart"`
+		User struct {
+			ID int `json:"id"`
+		} `json:"user"`
+	}
+	request := map[string]string{"lang": "fr", "path": "/checkout"}
+	s := &session{Lang: "de", Cart: 3}
+	s.User.ID = 7
+	defaults := ResolverFunc(func(name string) (interface{}, bool) {
+		val, ok := map[string]interface{}{"lang": "en", "cart": 0, "maxCart": 10, "user": map[string]interface{}{"id": 1, "name": "ann"}}[name]
+		return val, ok
+	})
+	args := Layers(request, s, defaults)
+
+	for cond, result := range map[string]bool{
+		`$path == "/checkout"`: true,
+		`$maxCart == 10`:       true,
+		// Earlier layers shadow later ones.
+		`$lang == "fr"`:    true,
+		`$cart == 3`:       true,
+		`$cart < $maxCart`: true,
+		`$user.id == 7`:    true,
+		`EXISTS $lang`:     true,
+		`EXISTS $missing`:  false,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// The layer order decides which value wins.
+	r, err := Evaluate(mustParse(t, `$lang == "en" AND $cart == 0`), Layers(defaults, s, request))
+	assert.NoError(t, err)
+	assert.True(t, r)
+	r, err = Evaluate(mustParse(t, `$lang == "de" AND $path == "/checkout"`), Layers(s, request))
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	// The first layer defining $user holds the whole path.
+	_, err = Evaluate(mustParse(t, `$user.name == "ann"`), args)
+	assert.Error(t, err)
+
+	_, err = Evaluate(mustParse(t, `$missing == 1`), args)
+	assert.EqualError(t, err, "Argument: `missing` not found")
+	_, err = Evaluate(mustParse(t, `$lang == "fr"`), Layers())
+	assert.EqualError(t, err, "Argument: `lang` not found")
+
+	_, err = Evaluate(mustParse(t, `$x == 1`), Layers(map[string]interface{}{}, 42))
+	assert.Error(t, err)
+}
+
+func TestDefaults(t *testing.T) {
+	type record struct {
+		Name  string
+		Score *int
+		User  struct{ Tier string }
+	}
+	score := 7
+	defaults := map[string]interface{}{
+		"Score":     0,
+		"Level":     int64(2),
+		"Since":     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		"User.Seat": "A1",
+		"Tags":      []string{"new"},
+		"Name":      "unused",
+	}
+	old := record{Name: "old"}
+	recent := record{Name: "recent", Score: &score}
+	recent.User.Tier = "gold"
+
+	for _, tc := range []struct {
+		cond   string
+		args   interface{}
+		result bool
+	}{
+		{`$Level > 1`, old, true},
+		{`$Level == 2 AND $Name == "old"`, recent, false},
+		{`$Since BEFORE "2021-01-01T00:00:00Z"`, map[string]interface{}{}, true},
+		{`$User.Seat == "A1"`, recent, true},
+		{`"new" IN $Tags`, old, true},
+		{`ANY $Tags SATISFIES $_ == "new"`, old, true},
+		// Args take precedence.
+		{`$Name == "recent"`, recent, true},
+		{`$Level == 3`, map[string]interface{}{"Level": 3}, true},
+		// EXISTS tells whether args define the variable.
+		{`EXISTS $Level`, old, false},
+	} {
+		r, err := EvaluateWithOptions(mustParse(t, tc.cond), tc.args, WithDefaults(defaults))
+		assert.NoError(t, err, tc.cond)
+		assert.Equal(t, tc.result, r, tc.cond)
+	}
+
+	// A nil field is not missing.
+	_, err := EvaluateWithOptions(mustParse(t, `$Score == 0`), old, Options{Defaults: defaults})
+	assert.IsType(t, &ErrNilValue{}, err)
+	r, err := EvaluateWithOptions(mustParse(t, `$Score == 0`), old, Options{Defaults: defaults, NilFalse: true})
+	assert.NoError(t, err)
+	assert.False(t, r)
+	r, err = EvaluateWithOptions(mustParse(t, `$Score == 0`), map[string]interface{}{}, Options{Defaults: defaults})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	// Variables missing from both args and defaults still fail.
+	_, err = EvaluateWithOptions(mustParse(t, `$Missing == 0`), map[string]interface{}{}, WithDefaults(defaults))
+	assert.EqualError(t, err, "Argument: `Missing` not found")
+	_, err = EvaluateWithOptions(mustParse(t, `$User.Missing == 0`), recent, WithDefaults(defaults))
+	assert.IsType(t, &ErrFieldNotFound{}, err)
+}
+
+func TestShadowing(t *testing.T) {
+	type source struct{ site, value string }
+	binder := source{"the binder of ANY $items", "binder"}
+	defaults := source{"Options.Defaults", "default"}
+
+	// Every combination of the sources defining $env, listed by
+	// precedence, with plain and layered args.
+	for _, sources := range [][]source{
+		{binder, {"args", "args"}, defaults},
+		{binder, {"layer 1", "layer 1"}, {"layer 2", "layer 2"}, defaults},
+	} {
+		for mask := 1; mask < 1<<len(sources); mask++ {
+			var defined []source
+			layers := make([]map[string]interface{}, len(sources)-2)
+			for i := range layers {
+				layers[i] = map[string]interface{}{}
+			}
+			layers[0]["items"] = []string{binder.value}
+			opts := Options{}
+			for i, src := range sources {
+				if mask&(1<<i) == 0 {
+					continue
+				}
+				defined = append(defined, src)
+				switch src {
+				case binder:
+				case defaults:
+					opts.Defaults = map[string]interface{}{"env": src.value}
+				default:
+					layers[i-1]["env"] = src.value
+				}
+			}
+			var args interface{} = layers[0]
+			if len(layers) > 1 {
+				args = Layers(layers[0], layers[1])
+			}
+			cond := fmt.Sprintf(`$env == %q`, defined[0].value)
+			if defined[0] == binder {
+				cond = "ANY $items AS $env SATISFIES " + cond
+			}
+			expr := mustParse(t, cond)
+
+			r, err := EvaluateWithOptions(expr, args, opts)
+			assert.NoError(t, err, "%s with %v", cond, defined)
+			assert.True(t, r, "%s with %v", cond, defined)
+
+			opts.ShadowingErrors = true
+			r, err = EvaluateWithOptions(expr, args, opts)
+			if len(defined) == 1 {
+				assert.NoError(t, err, "%s with %v", cond, defined)
+				assert.True(t, r, "%s with %v", cond, defined)
+				continue
+			}
+			var shadowed *ErrShadowedVariable
+			if assert.True(t, errors.As(err, &shadowed), "%s with %v: %v", cond, defined, err) {
+				assert.Equal(t, &ErrShadowedVariable{Name: "env", Site: defined[0].site, Shadowed: defined[1].site}, shadowed)
+			}
+		}
+	}
+
+	// The implicit binder of a quantifier rebinds its own slice.
+	r, err := EvaluateWithOptions(mustParse(t, `ANY $items == "a"`), map[string]interface{}{"items": []string{"a"}}, WithShadowingErrors())
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	// Nested binders, and paths into args defined twice.
+	_, err = EvaluateWithOptions(mustParse(t, `ANY $items AS $x SATISFIES ANY $items AS $x SATISFIES $x == "a"`),
+		map[string]interface{}{"items": []string{"a"}}, WithShadowingErrors())
+	assert.EqualError(t, err, "Variable $x defined by the binder of ANY $items shadows its definition by an enclosing quantifier")
+	_, err = EvaluateWithOptions(mustParse(t, `$user.tier == "gold"`),
+		Layers(map[string]interface{}{"user": map[string]interface{}{"tier": "gold"}}, map[string]interface{}{"user": nil}),
+		WithShadowingErrors())
+	assert.EqualError(t, err, "Variable $user.tier defined by layer 1 shadows its definition by layer 2")
+}
+
+func TestMissingFalse(t *testing.T) {
+	args := map[string]interface{}{
+		"severity": 3,
+		"labels":   map[string]string{"env": "prod"},
+		"hosts":    []string{"a"},
+		"owner":    nil,
+	}
+	for cond, result := range map[string]bool{
+		`$team == "db"`:                   false,
+		`$team != "db"`:                   false,
+		`$team IN ["db", "web"]`:          false,
+		`$team NOT IN ["db", "web"]`:      false,
+		`$team CONTAINS "d"`:              false,
+		`$team NOT LIKE "d%"`:             false,
+		`$count + 1 > 2`:                  false,
+		`$count <= 2`:                     false,
+		`$labels.region == "eu"`:          false,
+		`$labels.region != "eu"`:          false,
+		`ANY $pods SATISFIES $_ == "x"`:   false,
+		`ALL $pods SATISFIES $_ == "x"`:   false,
+		`$severity > 2 OR $team == "db"`:  true,
+		`$severity > 2 AND $team != "db"`: false,
+		`$labels.env == "prod"`:           true,
+		`NOT ($team == "db")`:             true,
+		`NOT EXISTS $team`:                true,
+		`$team IS NULL`:                   false,
+		`$team IS NOT NULL`:               false,
+	} {
+		r, err := EvaluateWithOptions(mustParse(t, cond), args, WithMissingFalse())
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+
+		// Strict mode is the default.
+		if result == false {
+			_, err := Evaluate(mustParse(t, cond), args)
+			assert.Error(t, err, cond)
+		}
+	}
+
+	var missing []string
+	r, err := EvaluateWithOptions(mustParse(t, `$team == "db" OR $team == "web" OR $labels.region == "eu" OR $severity > 2`), args,
+		WithMissingFalse(), WithOnMissing(func(name string) { missing = append(missing, name) }))
+	assert.NoError(t, err)
+	assert.True(t, r)
+	assert.Equal(t, []string{"team", "labels.region"}, missing)
+
+	// Nil values and other errors still fail.
+	_, err = EvaluateWithOptions(mustParse(t, `$owner == "ann"`), args, WithMissingFalse())
+	assert.IsType(t, &ErrNilValue{}, err)
+	_, err = EvaluateWithOptions(mustParse(t, `$severity == "x" OR $team == 1`), args, WithMissingFalse())
+	assert.Error(t, err)
+	_, err = EvaluateWithOptions(mustParse(t, `$flag AND $severity > 2`), args, WithMissingFalse())
+	assert.IsType(t, &ErrMissingVariable{}, err)
+
+	_, err = Evaluate(mustParse(t, `$team == "db"`), args)
+	assert.Equal(t, &ErrMissingVariable{Name: "team"}, err)
+}
+
+func TestConcurrentEvaluations(t *testing.T) {
+	type item struct {
+		Name  string
+		Price float64
+	}
+	expr := mustParse(t, `$tier NOT IN ["free", "trial"] AND $path !~ /^internal/ AND $name NOT LIKE "test%"
+		AND $tags NOT CONTAINS "blocked" AND ANY $items SATISFIES $_.Price > 10 AND (EXISTS $beta ? $beta : $score >= 50)`)
+	before := expr.String()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				args := map[string]interface{}{
+					"tier":  []string{"pro", "free"}[i%2],
+					"path":  "/api/v1",
+					"name":  "order",
+					"tags":  []string{"new"},
+					"items": []item{{"a", 5}, {"b", float64(i)}},
+					"score": 3 * j,
+				}
+				want := i%2 == 0 && i > 10 && 3*j >= 50
+				r, err := EvaluateWithOptions(expr, args, WithMemoryBudget(1<<20))
+				if assert.NoError(t, err) {
+					assert.Equal(t, want, r, "goroutine %d, iteration %d", i, j)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, before, expr.String())
+}
+
+func TestTypedErrors(t *testing.T) {
+	args := map[string]interface{}{"name": "ann", "age": 42, "tags": []string{"a"}, "owner": (*string)(nil)}
+
+	for cond, want := range map[string]*ErrTypeMismatch{
+		`$name > 1`:                {Op: GT, Left: "string", Right: "number"},
+		`$age == "42"`:             {Op: EQ, Left: "number", Right: "string"},
+		`$tags CONTAINS 1`:         {Op: CONTAINS, Left: "slice of strings", Right: "number"},
+		`$age IN ["a"]`:            {Op: IN, Left: "number", Right: "slice of strings"},
+		`$name + 1 > 2`:            {Op: ADD, Left: "string", Right: "number"},
+		`NOT $age`:                 {Op: NOT, Left: "number"},
+		`$name =~ 1`:               {Op: EREG, Left: "string", Right: "number"},
+		`($age > 1) AND $name`:     {Op: AND, Left: "boolean", Right: "string"},
+		`$age SIZEBETWEEN 1 AND 2`: {Op: SIZEBETWEEN, Left: "number", Right: "range"},
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		var m *ErrTypeMismatch
+		if assert.True(t, errors.As(err, &m), "%s: %v", cond, err) {
+			assert.Equal(t, want.Op, m.Op, cond)
+			assert.Equal(t, want.Left, m.Left, cond)
+			assert.Equal(t, want.Right, m.Right, cond)
+		}
+	}
+	_, err := Evaluate(mustParse(t, `$name > 1`), args)
+	assert.EqualError(t, err, "Literal is not a number: \"ann\" in `$name > 1`")
+	assert.EqualError(t, &ErrTypeMismatch{Op: LT, Left: "string", Right: "boolean"}, "Cannot evaluate string < boolean")
+
+	// Mismatches in function arguments are wrapped.
+	_, err = Evaluate(mustParse(t, `floor($name) > 1`), args)
+	var m *ErrTypeMismatch
+	assert.True(t, errors.As(err, &m))
+	assert.Equal(t, ILLEGAL, m.Op)
+	assert.EqualError(t, err, `floor: Literal is not a number: "ann"`)
+
+	_, err = Evaluate(mustParse(t, `$missing > 1`), args)
+	var missing *ErrMissingVariable
+	assert.True(t, errors.As(err, &missing))
+	assert.Equal(t, "missing", missing.Name)
+
+	_, err = Evaluate(mustParse(t, `$owner == "x"`), args)
+	var nilValue *ErrNilValue
+	assert.True(t, errors.As(err, &nilValue))
+	assert.Equal(t, "owner", nilValue.Name)
+
+	_, err = applyOperator(ILLEGAL, &NumberLiteral{Val: 1}, &NumberLiteral{Val: 2})
+	assert.Equal(t, &ErrUnsupportedOperator{Op: ILLEGAL}, err)
+
+	// Rule sets wrap the errors of their rules.
+	rs := NewRuleSet()
+	assert.NoError(t, rs.Add("adult", mustParse(t, `$age >= "18"`)))
+	_, err = rs.EvaluateAll(args)
+	assert.True(t, errors.As(err, &m))
+	assert.Equal(t, GTE, m.Op)
+}
+
+func TestErrorLocation(t *testing.T) {
+	args := map[string]interface{}{"Height": 180, "Name": "ann", "Active": false, "Tags": []string{"a"}}
+	for cond, msg := range map[string]string{
+		`$Active == false AND ($Height < 100 OR $Height > $Name)`: "Literal is not a number: \"ann\" in `$Height > $Name`",
+		`$Height > 100 AND NOT ($Height + 1)`:                     "Literal is not a boolean: 181.000 in `NOT ($Height + 1)`",
+		`$Tags CONTAINS "a" AND $Name * 2 > 1`:                    "Literal is not a number: \"ann\" in `$Name * 2`",
+		`$Active == false AND ($Height > 1 AND $Name)`:            "Literal is not a boolean: \"ann\" in `$Height > 1 AND $Name`",
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.EqualError(t, err, msg, cond)
+		var located *ErrEvaluation
+		if assert.True(t, errors.As(err, &located), cond) {
+			var m *ErrTypeMismatch
+			assert.True(t, errors.As(located.Err, &m), cond)
+		}
+	}
+
+	// Booleans are not ordered.
+	for cond, msg := range map[string]string{
+		`$Active > true`:        "Cannot order booleans with >, compare them with == or != in `$Active > true`",
+		`$Active <= $Height`:    "Cannot order booleans with <=, compare them with == or != in `$Active <= $Height`",
+		`1 < ($Height > 100)`:   "Cannot order booleans with <, compare them with == or != in `1 < ($Height > 100)`",
+		`$Height >= 1 >= false`: "Cannot order booleans with >=, compare them with == or != in `$Height >= 1 >= false`",
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.EqualError(t, err, msg, cond)
+		var m *ErrTypeMismatch
+		assert.True(t, errors.As(err, &m), cond)
+	}
+
+	// Variables are named by their own errors.
+	_, err := Evaluate(mustParse(t, `$Height > 1 AND $Missing == 1`), args)
+	assert.EqualError(t, err, "Argument: `Missing` not found")
+}
+
+func TestHooks(t *testing.T) {
+	args := map[string]interface{}{"Height": 180, "Name": "ann", "Tags": []string{"a", "b"}}
+	expr := mustParse(t, `($Height > 100 AND $Name == "ann") OR ($Height + 1 > 200 AND "c" IN $Tags) OR ANY $Tags SATISFIES $_ == "b"`)
+
+	applied := map[Token]int{}
+	var results []bool
+	var resolved []string
+	r, err := EvaluateWithOptions(expr, args,
+		WithOnApply(func(op Token, l, r Expr, result bool, err error) {
+			applied[op]++
+			results = append(results, result)
+			assert.NoError(t, err)
+		}),
+		WithOnResolve(func(name string, value interface{}, err error) {
+			resolved = append(resolved, fmt.Sprintf("%s=%v", name, value))
+			assert.NoError(t, err)
+		}))
+	assert.NoError(t, err)
+	assert.True(t, r)
+	// The first OR decides the result: its RHS is skipped, and so is the
+	// last one.
+	assert.Equal(t, map[Token]int{GT: 1, EQ: 1, AND: 1}, applied)
+	assert.Equal(t, []bool{true, true, true}, results)
+	assert.Equal(t, []string{"Height=180", "Name=ann"}, resolved)
+
+	applied = map[Token]int{}
+	resolved = nil
+	args["Height"] = 50
+	r, err = EvaluateWithOptions(expr, args,
+		WithOnApply(func(op Token, l, r Expr, result bool, err error) { applied[op]++ }),
+		WithOnResolve(func(name string, value interface{}, err error) { resolved = append(resolved, name) }))
+	assert.NoError(t, err)
+	assert.True(t, r)
+	assert.Equal(t, map[Token]int{GT: 2, EQ: 2, OR: 2}, applied)
+	assert.Equal(t, []string{"Height", "Height", "_", "_"}, resolved)
+
+	// Hooks see failures, and can't change the result.
+	var failures int
+	var missing []error
+	_, err = EvaluateWithOptions(mustParse(t, `$Name > 1 OR $Missing == 1`), args,
+		WithOnApply(func(op Token, l, r Expr, result bool, err error) {
+			if err != nil {
+				failures++
+			}
+		}),
+		WithOnResolve(func(name string, value interface{}, err error) {
+			if err != nil {
+				missing = append(missing, err)
+			}
+		}))
+	assert.Error(t, err)
+	assert.Equal(t, 1, failures)
+	assert.Empty(t, missing)
+	_, err = EvaluateWithOptions(mustParse(t, `$Missing == 1`), args,
+		WithOnResolve(func(name string, value interface{}, err error) { missing = append(missing, err) }))
+	assert.Error(t, err)
+	if assert.Len(t, missing, 1) {
+		assert.IsType(t, &ErrMissingVariable{}, missing[0])
+	}
+
+	// Hooks get copies of the operands: modifying them changes neither
+	// the tree nor the args.
+	expr = mustParse(t, `$Height > 100 AND "a" IN $Tags AND $Name == "ann" AND $Height BETWEEN 100 AND 200`)
+	tree := expr.String()
+	mutate := WithOnApply(func(op Token, l, r Expr, result bool, err error) {
+		for _, x := range []Expr{l, r} {
+			switch v := x.(type) {
+			case *NumberLiteral:
+				v.Val = -1
+			case *StringLiteral:
+				v.Val = "mutated"
+			case *SliceStringLiteral:
+				v.Val[0] = "mutated"
+			case *RangeExpr:
+				v.Low.(*NumberLiteral).Val = 1000
+			}
+		}
+	})
+	args["Height"] = 180
+	for i := 0; i < 2; i++ {
+		r, err = EvaluateWithOptions(expr, args, mutate)
+		assert.NoError(t, err)
+		assert.True(t, r)
+	}
+	assert.Equal(t, tree, expr.String())
+	assert.Equal(t, []string{"a", "b"}, args["Tags"])
+}
+
+func TestFallibleResolver(t *testing.T) {
+	errDown := errors.New("connection refused")
+	headers := map[string]interface{}{"User-Agent": "curl", "X-Nil": nil, "tenant": map[string]interface{}{"id": 7}}
+	lookups := 0
+	r := FallibleResolverFunc(func(name string) (interface{}, bool, error) {
+		lookups++
+		if name == "flags" {
+			return nil, false, errDown
+		}
+		v, ok := headers[name]
+		return v, ok, nil
+	})
+
+	for cond, result := range map[string]bool{
+		`${User-Agent} == "curl"`: true,
+		`$tenant.id == 7`:         true,
+		`${X-Nil} IS NULL`:        true,
+		`EXISTS ${X-Nil}`:         true,
+		`EXISTS $missing`:         false,
+	} {
+		ok, err := Evaluate(mustParse(t, cond), r)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, ok, cond)
+	}
+	// Missing variables are not NULL.
+	_, err := Evaluate(mustParse(t, `$missing IS NULL`), r)
+	assert.EqualError(t, err, "Argument: `missing` not found")
+
+	// Variables are resolved on demand.
+	lookups = 0
+	_, err = Evaluate(mustParse(t, `${User-Agent} == "wget" AND $flags.beta`), r)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, lookups)
+
+	for _, cond := range []string{`$flags == 1`, `$flags.beta`, `EXISTS $flags`} {
+		_, err := Evaluate(mustParse(t, cond), r)
+		var resolverErr *ErrResolver
+		if assert.ErrorAs(t, err, &resolverErr, cond) {
+			assert.Equal(t, "flags", resolverErr.Name)
+		}
+		assert.ErrorIs(t, err, errDown, cond)
+	}
+	_, err = Evaluate(mustParse(t, `$flags == 1`), r)
+	assert.EqualError(t, err, "Argument flags: connection refused")
+}
+
+func TestNearInt(t *testing.T) {
+	args := map[string]interface{}{"x": 3.0, "y": 2.75, "z": -4.125, "s": "2.75"}
+	for cond, result := range map[string]bool{
+		`$x NEARINT 0`:        true,
+		`$y NEARINT 0.25`:     true,
+		`$y NEARINT 0.24`:     false,
+		`$z NEARINT 0.125`:    true,
+		`$z NEARINT 0.1`:      false,
+		`2.5 NEARINT 0.5`:     true,
+		`2.5 NEARINT 0.49`:    false,
+		`$y + 0.25 NEARINT 0`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	r, err := EvaluateWithOptions(mustParse(t, `$s NEARINT 0.25`), args, Options{CoerceStrings: true})
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	for _, cond := range []string{`$y NEARINT -0.1`, `$s NEARINT 0.25`, `$y NEARINT "0.25"`} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+	assert.Equal(t, `y NEARINT 0.250`, mustParse(t, `$y nearint 0.25`).String())
+}
+
+func TestSizeBetween(t *testing.T) {
+	args := map[string]interface{}{
+		"items": []string{"a", "b", "c"},
+		"nums":  []float64{},
+		"attrs": map[string]interface{}{"k": 1, "l": 2},
+		"name":  "héllo",
+		"min":   2,
+	}
+	for cond, result := range map[string]bool{
+		// at the bounds
+		`$items SIZEBETWEEN 3 AND 5`: true,
+		`$items SIZEBETWEEN 1 AND 3`: true,
+		`$nums SIZEBETWEEN 0 AND 0`:  true,
+		// inside
+		`$items SIZEBETWEEN 1 AND 5`: true,
+		`$attrs SIZEBETWEEN 1 AND 3`: true,
+		`$name SIZEBETWEEN 5 AND 5`:  true,
+		// outside
+		`$items SIZEBETWEEN 4 AND 5`: false,
+		`$items SIZEBETWEEN 0 AND 2`: false,
+		`$nums SIZEBETWEEN 1 AND 5`:  false,
+		`$attrs SIZEBETWEEN 3 AND 4`: false,
+		`$items SIZEBETWEEN 5 AND 1`: false,
+		// bounds are expressions, AND after the range is the logical AND
+		`$items SIZEBETWEEN $min AND $min + 1`:          true,
+		`$items SIZEBETWEEN 1 AND 5 AND $min == 2`:      true,
+		`$items SIZEBETWEEN 1 AND 2 OR $name =~ /llo$/`: true,
+		`NOT $items SIZEBETWEEN 1 AND 2`:                true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	expr := mustParse(t, `$items sizebetween 1 AND $min + 1 AND $min == 2`)
+	assert.Equal(t, `items SIZEBETWEEN 1.000 AND min + 1.000 AND min == 2.000`, expr.String())
+	assert.Equal(t, []string{"min", "items"}, expr.(*BinaryExpr).LHS.Args())
+
+	for _, cond := range []string{`$min SIZEBETWEEN 1 AND 5`, `$items SIZEBETWEEN "a" AND 5`, `$missing SIZEBETWEEN 1 AND 5`} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+	for _, cond := range []string{`$items SIZEBETWEEN 1`, `$items SIZEBETWEEN 1 OR 5`, `$items SIZEBETWEEN 1 AND`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestBetween(t *testing.T) {
+	args := map[string]interface{}{
+		"Grade":   "C",
+		"Initial": "a",
+		"Code":    "B12",
+		"Score":   75,
+		"Wait":    90 * time.Second,
+		"Flag":    true,
+	}
+	for cond, result := range map[string]bool{
+		// Single characters, bounds included
+		`$Grade BETWEEN "A" AND "F"`: true,
+		`"A" BETWEEN "A" AND "F"`:    true,
+		`"F" BETWEEN "A" AND "F"`:    true,
+		`"G" BETWEEN "A" AND "F"`:    false,
+		`"@" BETWEEN "A" AND "F"`:    false,
+		// Strings are ordered byte-wise, lower case after upper case
+		`$Initial BETWEEN "A" AND "Z"`: false,
+		`$Initial BETWEEN "a" AND "z"`: true,
+		`$Code BETWEEN "B" AND "C"`:    true,
+		`$Code BETWEEN "B2" AND "C"`:   false,
+		`$Grade BETWEEN "F" AND "A"`:   false,
+		// Numbers and durations
+		`$Score BETWEEN 50 AND 75`:             true,
+		`$Score BETWEEN 76 AND 100`:            false,
+		`$Score BETWEEN $Score - 1 AND $Score`: true,
+		`$Wait BETWEEN 1m AND 2m`:              true,
+		`$Wait BETWEEN "1m" AND "90s"`:         true,
+		// AND after the range is the logical AND
+		`$Grade BETWEEN "A" AND "C" AND $Score > 50`: true,
+		`NOT $Grade BETWEEN "D" AND "F"`:             true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	expr := mustParse(t, `$Grade between "A" AND "F" AND $Score > 50`)
+	assert.Equal(t, `Grade BETWEEN "A" AND "F" AND Score > 50.000`, expr.String())
+
+	for _, cond := range []string{`$Grade BETWEEN 1 AND 5`, `$Score BETWEEN "A" AND "F"`, `$Flag BETWEEN false AND true`, `$Grade BETWEEN "A" AND 5`,
+		// Both bounds are checked, even when the first one decides.
+		`$Grade BETWEEN "D" AND 5`, `$Score BETWEEN 100 AND "F"`} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+	for _, cond := range []string{`$Grade BETWEEN "A"`, `$Grade BETWEEN "A" OR "F"`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+}
+
+func TestNestedMaps(t *testing.T) {
+	type geo struct {
+		Lat float64
+	}
+	type profile struct {
+		Attrs  map[string]interface{}
+		Scores map[string]float64
+	}
+	args := map[string]interface{}{
+		"payload": map[string]interface{}{
+			"user": map[string]interface{}{
+				"age":  float64(42),
+				"name": "Ann",
+				"geo":  &geo{Lat: 52.5},
+				"tags": []string{"vip"},
+			},
+			"none": nil,
+		},
+		"profile": profile{
+			Attrs:  map[string]interface{}{"plan": "pro", "home": geo{Lat: 48.8}},
+			Scores: map[string]float64{"risk": 0.2},
+		},
+		"version":  "1.2",
+		"flat.key": 1,
+		"flat":     map[string]interface{}{"key": 2},
+	}
+	for cond, result := range map[string]bool{
+		`$payload.user.age > 18`:          true,
+		`[payload][user][name] == "Ann"`:  true,
+		`$payload.user.geo.Lat > 52`:      true,
+		`"vip" IN $payload.user.tags`:     true,
+		`$profile.Attrs.plan == "pro"`:    true,
+		`$profile.Attrs.home.Lat < 50`:    true,
+		`$profile.Scores.risk < 0.5`:      true,
+		`$flat.key == 1`:                  true,
+		`${flat.key} == 1`:                true,
+		`EXISTS $payload.user.email`:      false,
+		`EXISTS $payload.none.x`:          false,
+		`EXISTS ${payload.user.age}`:      false,
+		`EXISTS $payload.user.age`:        true,
+		`ANY $payload.user.tags == "vip"`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for cond, msg := range map[string]string{
+		`$payload.user.email == ""`:    `$payload.user.email: field "email" not found`,
+		`$payload.user.age.years > 1`:  `$payload.user.age.years: field "age" is a float64, not a map, struct or slice`,
+		`$payload.none.x == 1`:         `$payload.none.x: field "none" is nil`,
+		`$version.major == 1`:          `$version.major: field "version" is a string, not a map, struct or slice`,
+		`$profile.Scores.risk.x == 1`:  `$profile.Scores.risk.x: field "risk" is a float64, not a map, struct or slice`,
+		`$profile.Attrs.home.Lng == 1`: `$profile.Attrs.home.Lng: field "Lng" not found`,
+		`${payload.user.age} > 18`:     "not found",
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), msg, cond)
+		}
+	}
+
+	// Struct containing a map containing a struct.
+	type event struct {
+		Labels map[string]interface{}
+	}
+	ev := event{Labels: map[string]interface{}{"owner": geo{Lat: 1}}}
+	r, err := Evaluate(mustParse(t, `$Labels.owner.Lat == 1`), ev)
+	assert.NoError(t, err)
+	assert.True(t, r)
+	assert.NoError(t, Validate(mustParse(t, `$Labels.owner.Lat == 1`), ev))
+}
+
+type embeddedBase struct {
+	ID     int
+	Tenant string
+}
+
+type embeddedAudit struct {
+	Author string
+}
+
+type embeddedMeta struct {
+	*embeddedAudit
+	Version int
+}
+
+type embeddedEvent struct {
+	embeddedBase
+	*embeddedMeta
+	Kind string
+}
+
+func TestEmbeddedStructs(t *testing.T) {
+	ev := embeddedEvent{
+		embeddedBase: embeddedBase{ID: 7, Tenant: "acme"},
+		embeddedMeta: &embeddedMeta{embeddedAudit: &embeddedAudit{Author: "ann"}, Version: 2},
+		Kind:         "created",
+	}
+	for cond, result := range map[string]bool{
+		`$ID == 7 AND $Tenant == "acme"`: true,
+		`$Version == 2`:                  true,
+		`$Author == "ann"`:               true,
+		`$Kind == "created"`:             true,
+		`EXISTS $Author`:                 true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), ev)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// Fields promoted through nil embedded pointers are missing.
+	for _, ev := range []embeddedEvent{
+		{Kind: "created"},
+		{Kind: "created", embeddedMeta: &embeddedMeta{Version: 2}},
+	} {
+		r, err := Evaluate(mustParse(t, `EXISTS $Author`), ev)
+		assert.NoError(t, err)
+		assert.False(t, r)
+		_, err = Evaluate(mustParse(t, `$Author == "ann"`), ev)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "not found")
+		}
+		r, err = Evaluate(mustParse(t, `$Kind == "created" AND $ID == 0`), ev)
+		assert.NoError(t, err)
+		assert.True(t, r)
+	}
+
+	r, err := Evaluate(mustParse(t, `$Event.Author == "ann"`), map[string]interface{}{"Event": ev})
+	assert.NoError(t, err)
+	assert.True(t, r)
+	_, err = Evaluate(mustParse(t, `$Event.Author == "ann"`), map[string]interface{}{"Event": embeddedEvent{}})
+	assert.EqualError(t, err, `$Event.Author: field "Author" not found`)
+
+	assert.NoError(t, Validate(mustParse(t, `$Author == "" AND $Tenant == ""`), embeddedEvent{}))
+}
+
+type embeddedOwner struct {
+	Author string
+}
+
+type embeddedClash struct {
+	*embeddedMeta
+	embeddedOwner
+}
+
+type embeddedShadow struct {
+	embeddedMeta
+	Author string
+}
+
+func TestAmbiguousEmbeddedFields(t *testing.T) {
+	ev := embeddedClash{
+		embeddedMeta:  &embeddedMeta{embeddedAudit: &embeddedAudit{Author: "ann"}, Version: 2},
+		embeddedOwner: embeddedOwner{Author: "bob"},
+	}
+
+	// The shallowest field wins: Version and the Author of embeddedOwner.
+	r, err := Evaluate(mustParse(t, `$Version == 2 AND $Author == "bob"`), ev)
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	clash := embeddedShadow{embeddedMeta: embeddedMeta{embeddedAudit: &embeddedAudit{Author: "ann"}}, Author: "bob"}
+	r, err = Evaluate(mustParse(t, `$Author == "bob"`), clash)
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	type twice struct {
+		embeddedOwner
+		embeddedAudit
+	}
+	_, err = Evaluate(mustParse(t, `$Author == "ann"`), twice{})
+	assert.EqualError(t, err, `$Author: field "Author" is ambiguous in conditions.twice, it could be embeddedOwner.Author or embeddedAudit.Author`)
+	var amb *ErrAmbiguousField
+	if assert.ErrorAs(t, err, &amb) {
+		assert.Equal(t, []string{"embeddedOwner.Author", "embeddedAudit.Author"}, amb.Candidates)
+	}
+	_, err = Evaluate(mustParse(t, `$Event.Author == "ann"`), map[string]interface{}{"Event": twice{}})
+	assert.EqualError(t, err, `$Event.Author: field "Author" is ambiguous in conditions.twice, it could be embeddedOwner.Author or embeddedAudit.Author`)
+
+	assert.ErrorAs(t, Validate(mustParse(t, `$Author == ""`), twice{}), &amb)
+	assert.NoError(t, Validate(mustParse(t, `$Author == ""`), embeddedClash{}))
+}
+
+func TestIndexAccess(t *testing.T) {
+	type item struct {
+		SKU string
+		Qty int
+	}
+	type order struct {
+		Items  []item
+		Extras []*item
+	}
+	args := map[string]interface{}{
+		"Goods":   []string{"A", "B", "C"},
+		"History": []interface{}{"created", "paid", "failed"},
+		"Scores":  []float64{1, 2},
+		"Matrix":  [][]string{{"a", "b"}, {"c"}},
+		"Order":   order{Items: []item{{"X1", 2}, {"X2", 1}}, Extras: []*item{nil}},
+		"Doc":     map[string]interface{}{"lines": []interface{}{map[string]interface{}{"sku": "L1"}}},
+	}
+	for cond, result := range map[string]bool{
+		`$Goods[0] == "A"`:                   true,
+		`$Goods[2] == "C"`:                   true,
+		`$Goods[-1] == "C"`:                  true,
+		`$Goods[-3] == "A"`:                  true,
+		`$History[-1] == "failed"`:           true,
+		`$Scores[1] > $Scores[0]`:            true,
+		`$Matrix[1][0] == "c"`:               true,
+		`$Order.Items[0].SKU == "X1"`:        true,
+		`$Order.Items[-1].Qty == 1`:          true,
+		`$Doc.lines[0].sku == "L1"`:          true,
+		`[Goods][1] == "B"`:                  true,
+		`EXISTS $Goods[2]`:                   true,
+		`EXISTS $Goods[3]`:                   false,
+		`EXISTS $Goods[-4]`:                  false,
+		`"B" IN $Goods AND $Goods[1] == "B"`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	assert.Equal(t, &VarRef{Val: "Order.Items.0.SKU"}, mustParse(t, `$Order.Items[0].SKU == "X1"`).(*BinaryExpr).LHS)
+
+	_, err := Evaluate(mustParse(t, `$Goods[5] == "A"`), args)
+	var outOfRange *ErrIndexOutOfRange
+	if assert.True(t, errors.As(err, &outOfRange), "%v", err) {
+		assert.Equal(t, 5, outOfRange.Index)
+		assert.Equal(t, 3, outOfRange.Length)
+		assert.EqualError(t, err, `$Goods.5: index 5 out of range, length is 3`)
+	}
+	for cond, msg := range map[string]string{
+		`$Goods[-4] == "A"`:          "index -4 out of range, length is 3",
+		`$Order.Items[2].SKU == ""`:  "index 2 out of range, length is 2",
+		`$Order.Extras[0].SKU == ""`: `field "0" is nil`,
+		`$Goods.first == "A"`:        `"first" is not an index`,
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), msg, cond)
+		}
+	}
+
+	for _, cond := range []string{`$Goods[] == "A"`, `$Goods[a] == "A"`, `$Goods[-] == "A"`, `$Goods[1 == "A"`, `$Goods[1.5] == "A"`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+
+	assert.NoError(t, Validate(mustParse(t, `$Items[0].SKU == "X1"`), order{}))
+	assert.Error(t, Validate(mustParse(t, `$Items[0].Name == "X1"`), order{}))
+}
+
+func TestTimeComparison(t *testing.T) {
+	type account struct {
+		CreatedAt time.Time
+		ClosedAt  time.Time
+	}
+	acc := account{
+		CreatedAt: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC),
+		ClosedAt:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600)),
+	}
+	for cond, result := range map[string]bool{
+		`$CreatedAt AFTER "2023-01-01T00:00:00Z"`:          true,
+		`$CreatedAt BEFORE "2023-01-01T00:00:00Z"`:         false,
+		`$CreatedAt after "2023-06-01T12:00:00Z"`:          false,
+		`$CreatedAt AFTER "2023-06-01T11:59:59.999Z"`:      true,
+		`$CreatedAt BEFORE "2023-06-01T14:00:01+02:00"`:    true,
+		`"2022-12-31T23:59:59Z" BEFORE $CreatedAt`:         true,
+		`$ClosedAt AFTER $CreatedAt`:                       true,
+		`$ClosedAt BEFORE "2024-01-01T00:00:00Z"`:          true,
+		`$ClosedAt AFTER "2023-12-31T23:00:00Z"`:           false,
+		`$CreatedAt AFTER '2023-01-01T00:00:00Z' AND true`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), acc)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for cond, msg := range map[string]string{
+		`$CreatedAt AFTER "2023-13-01T00:00:00Z"`:             "Invalid time",
+		`$CreatedAt AFTER "2023-01-01"`:                       "RFC 3339",
+		`$CreatedAt AFTER "yesterday"`:                        "Invalid time",
+		`$CreatedAt AFTER true`:                               "not a time",
+		`"2023-01-01T00:00:00Z" AFTER "2022-01-01T00:00:00Z"`: "not a time",
+	} {
+		_, err := Evaluate(mustParse(t, cond), acc)
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), msg, cond)
+		}
+	}
+	assert.Equal(t, `CreatedAt AFTER "2023-01-01T00:00:00Z"`, mustParse(t, `$CreatedAt after "2023-01-01T00:00:00Z"`).String())
+}
+
+func TestTimeComparisonDuration(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	clock := WithClock(func() time.Time { return now })
+	args := map[string]interface{}{
+		"Birth":   now.Add(-72 * time.Hour),
+		"Created": now.Add(-30 * time.Minute),
+	}
+	for cond, result := range map[string]bool{
+		`$Birth BEFORE 48h`:                       true,
+		`$Birth BEFORE 3d`:                        false,
+		`$Birth BEFORE 71h59m`:                    true,
+		`$Created BEFORE 1h`:                      false,
+		`$Created AFTER 1h`:                       true,
+		`$Created AFTER 10m`:                      false,
+		`$Birth BEFORE 48h AND $Created AFTER 1h`: true,
+		// Numbers are days.
+		`$Birth BEFORE 2`:                       true,
+		`$Birth BEFORE 3`:                       false,
+		`$Birth BEFORE 2.5`:                     true,
+		`$Created AFTER 1`:                      true,
+		`$Birth BEFORE 2 AND $Birth BEFORE 48h`: true,
+		`$Birth BEFORE 4 OR $Birth BEFORE 96h`:  false,
+	} {
+		r, err := EvaluateWithOptions(mustParse(t, cond), args, clock)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	_, err := EvaluateWithOptions(mustParse(t, `$Birth BEFORE "2"`), args, clock)
+	assert.Error(t, err)
+}
+
+func TestConditionalExpr(t *testing.T) {
+	for _, td := range []struct {
+		cond   string
+		args   map[string]interface{}
+		result bool
+	}{
+		{`($type == "A" ? $fieldA : $fieldB) > 10`, map[string]interface{}{"type": "A", "fieldA": 11, "fieldB": 1}, true},
+		{`($type == "A" ? $fieldA : $fieldB) > 10`, map[string]interface{}{"type": "B", "fieldA": 11, "fieldB": 1}, false},
+		// The unchosen branch may reference a missing variable.
+		{`($type == "A" ? $fieldA : $fieldB) > 10`, map[string]interface{}{"type": "A", "fieldA": 11}, true},
+		{`($type == "A" ? $fieldA : $fieldB) > 10`, map[string]interface{}{"type": "B", "fieldB": 12}, true},
+		{`EXISTS $override ? $override == "on" : $default == "on"`, map[string]interface{}{"default": "on"}, true},
+		{`EXISTS $override ? $override == "on" : $default == "on"`, map[string]interface{}{"override": "off", "default": "on"}, false},
+		// Right associative, looser than any operator.
+		{`$n < 0 ? false : $n < 10 ? true : $big`, map[string]interface{}{"n": 5}, true},
+		{`$n < 0 ? false : $n < 10 ? true : $big`, map[string]interface{}{"n": 50, "big": false}, false},
+		{`$a AND $b ? $x : $y`, map[string]interface{}{"a": true, "b": false, "y": true}, true},
+		{`$a ? $b ? $x : $y : $z`, map[string]interface{}{"a": true, "b": false, "y": true}, true},
+		{`($a ? 1 : 2) + 1 == 2`, map[string]interface{}{"a": true}, true},
+	} {
+		r, err := Evaluate(mustParse(t, td.cond), td.args)
+		assert.NoError(t, err, "%s %v", td.cond, td.args)
+		assert.Equal(t, td.result, r, "%s %v", td.cond, td.args)
+	}
+
+	expr := mustParse(t, `($type == "A" ? $fieldA : $fieldB) > 10`)
+	assert.Equal(t, `(type == "A" ? fieldA : fieldB) > 10.000`, expr.String())
+	assert.Equal(t, []string{"type", "fieldA", "fieldB"}, Variables(expr))
+
+	for cond, args := range map[string]map[string]interface{}{
+		`($type == "A" ? $fieldA : $fieldB) > 10`: {"type": "A", "fieldB": 1},
+		`($n ? 1 : 2) > 1`:                        {"n": 1},
+	} {
+		_, err := Evaluate(mustParse(t, cond), args)
+		assert.Error(t, err, cond)
+	}
+	for _, cond := range []string{`$a ? $b`, `$a ? : $b`, `$a ? $b : `, `$a ? $b , $c`, `? $a : $b`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+}
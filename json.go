@@ -0,0 +1,155 @@
+package conditions
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONOption configures EvaluateJSON.
+type JSONOption func(*jsonOptions)
+
+type jsonOptions struct {
+	pointerVars bool
+}
+
+// WithJSONPointerVars makes EvaluateJSON read variable names as JSON
+// Pointers (RFC 6901) like /user/address/city instead of dotted paths
+// like user.address.city.
+func WithJSONPointerVars() JSONOption {
+	return func(o *jsonOptions) { o.pointerVars = true }
+}
+
+// EvaluateJSON evaluates expr against a JSON document. Variables are
+// dotted paths into the document, where a dot which is part of a key is
+// escaped as `\.` and a backslash as `\\`. Array elements are addressed
+// by their index.
+func EvaluateJSON(expr Expr, data []byte, opts ...JSONOption) (bool, error) {
+	var o jsonOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return false, fmt.Errorf("Invalid JSON document: %s", err)
+	}
+
+	args := map[string]interface{}{}
+	for _, name := range Variables(expr) {
+		var (
+			path []string
+			err  error
+		)
+		if o.pointerVars {
+			path, err = splitPointer(name)
+		} else {
+			path, err = splitDotPath(name)
+		}
+		if err != nil {
+			return false, err
+		}
+		if v, ok := lookupJSON(doc, path); ok {
+			args[name] = v
+		}
+	}
+	return Evaluate(expr, args)
+}
+
+// lookupJSON walks a decoded JSON document along path. Negative array
+// indexes count from the end, as in other paths.
+func lookupJSON(doc interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch n := doc.(type) {
+		case map[string]interface{}:
+			v, ok := n[key]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err == nil && i < 0 {
+				i += len(n)
+			}
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, false
+			}
+			doc = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// splitDotPath splits a dotted path into keys, honoring `\.` and `\\`.
+func splitDotPath(s string) ([]string, error) {
+	var (
+		keys []string
+		key  strings.Builder
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 == len(s) || (s[i+1] != '.' && s[i+1] != '\\') {
+				return nil, fmt.Errorf("Invalid escape in path %q at offset %d", s, i)
+			}
+			i++
+			key.WriteByte(s[i])
+		case '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(c)
+		}
+	}
+	return append(keys, key.String()), nil
+}
+
+// splitPointer splits a JSON Pointer into unescaped keys.
+func splitPointer(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("Invalid JSON pointer %q: must start with /", s)
+	}
+	keys := strings.Split(s[1:], "/")
+	for i, k := range keys {
+		for j := 0; j < len(k); j++ {
+			if k[j] == '~' && (j+1 == len(k) || (k[j+1] != '0' && k[j+1] != '1')) {
+				return nil, fmt.Errorf("Invalid escape in JSON pointer %q", s)
+			}
+		}
+		keys[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(k)
+	}
+	return keys, nil
+}
+
+// DotToPointer converts a dotted path, where literal dots in keys are
+// escaped as `\.`, into a JSON Pointer.
+func DotToPointer(s string) string {
+	keys, err := splitDotPath(s)
+	if err != nil {
+		// Take stray backslashes literally.
+		keys = strings.Split(s, ".")
+	}
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteByte('/')
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(k))
+	}
+	return b.String()
+}
+
+// PointerToDot converts a JSON Pointer into a dotted path, escaping the
+// dots and backslashes which are part of keys.
+func PointerToDot(s string) (string, error) {
+	keys, err := splitPointer(s)
+	if err != nil {
+		return "", err
+	}
+	for i, k := range keys {
+		keys[i] = strings.NewReplacer(`\`, `\\`, ".", `\.`).Replace(k)
+	}
+	return strings.Join(keys, "."), nil
+}
@@ -0,0 +1,192 @@
+package conditions
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const jsonDoc = `{
+	"user": {
+		"name": "Ann",
+		"address": {"city": "Berlin", "zip": 10115},
+		"tags": ["a", "b"]
+	},
+	"example.com": {"visits": 3},
+	"a/b": {"c.d": true},
+	"til~de": 1
+}`
+
+func TestEvaluateJSON(t *testing.T) {
+	for _, td := range []struct {
+		cond   string
+		result bool
+	}{
+		{`[user][address][city] == "Berlin"`, true},
+		{`[user][address][zip] > 10000 AND [user][name] == "Ann"`, true},
+		{`[user][tags][1] == "b"`, true},
+	} {
+		expr := mustParse(t, td.cond)
+
+		r, err := EvaluateJSON(expr, []byte(jsonDoc))
+		assert.NoError(t, err, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+
+		// The same rule migrated to JSON pointers.
+		migrated := RenameVars(expr, DotToPointer)
+		r, err = EvaluateJSON(migrated, []byte(jsonDoc), WithJSONPointerVars())
+		assert.NoError(t, err, migrated.String())
+		assert.Equal(t, td.result, r, migrated.String())
+
+		_, err = EvaluateJSON(migrated, []byte(jsonDoc))
+		assert.Error(t, err, "pointer names are not dotted paths")
+	}
+
+	// Keys containing dots, slashes and tildes.
+	for _, td := range []struct {
+		dot, pointer string
+		value        interface{}
+	}{
+		{`example\.com.visits`, `/example.com/visits`, 3},
+		{`a/b.c\.d`, `/a~1b/c.d`, true},
+		{`til~de`, `/til~0de`, 1},
+	} {
+		assert.Equal(t, td.pointer, DotToPointer(td.dot))
+		dot, err := PointerToDot(td.pointer)
+		assert.NoError(t, err)
+		assert.Equal(t, td.dot, dot)
+
+		expr := &BinaryExpr{Op: EQ, LHS: &VarRef{Val: td.dot}, RHS: literalFor(td.value)}
+		r, err := EvaluateJSON(expr, []byte(jsonDoc))
+		assert.NoError(t, err, td.dot)
+		assert.True(t, r, td.dot)
+
+		expr = &BinaryExpr{Op: EQ, LHS: &VarRef{Val: td.pointer}, RHS: literalFor(td.value)}
+		r, err = EvaluateJSON(expr, []byte(jsonDoc), WithJSONPointerVars())
+		assert.NoError(t, err, td.pointer)
+		assert.True(t, r, td.pointer)
+	}
+
+	// A naive conversion would split the dotted key.
+	assert.Equal(t, "/example/com/visits", DotToPointer("example.com.visits"))
+	_, err := EvaluateJSON(&VarRef{Val: "example.com.visits"}, []byte(jsonDoc))
+	assert.Error(t, err)
+
+	for _, invalid := range []string{"user/name", "/a~2b", "/a~"} {
+		_, err := PointerToDot(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	_, err = EvaluateJSON(&VarRef{Val: "user"}, []byte(`{`))
+	assert.Error(t, err)
+}
+
+func TestEvaluateJSONNested(t *testing.T) {
+	doc := []byte(`{
+		"a": {"b": 1, "ratio": 0.25, "big": 1e21, "m": {"x": 1.5}},
+		"items": [{"sku": "X1", "qty": 2}, {"sku": "Y2", "qty": 12}],
+		"none": null
+	}`)
+	for cond, result := range map[string]bool{
+		`$a.b == 1`:                true,
+		`$a.b == 1.0 AND $a.b < 2`: true,
+		`$a.ratio * 4 == $a.b`:     true,
+		`$a.big > 1e20`:            true,
+		`$a.m.x + $a.b == 2.5`:     true,
+		`"x" INKEYS $a.m`:          true,
+		`$items[1].qty > 10 AND $items[-1].sku == "Y2"`: true,
+		`ANY $items SATISFIES $_.qty > 10`:              true,
+		`ALL $items AS $i SATISFIES $i.sku =~ /^[XY]/`:  true,
+		`EXISTS $none AND NOT EXISTS $a.missing`:        true,
+	} {
+		r, err := EvaluateJSON(mustParse(t, cond), doc)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	_, err := EvaluateJSON(mustParse(t, `$a.missing == 1`), doc)
+	assert.Error(t, err)
+}
+
+func TestJSONNumbers(t *testing.T) {
+	dec := json.NewDecoder(strings.NewReader(`{
+		"Amount": 150,
+		"Fee": 2.5,
+		"Code": "150",
+		"Order": {"total": 99.99, "items": 3}
+	}`))
+	dec.UseNumber()
+	var args map[string]interface{}
+	assert.NoError(t, dec.Decode(&args))
+	assert.IsType(t, json.Number(""), args["Amount"])
+
+	for cond, result := range map[string]bool{
+		`$Amount > 100`:              true,
+		`$Amount == 150`:             true,
+		`$Amount + $Fee == 152.5`:    true,
+		`$Amount IN [100, 150]`:      true,
+		`$Code == "150"`:             true,
+		`$Order.total < 100`:         true,
+		`$Order.items * 2 == 6`:      true,
+		`$Amount > $Order.total * 2`: false,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	_, err := Evaluate(mustParse(t, `$Amount > 1`), map[string]interface{}{"Amount": json.Number("12abc")})
+	assert.EqualError(t, err, `Argument Amount is an invalid json.Number "12abc"`)
+}
+
+func TestJSONArrays(t *testing.T) {
+	var args map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"roles": ["dev", "admin"],
+		"sizes": [38, 42.5],
+		"empty": [],
+		"mixed": ["a", 1, true, "b"],
+		"nested": [["a"]]
+	}`), &args))
+
+	for cond, result := range map[string]bool{
+		`"admin" IN $roles`:                      true,
+		`"ops" NOT IN $roles`:                    true,
+		`$roles CONTAINS "dev"`:                  true,
+		`42.5 IN $sizes`:                         true,
+		`$sizes CONTAINS 40`:                     false,
+		`"x" IN $empty`:                          false,
+		`$empty CONTAINS "x"`:                    false,
+		`ANY $roles == "admin"`:                  true,
+		`"dev" IN $roles AND $sizes CONTAINS 38`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	_, err := Evaluate(mustParse(t, `"a" IN $mixed`), args)
+	assert.EqualError(t, err, "Unsupported argument mixed: slice elements must be all strings or all numbers, found string, number, bool")
+	_, err = Evaluate(mustParse(t, `"a" IN $nested`), args)
+	assert.EqualError(t, err, "Unsupported argument nested: slice elements must be all strings or all numbers, found []interface {}")
+
+	// Numbers decoded with UseNumber too.
+	dec := json.NewDecoder(strings.NewReader(`{"ids": [7, 9007199254740993]}`))
+	dec.UseNumber()
+	assert.NoError(t, dec.Decode(&args))
+	r, err := Evaluate(mustParse(t, `7 IN $ids`), args)
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func literalFor(v interface{}) Expr {
+	switch v := v.(type) {
+	case int:
+		return &NumberLiteral{Val: float64(v)}
+	case bool:
+		return &BooleanLiteral{Val: v}
+	}
+	return &StringLiteral{Val: v.(string)}
+}
@@ -0,0 +1,119 @@
+package conditions
+
+import (
+	"strings"
+	"sync"
+)
+
+// Normalizer is a step of the normalization pipeline of a variable, see
+// RegisterNormalizer. Functions like strings.TrimSpace, strings.ToLower
+// and Unaccent can be used as is.
+type Normalizer func(s string) string
+
+var (
+	normalizersMu sync.RWMutex
+	normalizers   = map[string][]Normalizer{}
+)
+
+// RegisterNormalizer sets the pipeline applied to both operands of the
+// string comparisons in which the variable called name is an operand:
+// ==, !=, IN, NOT IN, CONTAINS and NOT CONTAINS. The steps run in order, for slices on
+// every element. Registering a name again replaces its pipeline, and
+// registering no steps removes it.
+//
+// For instance, with
+//
+//	RegisterNormalizer("city", strings.TrimSpace, strings.ToLower, Unaccent)
+//
+// $city == "sao paulo" is true for a city of " São Paulo".
+func RegisterNormalizer(name string, steps ...Normalizer) {
+	normalizersMu.Lock()
+	defer normalizersMu.Unlock()
+
+	if len(steps) == 0 {
+		delete(normalizers, name)
+		return
+	}
+	normalizers[name] = append([]Normalizer(nil), steps...)
+}
+
+// lookupNormalizer returns the pipeline registered for the variable x, nil
+// if x is not a variable or has none.
+func lookupNormalizer(x Expr) []Normalizer {
+	v, ok := x.(*VarRef)
+	if !ok {
+		return nil
+	}
+	normalizersMu.RLock()
+	defer normalizersMu.RUnlock()
+
+	return normalizers[v.Val]
+}
+
+// normalizeOperands applies the pipelines of the variable operands of the
+// comparison n to both its evaluated operands l and r.
+func normalizeOperands(n *BinaryExpr, l, r Expr) (Expr, Expr) {
+	switch n.Op {
+	case EQ, NEQ, IN, NOTIN, CONTAINS, NOTCONTAINS:
+	default:
+		return l, r
+	}
+	for _, steps := range [][]Normalizer{lookupNormalizer(n.LHS), lookupNormalizer(n.RHS)} {
+		if steps != nil {
+			l, r = normalize(l, steps), normalize(r, steps)
+		}
+	}
+	return l, r
+}
+
+// normalize applies steps to a string or to the elements of a slice of
+// strings. Other values are returned untouched.
+func normalize(x Expr, steps []Normalizer) Expr {
+	apply := func(s string) string {
+		for _, step := range steps {
+			s = step(s)
+		}
+		return s
+	}
+	switch v := x.(type) {
+	case *StringLiteral:
+		return &StringLiteral{Val: apply(v.Val)}
+	case *SliceStringLiteral:
+		elems := make([]string, len(v.Val))
+		for i, s := range v.Val {
+			elems[i] = apply(s)
+		}
+		return &SliceStringLiteral{Val: elems}
+	}
+	return x
+}
+
+// unaccented maps the accented Latin letters to their base letter.
+var unaccented = strings.NewReplacer(
+	"À", "A", "Á", "A", "Â", "A", "Ã", "A", "Ä", "A", "Å", "A", "Ā", "A", "Ă", "A", "Ą", "A",
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "ā", "a", "ă", "a", "ą", "a",
+	"Ç", "C", "Ć", "C", "Č", "C", "ç", "c", "ć", "c", "č", "c",
+	"Ď", "D", "ď", "d", "Đ", "D", "đ", "d",
+	"È", "E", "É", "E", "Ê", "E", "Ë", "E", "Ē", "E", "Ė", "E", "Ę", "E", "Ě", "E",
+	"è", "e", "é", "e", "ê", "e", "ë", "e", "ē", "e", "ė", "e", "ę", "e", "ě", "e",
+	"Ğ", "G", "ğ", "g",
+	"Ì", "I", "Í", "I", "Î", "I", "Ï", "I", "Ī", "I", "İ", "I",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ī", "i", "ı", "i",
+	"Ł", "L", "ł", "l", "Ľ", "L", "ľ", "l",
+	"Ñ", "N", "Ń", "N", "Ň", "N", "ñ", "n", "ń", "n", "ň", "n",
+	"Ò", "O", "Ó", "O", "Ô", "O", "Õ", "O", "Ö", "O", "Ø", "O", "Ō", "O", "Ő", "O",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "ō", "o", "ő", "o",
+	"Ř", "R", "ř", "r",
+	"Ś", "S", "Š", "S", "Ş", "S", "ś", "s", "š", "s", "ş", "s", "ß", "ss",
+	"Ť", "T", "ť", "t", "Ţ", "T", "ţ", "t",
+	"Ù", "U", "Ú", "U", "Û", "U", "Ü", "U", "Ū", "U", "Ů", "U", "Ű", "U",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ū", "u", "ů", "u", "ű", "u",
+	"Ý", "Y", "Ÿ", "Y", "ý", "y", "ÿ", "y",
+	"Ź", "Z", "Ż", "Z", "Ž", "Z", "ź", "z", "ż", "z", "ž", "z",
+)
+
+// Unaccent removes the accents of Latin letters, as in "Crème brûlée" to
+// "Creme brulee". Other characters are kept.
+func Unaccent(s string) string {
+	return unaccented.Replace(s)
+}
@@ -0,0 +1,65 @@
+package conditions
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NumberFormat describes how numbers are written in strings which get
+// coerced to numbers during evaluation, e.g. "1.234,5" in most European
+// locales is NumberFormat{Decimal: ',', Grouping: '.'}.
+type NumberFormat struct {
+	// Decimal separates the integer part from the fraction, '.' if zero.
+	Decimal rune
+	// Grouping separates groups of three digits in the integer part.
+	// Zero means grouping separators are not accepted.
+	Grouping rune
+}
+
+// ParseFloat parses s according to the number format.
+func (f NumberFormat) ParseFloat(s string) (float64, error) {
+	dec := f.Decimal
+	if dec == 0 {
+		dec = '.'
+	}
+	if f.Grouping != 0 && f.Grouping == dec {
+		return 0, fmt.Errorf("Number format uses %q as both decimal and grouping separator", dec)
+	}
+
+	s = strings.TrimSpace(s)
+	intPart, frac := s, ""
+	if i := strings.IndexRune(s, dec); i >= 0 {
+		intPart, frac = s[:i], s[i+len(string(dec)):]
+	}
+
+	if f.Grouping != 0 && strings.ContainsRune(intPart, f.Grouping) {
+		groups := strings.Split(intPart, string(f.Grouping))
+		for i, g := range groups {
+			digits := strings.TrimLeft(g, "+-")
+			if (i == 0 && (len(digits) == 0 || len(digits) > 3)) || (i > 0 && len(g) != 3) {
+				return 0, fmt.Errorf("Unable to parse number %q: misplaced grouping separator", s)
+			}
+		}
+		intPart = strings.Join(groups, "")
+	}
+
+	if !isDigits(strings.TrimLeft(intPart, "+-")) || !isDigits(frac) {
+		return 0, fmt.Errorf("Unable to parse number %q", s)
+	}
+	v, err := strconv.ParseFloat(intPart+"."+frac, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse number %q", s)
+	}
+	return v, nil
+}
+
+// isDigits reports whether s consists of ASCII digits only.
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package conditions
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// OperatorFunc evaluates a binary operator on already evaluated operands.
+type OperatorFunc func(l, r Expr) (*BooleanLiteral, error)
+
+// customOperator is an operator added by RegisterOperator.
+type customOperator struct {
+	name string
+	tok  Token
+	fn   OperatorFunc
+}
+
+var (
+	customOperatorsMu     sync.RWMutex
+	customOperators       []*customOperator
+	customOperatorsByName = map[string]*customOperator{}
+
+	operatorNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// RegisterOperator adds a binary keyword operator, such as SEMVER_GT, to
+// the language. Registered operators are case insensitive, have the
+// precedence of comparison operators and are evaluated by fn.
+// Registering a name again replaces its function. It panics if the name is
+// not a valid identifier or clashes with a built-in keyword.
+func RegisterOperator(token string, fn func(l, r Expr) (*BooleanLiteral, error)) {
+	if !operatorNameRe.MatchString(token) {
+		panic(fmt.Sprintf("conditions: invalid operator name %q", token))
+	}
+	if fn == nil {
+		panic(fmt.Sprintf("conditions: nil function for operator %q", token))
+	}
+	name := strings.ToUpper(token)
+	for _, s := range tokens {
+		if s == name {
+			panic(fmt.Sprintf("conditions: operator %q clashes with a keyword", token))
+		}
+	}
+
+	customOperatorsMu.Lock()
+	defer customOperatorsMu.Unlock()
+
+	op := &customOperator{name: name, tok: customBegin + Token(len(customOperators)), fn: fn}
+	if prev, ok := customOperatorsByName[name]; ok {
+		op.tok = prev.tok
+		customOperators[op.tok-customBegin] = op
+	} else {
+		customOperators = append(customOperators, op)
+	}
+	customOperatorsByName[name] = op
+}
+
+// lookupCustomOperator returns the registered operator for the token.
+func lookupCustomOperator(tok Token) *customOperator {
+	if tok < customBegin {
+		return nil
+	}
+	customOperatorsMu.RLock()
+	defer customOperatorsMu.RUnlock()
+
+	if i := int(tok - customBegin); i < len(customOperators) {
+		return customOperators[i]
+	}
+	return nil
+}
+
+// lookupCustomOperatorName returns the registered operator for the
+// upper-cased keyword.
+func lookupCustomOperatorName(name string) *customOperator {
+	customOperatorsMu.RLock()
+	defer customOperatorsMu.RUnlock()
+
+	return customOperatorsByName[name]
+}
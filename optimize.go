@@ -0,0 +1,169 @@
+package conditions
+
+import "strings"
+
+// volatileBuiltins lists the builtin functions whose result may change
+// between evaluations of the same arguments, never folded by Optimize.
+var volatileBuiltins = map[string]bool{
+	"now":     true,
+	"convert": true,
+}
+
+// Optimize returns a copy of expr where the subtrees without variables are
+// replaced by their value, AND/OR operations with a constant operand are
+// simplified: true AND e is e, false AND e is false, and so on, and
+// parentheses which group nothing are removed.
+// Subtrees failing to evaluate are kept, so that evaluations report the
+// same errors. The input expression is left untouched.
+//
+// Constants are evaluated with the default Options: evaluations using
+// options which change the result of operations on literals, such as
+// FloatEpsilon or Equality, should use the original expression.
+func Optimize(expr Expr) Expr {
+	switch n := expr.(type) {
+	case *ParenExpr:
+		// Nested parentheses, and parentheses around a single operand,
+		// group nothing.
+		switch x := Optimize(n.Expr).(type) {
+		case *ParenExpr, *VarRef, *CallExpr:
+			return x
+		default:
+			if isLiteral(x) {
+				return x
+			}
+			expr = &ParenExpr{Expr: x}
+		}
+	case *BinaryExpr:
+		l, r := Optimize(n.LHS), Optimize(n.RHS)
+		if n.Op == AND || n.Op == OR {
+			if x, ok := simplifyLogical(n.Op, l, r); ok {
+				return x
+			}
+		}
+		expr = &BinaryExpr{Op: n.Op, LHS: l, RHS: r}
+	case *UnaryExpr:
+		if n.Op == EXISTS {
+			return expr
+		}
+		expr = &UnaryExpr{Op: n.Op, Expr: Optimize(n.Expr)}
+	case *ConditionalExpr:
+		cond := Optimize(n.Cond)
+		// Only the chosen branch is ever evaluated.
+		if b, ok := cond.(*BooleanLiteral); ok {
+			if b.Val {
+				return Optimize(n.Then)
+			}
+			return Optimize(n.Else)
+		}
+		expr = &ConditionalExpr{Cond: cond, Then: Optimize(n.Then), Else: Optimize(n.Else)}
+	case *QuantifierExpr:
+		return &QuantifierExpr{Op: n.Op, Var: n.Var, Binder: n.Binder, Expr: Optimize(n.Expr)}
+	case *CallExpr:
+		params := make([]Expr, len(n.Params))
+		for i, p := range n.Params {
+			params[i] = Optimize(p)
+		}
+		expr = &CallExpr{Name: n.Name, Params: params}
+	case *RangeExpr:
+		return &RangeExpr{Low: Optimize(n.Low), High: Optimize(n.High)}
+	case *TupleExpr:
+		elems := make([]Expr, len(n.Elems))
+		for i, x := range n.Elems {
+			elems[i] = Optimize(x)
+		}
+		return &TupleExpr{Elems: elems}
+	default:
+		return expr
+	}
+
+	if !isConstant(expr) {
+		return expr
+	}
+	e := &evaluator{opts: &Options{}}
+	v, err := e.evaluateSubtree(expr)
+	if err != nil || !isLiteral(v) {
+		return expr
+	}
+	return v
+}
+
+// simplifyLogical returns the simplification of l op r, op being AND or
+// OR, when one of the operands decides the result or is neutral. Only
+// operands known to evaluate to booleans are dropped: the AND of true and
+// a number is an error.
+func simplifyLogical(op Token, l, r Expr) (Expr, bool) {
+	// The value of the LHS deciding the result, true for OR.
+	decisive := op == OR
+	if b, ok := l.(*BooleanLiteral); ok {
+		if b.Val == decisive {
+			return &BooleanLiteral{Val: decisive}, true
+		}
+		if isBoolean(r) {
+			return r, true
+		}
+	}
+	// A decisive RHS cannot replace the LHS, which must still be evaluated
+	// for its errors.
+	if b, ok := r.(*BooleanLiteral); ok && b.Val != decisive && isBoolean(l) {
+		return l, true
+	}
+	return nil, false
+}
+
+// isBoolean reports whether expr evaluates to a boolean, when it
+// evaluates without error.
+func isBoolean(expr Expr) bool {
+	switch n := expr.(type) {
+	case *BooleanLiteral, *QuantifierExpr, *RuleRef:
+		return true
+	case *ParenExpr:
+		return isBoolean(n.Expr)
+	case *BinaryExpr:
+		return !n.Op.isArithmetic()
+	case *UnaryExpr:
+		switch n.Op {
+		case NOT, EXISTS, ISBUSINESSDAY, ISPOWEROFTWO, ISNULL, ISNOTNULL:
+			return true
+		}
+	}
+	return false
+}
+
+// isLiteral reports whether expr is a literal value.
+func isLiteral(expr Expr) bool {
+	switch expr.(type) {
+	case *NumberLiteral, *StringLiteral, *BooleanLiteral, *TimeLiteral, *DurationLiteral,
+		*SliceStringLiteral, *SliceNumberLiteral, *NullLiteral:
+		return true
+	}
+	return false
+}
+
+// isConstant reports whether expr evaluates to the same value whatever the
+// args: it refers to no variable, rule or volatile function, and compares
+// no time to the current one.
+func isConstant(expr Expr) bool {
+	constant := true
+	Inspect(expr, func(n Node) bool {
+		switch x := n.(type) {
+		case *VarRef, *RuleRef, *QuantifierExpr:
+			constant = false
+		case *CallExpr:
+			if volatileBuiltins[strings.ToLower(x.Name)] {
+				constant = false
+			}
+		case *BinaryExpr:
+			// BEFORE and AFTER a duration or a number of days are relative
+			// to the clock, only times and dates are fixed.
+			if x.Op == BEFORE || x.Op == AFTER {
+				switch x.RHS.(type) {
+				case *StringLiteral, *TimeLiteral:
+				default:
+					constant = false
+				}
+			}
+		}
+		return constant
+	})
+	return constant
+}
@@ -0,0 +1,103 @@
+package conditions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptimize(t *testing.T) {
+	for cond, want := range map[string]string{
+		`(2 + 3) > $x`:                        `5 > $x`,
+		`"a" == "a" AND $y > 1`:               `$y > 1`,
+		`"a" == "a" AND $y`:                   `true AND $y`,
+		`"a" == "b" AND $y`:                   `false`,
+		`$y == 1 AND 1 < 2`:                   `$y == 1`,
+		`$y AND 1 < 2`:                        `$y AND true`,
+		`$y OR 1 > 2`:                         `$y OR false`,
+		`1 < 2 OR $y`:                         `true`,
+		`NOT (1 > 2) AND $x > 1`:              `$x > 1`,
+		`$x > 1 AND 2 * 3 == 6`:               `$x > 1`,
+		`$x IN [1, 2] OR "b" IN ["a"]`:        `$x IN [1, 2]`,
+		`(1 < 2 ? $x : $z) > floor(2.5)`:      `$x > 2`,
+		`(1 == 1 AND $x > 5)`:                 `($x > 5)`,
+		`"a" IN ["a","b"] AND $x > 5`:         `$x > 5`,
+		`((($x > 5))) OR (($y))`:              `($x > 5) OR $y`,
+		`(floor($x)) > 1`:                     `floor($x) > 1`,
+		`($x + (1 + 1)) * 2 > 5`:              `($x + 2) * 2 > 5`,
+		`ANY $items SATISFIES $items > 2 + 2`: `ANY $items SATISFIES $items > 4`,
+		`$y AND now() > 2`:                    `$y AND now() > 2`,
+		// Durations and days are relative to the clock.
+		`"2030-01-01T00:00:00Z" BEFORE 48h AND $y`: `"2030-01-01T00:00:00Z" BEFORE 48h AND $y`,
+		// The RHS must still be evaluated for its errors.
+		`$y AND false`: `$y AND false`,
+		// true AND a number is an error, not a number.
+		`true AND $x`:     `true AND $x`,
+		`true AND NOT $x`: `NOT $x`,
+		// Errors are reported during evaluations.
+		`$y OR 1 / 0 > 1`: `$y OR 1 / 0 > 1`,
+	} {
+		assert.Equal(t, mustParse(t, want).String(), Optimize(mustParse(t, cond)).String(), cond)
+	}
+
+	// Comparisons to the current time are left to the evaluation.
+	later := WithClock(func() time.Time { return time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC) })
+	for _, cond := range []string{`"2030-01-01T00:00:00Z" BEFORE 48h AND $y`, `"2030-01-01T00:00:00Z" BEFORE 2 AND $y`} {
+		r, err := EvaluateWithOptions(Optimize(mustParse(t, cond)), map[string]interface{}{"y": true}, later)
+		assert.NoError(t, err, cond)
+		assert.True(t, r, cond)
+	}
+
+	// The input expression is left untouched.
+	expr := mustParse(t, `(2 + 3) > $x`)
+	before := expr.String()
+	Optimize(expr)
+	assert.Equal(t, before, expr.String())
+}
+
+func TestOptimizeEquivalence(t *testing.T) {
+	conds := []string{
+		`(2 + 3) > $x`,
+		`"a" == "a" AND $y`,
+		`"a" == "b" AND $y`,
+		`$y AND 1 < 2`,
+		`$y OR 1 > 2`,
+		`$y == 1 AND 1 < 2`,
+		`"a" == "a" AND $y > 1`,
+		`true AND NOT $x`,
+		`1 < 2 OR $y`,
+		`$y AND false`,
+		`true AND $x`,
+		`false OR $x`,
+		`$x + 1 * 2 == 3`,
+		`(1 < 2 ? $x : $z) > floor(2.5)`,
+		`$x IN [1, 2] OR "b" IN ["a"]`,
+		`$y OR 1 / 0 > 1`,
+		`NOT ("x" CONTAINS "y") AND NOT $y`,
+		`ANY $items SATISFIES $items > 2 + 2`,
+		`(1 == 1 AND $x > 5)`,
+		`((($x > 5))) OR (($y))`,
+		`($x + (1 + 1)) * 2 > 5`,
+		`"a" IN ["a","b"] AND $x > 5`,
+		`"2030-01-01T00:00:00Z" BEFORE 48h AND $y`,
+		`"2030-01-01T00:00:00Z" AFTER 1 OR $y`,
+	}
+	argsList := []map[string]interface{}{
+		{"x": 1, "y": true, "z": 5, "items": []float64{1, 5}},
+		{"x": 3, "y": false, "z": 0, "items": []float64{}},
+		{"x": true, "y": 2, "z": "a", "items": []float64{3}},
+		{"y": true},
+		{},
+	}
+	for _, cond := range conds {
+		expr := mustParse(t, cond)
+		optimized := Optimize(expr)
+		for _, args := range argsList {
+			want, wantErr := Evaluate(expr, args)
+			got, gotErr := Evaluate(optimized, args)
+			assert.Equal(t, want, got, "%s with %v", cond, args)
+			assert.Equal(t, wantErr != nil, gotErr != nil, "%s with %v: %v, %v", cond, args, wantErr, gotErr)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package conditions
+
+import "time"
+
+// Option tweaks the evaluation of EvaluateWithOptions. An Options value is
+// an Option replacing every setting made by the options before it, while
+// functional options such as WithCoerceStrings change a single setting.
+// Both styles can be mixed, which lets call sites move from one to the
+// other one option at a time.
+type Option interface {
+	apply(o *Options)
+}
+
+func (opts Options) apply(o *Options) { *o = opts }
+
+// optionFunc is an Option changing a single setting.
+type optionFunc func(o *Options)
+
+func (f optionFunc) apply(o *Options) { f(o) }
+
+// collectOptions applies opts in order to the zero Options.
+func collectOptions(opts []Option) *Options {
+	o := &Options{}
+	for _, opt := range opts {
+		opt.apply(o)
+	}
+	return o
+}
+
+// WithCoerceStrings sets Options.CoerceStrings.
+func WithCoerceStrings() Option {
+	return optionFunc(func(o *Options) { o.CoerceStrings = true })
+}
+
+// WithNumberFormat sets Options.NumberFormat.
+func WithNumberFormat(f NumberFormat) Option {
+	return optionFunc(func(o *Options) { o.NumberFormat = &f })
+}
+
+// WithLocation sets Options.Location.
+func WithLocation(loc *time.Location) Option {
+	return optionFunc(func(o *Options) { o.Location = loc })
+}
+
+// WithStructTag sets Options.StructTag.
+func WithStructTag(tag string) Option {
+	return optionFunc(func(o *Options) { o.StructTag = tag })
+}
+
+// WithStrictIntegers sets Options.StrictIntegers.
+func WithStrictIntegers() Option {
+	return optionFunc(func(o *Options) { o.StrictIntegers = true })
+}
+
+// WithMemoryBudget sets Options.MemoryBudget.
+func WithMemoryBudget(bytes int) Option {
+	return optionFunc(func(o *Options) { o.MemoryBudget = bytes })
+}
+
+// WithNaN sets Options.NaN.
+func WithNaN(p NaNPolicy) Option {
+	return optionFunc(func(o *Options) { o.NaN = p })
+}
+
+// WithClock sets Options.Clock.
+func WithClock(clock func() time.Time) Option {
+	return optionFunc(func(o *Options) { o.Clock = clock })
+}
+
+// WithEquality sets Options.Equality. Pass EqualityLenient to keep the
+// current behavior of == and != once EqualityStrict becomes the default.
+func WithEquality(mode EqualityMode) Option {
+	return optionFunc(func(o *Options) { o.Equality = mode })
+}
+
+// WithNilFalse sets Options.NilFalse.
+func WithNilFalse() Option {
+	return optionFunc(func(o *Options) { o.NilFalse = true })
+}
+
+// WithFloatEpsilon sets Options.FloatEpsilon.
+func WithFloatEpsilon(epsilon float64) Option {
+	return optionFunc(func(o *Options) { o.FloatEpsilon = epsilon })
+}
+
+// WithComplexityLimits sets Options.MaxDepth and Options.MaxNodes.
+func WithComplexityLimits(maxDepth, maxNodes int) Option {
+	return optionFunc(func(o *Options) { o.MaxDepth, o.MaxNodes = maxDepth, maxNodes })
+}
+
+// WithCaseInsensitiveFields sets Options.CaseInsensitiveFields.
+func WithCaseInsensitiveFields() Option {
+	return optionFunc(func(o *Options) { o.CaseInsensitiveFields = true })
+}
+
+// WithDefaults sets Options.Defaults.
+func WithDefaults(defaults map[string]interface{}) Option {
+	return optionFunc(func(o *Options) { o.Defaults = defaults })
+}
+
+// WithShadowingErrors sets Options.ShadowingErrors.
+func WithShadowingErrors() Option {
+	return optionFunc(func(o *Options) { o.ShadowingErrors = true })
+}
+
+// WithMissingFalse sets Options.MissingFalse.
+func WithMissingFalse() Option {
+	return optionFunc(func(o *Options) { o.MissingFalse = true })
+}
+
+// WithOnMissing sets Options.OnMissing.
+func WithOnMissing(fn func(name string)) Option {
+	return optionFunc(func(o *Options) { o.OnMissing = fn })
+}
+
+// WithOnApply sets Options.OnApply.
+func WithOnApply(fn func(op Token, l, r Expr, result bool, err error)) Option {
+	return optionFunc(func(o *Options) { o.OnApply = fn })
+}
+
+// WithOnResolve sets Options.OnResolve.
+func WithOnResolve(fn func(name string, value interface{}, err error)) Option {
+	return optionFunc(func(o *Options) { o.OnResolve = fn })
+}
@@ -7,6 +7,9 @@ import (
 	"strconv"
 	"strings"
 	"text/scanner"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Parser encapsulates the scanner and responsible for returning AST
@@ -18,23 +21,127 @@ type Parser struct {
 	buf struct {
 		tok rune   // last read token
 		tt  string // token text
+		pos Pos    // token position
 		n   int    // buffer size (max=1)
 	}
+	// Buffer to keep the read forward mapped token
+	tbuf struct {
+		tok Token  // last mapped token
+		lit string // token literal
+		pos Pos    // token position
+		n   int    // buffer size (max=1)
+	}
+	// Literal and position of the last mapped token, reported on errors
+	last struct {
+		lit string
+		pos Pos
+	}
+	// Error describing the last ILLEGAL token, if any
+	err error
+	// Whether the last scanned literal misses its closing quote
+	unterminated bool
+	// Options tuning the language accepted by the parser
+	opts ParserOptions
+	// Warnings about deprecated constructs, see ParseWithWarnings
+	warnings []Warning
+	// Nesting of the expression being parsed
+	depth int
+}
+
+// ParserOptions tunes the language accepted by a Parser.
+type ParserOptions struct {
+	// StrictKeywords requires operator keywords such as AND, IN or NOT to
+	// be written in upper-case. TRUE, FALSE and NULL are always case
+	// insensitive.
+	StrictKeywords bool
+	// SuppressWarnings lists the codes of the warnings which
+	// ParseWithWarnings must not report.
+	SuppressWarnings []string
+	// MaxDepth and MaxNodes limit the depth and the number of nodes of
+	// the parsed expression, see ErrTooComplex. Zero means
+	// DefaultMaxDepth and DefaultMaxNodes, a negative value no limit.
+	MaxDepth, MaxNodes int
 }
 
 // NewParser returns a new instance of Parser.
 func NewParser(r io.Reader) *Parser {
-	p := &Parser{s: scanner.Scanner{}}
-	p.s.Mode = scanner.ScanIdents | scanner.ScanFloats | scanner.ScanStrings
+	return NewParserWithOptions(r, ParserOptions{})
+}
+
+// NewParserWithOptions returns a new instance of Parser accepting the
+// language variant described by opts.
+func NewParserWithOptions(r io.Reader, opts ParserOptions) *Parser {
+	p := &Parser{s: scanner.Scanner{}, opts: opts}
+	// Line // and block /* */ comments are skipped like whitespace.
+	p.s.Mode = scanner.ScanIdents | scanner.ScanFloats | scanner.ScanStrings | scanner.ScanRawStrings |
+		scanner.ScanComments | scanner.SkipComments
 	p.s.Init(r)
+	p.s.Error = p.scanError
 	return p
 }
 
+// scanError records the errors reported by the scanner. Unterminated
+// literals and block comments become ILLEGAL tokens, other messages are
+// tolerated: escape sequences are not interpreted and char literals hold
+// whole strings.
+func (p *Parser) scanError(_ *scanner.Scanner, msg string) {
+	if msg == "literal not terminated" || msg == "comment not terminated" {
+		p.unterminated = true
+	}
+}
+
 // Parse starts scanning & parsing process (main entry point).
 // It returns an expression (AST) which you can use for the final evaluation
-// of the conditions/statements
+// of the conditions/statements. Errors are returned as *ParseError.
 func (p *Parser) Parse() (Expr, error) {
-	return p.parseExpr()
+	expr, err := p.parse()
+	if err != nil {
+		return nil, &ParseError{Msg: err.Error(), Token: p.last.lit, Pos: p.last.pos, Err: err}
+	}
+	// The limits apply to the whole tree, no token is at fault.
+	maxDepth := complexityLimit(p.opts.MaxDepth, DefaultMaxDepth)
+	if err := checkComplexity(expr, maxDepth, complexityLimit(p.opts.MaxNodes, DefaultMaxNodes)); err != nil {
+		return nil, &ParseError{Msg: err.Error(), Err: err}
+	}
+	return expr, nil
+}
+
+// MustParse is like Parse on the string s but panics if s can't be parsed.
+// It simplifies the initialization of global variables holding
+// expressions.
+func MustParse(s string) Expr {
+	expr, err := NewParser(strings.NewReader(s)).Parse()
+	if err != nil {
+		panic(fmt.Sprintf("conditions: MustParse(%q): %s", s, err))
+	}
+	return expr
+}
+
+// ParseWithWarnings is like Parse, and also returns warnings about the
+// deprecated constructs found in the input, in order of appearance.
+func (p *Parser) ParseWithWarnings() (Expr, []Warning, error) {
+	expr, err := p.Parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	return expr, p.warnings, nil
+}
+
+// parse parses the whole input as a single expression.
+func (p *Parser) parse() (Expr, error) {
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole input must be consumed.
+	if tok, lit := p.scanWithMapping(); tok != EOF {
+		if tok == ILLEGAL {
+			return nil, p.illegal(lit)
+		}
+		return nil, fmt.Errorf("Unexpected %s after expression", tokstr(tok, lit))
+	}
+	return expr, nil
 }
 
 // scan returns the next token from the underlying scanner.
@@ -45,7 +152,10 @@ func (p *Parser) scan() (rune, string) {
 		p.buf.n = 0
 	} else {
 		// Otherwise read and put into buffer in case we 'unscan' it later
-		p.buf.tok, p.buf.tt = p.s.Scan(), p.s.TokenText()
+		p.unterminated = false
+		p.buf.tok = p.s.Scan()
+		p.buf.tt = p.s.TokenText()
+		p.buf.pos = Pos{Offset: p.s.Offset, Line: p.s.Line, Column: p.s.Column}
 	}
 	return p.buf.tok, p.buf.tt
 }
@@ -59,49 +169,105 @@ func (p *Parser) scanWithMapping() (Token, string) {
 		tt  string
 	)
 
+	// If we have a mapped token on the buffer, then return it.
+	if p.tbuf.n != 0 {
+		p.tbuf.n = 0
+		p.last.lit, p.last.pos = p.tbuf.lit, p.tbuf.pos
+		return p.tbuf.tok, p.tbuf.lit
+	}
+
+	p.err = nil
 	t, tt = p.scan()
+	pos := p.buf.pos
 
 	// Map Go's token to our Token
 	switch t {
 	case scanner.EOF:
 		tok = EOF
+		if p.unterminated {
+			tok, tt = ILLEGAL, "/*"
+			p.err = fmt.Errorf("ILLEGAL /*, comment not terminated")
+		}
 	case '(':
 		tok = LPAREN
 	case ')':
 		tok = RPAREN
+	case '+':
+		tok = ADD
 	case '-':
-		t, tt = p.scan()
-
-		if t == scanner.Float || t == scanner.Int {
-			tok = NUMBER
-			tt = "-" + tt
-		} else {
-			tok = ILLEGAL
-		}
+		// A minus before a number is parsed as part of the literal.
+		tok = SUB
+	case '*':
+		tok = MUL
 	case scanner.Float, scanner.Int:
 		tok = NUMBER
+		// A unit right after a number makes a duration, as in 5s or 1h30m.
+		if unicode.IsLetter(p.s.Peek()) {
+			_, unit := p.scan()
+			tt += unit
+			if _, err := parseDuration(tt); err != nil {
+				tok = ILLEGAL
+				p.err = err
+			} else {
+				tok = DURATION
+			}
+		}
 	case '$':
+		if p.s.Peek() == '{' {
+			p.s.Next()
+			var err error
+			if tt, err = p.scanBracedIdent(); err != nil {
+				tok, tt = ILLEGAL, "${"+tt
+				p.err = err
+			} else {
+				// Kept braced for varRef to tell it from $name.
+				tok, tt = IDENT, "${"+tt+"}"
+			}
+			break
+		}
 		t, tt = p.scan()
 
 		if t == scanner.Ident {
 			tok = IDENT
-
+			// $a.b is the same variable as [a][b], and $a[0] as [a][0].
+			for tok == IDENT && (p.s.Peek() == '.' || p.s.Peek() == '[') {
+				if p.s.Next() == '[' {
+					index, err := p.scanIndex()
+					if err != nil {
+						tok, tt = ILLEGAL, tt+"["+index
+						p.err = err
+					} else {
+						tt += "." + index
+					}
+				} else if t, lit := p.scan(); t == scanner.Ident {
+					tt += "." + lit
+				} else {
+					tok, tt = ILLEGAL, tt+"."+lit
+				}
+			}
 		} else {
 			tok = ILLEGAL
 		}
 	case '[':
-
-		// TODO : capter les tableau de string comme ["hello", "world", "foo"] => StringLiteral
-		var err error
-		t, tt, err = p.scanArg()
-		if err != nil {
-			p.unscan()
-			t, tt, err = p.scanArray(tt)
-			if err == nil {
-				tok = ARRAY
-			} else {
+		// An array literal starts with a string or a number, a [variable]
+		// reference with a name.
+		next, _ := p.scan()
+		p.unscan()
+		if next == scanner.String || next == scanner.Char || next == scanner.RawString ||
+			next == scanner.Int || next == scanner.Float || next == '-' {
+			var err error
+			if tt, err = p.scanArray(); err != nil {
 				tok = ILLEGAL
+				p.err = err
+			} else {
+				tok = ARRAY
 			}
+			break
+		}
+
+		var err error
+		if t, tt, err = p.scanArg(); err != nil {
+			tok = ILLEGAL
 		} else {
 			tok = IDENT
 		}
@@ -115,7 +281,34 @@ func (p *Parser) scanWithMapping() (Token, string) {
 			tok = NEREG
 			tt = "!~"
 		} else {
-			tok = ILLEGAL
+			tok = NOT
+			tt = "!"
+			p.unscan()
+			p.warn(WarnNotAlias, tt, pos, "NOT")
+		}
+	case '&':
+		t, tt = p.scan()
+
+		if t == '&' {
+			tok = AND
+			tt = "&&"
+			p.warn(WarnAndAlias, tt, pos, "AND")
+		} else {
+			p.unscan()
+			tok, tt = ILLEGAL, "&"
+			p.err = fmt.Errorf("ILLEGAL &, did you mean && or BAND?")
+		}
+	case '|':
+		t, tt = p.scan()
+
+		if t == '|' {
+			tok = OR
+			tt = "||"
+			p.warn(WarnOrAlias, tt, pos, "OR")
+		} else {
+			p.unscan()
+			tok, tt = ILLEGAL, "|"
+			p.err = fmt.Errorf("ILLEGAL |, did you mean || or BOR?")
 		}
 	case '>':
 		t, tt = p.scan()
@@ -134,6 +327,10 @@ func (p *Parser) scanWithMapping() (Token, string) {
 		if t == '=' {
 			tok = LTE
 			tt = "<="
+		} else if t == '>' {
+			tok = NEQ
+			tt = "<>"
+			p.warn(WarnNeqAlias, tt, pos, "!=")
 		} else {
 			tok = LT
 			tt = "<"
@@ -150,26 +347,42 @@ func (p *Parser) scanWithMapping() (Token, string) {
 			tok = EREG
 			tt = "=~"
 		} else {
-			tok = ILLEGAL
+			tok = EQ
+			tt = "="
+			p.unscan()
+			p.warn(WarnEqAlias, tt, pos, "==")
 		}
 
 	case '/':
-		var ttTmp string
-		for {
-			t, ttTmp = p.scan()
-			tt = tt + ttTmp
-			if t == '/' {
-				tok = STRING
-				break
+		// A regular expression literal when an operand is expected, see
+		// parsePrimaryExpr. // and /* start comments, so such a literal
+		// can neither be empty nor start with *.
+		tok = DIV
+
+	case scanner.String, scanner.Char, scanner.RawString:
+		// Single-quoted strings are scanned as char literals. Raw strings
+		// are taken verbatim, backslashes are not escapes.
+		if p.unterminated {
+			tok = ILLEGAL
+			p.err = fmt.Errorf("ILLEGAL %s, string literal not terminated", tt)
+		} else if _, err := unquote(tt); err != nil {
+			tok = ILLEGAL
+			p.err = fmt.Errorf("ILLEGAL %s, %s", tt, err)
+			// Point at the escape sequence, literals span a single line.
+			if e, ok := err.(*escapeError); ok {
+				pos.Offset += e.off
+				pos.Column += utf8.RuneCountInString(tt[:e.off])
 			}
+		} else {
+			tok = STRING
 		}
-
-	case scanner.String:
-		tok = STRING
 	case scanner.Ident:
 		ttU := strings.ToUpper(tt)
 
-		if ttU == "AND" {
+		if p.opts.StrictKeywords && tt != ttU && isKeyword(ttU) {
+			tok = ILLEGAL
+			p.err = fmt.Errorf("ILLEGAL %s, keywords must be upper-case: %s", tt, ttU)
+		} else if ttU == "AND" {
 			tok = AND
 		} else if ttU == "OR" {
 			tok = OR
@@ -181,78 +394,483 @@ func (p *Parser) scanWithMapping() (Token, string) {
 			tok = CONTAINS
 		} else if ttU == "IN" {
 			tok = IN
+		} else if ttU == "NOTIN" && (tt == ttU || !p.opts.StrictKeywords) {
+			tok = NOTIN
+			p.warn(WarnNotInToken, tt, pos, "NOT IN")
+		} else if ttU == "LIKE" {
+			tok = LIKE
+		} else if ttU == "INKEYS" {
+			tok = INKEYS
+		} else if ttU == "PHONEEQ" {
+			tok = PHONEEQ
+		} else if ttU == "NEARINT" {
+			tok = NEARINT
+		} else if ttU == "BEFORE" {
+			tok = BEFORE
+		} else if ttU == "AFTER" {
+			tok = AFTER
+		} else if ttU == "SIZEBETWEEN" {
+			tok = SIZEBETWEEN
+		} else if ttU == "BETWEEN" {
+			tok = BETWEEN
+		} else if ttU == "ISNTHWEEKDAY" {
+			tok = ISNTHWEEKDAY
+		} else if ttU == "BAND" {
+			tok = BAND
+		} else if ttU == "BOR" {
+			tok = BOR
+		} else if ttU == "BXOR" {
+			tok = BXOR
+		} else if ttU == "ANY" {
+			tok = ANY
+		} else if ttU == "ALL" {
+			tok = ALL
+		} else if ttU == "EXISTS" {
+			tok = EXISTS
+		} else if ttU == "SATISFIES" {
+			tok = SATISFIES
+		} else if ttU == "AS" {
+			tok = AS
+		} else if ttU == "ISBUSINESSDAY" {
+			tok = ISBUSINESSDAY
+		} else if ttU == "ENTROPY" {
+			tok = ENTROPY
+		} else if ttU == "ISPOWEROFTWO" {
+			tok = ISPOWEROFTWO
+		} else if ttU == "IS" {
+			_, next := p.scan()
+			tt = "IS " + strings.ToUpper(next)
+			if tt == "IS NOT" {
+				_, next = p.scan()
+				tt += " " + strings.ToUpper(next)
+			}
+			switch tt {
+			case "IS NULL":
+				tok = ISNULL
+			case "IS NOT NULL":
+				tok = ISNOTNULL
+			default:
+				tok = ILLEGAL
+				p.err = fmt.Errorf("ILLEGAL %s, expected IS NULL or IS NOT NULL", tt)
+			}
 		} else if ttU == "NOT" {
 			_, tmp := p.scan()
-			if strings.ToUpper(tmp) == "IN" {
+			if !p.opts.StrictKeywords {
+				tmp = strings.ToUpper(tmp)
+			}
+			if tmp == "IN" {
 				tok = NOTIN
 				tt = "NOT IN"
+			} else if tmp == "CONTAINS" {
+				tok = NOTCONTAINS
+				tt = "NOT CONTAINS"
+			} else if tmp == "LIKE" {
+				tok = NOTLIKE
+				tt = "NOT LIKE"
 			} else {
 				p.unscan()
-				tok = ILLEGAL
+				tok = NOT
 			}
 		} else if ttU == "TRUE" {
 			tok = TRUE
 		} else if ttU == "FALSE" {
 			tok = FALSE
-		} else if strings.HasPrefix(ttU, "C") || strings.HasPrefix(ttU, "P") {
+		} else if ttU == "NULL" {
+			tok = NULL
+		} else if op := lookupCustomOperatorName(ttU); op != nil {
+			tok = op.tok
+			tt = op.name
+		} else if t, _ = p.scan(); t == '(' {
+			p.unscan()
+			tok = FUNC
+		} else if p.unscan(); strings.HasPrefix(ttU, "C") || strings.HasPrefix(ttU, "P") {
 			tok = IDENT
 		} else {
 			tok = ILLEGAL
 		}
+	case ',':
+		tok = COMMA
+	case '?':
+		tok = QUESTION
+	case ':':
+		tok = COLON
+	case '@':
+		t, tt = p.scan()
+		if t == scanner.Ident && strings.ToLower(tt) == "rule" {
+			tok, tt = RULE, "@rule"
+		} else {
+			tok, tt = ILLEGAL, "@"+tt
+		}
 	}
 
+	p.last.lit, p.last.pos = tt, pos
 	return tok, tt
 }
 
+// scanRegex reads the rest of a /regular expression/ literal, the opening
+// slash having been read, and returns the pattern. It is taken as written,
+// a slash preceded by a backslash does not close the literal.
+func (p *Parser) scanRegex() (string, error) {
+	var b strings.Builder
+	for {
+		ch := p.s.Next()
+		switch ch {
+		case scanner.EOF:
+			return "", fmt.Errorf("ILLEGAL /%s, regular expression not terminated", b.String())
+		case '/':
+			return b.String(), nil
+		case '\\':
+			b.WriteRune(ch)
+			if p.s.Peek() != scanner.EOF {
+				ch = p.s.Next()
+			}
+		}
+		b.WriteRune(ch)
+	}
+}
+
+// scanIndex reads the integer index of a $a[0] variable reference up to
+// the closing bracket. Negative indexes count from the end.
+func (p *Parser) scanIndex() (string, error) {
+	var b strings.Builder
+	for {
+		ch := p.s.Next()
+		switch {
+		case ch == ']' && b.Len() > 0 && b.String() != "-":
+			return b.String(), nil
+		case ch >= '0' && ch <= '9', ch == '-' && b.Len() == 0:
+			b.WriteRune(ch)
+		default:
+			if ch != scanner.EOF {
+				b.WriteRune(ch)
+			}
+			return b.String(), fmt.Errorf("ILLEGAL [%s, expected an integer index and ]", b.String())
+		}
+	}
+}
+
+// scanBracedIdent reads a ${...} variable name up to the closing brace,
+// which can be escaped as \}. The name is taken verbatim otherwise.
+func (p *Parser) scanBracedIdent() (string, error) {
+	var b strings.Builder
+	for {
+		ch := p.s.Next()
+		switch ch {
+		case scanner.EOF:
+			return b.String(), fmt.Errorf("ILLEGAL ${%s, variable name not terminated, missing }", b.String())
+		case '}':
+			if b.Len() == 0 {
+				return "}", fmt.Errorf("ILLEGAL ${}, empty variable name")
+			}
+			return b.String(), nil
+		case '\\':
+			if p.s.Peek() == '}' {
+				ch = p.s.Next()
+			}
+		}
+		b.WriteRune(ch)
+	}
+}
+
+// escapeError reports an invalid escape sequence in a string literal.
+type escapeError struct {
+	msg string
+	// Byte offset of the backslash in the literal
+	off int
+}
+
+func (e *escapeError) Error() string { return e.msg }
+
+// unquote returns the value of a string literal. Escape sequences are
+// interpreted in double-quoted strings only: \", \\, \n, \t, \r and
+// \uXXXX. Any other escape is an *escapeError.
+func unquote(lit string) (string, error) {
+	s := lit[1 : len(lit)-1]
+	if lit[0] != '"' || !strings.ContainsRune(s, '\\') {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		off := i + 1
+		i++
+		if i == len(s) {
+			return "", &escapeError{"escape sequence not terminated", off}
+		}
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte(c)
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'u':
+			if i+5 > len(s) {
+				return "", &escapeError{fmt.Sprintf("invalid escape sequence \\%s", s[i:]), off}
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", &escapeError{fmt.Sprintf("invalid escape sequence \\%s", s[i:i+5]), off}
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			r, _ := utf8.DecodeRuneInString(s[i:])
+			return "", &escapeError{fmt.Sprintf("unknown escape sequence \\%c", r), off}
+		}
+	}
+	return b.String(), nil
+}
+
 // unscan pushes the previously read token back onto the buffer.
 func (p *Parser) unscan() {
 	p.buf.n = 1
 }
 
+// unscanMapped pushes the previously mapped token back onto the buffer.
+func (p *Parser) unscanMapped(tok Token, lit string) {
+	p.tbuf.tok, p.tbuf.lit, p.tbuf.pos, p.tbuf.n = tok, lit, p.last.pos, 1
+}
+
+// illegal returns the error for an ILLEGAL token read by scanWithMapping.
+func (p *Parser) illegal(lit string) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("ILLEGAL %s", lit)
+}
+
 // parseExpr is an entry point to parsing
 func (p *Parser) parseExpr() (Expr, error) {
+	cond, err := p.parseBinaryExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	// cond ? a : b binds looser than any operator, and to the right.
+	tok, lit := p.scanWithMapping()
+	if tok != QUESTION {
+		p.unscanMapped(tok, lit)
+		return cond, nil
+	}
+	then, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok, lit := p.scanWithMapping(); tok != COLON {
+		return nil, fmt.Errorf("Expected : in conditional expression, got: %s", tokstr(tok, lit))
+	}
+	els, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &ConditionalExpr{Cond: cond, Then: then, Else: els}, nil
+}
+
+// parseBinaryExpr parses a chain of binary expressions, stopping before
+// the first operator whose precedence is lower than minPrec.
+func (p *Parser) parseBinaryExpr(minPrec int) (Expr, error) {
 	// Parse a non-binary expression type to start.
-	// This variable will always be the root of the expression tree.
 	expr, err := p.parseUnaryExpr()
 	if err != nil {
 		return nil, err
 	}
+	return p.parseBinaryExprFrom(expr, minPrec)
+}
+
+// parseBinaryExprFrom is like parseBinaryExpr, with the first operand
+// already parsed as expr.
+func (p *Parser) parseBinaryExprFrom(expr Expr, minPrec int) (Expr, error) {
+	// The root is a placeholder whose RHS holds the expression tree.
+	root := &BinaryExpr{RHS: expr}
 
 	// Loop over operations and unary exprs and build a tree based on precendence.
 	for {
 		// If the next token is NOT an operator then return the expression.
 		op, tx := p.scanWithMapping()
 		if op == ILLEGAL {
-			return nil, fmt.Errorf("ILLEGAL %s", tx)
+			if p.err == nil {
+				return nil, fmt.Errorf("ILLEGAL operator %s, expected one of: %s", tx, strings.Join(operatorSpellings(), ", "))
+			}
+			return nil, p.illegal(tx)
 		}
-		if !op.isOperator() {
-			p.unscan()
-			return expr, nil
-
+		if !op.isOperator() || op.Precedence() < minPrec {
+			p.unscanMapped(op, tx)
+			return root.RHS, nil
 		}
 
-		// Otherwise parse the next unary expression.
-		rhs, err := p.parseUnaryExpr()
+		// Otherwise parse the next unary expression, or the operands of
+		// the operators taking several.
+		var rhs Expr
+		var err error
+		switch op {
+		case SIZEBETWEEN, BETWEEN:
+			rhs, err = p.parseRange(op)
+		case ISNTHWEEKDAY:
+			rhs, err = p.parseTuple(op, 2)
+		case BEFORE, AFTER:
+			p.warnDayCount(op)
+			rhs, err = p.parseUnaryExpr()
+		default:
+			rhs, err = p.parseUnaryExpr()
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		// Assign the new root based on the precendence of the LHS and RHS operators.
-		if lhs, ok := expr.(*BinaryExpr); ok && lhs.Op.Precedence() <= op.Precedence() {
-			expr = &BinaryExpr{
-				LHS: lhs.LHS,
-				RHS: &BinaryExpr{LHS: lhs.RHS, RHS: rhs, Op: op},
-				Op:  lhs.Op,
+		// Find the right spot in the tree to add the new expression by
+		// descending the RHS of the tree until we reach the last BinaryExpr
+		// or a BinaryExpr whose operator has precedence >= the new one.
+		for node := root; ; {
+			r, ok := node.RHS.(*BinaryExpr)
+			if !ok || r.Op.Precedence() >= op.Precedence() {
+				node.RHS = &BinaryExpr{LHS: node.RHS, RHS: rhs, Op: op}
+				break
 			}
-		} else {
-			expr = &BinaryExpr{LHS: expr, RHS: rhs, Op: op}
+			node = r
 		}
 	}
 
 }
 
+// parseRange parses the "low AND high" bounds of the operator op. The
+// bounds bind tighter than op, so AND is never part of them.
+func (p *Parser) parseRange(op Token) (Expr, error) {
+	low, err := p.parseBinaryExpr(op.Precedence() + 1)
+	if err != nil {
+		return nil, err
+	}
+	if tok, lit := p.scanWithMapping(); tok != AND {
+		return nil, fmt.Errorf("Expected AND between the bounds of %s, got: %s", op, tokstr(tok, lit))
+	}
+	high, err := p.parseBinaryExpr(op.Precedence() + 1)
+	if err != nil {
+		return nil, err
+	}
+	return &RangeExpr{Low: low, High: high}, nil
+}
+
+// parseTuple parses the n operands following the operator op, separated
+// by spaces. Operands bind tighter than op.
+func (p *Parser) parseTuple(op Token, n int) (Expr, error) {
+	tuple := &TupleExpr{}
+	for i := 0; i < n; i++ {
+		x, err := p.parseBinaryExpr(op.Precedence() + 1)
+		if err != nil {
+			return nil, err
+		}
+		tuple.Elems = append(tuple.Elems, x)
+	}
+	return tuple, nil
+}
+
 // parseUnaryExpr parses an non-binary expression.
 func (p *Parser) parseUnaryExpr() (Expr, error) {
+	// Nested expressions recurse through here, stop before they exhaust
+	// the stack.
+	p.depth++
+	defer func() { p.depth-- }()
+	if max := complexityLimit(p.opts.MaxDepth, DefaultMaxDepth); max >= 0 && p.depth > max {
+		return nil, &ErrTooComplex{Limit: "depth", Max: max}
+	}
+
+	// NOT negates the comparison which follows it.
+	tok, lit := p.scanWithMapping()
+	if tok == NOT {
+		expr, err := p.parseBinaryExpr(NOT.Precedence())
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: NOT, Expr: expr}, nil
+	}
+
+	// ANY/ALL bind the slice variable which follows them to each element
+	// while evaluating the comparison.
+	// With SATISFIES, the element is bound to $_ instead, or to the
+	// variable named by AS, and the slice variable keeps its value.
+	if tok == ANY || tok == ALL {
+		op := tok
+		tok, lit := p.scanWithMapping()
+		if tok != IDENT {
+			return nil, fmt.Errorf("%s expects a variable, got: %s", op, tokstr(tok, lit))
+		}
+
+		binder := "_"
+		switch next, nlit := p.scanWithMapping(); next {
+		case AS:
+			tok, blit := p.scanWithMapping()
+			if tok != IDENT {
+				return nil, fmt.Errorf("%s expects a variable, got: %s", AS, tokstr(tok, blit))
+			}
+			binder = varRef(blit).Val
+			if tok, slit := p.scanWithMapping(); tok != SATISFIES {
+				return nil, fmt.Errorf("Expected %s after %s %s, got: %s", SATISFIES, AS, blit, tokstr(tok, slit))
+			}
+		case SATISFIES:
+		default:
+			p.unscanMapped(next, nlit)
+			expr, err := p.parsePostfixExpr(varRef(lit))
+			if err != nil {
+				return nil, err
+			}
+			if expr, err = p.parseBinaryExprFrom(expr, op.Precedence()); err != nil {
+				return nil, err
+			}
+			return &QuantifierExpr{Op: op, Var: varRef(lit), Expr: expr}, nil
+		}
+
+		expr, err := p.parseBinaryExpr(op.Precedence())
+		if err != nil {
+			return nil, err
+		}
+		return &QuantifierExpr{Op: op, Var: varRef(lit), Binder: binder, Expr: expr}, nil
+	}
+	// EXISTS tests the presence of the variable which follows it.
+	if tok == EXISTS {
+		tok, lit := p.scanWithMapping()
+		if tok != IDENT {
+			return nil, fmt.Errorf("%s expects a variable, got: %s", EXISTS, tokstr(tok, lit))
+		}
+		return &UnaryExpr{Op: EXISTS, Expr: varRef(lit)}, nil
+	}
+	p.unscanMapped(tok, lit)
+
+	expr, err := p.parsePrimaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	return p.parsePostfixExpr(expr)
+}
+
+// parsePostfixExpr applies the postfix operators following the operand
+// expr.
+func (p *Parser) parsePostfixExpr(expr Expr) (Expr, error) {
+	for {
+		tok, lit := p.scanWithMapping()
+		if !tok.isPostfix() {
+			p.unscanMapped(tok, lit)
+			return expr, nil
+		}
+		expr = &UnaryExpr{Op: tok, Expr: expr}
+	}
+}
+
+// varRef returns the reference to the variable of an IDENT literal.
+func varRef(lit string) *VarRef {
+	if strings.HasPrefix(lit, "${") {
+		return &VarRef{Val: lit[2 : len(lit)-1], Literal: true}
+	}
+	return &VarRef{Val: lit}
+}
+
+// parsePrimaryExpr parses a literal, a variable or a grouped expression.
+func (p *Parser) parsePrimaryExpr() (Expr, error) {
 	// If the first token is a LPAREN then parse it as its own grouped expression.
 	tok, lit := p.scanWithMapping()
 	if tok == LPAREN {
@@ -271,72 +889,257 @@ func (p *Parser) parseUnaryExpr() (Expr, error) {
 
 	// Read next token.
 	switch tok {
+	case FUNC:
+		return p.parseCallExpr(lit)
+	case RULE:
+		return p.parseRuleRef()
 	case IDENT:
-		return &VarRef{Val: lit}, nil
+		return varRef(lit), nil
+	case SUB:
+		tok, lit := p.scanWithMapping()
+		if tok == DURATION {
+			d, err := parseDuration(lit)
+			if err != nil {
+				return nil, err
+			}
+			return &DurationLiteral{Val: -d}, nil
+		}
+		if tok != NUMBER {
+			return nil, fmt.Errorf("Expected a number after -, got: %s", tokstr(tok, lit))
+		}
+		v, err := parseNumber(lit)
+		if err != nil {
+			return nil, err
+		}
+		return &NumberLiteral{Val: -v}, nil
+	case DIV:
+		s, err := p.scanRegex()
+		if err != nil {
+			return nil, err
+		}
+		return &StringLiteral{Val: s}, nil
 	case STRING:
-		return &StringLiteral{Val: lit[1 : len(lit)-1]}, nil
+		s, err := unquote(lit)
+		if err != nil {
+			return nil, err
+		}
+		return &StringLiteral{Val: s}, nil
 	case NUMBER:
-		v, err := strconv.ParseFloat(lit, 64)
+		v, err := parseNumber(lit)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to parse number")
+			return nil, err
 		}
 		return &NumberLiteral{Val: v}, nil
+	case DURATION:
+		d, err := parseDuration(lit)
+		if err != nil {
+			return nil, err
+		}
+		return &DurationLiteral{Val: d}, nil
 	case TRUE, FALSE:
 		return &BooleanLiteral{Val: (tok == TRUE)}, nil
+	case NULL:
+		return &NullLiteral{}, nil
 	case ARRAY:
-		mapVal := []interface{}{}
-		err := json.Unmarshal([]byte(`[`+lit+`]`), &mapVal)
-		if len(mapVal) == 0 {
-			return nil, fmt.Errorf("Empty Slice not castable")
-		}
-		switch t := mapVal[0].(type) {
-		case string:
-			values := []string{}
-			for _, v := range mapVal {
-				values = append(values, v.(string))
-			}
-			return &SliceStringLiteral{Val: values}, err
-		case float64:
-			values := []float64{}
-			for _, v := range mapVal {
-				values = append(values, v.(float64))
+		// Elements are strings or numbers, see scanArray.
+		var elems []interface{}
+		if err := json.Unmarshal([]byte(lit), &elems); err != nil {
+			return nil, err
+		}
+		var (
+			strs []string
+			nums []float64
+		)
+		for _, v := range elems {
+			if s, ok := v.(string); ok {
+				strs = append(strs, s)
+			} else {
+				nums = append(nums, v.(float64))
 			}
-			return &SliceNumberLiteral{Val: values}, err
-		default:
-			return nil, fmt.Errorf("Slice of unknow type %s %T", t, t)
 		}
+		switch {
+		case len(nums) == 0:
+			return &SliceStringLiteral{Val: strs}, nil
+		case len(strs) == 0:
+			return &SliceNumberLiteral{Val: nums}, nil
+		}
+		return nil, fmt.Errorf("Array literal %s mixes strings and numbers", lit)
 
+	case ILLEGAL:
+		return nil, p.illegal(lit)
 	default:
 		return nil, fmt.Errorf("Parsing error: tok=%v, lit=%v", tok, lit)
 	}
 }
 
-func (p *Parser) scanArray(tt string) (rune, string, error) {
-	var t rune
+// parseRuleRef parses the parenthesized rule name of a @rule reference.
+func (p *Parser) parseRuleRef() (Expr, error) {
+	if tok, lit := p.scanWithMapping(); tok != LPAREN {
+		return nil, fmt.Errorf("Expected ( after @rule, got: %s", tokstr(tok, lit))
+	}
+	tok, lit := p.scanWithMapping()
+	if tok == ILLEGAL {
+		return nil, p.illegal(lit)
+	}
+	if tok != STRING {
+		return nil, fmt.Errorf("@rule expects a rule name string, got: %s", tokstr(tok, lit))
+	}
+	name, err := unquote(lit)
+	if err != nil {
+		return nil, err
+	}
+	if tok, lit := p.scanWithMapping(); tok != RPAREN {
+		return nil, fmt.Errorf("Expected ) after @rule(%s, got: %s", Quote(name), tokstr(tok, lit))
+	}
+	return &RuleRef{Name: name}, nil
+}
 
-	var ttTmp string
-	var sep string
+// parseNumber returns the value of a number literal, either a decimal
+// number or an integer in hexadecimal, octal or binary notation such as
+// 0xF0, 0o17 or 0b101, convenient for bit masks.
+func parseNumber(lit string) (float64, error) {
+	if v, err := strconv.ParseFloat(lit, 64); err == nil {
+		return v, nil
+	}
+	v, err := strconv.ParseInt(lit, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse number")
+	}
+	return float64(v), nil
+}
+
+// durationUnits lists the units of durations, as in 1h30m. On top of the
+// units of time.ParseDuration, d is a day and w a week of 24 hour days.
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
 
+// parseDuration parses a sequence of numbers each followed by a unit of
+// durationUnits, such as 5s, 1.5h or 1h30m.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("Invalid duration %q", s)
+	}
+	var d time.Duration
+	for rest := s; rest != ""; {
+		i := strings.IndexFunc(rest, unicode.IsLetter)
+		if i <= 0 {
+			return 0, fmt.Errorf("Invalid duration %q", s)
+		}
+		j := strings.IndexFunc(rest[i:], func(r rune) bool { return !unicode.IsLetter(r) })
+		if j < 0 {
+			j = len(rest)
+		} else {
+			j += i
+		}
+		n, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid duration %q", s)
+		}
+		unit, ok := durationUnits[rest[i:j]]
+		if !ok {
+			return 0, fmt.Errorf("Invalid duration %q, unknown unit %q", s, rest[i:j])
+		}
+		d += time.Duration(n * float64(unit))
+		rest = rest[j:]
+	}
+	return d, nil
+}
+
+// parseCallExpr parses the parenthesized arguments of a function call.
+func (p *Parser) parseCallExpr(name string) (Expr, error) {
+	if lookupBuiltin(name) == nil {
+		return nil, fmt.Errorf("Unknown function %s", name)
+	}
+	if tok, lit := p.scanWithMapping(); tok != LPAREN {
+		return nil, fmt.Errorf("Expected ( after %s, got: %s", name, tokstr(tok, lit))
+	}
+
+	call := &CallExpr{Name: strings.ToLower(name)}
+	if tok, lit := p.scanWithMapping(); tok == RPAREN {
+		return call, nil
+	} else if tok == ILLEGAL {
+		return nil, p.illegal(lit)
+	} else {
+		p.unscanMapped(tok, lit)
+	}
 	for {
-		t, ttTmp = p.scan()
-		if t == ']' {
-			return t, tt, nil
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
 		}
+		call.Params = append(call.Params, arg)
 
-		tt = tt + sep + ttTmp
-		// pp.Print(tt)
-		// fmt.Printf("\n")
+		tok, lit := p.scanWithMapping()
+		if tok == RPAREN {
+			if check := lookupBuiltin(name).check; check != nil {
+				if err := check(call.Params); err != nil {
+					return nil, fmt.Errorf("%s: %s", call.Name, err)
+				}
+			}
+			return call, nil
+		}
+		if tok != COMMA {
+			return nil, fmt.Errorf("Expected , or ) in arguments of %s, got: %s", name, tokstr(tok, lit))
+		}
 	}
+}
 
-	return t, tt, nil
+// scanArray reads an array literal of strings or numbers such as
+// ["a", 'b'] or [1, -2.5] up to the closing bracket, the opening one
+// having been read, and returns it as a JSON array.
+func (p *Parser) scanArray() (string, error) {
+	var elems []string
+	for {
+		t, tt := p.scan()
+		sign := ""
+		if t == '-' {
+			sign = "-"
+			t, tt = p.scan()
+		}
+		switch {
+		case sign == "" && (t == scanner.String || t == scanner.Char || t == scanner.RawString):
+			if p.unterminated {
+				return "", fmt.Errorf("ILLEGAL %s, string literal not terminated", tt)
+			}
+			s, err := unquote(tt)
+			if err != nil {
+				return "", fmt.Errorf("ILLEGAL %s, %s", tt, err)
+			}
+			b, _ := json.Marshal(s)
+			elems = append(elems, string(b))
+		case t == scanner.Int || t == scanner.Float:
+			v, err := parseNumber(sign + tt)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, strconv.FormatFloat(v, 'g', -1, 64))
+		default:
+			return "", fmt.Errorf("ILLEGAL %s, array elements must be strings or numbers", tokstr(EOF, sign+tt))
+		}
 
+		switch t, tt = p.scan(); t {
+		case ',':
+		case ']':
+			return "[" + strings.Join(elems, ",") + "]", nil
+		default:
+			return "", fmt.Errorf("ILLEGAL %s, expected , or ] in array literal", tokstr(EOF, tt))
+		}
+	}
 }
 
 // extract [variable] to variable
 // extract [variable][key1][key1] to variable.key1.key2
 // handle variable name which start with a "@"
 func (p *Parser) scanArg() (rune, string, error) {
-	var err error
 	var t rune
 	var tt string
 	var ttTmp string
@@ -366,8 +1169,6 @@ func (p *Parser) scanArg() (rune, string, error) {
 			return t, tt, fmt.Errorf("Args error")
 		}
 	}
-
-	return t, tt, err
 }
 
 func Variables(expression Expr) []string {
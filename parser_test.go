@@ -1,8 +1,12 @@
 package conditions
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,9 +16,13 @@ var invalidTestData = []string{
 	// "[] AND true",
 	"A",
 	"[var0] == DEMO",
-	"[var0] == 'DEMO'",
-	"![var0]",
-	"[var0] <> `DEMO`",
+	"[var0] == 'DEMO",
+	"[var0] & [var1]",
+	"[var0] | [var1]",
+	"!",
+	"[var0] 5",
+	"([var0]))",
+	"[var0] <> `DEMO",
 }
 
 var validTestData = []struct {
@@ -86,6 +94,64 @@ var validTestData = []struct {
 	{`[foo] not in [2,3,4]`, map[string]interface{}{"foo": 4}, false, false},
 	{`[foo] not in [2,3,4]`, map[string]interface{}{"foo": 5}, true, false},
 
+	// CONTAINS and NOT CONTAINS with substrings
+	{`[foo] contains "monde"`, map[string]interface{}{"foo": "le monde"}, true, false},
+	{`[foo] contains "world"`, map[string]interface{}{"foo": "le monde"}, false, false},
+	{`[foo] not contains "monde"`, map[string]interface{}{"foo": "le monde"}, false, false},
+	{`[foo] NOT CONTAINS "world"`, map[string]interface{}{"foo": "le monde"}, true, false},
+
+	// CONTAINS with numbers searched in strings
+	{`[foo] contains 123`, map[string]interface{}{"foo": "abc123"}, true, false},
+	{`[foo] contains 1.5`, map[string]interface{}{"foo": "v1.50"}, true, false},
+	{`[foo] contains 4`, map[string]interface{}{"foo": "abc123"}, false, false},
+	{`[foo] not contains 4`, map[string]interface{}{"foo": "abc123"}, true, false},
+
+	// NOT CONTAINS with slices of strings and numbers
+	{`[foo] not contains "may"`, map[string]interface{}{"foo": []string{"notme", "may"}}, false, false},
+	{`[foo] not contains "findme"`, map[string]interface{}{"foo": []string{"notme", "may"}}, true, false},
+	{`[foo] NOT CONTAINS 4`, map[string]interface{}{"foo": []float64{2, 3, 4}}, false, false},
+	{`[foo] NOT CONTAINS 5`, map[string]interface{}{"foo": []float64{2, 3, 4}}, true, false},
+	{`[foo] NOT CONTAINS 5`, map[string]interface{}{"foo": 5}, false, true},
+
+	// Strings are ordered byte-wise
+	{`$v > "1.2.0"`, map[string]interface{}{"v": "1.3.0"}, true, false},
+	{`$v > "1.2.0"`, map[string]interface{}{"v": "1.2.0"}, false, false},
+	{`$v >= "1.2.0"`, map[string]interface{}{"v": "1.2.0"}, true, false},
+	{`$v > "1.2"`, map[string]interface{}{"v": "1.2.0"}, true, false},
+	{`$v < "1.2"`, map[string]interface{}{"v": "1.2.0"}, false, false},
+	{`$v <= "abc"`, map[string]interface{}{"v": "ab"}, true, false},
+	{`$v < "b"`, map[string]interface{}{"v": "B"}, true, false},
+	{`$v > ""`, map[string]interface{}{"v": "a"}, true, false},
+	{`$v < "1.10"`, map[string]interface{}{"v": "1.9"}, false, false},
+	{`$v > "1"`, map[string]interface{}{"v": 2}, false, true},
+	{`$v > 1`, map[string]interface{}{"v": "2"}, false, true},
+
+	// LIKE and NOT LIKE with SQL wildcards
+	{`$name LIKE "J%n"`, map[string]interface{}{"name": "John"}, true, false},
+	{`$name LIKE "J%n"`, map[string]interface{}{"name": "Joan "}, false, false},
+	{`$name like "J_hn"`, map[string]interface{}{"name": "John"}, true, false},
+	{`$name LIKE "J_n"`, map[string]interface{}{"name": "John"}, false, false},
+	{`$name LIKE "%"`, map[string]interface{}{"name": ""}, true, false},
+	{`$name LIKE "a.c"`, map[string]interface{}{"name": "abc"}, false, false},
+	{`$name LIKE "(a)+[b]"`, map[string]interface{}{"name": "(a)+[b]"}, true, false},
+	{`$rate LIKE "100\\%"`, map[string]interface{}{"rate": "100%"}, true, false},
+	{`$rate LIKE "100\\%"`, map[string]interface{}{"rate": "1000"}, false, false},
+	{"$rate LIKE `a\\_b%`", map[string]interface{}{"rate": "a_b c"}, true, false},
+	{"$rate LIKE `a\\_b`", map[string]interface{}{"rate": "axb"}, false, false},
+	{`$name NOT LIKE "J%"`, map[string]interface{}{"name": "Ann"}, true, false},
+	{`$name not like "J%"`, map[string]interface{}{"name": "Jo"}, false, false},
+	{`$name LIKE "J%"`, map[string]interface{}{"name": 5}, false, true},
+
+	// Durations, compared to duration literals and strings
+	{`$timeout > 5s`, map[string]interface{}{"timeout": 10 * time.Second}, true, false},
+	{`$timeout > 1h30m`, map[string]interface{}{"timeout": 90 * time.Minute}, false, false},
+	{`$timeout >= 1.5h AND $timeout <= 90m`, map[string]interface{}{"timeout": 90 * time.Minute}, true, false},
+	{`$timeout == "2m" AND $timeout != "3m"`, map[string]interface{}{"timeout": 2 * time.Minute}, true, false},
+	{`$timeout < 1w`, map[string]interface{}{"timeout": 6 * 24 * time.Hour}, true, false},
+	{`$timeout > -1ms`, map[string]interface{}{"timeout": time.Duration(0)}, true, false},
+	{`$timeout > 5`, map[string]interface{}{"timeout": 10 * time.Second}, false, true},
+	{`$timeout > "soon"`, map[string]interface{}{"timeout": 10 * time.Second}, false, true},
+
 	// =~
 	{"[status] =~ /^5\\d\\d/", map[string]interface{}{"status": "500"}, true, false},
 	{"[status] =~ /^4\\d\\d/", map[string]interface{}{"status": "500"}, false, false},
@@ -93,6 +159,7 @@ var validTestData = []struct {
 	// !~
 	{"[status] !~ /^5\\d\\d/", map[string]interface{}{"status": "500"}, false, false},
 	{"[status] !~ /^4\\d\\d/", map[string]interface{}{"status": "500"}, true, false},
+	{"[status] !~ /^4\\d\\d/", map[string]interface{}{"status": 500}, false, true},
 }
 
 func TestInvalid(t *testing.T) {
@@ -140,7 +207,7 @@ func TestValid(t *testing.T) {
 			break
 		}
 
-		t.Log("Evaluating with: %#v", td.args)
+		t.Logf("Evaluating with: %#v", td.args)
 		r, err = Evaluate(expr, td.args)
 		if err != nil {
 			if td.isErr {
@@ -196,6 +263,22 @@ func TestValid(t *testing.T) {
 	*/
 }
 
+func TestTrailingTokens(t *testing.T) {
+	for cond, msg := range map[string]string{
+		`$a == 1 $b`:     "Unexpected b after expression",
+		`($a == 1))`:     "Unexpected ) after expression",
+		`$a == 1 "x"`:    `Unexpected "x" after expression`,
+		`$a == 1 true 2`: "Unexpected true after expression",
+		`$a == 1 & $b`:   "ILLEGAL &",
+	} {
+		expr, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Nil(t, expr, cond)
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), msg, cond)
+		}
+	}
+}
+
 func TestExpressionsVariableNames(t *testing.T) {
 	cond := "[@foo][a] == true and [bar] == true or [var9] > 10"
 	p := NewParser(strings.NewReader(cond))
@@ -209,3 +292,736 @@ func TestExpressionsVariableNames(t *testing.T) {
 	assert.NotContains(t, args, "foo", "...")
 	assert.NotContains(t, args, "@foo", "...")
 }
+
+func TestPrecedence(t *testing.T) {
+	for cond, tree := range map[string]string{
+		`$a == 1 AND $b == 2 AND $c == 3`:  `a == 1.000 AND b == 2.000 AND c == 3.000`,
+		`$a == 1 OR $b == 2 AND $c == 3`:   `a == 1.000 OR b == 2.000 AND c == 3.000`,
+		`$a CONTAINS "x" AND $b == "y"`:    `a CONTAINS "x" AND b == "y"`,
+		`($a == 1 OR $b == 2) AND $c == 3`: `(a == 1.000 OR b == 2.000) AND c == 3.000`,
+	} {
+		p := NewParser(strings.NewReader(cond))
+		expr, err := p.Parse()
+		assert.Nil(t, err)
+		assert.Equal(t, tree, expr.String())
+	}
+
+	p := NewParser(strings.NewReader(`$a == 1 OR $b == 2 AND $c == 3`))
+	expr, err := p.Parse()
+	assert.Nil(t, err)
+	root, ok := expr.(*BinaryExpr)
+	assert.True(t, ok)
+	assert.Equal(t, OR, root.Op)
+	assert.Equal(t, AND, root.RHS.(*BinaryExpr).Op)
+
+	args := map[string]interface{}{"a": 1, "b": 2, "c": 3}
+	r, err := Evaluate(mustParse(t, `$a == 1 AND $b == 2 AND $c == 3`), args)
+	assert.Nil(t, err)
+	assert.True(t, r)
+}
+
+func TestTokenValues(t *testing.T) {
+	// Tokens are exported, new ones must not shift the existing values.
+	assert.Equal(t, Token(3), IDENT)
+	assert.Equal(t, Token(11), AND)
+	assert.Equal(t, Token(25), NOTIN)
+	assert.Equal(t, Token(28), RPAREN)
+	assert.Equal(t, RPAREN+1, INKEYS)
+
+	for tok := ILLEGAL; tok < customBegin; tok++ {
+		assert.False(t, tok.isOperator() && tok.isPostfix(), tok.String())
+	}
+	for _, tok := range []Token{DURATION, NULL} {
+		assert.True(t, tok.isLiteral(), tok.String())
+	}
+	for _, tok := range []Token{INKEYS, LIKE, BEFORE, BETWEEN, ISNTHWEEKDAY} {
+		assert.True(t, tok.isOperator(), tok.String())
+	}
+}
+
+func TestSymbolicAliases(t *testing.T) {
+	for _, td := range []struct {
+		cond   string
+		args   map[string]interface{}
+		result bool
+	}{
+		{"$a && $b", map[string]interface{}{"a": true, "b": true}, true},
+		{"$a || $b", map[string]interface{}{"a": false, "b": true}, true},
+		{"!$a", map[string]interface{}{"a": false}, true},
+		{"not $a", map[string]interface{}{"a": true}, false},
+		{"![var0]", map[string]interface{}{"var0": true}, false},
+		{"NOT $x == 1 AND $y == 2", map[string]interface{}{"x": 2, "y": 2}, true},
+		{"!$x == 1 && $y == 2", map[string]interface{}{"x": 1, "y": 2}, false},
+		{"$a && $b OR $c", map[string]interface{}{"a": false, "b": true, "c": true}, true},
+		{"$a AND $b || $c && !$d", map[string]interface{}{"a": false, "b": true, "c": true, "d": false}, true},
+		{"$x != 1 && ($y == 2 || !($y == 3)) and NOT NOT $a", map[string]interface{}{"x": 2, "y": 3, "a": true}, false},
+	} {
+		expr := mustParse(t, td.cond)
+		r, err := Evaluate(expr, td.args)
+		assert.Nil(t, err, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+	}
+
+	// Both spellings build the same tree.
+	sym := mustParse(t, "$a && $b || !$c == 1")
+	kw := mustParse(t, "$a AND $b OR NOT $c == 1")
+	assert.Equal(t, kw.String(), sym.String())
+	assert.Equal(t, "a AND b OR NOT c == 1.000", kw.String())
+
+	_, err := NewParser(strings.NewReader("$a & $b")).Parse()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "&& or BAND")
+	}
+	_, err = NewParser(strings.NewReader("$a | $b")).Parse()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "|| or BOR")
+	}
+}
+
+func TestSQLOperatorAliases(t *testing.T) {
+	for _, td := range []struct {
+		cond   string
+		args   map[string]interface{}
+		result bool
+	}{
+		{`$a <> 1`, map[string]interface{}{"a": 2}, true},
+		{`$a <> 1`, map[string]interface{}{"a": 1}, false},
+		{`$a = 1`, map[string]interface{}{"a": 1}, true},
+		{`$a = "x" AND $b<>"y"`, map[string]interface{}{"a": "x", "b": "z"}, true},
+		{`$a == 1 AND $b >= 2 AND $c <= 3 AND $d = 4`, map[string]interface{}{"a": 1, "b": 2, "c": 3, "d": 4}, true},
+		{`$a=1`, map[string]interface{}{"a": 1}, true},
+		{`$a<2`, map[string]interface{}{"a": 1}, true},
+		{`$a>0`, map[string]interface{}{"a": 1}, true},
+	} {
+		expr := mustParse(t, td.cond)
+		r, err := Evaluate(expr, td.args)
+		assert.Nil(t, err, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+	}
+
+	assert.Equal(t, `a != 1.000`, mustParse(t, `$a <> 1`).String())
+	assert.Equal(t, `a == 1.000`, mustParse(t, `$a = 1`).String())
+	assert.Equal(t, `a =~ "x"`, mustParse(t, `$a =~ /x/`).String())
+
+	_, err := NewParser(strings.NewReader(`$a ~ 1`)).Parse()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ILLEGAL operator ~")
+		for _, op := range []string{"==", "!=", "<>", "=", ">=", "=~", "NOT IN", "&&"} {
+			assert.Contains(t, err.Error(), op)
+		}
+	}
+}
+
+func TestCaseInsensitiveKeywords(t *testing.T) {
+	args := map[string]interface{}{"a": true, "b": false, "s": "And", "l": []string{"x"}}
+	for _, cond := range []string{
+		`$a AND NOT $b`,
+		`$a and not $b`,
+		`$a And Not $b`,
+		`$a oR $b`,
+		`$a xor $b`,
+		`$b Nand $a`,
+		`"x" in $l AND "y" Not In $l`,
+		`$l contains "x"`,
+		`any $l == "x"`,
+		`$s == "And"`,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.Nil(t, err, cond)
+		assert.True(t, r, cond)
+	}
+
+	// String literal contents are never case-folded.
+	r, err := Evaluate(mustParse(t, `$s == "AND"`), args)
+	assert.Nil(t, err)
+	assert.False(t, r)
+
+	strict := ParserOptions{StrictKeywords: true}
+	for _, cond := range []string{`$a AND NOT $b`, `"x" NOT IN $l OR $a`, `$s == "and"`, `$a == true`} {
+		_, err := NewParserWithOptions(strings.NewReader(cond), strict).Parse()
+		assert.Nil(t, err, cond)
+	}
+	for _, cond := range []string{`$a and $b`, `not $a`, `"x" NOT in $l`, `$l Contains "x"`, `$a Xor $b`} {
+		_, err := NewParserWithOptions(strings.NewReader(cond), strict).Parse()
+		assert.Error(t, err, cond)
+	}
+	_, err = NewParserWithOptions(strings.NewReader(`$a and $b`), strict).Parse()
+	assert.Contains(t, err.Error(), "upper-case")
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	for _, td := range []struct {
+		cond  string
+		token string
+		pos   Pos
+	}{
+		// Missing right operand
+		{`$a == `, "", Pos{Offset: 6, Line: 1, Column: 7}},
+		{`$a == AND $b == 1`, "AND", Pos{Offset: 6, Line: 1, Column: 7}},
+		{`$a == 1 AND OR $b`, "OR", Pos{Offset: 12, Line: 1, Column: 13}},
+		{"$a == 1 AND\n  $b >", "", Pos{Offset: 18, Line: 2, Column: 7}},
+		// Missing left operand
+		{`== 1`, "==", Pos{Offset: 0, Line: 1, Column: 1}},
+		{`($a == 1`, "", Pos{Offset: 8, Line: 1, Column: 9}},
+		{`$a == 1 )`, ")", Pos{Offset: 8, Line: 1, Column: 9}},
+		{`$a & $b`, "&", Pos{Offset: 3, Line: 1, Column: 4}},
+	} {
+		_, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Error(t, err, td.cond) {
+			continue
+		}
+		perr, ok := err.(*ParseError)
+		if !assert.True(t, ok, "%s: %T", td.cond, err) {
+			continue
+		}
+		assert.Equal(t, td.token, perr.Token, td.cond)
+		assert.Equal(t, td.pos, perr.Pos, td.cond)
+	}
+
+	_, err := NewParser(strings.NewReader(`$a == AND $b == 1`)).Parse()
+	assert.Contains(t, err.Error(), `line 1, column 7 near "AND"`)
+	_, err = NewParser(strings.NewReader(`$a == `)).Parse()
+	assert.Contains(t, err.Error(), "end of input")
+}
+
+func TestRawStrings(t *testing.T) {
+	args := map[string]interface{}{"Phone": "555-1234", "Path": `C:\temp\x`}
+	for cond, result := range map[string]bool{
+		"$Phone =~ `\\d{3}-\\d{4}`":     true,
+		"$Phone =~ `^\\d{4}`":           false,
+		"$Phone !~ `\\s`":               true,
+		"$Path == `C:\\temp\\x`":        true,
+		"$Phone == `555-1234` AND true": true,
+		"$Phone =~ `\"?\\d+`":           true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	expr := mustParse(t, "$Phone =~ `\\d{3}-\\d{4}`")
+	assert.Equal(t, &StringLiteral{Val: `\d{3}-\d{4}`}, expr.(*BinaryExpr).RHS)
+
+	for _, cond := range []string{"$Phone =~ `\\d{3}", "`abc"} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), "string literal not terminated", cond)
+		}
+	}
+}
+
+func TestSingleQuotedStrings(t *testing.T) {
+	args := map[string]interface{}{"Name": "test", "Quote": `say "hi"`, "Apos": "it's"}
+	for cond, result := range map[string]bool{
+		`$Name == 'test'`:               true,
+		`$Name == "test"`:               true,
+		`$Name == 'Test'`:               false,
+		`'test' == "test"`:              true,
+		`$Quote == 'say "hi"'`:          true,
+		`$Apos == "it's"`:               true,
+		`$Name == 'test' AND $Name!=''`: true,
+		`$Name =~ '^t.+t$'`:             true,
+	} {
+		expr, err := NewParser(strings.NewReader(cond)).Parse()
+		if !assert.NoError(t, err, cond) {
+			continue
+		}
+		r, err := Evaluate(expr, args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	expr := mustParse(t, `$Quote == 'say "hi"'`)
+	assert.Equal(t, &StringLiteral{Val: `say "hi"`}, expr.(*BinaryExpr).RHS)
+	expr = mustParse(t, `$Name == ''`)
+	assert.Equal(t, &StringLiteral{Val: ""}, expr.(*BinaryExpr).RHS)
+
+	for _, cond := range []string{`$Name == 'test`, `$Name == 'test"`, `$Name == "test'`, "$Name == 'te\nst'"} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+	_, err := NewParser(strings.NewReader(`$Name == 'test`)).Parse()
+	assert.Contains(t, err.Error(), "not terminated")
+}
+
+func TestStringEscapes(t *testing.T) {
+	args := map[string]interface{}{"Msg": `say "hi"`, "Path": `C:\temp`, "Multi": "a\tb\r\nc", "Word": "café"}
+	for cond, result := range map[string]bool{
+		`$Msg == "say \"hi\""`:     true,
+		`$Path == "C:\\temp"`:      true,
+		`$Multi == "a\tb\r\nc"`:    true,
+		`$Word == "caf\u00e9"`:     true,
+		`$Word == "caf\u00E9"`:     true,
+		`$Msg =~ "\"\\w+\"$"`:      true,
+		`$Path =~ "^C:\\\\t"`:      true,
+		`$Path == 'C:\temp'`:       true,
+		`$Msg == "say \\\"hi\\\""`: false,
+		`"\\\"" == '\"'`:           true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// Literals containing quotes and backslashes survive a round trip.
+	for _, s := range []string{`say "hi"`, `C:\temp\`, "a\tb\r\nc", `\"`, `\\d+"`} {
+		expr := mustParse(t, `$x == `+Quote(s))
+		assert.Equal(t, &StringLiteral{Val: s}, expr.(*BinaryExpr).RHS)
+		again := mustParse(t, `$x == `+expr.(*BinaryExpr).RHS.String())
+		assert.Equal(t, expr, again, s)
+	}
+
+	for _, cond := range []string{`$Msg == "\d"`, `$Msg == "\x41"`, `$Msg == "\u00"`, `$Msg == "\u00zz"`, `$Msg == "\ud800"`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), "escape sequence", cond)
+		}
+	}
+}
+
+func TestStringEscapeErrorPosition(t *testing.T) {
+	for _, td := range []struct {
+		cond string
+		pos  Pos
+	}{
+		{`$Msg == "\d"`, Pos{Offset: 9, Line: 1, Column: 10}},
+		{`$Msg == "say \"hi\" \q"`, Pos{Offset: 20, Line: 1, Column: 21}},
+		{`$Msg == "café \x41"`, Pos{Offset: 15, Line: 1, Column: 15}},
+		{"$a == 1 AND\n$Msg == \"\\u12\"", Pos{Offset: 21, Line: 2, Column: 10}},
+	} {
+		_, err := NewParser(strings.NewReader(td.cond)).Parse()
+		perr, ok := err.(*ParseError)
+		if !assert.True(t, ok, "%s: %v", td.cond, err) {
+			continue
+		}
+		assert.Contains(t, perr.Msg, "escape sequence", td.cond)
+		assert.Equal(t, td.pos, perr.Pos, td.cond)
+	}
+
+	r, err := Evaluate(mustParse(t, `$Msg == "say \"hi\" \u263A"`), map[string]interface{}{"Msg": `say "hi" ☺`})
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestSlashDisambiguation(t *testing.T) {
+	args := map[string]interface{}{"Path": "/api/v1 beta", "Spend": 3000}
+	for cond, result := range map[string]bool{
+		`$Path =~ /^\/api\//`:                    true,
+		`$Path =~ /v1 beta$/`:                    true,
+		`$Spend / 1000 == 3 AND $Path =~ /api/`:  true,
+		`$Path =~ /api/ AND $Spend / 3 == 1000`:  true,
+		`$Path !~ /^api/ AND $Spend/1000/3 == 1`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	for _, cond := range []string{`$Path =~ /api`, `$Spend / == 1`, `$Spend > -$Spend`, `$Spend + > 1`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+	_, err := NewParser(strings.NewReader(`$Path =~ /api`)).Parse()
+	assert.Contains(t, err.Error(), "not terminated")
+}
+
+func TestComments(t *testing.T) {
+	args := map[string]interface{}{"x": 2, "y": 1, "Note": "a // b /* c */", "Path": "/api"}
+	for cond, result := range map[string]bool{
+		`$x > 1 AND $y < 2 // only adults`:                 true,
+		`$x > 1 /* the age */ AND $y < 2`:                  true,
+		"// adults\n$x > 1 AND\n// and minors\n$y < 2":     true,
+		"$x > 1 /* multi\nline */ AND $y > 1":              false,
+		`/* leading */ $x == 2`:                            true,
+		`$x/*no space*/== 2`:                               true,
+		`$x / 2 == 1 // halved`:                            true,
+		`$Note == "a // b /* c */"`:                        true,
+		"$Note == `a // b /* c */`":                        true,
+		`$Note == 'a // b /* c */' // compared verbatim`:   true,
+		`$Path =~ /^\/api/ // regexp before a comment`:     true,
+		`$Path =~ /^\/api/ /* regexp */ AND $x == 2 // ok`: true,
+	} {
+		expr, err := NewParser(strings.NewReader(cond)).Parse()
+		if !assert.NoError(t, err, cond) {
+			continue
+		}
+		r, err := Evaluate(expr, args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// Comments produce no tokens: the tree is the one without them.
+	assert.Equal(t, mustParse(t, `$x > 1 AND $y < 2`), mustParse(t, "$x /* a */ > 1 // b\nAND $y < 2 /* c */"))
+
+	for _, cond := range []string{`$x == 1 /* unterminated`, `/* only a comment */`, `// only a comment`, `$x == /* */`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+	_, err := NewParser(strings.NewReader(`$x == 1 /* unterminated`)).Parse()
+	assert.Contains(t, err.Error(), "comment not terminated")
+}
+
+func TestArrayLiterals(t *testing.T) {
+	args := map[string]interface{}{"Color": "green", "Size": 42, "Delta": -1.5, "Tags": []string{"a", "b"}, "x": "var"}
+	for cond, result := range map[string]bool{
+		`$Color IN ["red", "green", "blue"]`:     true,
+		`$Color IN ["red", 'blue', ` + "`pink`]": false,
+		`$Color NOT IN ["red"]`:                  true,
+		`$Color IN ["green"]`:                    true,
+		`$Size IN [38, 40, 42]`:                  true,
+		`$Size IN [42]`:                          true,
+		`$Size NOT IN [1e1, 0x2A]`:               false,
+		`$Delta IN [-1.5, 1.5]`:                  true,
+		`["a", "b"] CONTAINS "b"`:                true,
+		`[1, 2] CONTAINS 3`:                      false,
+		`$Tags == ["a", "b"]`:                    true,
+		`$Color IN ["gr\u0065en", "<&>"]`:        true,
+		// [name] is still a variable.
+		`[x] == "var"`: true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	// Numeric IN, against inline lists and list fields, whatever the Go
+	// number types.
+	codes := map[string]interface{}{
+		"Code":    201,
+		"Status":  uint16(204),
+		"Ratio":   float32(0.5),
+		"Parsed":  json.Number("200"),
+		"Allowed": []int{200, 201, 204},
+		"Retry":   []uint8{3, 5},
+		"Limits":  []float64{0.25, 0.5},
+	}
+	for cond, result := range map[string]bool{
+		`$Code IN [200, 201, 204]`:     true,
+		`$Code NOT IN [200, 201, 204]`: false,
+		`$Status IN [200, 201, 204]`:   true,
+		`$Parsed IN [200, 201, 204]`:   true,
+		`$Ratio IN [0.25, 0.5]`:        true,
+		`$Code + 3 IN [200, 204]`:      true,
+		`$Code IN [404]`:               false,
+		`$Code IN $Allowed`:            true,
+		`$Status IN $Allowed`:          true,
+		`$Code - 1 NOT IN $Allowed`:    false,
+		`$Code IN $Retry`:              false,
+		`4 + 1 IN $Retry`:              true,
+		`$Ratio IN $Limits`:            true,
+		`$Allowed CONTAINS $Status`:    true,
+		`$Code IN [2.01e2]`:            true,
+	} {
+		r, err := Evaluate(mustParse(t, cond), codes)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+	for _, cond := range []string{`$Code IN ["200", "201"]`, `$Parsed IN ["200"]`} {
+		_, err := Evaluate(mustParse(t, cond), codes)
+		assert.Error(t, err, cond)
+	}
+
+	expr := mustParse(t, `$Color IN ["red", 'it"s']`)
+	assert.Equal(t, &SliceStringLiteral{Val: []string{"red", `it"s`}}, expr.(*BinaryExpr).RHS)
+	expr = mustParse(t, `$Size IN [-1, 2.5]`)
+	assert.Equal(t, &SliceNumberLiteral{Val: []float64{-1, 2.5}}, expr.(*BinaryExpr).RHS)
+
+	for cond, msg := range map[string]string{
+		`$Color IN ["red", 1]`:     "mixes strings and numbers",
+		`$Color IN ["red" "blue"]`: "expected , or ] in array literal",
+		`$Color IN ["red",]`:       "array elements must be strings or numbers",
+		`$Color IN ["red", $x]`:    "array elements must be strings or numbers",
+		`$Color IN ["red"`:         "expected , or ] in array literal",
+		`$Color IN [-"red"]`:       "array elements must be strings or numbers",
+		`$Color IN ["\q"]`:         "escape sequence",
+	} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), msg, cond)
+		}
+	}
+}
+
+func TestMustParse(t *testing.T) {
+	expr := MustParse(`$a > 1 AND $b == "x"`)
+	assert.Equal(t, mustParse(t, `$a > 1 AND $b == "x"`).String(), expr.String())
+
+	assert.PanicsWithValue(t, `conditions: MustParse("$a >"): Parsing error: tok=EOF, lit= at line 1, column 5 (end of input)`, func() {
+		MustParse(`$a >`)
+	})
+}
+
+func TestDurationLiterals(t *testing.T) {
+	for cond, want := range map[string]time.Duration{
+		`$t > 5s`:      5 * time.Second,
+		`$t > 1h30m`:   90 * time.Minute,
+		`$t > 1.5h`:    90 * time.Minute,
+		`$t > 250ms`:   250 * time.Millisecond,
+		`$t > 10us`:    10 * time.Microsecond,
+		`$t > 2d`:      48 * time.Hour,
+		`$t > 1w`:      7 * 24 * time.Hour,
+		`$t > -1m`:     -time.Minute,
+		`$t > 1h0m30s`: time.Hour + 30*time.Second,
+	} {
+		expr := mustParse(t, cond)
+		d, ok := expr.(*BinaryExpr).RHS.(*DurationLiteral)
+		if assert.True(t, ok, cond) {
+			assert.Equal(t, want, d.Val, cond)
+			// Durations are read back from their string representation.
+			back := mustParse(t, "$t > "+d.String()).(*BinaryExpr).RHS
+			assert.Equal(t, d, back, cond)
+		}
+	}
+
+	_, err := NewParser(strings.NewReader(`$t > 5x`)).Parse()
+	assert.EqualError(t, err, `Invalid duration "5x", unknown unit "x" at line 1, column 6 near "5x"`)
+}
+
+func TestInspect(t *testing.T) {
+	expr := mustParse(t, `($a == "x" OR floor($b) IN [1, 2]) AND `+
+		`ANY $items AS $i SATISFIES $i.name != "w" AND $c SIZEBETWEEN 1 AND 2 AND `+
+		`NOT $t ISNTHWEEKDAY 2 "monday" AND ($d ? "u" : "v") == "u"`)
+
+	counts := map[string]int{}
+	Inspect(expr, func(n Node) bool {
+		counts[fmt.Sprintf("%T", n)]++
+		return true
+	})
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	assert.Equal(t, 36, total)
+	assert.Equal(t, 7, counts["*conditions.VarRef"])
+	assert.Equal(t, 1, counts["*conditions.QuantifierExpr"])
+	assert.Equal(t, 1, counts["*conditions.TupleExpr"])
+	assert.Equal(t, 1, counts["*conditions.ConditionalExpr"])
+
+	var strs []string
+	Inspect(expr, func(n Node) bool {
+		if s, ok := n.(*StringLiteral); ok {
+			strs = append(strs, s.Val)
+		}
+		return true
+	})
+	assert.Equal(t, []string{"x", "w", "monday", "u", "v", "u"}, strs)
+
+	// Returning false skips the children of a node.
+	strs = nil
+	Inspect(expr, func(n Node) bool {
+		if s, ok := n.(*StringLiteral); ok {
+			strs = append(strs, s.Val)
+		}
+		_, skip := n.(*QuantifierExpr)
+		return !skip
+	})
+	assert.Equal(t, []string{"x", "monday", "u", "v", "u"}, strs)
+
+	visited := 0
+	Inspect(expr, func(Node) bool { visited++; return false })
+	assert.Equal(t, 1, visited)
+}
+
+func TestBracedVariableNames(t *testing.T) {
+	args := map[string]interface{}{
+		"app.kubernetes.io/name": "web",
+		"X-Request-Id":           "abc",
+		"first name":             "Ada",
+		"a{b}":                   1,
+		"app":                    map[string]interface{}{"kubernetes": "nested"},
+	}
+	for cond, result := range map[string]bool{
+		`${app.kubernetes.io/name} == "web"`:               true,
+		`${X-Request-Id} == "abc" AND ${first name} != ""`: true,
+		`${first name} == 'Ada'`:                           true,
+		`${a{b\}} == 1`:                                    true,
+		`EXISTS ${app.kubernetes.io/name}`:                 true,
+		`EXISTS ${app.kubernetes}`:                         false,
+	} {
+		r, err := Evaluate(mustParse(t, cond), args)
+		assert.NoError(t, err, cond)
+		assert.Equal(t, result, r, cond)
+	}
+
+	expr := mustParse(t, `${app.kubernetes.io/name} == "web"`)
+	assert.Equal(t, &VarRef{Val: "app.kubernetes.io/name", Literal: true}, expr.(*BinaryExpr).LHS)
+	assert.Equal(t, []string{"app.kubernetes.io/name"}, Variables(expr))
+
+	for _, td := range []struct {
+		cond, msg string
+	}{
+		{`${app.kubernetes.io/name == "web"`, "missing }"},
+		{`$a == 1 AND ${b`, "missing }"},
+		{`${} == 1`, "empty variable name"},
+	} {
+		_, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if assert.Error(t, err, td.cond) {
+			assert.Contains(t, err.Error(), td.msg, td.cond)
+		}
+	}
+}
+
+func TestParseWithWarnings(t *testing.T) {
+	for _, td := range []struct {
+		cond     string
+		warnings []Warning
+	}{
+		{`$a AND NOT $b OR $c == 1 AND $d != 2`, nil},
+		{`$a && $b`, []Warning{{WarnAndAlias, "Deprecated &&, use AND", "&&", Pos{3, 1, 4}, "AND"}}},
+		{`$a || $b`, []Warning{{WarnOrAlias, "Deprecated ||, use OR", "||", Pos{3, 1, 4}, "OR"}}},
+		{`!$a`, []Warning{{WarnNotAlias, "Deprecated !, use NOT", "!", Pos{0, 1, 1}, "NOT"}}},
+		{`$a = 1`, []Warning{{WarnEqAlias, "Deprecated =, use ==", "=", Pos{3, 1, 4}, "=="}}},
+		{`$a <> 1`, []Warning{{WarnNeqAlias, "Deprecated <>, use !=", "<>", Pos{3, 1, 4}, "!="}}},
+		{"$a == 1 &&\n !($b <> 2)", []Warning{
+			{WarnAndAlias, "Deprecated &&, use AND", "&&", Pos{8, 1, 9}, "AND"},
+			{WarnNotAlias, "Deprecated !, use NOT", "!", Pos{12, 2, 2}, "NOT"},
+			{WarnNeqAlias, "Deprecated <>, use !=", "<>", Pos{17, 2, 7}, "!="},
+		}},
+		{`"a" NOTIN $l`, []Warning{{WarnNotInToken, "Deprecated NOTIN, use NOT IN", "NOTIN", Pos{4, 1, 5}, "NOT IN"}}},
+		{`"a" notin $l`, []Warning{{WarnNotInToken, "Deprecated notin, use NOT IN", "notin", Pos{4, 1, 5}, "NOT IN"}}},
+		{`$t BEFORE 2`, []Warning{{WarnDayCount, "Deprecated day count 2 after BEFORE, use 2d", "2", Pos{10, 1, 11}, "2d"}}},
+		{`$t AFTER 1.5`, []Warning{{WarnDayCount, "Deprecated day count 1.5 after AFTER, use 36h", "1.5", Pos{9, 1, 10}, "36h"}}},
+		{`$t BEFORE 3d AND $t AFTER "2020-01-01"`, nil},
+	} {
+		expr, warnings, err := NewParser(strings.NewReader(td.cond)).ParseWithWarnings()
+		if !assert.NoError(t, err, td.cond) {
+			continue
+		}
+		assert.Equal(t, td.warnings, warnings, td.cond)
+		// Warnings don't change the tree.
+		assert.Equal(t, mustParse(t, td.cond), expr, td.cond)
+	}
+
+	opts := ParserOptions{SuppressWarnings: []string{WarnAndAlias, WarnEqAlias}}
+	_, warnings, err := NewParserWithOptions(strings.NewReader(`$a && $b = 1 || $c = 2`), opts).ParseWithWarnings()
+	assert.NoError(t, err)
+	if assert.Len(t, warnings, 1) {
+		assert.Equal(t, WarnOrAlias, warnings[0].Code)
+	}
+
+	_, warnings, err = NewParser(strings.NewReader(`$a && `)).ParseWithWarnings()
+	assert.Error(t, err)
+	assert.Nil(t, warnings)
+
+	// The single token is an identifier when keywords are strict.
+	_, err = NewParserWithOptions(strings.NewReader(`"a" notin $l`), ParserOptions{StrictKeywords: true}).Parse()
+	assert.Error(t, err)
+	assert.Equal(t, mustParse(t, `"a" NOT IN $l`), mustParse(t, `"a" NOTIN $l`))
+}
+
+func TestModernize(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	args := map[string]interface{}{
+		"t": now.Add(-36 * time.Hour),
+		"l": []string{"b"},
+	}
+	for _, td := range []struct {
+		cond, want string
+	}{
+		{`$t BEFORE 2`, `$t BEFORE 2d`},
+		{`$t AFTER 1.5 && !($t BEFORE 7)`, `$t AFTER 36h AND NOT ($t BEFORE 1w)`},
+		{`"a" NOTIN $l || $t <> $t`, `"a" NOT IN $l OR $t != $t`},
+		{`$t BEFORE 1 ? ANY $l == "b" : false`, `$t BEFORE 1d ? ANY $l == "b" : false`},
+		{`$t BEFORE "2024-01-01T00:00:00Z"`, `$t BEFORE "2024-01-01T00:00:00Z"`},
+	} {
+		expr := mustParse(t, td.cond)
+		orig := expr.String()
+		modern := Modernize(expr)
+		assert.Equal(t, mustParse(t, td.want).String(), modern.String(), td.cond)
+		assert.Equal(t, orig, expr.String(), td.cond)
+
+		opts := WithClock(func() time.Time { return now })
+		want, err := EvaluateWithOptions(expr, args, opts)
+		assert.NoError(t, err, td.cond)
+		got, err := EvaluateWithOptions(modern, args, opts)
+		assert.NoError(t, err, td.cond)
+		assert.Equal(t, want, got, td.cond)
+	}
+}
+
+func TestComplexityLimits(t *testing.T) {
+	nested := func(n int) string {
+		return strings.Repeat("(", n) + "$a == 1" + strings.Repeat(")", n)
+	}
+
+	// The default depth stops deeply nested parentheses before they
+	// exhaust the stack.
+	_, err := NewParser(strings.NewReader(nested(100000))).Parse()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Expression too complex: depth exceeds the limit of 1000")
+	}
+	_, err = NewParser(strings.NewReader(nested(100))).Parse()
+	assert.NoError(t, err)
+
+	for _, td := range []struct {
+		cond string
+		opts ParserOptions
+		msg  string
+	}{
+		{nested(10), ParserOptions{MaxDepth: 5}, "depth exceeds the limit of 5"},
+		{`$a == 1 AND $b == 2 AND $c == 3`, ParserOptions{MaxDepth: 2}, "depth exceeds the limit of 2"},
+		{`$a == 1 AND ($b == 2 OR $c == 3)`, ParserOptions{MaxDepth: 4}, "depth exceeds the limit of 4"},
+		{`$a == 1 AND $b == 2 AND $c == 3`, ParserOptions{MaxNodes: 10}, "nodes exceeds the limit of 10"},
+		{`($a + 1) * 2 > 3`, ParserOptions{MaxNodes: 5}, "nodes exceeds the limit of 5"},
+	} {
+		_, err := NewParserWithOptions(strings.NewReader(td.cond), td.opts).Parse()
+		if assert.Error(t, err, td.cond) {
+			assert.Contains(t, err.Error(), td.msg, td.cond)
+		}
+	}
+	for _, td := range []struct {
+		cond string
+		opts ParserOptions
+	}{
+		{nested(4), ParserOptions{MaxDepth: 6}},
+		{`$a == 1 AND $b == 2 AND $c == 3`, ParserOptions{MaxDepth: 3, MaxNodes: 11}},
+		{`$a == 1 AND ($b == 2 OR $c == 3)`, ParserOptions{MaxDepth: 5}},
+		{nested(5000), ParserOptions{MaxDepth: -1}},
+	} {
+		_, err := NewParserWithOptions(strings.NewReader(td.cond), td.opts).Parse()
+		assert.NoError(t, err, td.cond)
+	}
+
+	// Long chains of clauses don't nest.
+	clauses := make([]string, 5000)
+	for i := range clauses {
+		clauses[i] = fmt.Sprintf("$a == %d", i)
+	}
+	chain, err := NewParser(strings.NewReader(strings.Join(clauses, " OR "))).Parse()
+	assert.NoError(t, err)
+	r, err := Evaluate(chain, map[string]interface{}{"a": 4999})
+	assert.NoError(t, err)
+	assert.True(t, r)
+	_, err = NewParser(strings.NewReader(`$a + 1 - 2 + 3 > 1 AND ` + strings.Join(clauses, " AND "))).Parse()
+	assert.NoError(t, err)
+
+	// The limit is found through the *ParseError. A limit on the whole tree
+	// is not reported at a position.
+	var tooComplex *ErrTooComplex
+	_, err = NewParser(strings.NewReader(nested(2000))).Parse()
+	if assert.True(t, errors.As(err, &tooComplex), "%v", err) {
+		assert.Equal(t, &ErrTooComplex{Limit: "depth", Max: DefaultMaxDepth}, tooComplex)
+	}
+	_, err = NewParserWithOptions(strings.NewReader(`$a == 1 AND $b == 2`), ParserOptions{MaxNodes: 5}).Parse()
+	if assert.True(t, errors.As(err, &tooComplex), "%v", err) {
+		assert.Equal(t, &ErrTooComplex{Limit: "nodes", Max: 5}, tooComplex)
+	}
+	assert.EqualError(t, err, "Expression too complex: nodes exceeds the limit of 5")
+
+	// The same limits apply when evaluating trees built by hand.
+	var expr Expr = &BinaryExpr{Op: EQ, LHS: &VarRef{Val: "a"}, RHS: &NumberLiteral{Val: 1}}
+	for i := 0; i < 2000; i++ {
+		expr = &ParenExpr{Expr: expr}
+	}
+	args := map[string]interface{}{"a": 1}
+	_, err = Evaluate(expr, args)
+	if assert.IsType(t, &ErrTooComplex{}, err) {
+		assert.Equal(t, &ErrTooComplex{Limit: "depth", Max: DefaultMaxDepth}, err)
+	}
+	r, err = EvaluateWithOptions(expr, args, WithComplexityLimits(-1, 0))
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	_, err = EvaluateWithOptions(mustParse(t, `ANY $l > 5`), map[string]interface{}{"l": make([]float64, 100)}, Options{MaxNodes: 50})
+	assert.Equal(t, &ErrTooComplex{Limit: "nodes", Max: 50}, err)
+}
@@ -0,0 +1,63 @@
+package conditions
+
+import (
+	"strings"
+)
+
+// Bounds used to recognize a country code missing from one of two phone
+// numbers compared by PHONEEQ.
+const (
+	maxCountryCodeDigits = 3
+	minNationalDigits    = 7
+)
+
+// normalizePhone returns the digits of a phone number and whether it was
+// written in international form, starting with + or 00.
+func normalizePhone(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	international := strings.HasPrefix(s, "+")
+
+	var b strings.Builder
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	digits := b.String()
+	if !international && strings.HasPrefix(digits, "00") {
+		digits, international = digits[2:], true
+	}
+	return digits, international
+}
+
+// applyPHONEEQ applies PHONEEQ to l/r operands: whether the strings are the
+// same phone number once formatting characters are ignored. A number in
+// international form also matches the same number without its country
+// code, so "+1 555 123 4567" matches "(555) 123-4567".
+func applyPHONEEQ(l, r Expr) (*BooleanLiteral, error) {
+	a, err := getString(l)
+	if err != nil {
+		return nil, err
+	}
+	b, err := getString(r)
+	if err != nil {
+		return nil, err
+	}
+
+	da, ia := normalizePhone(a)
+	db, ib := normalizePhone(b)
+	if len(da) < len(db) {
+		da, db, ia = db, da, ib
+	}
+	if da == "" || db == "" {
+		return &BooleanLiteral{Val: false}, nil
+	}
+	if da == db {
+		return &BooleanLiteral{Val: true}, nil
+	}
+
+	// The longer number must be international and only add a country code.
+	extra := len(da) - len(db)
+	match := ia && extra <= maxCountryCodeDigits && len(db) >= minNationalDigits && strings.HasSuffix(da, db)
+	return &BooleanLiteral{Val: match}, nil
+}
@@ -0,0 +1,164 @@
+package conditions
+
+import (
+	"sort"
+)
+
+// ClauseStat holds the observed behavior of a single clause, that is an
+// operand of an AND/OR chain which is not an AND/OR itself.
+type ClauseStat struct {
+	// Evaluations is the number of times the clause was evaluated.
+	Evaluations int
+	// Trues is the number of evaluations which returned true.
+	Trues int
+	// Cost is the relative cost of a single evaluation of the clause.
+	Cost float64
+}
+
+// Selectivity returns the observed probability of the clause being true,
+// 0.5 when nothing was observed yet.
+func (s ClauseStat) Selectivity() float64 {
+	if s.Evaluations == 0 {
+		return 0.5
+	}
+	return float64(s.Trues) / float64(s.Evaluations)
+}
+
+// ClauseStats is a snapshot of clause statistics keyed by the clause
+// string representation.
+type ClauseStats map[string]ClauseStat
+
+// Relative costs used by ClauseCost for each kind of node.
+const (
+	nodeCost  = 1.0
+	regexCost = 10.0
+)
+
+// ClauseCost returns the static relative cost of evaluating the expression:
+// every node counts once, regular expression matches count more.
+func ClauseCost(expr Expr) float64 {
+	var cost float64
+	WalkFunc(expr, func(n Node) {
+		cost += nodeCost
+		if b, ok := n.(*BinaryExpr); ok && (b.Op == EREG || b.Op == NEREG) {
+			cost += regexCost
+		}
+	})
+	return cost
+}
+
+// CollectClauseStats evaluates every clause of expr against each args of
+// the corpus and returns the observed statistics. Clauses failing to
+// evaluate are counted as false.
+func CollectClauseStats(expr Expr, corpus []interface{}) ClauseStats {
+	stats := ClauseStats{}
+	var clauses []Expr
+	collectClauses(expr, &clauses)
+
+	for _, c := range clauses {
+		key := c.String()
+		st := stats[key]
+		st.Cost = ClauseCost(c)
+		for _, args := range corpus {
+			r, err := Evaluate(c, args)
+			st.Evaluations++
+			if err == nil && r {
+				st.Trues++
+			}
+		}
+		stats[key] = st
+	}
+	return stats
+}
+
+// collectClauses appends the clauses of all AND/OR chains found in expr.
+func collectClauses(expr Expr, clauses *[]Expr) {
+	switch n := expr.(type) {
+	case *ParenExpr:
+		collectClauses(n.Expr, clauses)
+	case *BinaryExpr:
+		if n.Op == AND || n.Op == OR {
+			collectClauses(n.LHS, clauses)
+			collectClauses(n.RHS, clauses)
+			return
+		}
+		*clauses = append(*clauses, expr)
+	default:
+		*clauses = append(*clauses, expr)
+	}
+}
+
+// Reorder returns a copy of expr where the operands of AND/OR chains are
+// sorted so that cheap clauses likely to decide the chain come first:
+// false-prone clauses under AND and true-prone clauses under OR.
+// Only operands of the same commutative operator are swapped, the input
+// expression is left untouched. Clauses are assumed to evaluate without
+// errors, as swapping them may change which error gets reported.
+func Reorder(expr Expr, stats ClauseStats) Expr {
+	switch n := expr.(type) {
+	case *ParenExpr:
+		return &ParenExpr{Expr: Reorder(n.Expr, stats)}
+	case *BinaryExpr:
+		if n.Op != AND && n.Op != OR {
+			return expr
+		}
+		var operands []Expr
+		flattenChain(n.Op, n, &operands)
+		for i, o := range operands {
+			operands[i] = Reorder(o, stats)
+		}
+		rank := func(o Expr) float64 { return chainRank(n.Op, o, stats) }
+		sort.SliceStable(operands, func(i, j int) bool {
+			return rank(operands[i]) < rank(operands[j])
+		})
+
+		result := operands[0]
+		for _, o := range operands[1:] {
+			result = &BinaryExpr{Op: n.Op, LHS: result, RHS: o}
+		}
+		return result
+	}
+	return expr
+}
+
+// flattenChain appends the operands of a chain of op, looking through
+// parentheses wrapping the same operator.
+func flattenChain(op Token, expr Expr, operands *[]Expr) {
+	switch n := expr.(type) {
+	case *BinaryExpr:
+		if n.Op == op {
+			flattenChain(op, n.LHS, operands)
+			flattenChain(op, n.RHS, operands)
+			return
+		}
+	case *ParenExpr:
+		if b, ok := n.Expr.(*BinaryExpr); ok && b.Op == op {
+			flattenChain(op, b, operands)
+			return
+		}
+	}
+	*operands = append(*operands, expr)
+}
+
+// chainRank returns the cost of an operand divided by the probability that
+// it decides the chain of op. Lower ranks should be evaluated first.
+func chainRank(op Token, operand Expr, stats ClauseStats) float64 {
+	st, ok := stats[operand.String()]
+	if !ok {
+		st = ClauseStat{}
+	}
+	cost := st.Cost
+	if cost == 0 {
+		cost = ClauseCost(operand)
+	}
+
+	decisive := st.Selectivity()
+	if op == AND {
+		decisive = 1 - decisive
+	}
+	if decisive == 0 {
+		// Never decides the chain, keep it last.
+		decisive = 1e-9
+	}
+	return cost / decisive
+}
@@ -0,0 +1,104 @@
+package conditions
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// replayCorpus mimics a trace of request payloads: most requests are cheap
+// GETs, few are failing POSTs to the admin area.
+func replayCorpus() []interface{} {
+	corpus := []interface{}{}
+	for i := 0; i < 200; i++ {
+		method, status, path := "GET", 200, fmt.Sprintf("/shop/items/%d", i)
+		if i%10 == 0 {
+			method = "POST"
+		}
+		if i%25 == 0 {
+			status = 500
+		}
+		if i%4 == 0 {
+			path = fmt.Sprintf("/admin/users/%d", i)
+		}
+		corpus = append(corpus, map[string]interface{}{
+			"Method": method,
+			"Status": status,
+			"Path":   path,
+			"Retry":  i%2 == 0,
+		})
+	}
+	return corpus
+}
+
+// evaluatedNodes evaluates expr with short-circuit AND/OR semantics and
+// returns the result together with the number of evaluated nodes.
+func evaluatedNodes(t *testing.T, expr Expr, args interface{}) (bool, int) {
+	switch n := expr.(type) {
+	case *ParenExpr:
+		r, c := evaluatedNodes(t, n.Expr, args)
+		return r, c + 1
+	case *BinaryExpr:
+		if n.Op == AND || n.Op == OR {
+			l, lc := evaluatedNodes(t, n.LHS, args)
+			if (n.Op == AND && !l) || (n.Op == OR && l) {
+				return l, lc + 1
+			}
+			r, rc := evaluatedNodes(t, n.RHS, args)
+			return r, lc + rc + 1
+		}
+	}
+	r, err := Evaluate(expr, args)
+	assert.NoError(t, err)
+	return r, int(ClauseCost(expr))
+}
+
+func TestReorder(t *testing.T) {
+	corpus := replayCorpus()
+
+	for _, cond := range []string{
+		`$Path =~ /admin/ AND $Method == "POST" AND $Status == 500`,
+		`$Path =~ /shop/ OR $Retry == true OR $Method == "GET"`,
+		`($Path =~ /admin/ AND ($Method == "POST" AND $Status == 500)) OR $Status == 200`,
+		`($Path =~ /admin/ XOR $Retry == true) AND $Status == 500`,
+	} {
+		expr := mustParse(t, cond)
+		original := expr.String()
+		stats := CollectClauseStats(expr, corpus)
+		reordered := Reorder(expr, stats)
+		assert.Equal(t, original, expr.String(), "input must not be mutated")
+
+		var before, after int
+		for _, args := range corpus {
+			r1, c1 := evaluatedNodes(t, expr, args)
+			r2, c2 := evaluatedNodes(t, reordered, args)
+			assert.Equal(t, r1, r2, "%s vs %s on %v", expr, reordered, args)
+			before += c1
+			after += c2
+		}
+		t.Logf("%s => %s: %d => %d nodes", expr, reordered, before, after)
+		assert.True(t, after <= before, "%s => %s", expr, reordered)
+	}
+
+	expr := mustParse(t, `$Path =~ /admin/ AND $Method == "POST" AND $Status == 500`)
+	reordered := Reorder(expr, CollectClauseStats(expr, corpus))
+	assert.Equal(t, `Status == 500.000 AND Method == "POST" AND Path =~ "admin"`, reordered.String())
+
+	var before, after int
+	for _, args := range corpus {
+		_, c1 := evaluatedNodes(t, expr, args)
+		_, c2 := evaluatedNodes(t, reordered, args)
+		before += c1
+		after += c2
+	}
+	assert.True(t, after < before/2, "expected a large reduction: %d => %d", before, after)
+}
+
+func TestReorderKeepsNonCommutative(t *testing.T) {
+	expr := mustParse(t, `$a =~ /x/ XOR $b == 1`)
+	assert.Equal(t, expr, Reorder(expr, ClauseStats{}))
+
+	expr = mustParse(t, `$a =~ /x/ AND $b == 1`)
+	assert.Equal(t, `b == 1.000 AND a =~ "x"`, Reorder(expr, ClauseStats{}).String())
+}
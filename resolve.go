@@ -0,0 +1,624 @@
+package conditions
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// conditionsTag is the struct tag naming fields for expressions only, it
+// is looked up before Options.StructTag and the field name. A field tagged
+// conditions:"-" can't be resolved at all.
+const conditionsTag = "conditions"
+
+// structField returns the field of the struct v called name, see
+// findField, and falls back to a method, see structMethod. It returns the
+// zero Value if none matches. A name promoted from several embedded
+// structs at the same depth is an *ErrAmbiguousField, as it is for Go
+// selectors.
+func (e *evaluator) structField(v reflect.Value, path, name string) (reflect.Value, error) {
+	sf, ok, names := findField(v.Type(), e.opts, name)
+	if len(names) > 1 {
+		return reflect.Value{}, &ErrAmbiguousField{Path: path, Field: name, Type: v.Type().String(), Candidates: names}
+	}
+	var f reflect.Value
+	if ok {
+		f = fieldByIndex(v, sf.Index)
+	}
+	if !f.IsValid() {
+		if !ok {
+			if fields := promotedFields(v.Type(), name); len(fields) > 1 {
+				return reflect.Value{}, &ErrAmbiguousField{Path: path, Field: name, Type: v.Type().String(), Candidates: fields}
+			}
+		}
+		return structMethod(v, path, name)
+	}
+	if !f.CanInterface() {
+		return reflect.Value{}, nil
+	}
+	return f, nil
+}
+
+// findField returns the field of the struct type t called name, by its
+// conditions tag, its Options.StructTag tag or its Go name, in that
+// order, then by its Options.StructTag tag ignoring case, then by its Go
+// name ignoring case if Options.CaseInsensitiveFields is set. Unexported
+// fields and fields tagged "-" can't be read and never match. names lists
+// the fields matching name when it is ambiguous ignoring case.
+func findField(t reflect.Type, o *Options, name string) (f reflect.StructField, ok bool, names []string) {
+	tag := o.structTag()
+	if i, ok := structTags(t, conditionsTag).exact[name]; ok {
+		return t.Field(i), true, nil
+	}
+	if f, ok := fieldByTag(t, tag, name, false); ok {
+		return f, true, nil
+	}
+	if f, ok := fieldByName(t, tag, name); ok {
+		return f, true, nil
+	}
+	if f, ok := fieldByTag(t, tag, name, true); ok {
+		return f, true, nil
+	}
+	if o.CaseInsensitiveFields {
+		switch names := foldedFields(t)[strings.ToLower(name)]; {
+		case len(names) == 1:
+			f, ok := fieldByName(t, tag, names[0])
+			return f, ok, nil
+		case len(names) > 1:
+			return reflect.StructField{}, false, names
+		}
+	}
+	return reflect.StructField{}, false, nil
+}
+
+// structMethod returns the result of the exported method called name of
+// the struct v, such as FullName() for $FullName. Methods with a pointer
+// receiver are called on a copy of v unless it is addressable. Methods
+// taking arguments or returning several values can't be resolved, methods
+// promoted through a nil embedded pointer are missing.
+func structMethod(v reflect.Value, path, name string) (reflect.Value, error) {
+	m := v.MethodByName(name)
+	if !m.IsValid() {
+		var p reflect.Value
+		if v.CanAddr() {
+			p = v.Addr()
+		} else {
+			p = reflect.New(v.Type())
+			p.Elem().Set(v)
+		}
+		m = p.MethodByName(name)
+	}
+	if !m.IsValid() || promotedThroughNil(v, name) {
+		return reflect.Value{}, nil
+	}
+	if t := m.Type(); t.NumIn() != 0 || t.NumOut() != 1 {
+		return reflect.Value{}, fmt.Errorf("$%s: method %s of %s must take no arguments and return a single value", path, name, v.Type())
+	}
+	return m.Call(nil)[0], nil
+}
+
+// promotedThroughNil returns true if the method called name of the
+// struct v is promoted from an embedded field which is a nil pointer or
+// interface, as fieldByName does for fields: Go can't call it.
+func promotedThroughNil(v reflect.Value, name string) bool {
+	for v.Kind() == reflect.Struct {
+		i, ok := methodProvider(v.Type(), name, map[reflect.Type]bool{})
+		if !ok {
+			return false
+		}
+		for v = v.Field(i); v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface; v = v.Elem() {
+			if v.IsNil() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// methodProvider returns the index of the embedded field of the struct
+// type t which the method called name is promoted from, the one declaring
+// it the shallowest. A method found in an embedded field is taken as
+// promoted from it.
+func methodProvider(t reflect.Type, name string, seen map[reflect.Type]bool) (int, bool) {
+	seen[t] = true
+	best, depth := -1, 0
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.Anonymous || !hasMethod(f.Type, name) {
+			continue
+		}
+		if d := methodDepth(f.Type, name, seen); best < 0 || d < depth {
+			best, depth = i, d
+		}
+	}
+	return best, best >= 0
+}
+
+// methodDepth returns how deep in the embedded fields of t the method
+// called name is declared, 0 for t itself.
+func methodDepth(t reflect.Type, name string, seen map[reflect.Type]bool) int {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return 0
+	}
+	i, ok := methodProvider(t, name, seen)
+	if !ok {
+		return 0
+	}
+	return 1 + methodDepth(t.Field(i).Type, name, seen)
+}
+
+// hasMethod returns true if the method set of t, or of a pointer to t,
+// has a method called name.
+func hasMethod(t reflect.Type, name string) bool {
+	if t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface {
+		t = reflect.PtrTo(t)
+	}
+	_, ok := t.MethodByName(name)
+	return ok
+}
+
+// promotedFields returns the dotted paths of the fields called name at the
+// shallowest depth of the struct type t, embedded structs included. More
+// than one path means the name is ambiguous.
+func promotedFields(t reflect.Type, name string) []string {
+	type embed struct {
+		t    reflect.Type
+		path string
+	}
+	seen := map[reflect.Type]bool{}
+	for level := []embed{{t: t}}; len(level) > 0; {
+		var found []string
+		var next []embed
+		for _, e := range level {
+			seen[e.t] = true
+			for i := 0; i < e.t.NumField(); i++ {
+				f := e.t.Field(i)
+				path := f.Name
+				if e.path != "" {
+					path = e.path + "." + f.Name
+				}
+				if f.Name == name {
+					found = append(found, path)
+					continue
+				}
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if f.Anonymous && ft.Kind() == reflect.Struct && !seen[ft] {
+					next = append(next, embed{t: ft, path: path})
+				}
+			}
+		}
+		if len(found) > 0 {
+			return found
+		}
+		level = next
+	}
+	return nil
+}
+
+// Resolver supplies the variables of an evaluation on demand. It can be
+// given as args instead of a map or a struct, Resolve returning the value
+// of the variable called name and whether it is defined.
+type Resolver interface {
+	Resolve(name string) (interface{}, bool)
+}
+
+// ResolverFunc adapts a function to the Resolver interface.
+type ResolverFunc func(name string) (interface{}, bool)
+
+// Resolve calls f(name).
+func (f ResolverFunc) Resolve(name string) (interface{}, bool) { return f(name) }
+
+// ResolverChain is a Resolver trying its members in order, the first one
+// defining a variable wins. It lets layered configurations, such as
+// request, session and global settings, be registered once and reused
+// across evaluations:
+//
+//	chain := ResolverChain{request, session, global}
+//	ok, err := Evaluate(expr, chain)
+type ResolverChain []Resolver
+
+// Resolve returns the value of the variable called name from the first
+// member defining it.
+func (c ResolverChain) Resolve(name string) (interface{}, bool) {
+	for _, r := range c {
+		if val, ok := r.Resolve(name); ok {
+			return val, true
+		}
+	}
+	return nil, false
+}
+
+// LayeredArgs are args looking variables up in several sources in order,
+// see Layers.
+type LayeredArgs []interface{}
+
+// Layers returns args made of layers of args, each a map, a struct, a
+// Resolver or any other args value Evaluate accepts. A variable is read
+// from the first layer defining it, the first segment of a dotted path
+// deciding the layer of the whole path. A variable missing from every
+// layer is missing, as with a single args value:
+//
+//	ok, err := Evaluate(expr, Layers(request, session, defaults))
+//
+// Unlike ResolverChain, the layers are read with the options of the
+// evaluation, such as Options.StructTag.
+func Layers(layers ...interface{}) LayeredArgs {
+	l := make(LayeredArgs, len(layers))
+	for i, args := range layers {
+		l[i] = indirectArgs(args)
+	}
+	return l
+}
+
+// lookupLayers returns the unconverted value of the argument called name
+// from the first of the layers defining it.
+func (e *evaluator) lookupLayers(layers LayeredArgs, name string) (val interface{}, found bool, err error) {
+	defer func(args interface{}) { e.args = args }(e.args)
+	for _, args := range layers {
+		e.args = args
+		if val, found, err = e.lookupName(name); found || err != nil {
+			return val, found, err
+		}
+	}
+	return nil, false, nil
+}
+
+// FallibleResolver is a Resolver for sources which may fail, such as a
+// remote store. An error aborts the evaluation with an *ErrResolver
+// naming the variable. Resolve returns whether the variable is defined,
+// a defined variable may be nil.
+type FallibleResolver interface {
+	Resolve(name string) (interface{}, bool, error)
+}
+
+// FallibleResolverFunc adapts a function to the FallibleResolver
+// interface.
+type FallibleResolverFunc func(name string) (interface{}, bool, error)
+
+// Resolve calls f(name).
+func (f FallibleResolverFunc) Resolve(name string) (interface{}, bool, error) { return f(name) }
+
+// resolverOf returns args as a FallibleResolver if it is a Resolver or a
+// FallibleResolver.
+func resolverOf(args interface{}) (FallibleResolver, bool) {
+	switch r := args.(type) {
+	case FallibleResolver:
+		return r, true
+	case Resolver:
+		return FallibleResolverFunc(func(name string) (interface{}, bool, error) {
+			val, ok := r.Resolve(name)
+			return val, ok, nil
+		}), true
+	}
+	return nil, false
+}
+
+// resolveName returns the value of the variable called name from the
+// resolver r.
+func resolveName(r FallibleResolver, name string) (interface{}, bool, error) {
+	val, found, err := r.Resolve(name)
+	if err != nil {
+		return nil, false, &ErrResolver{Name: name, Err: err}
+	}
+	return val, found, nil
+}
+
+// indirectArgs dereferences args given as a pointer, such as a pointer to
+// a struct. Resolvers, dynamic messages and nil pointers are returned
+// untouched.
+func indirectArgs(args interface{}) interface{} {
+	v := reflect.ValueOf(args)
+	if v.Kind() != reflect.Ptr {
+		return args
+	}
+	if _, ok := resolverOf(args); ok {
+		return args
+	}
+	if _, ok := dynamicFields(args); ok {
+		return args
+	}
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v.Interface()
+}
+
+// fieldByName returns the field of the struct type t called name,
+// promoted fields included. Fields hidden by a "-" tag, the conditions
+// one or the given one, are missing, unless tag is "-" which turns the
+// given tag off.
+func fieldByName(t reflect.Type, tag, name string) (reflect.StructField, bool) {
+	sf, ok := t.FieldByName(name)
+	if !ok || hidden(sf) {
+		return reflect.StructField{}, false
+	}
+	if _, visible := tagName(sf, tag); !visible && tag != "-" {
+		return reflect.StructField{}, false
+	}
+	return sf, true
+}
+
+// fieldByIndex returns the field of the struct v at index, see
+// reflect.StructField.Index. It returns the zero Value if an embedded
+// pointer on the way is nil.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// lookupPath follows the dotted path through the nested maps, structs,
+// slices and dynamic messages of args, dereferencing pointers along the
+// way. Slices are indexed by integer segments, negative ones counting from
+// the end. It returns an *ErrFieldNotFound naming the failing segment when
+// a key or a field is missing or nil, and an *ErrIndexOutOfRange when an
+// index is out of bounds.
+func (e *evaluator) lookupPath(args interface{}, path string) (interface{}, error) {
+	segments := strings.Split(path, ".")
+	v := reflect.ValueOf(args)
+	for i, seg := range segments {
+		if i > 0 {
+			for (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+				v = v.Elem()
+			}
+			if !v.IsValid() || v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+				return nil, &ErrFieldNotFound{Path: path, Field: segments[i-1], Nil: true}
+			}
+		}
+
+		if fields, ok := dynamicFields(v.Interface()); ok {
+			val, found, _ := dynamicField(fields, seg)
+			if !found {
+				return nil, &ErrFieldNotFound{Path: path, Field: seg}
+			}
+			v = reflect.ValueOf(val)
+			continue
+		}
+		switch v.Kind() {
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return nil, fmt.Errorf("$%s: field %q is a %s, not a map with string keys", path, segments[i-1], v.Type())
+			}
+			key := reflect.ValueOf(seg).Convert(v.Type().Key())
+			if e.opts.CaseInsensitiveFields && !v.MapIndex(key).IsValid() {
+				folded, err := e.foldedKey(v, path, seg)
+				if err != nil {
+					return nil, err
+				}
+				if folded.IsValid() {
+					key = folded
+				}
+			}
+			if v = v.MapIndex(key); !v.IsValid() {
+				return nil, &ErrFieldNotFound{Path: path, Field: seg}
+			}
+		case reflect.Struct:
+			f, err := e.structField(v, path, seg)
+			if err != nil {
+				return nil, err
+			}
+			if v = f; !v.IsValid() {
+				return nil, &ErrFieldNotFound{Path: path, Field: seg}
+			}
+		case reflect.Slice, reflect.Array:
+			index, err := strconv.Atoi(seg)
+			if err != nil {
+				return nil, fmt.Errorf("$%s: field %q is a %s, %q is not an index", path, segments[i-1], v.Type(), seg)
+			}
+			// Negative indexes count from the end.
+			at := index
+			if at < 0 {
+				at += v.Len()
+			}
+			if at < 0 || at >= v.Len() {
+				return nil, &ErrIndexOutOfRange{Path: path, Index: index, Length: v.Len()}
+			}
+			v = v.Index(at)
+		default:
+			return nil, fmt.Errorf("$%s: field %q is a %s, not a map, struct or slice", path, segments[i-1], v.Type())
+		}
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+	return v.Interface(), nil
+}
+
+// fieldByTag returns the field of the struct type t whose tag name,
+// ignoring options such as omitempty, is name, or is name ignoring case if
+// fold is set.
+func fieldByTag(t reflect.Type, tag, name string, fold bool) (reflect.StructField, bool) {
+	if tag == "-" {
+		return reflect.StructField{}, false
+	}
+
+	idx := structTags(t, tag)
+	if i, ok := idx.exact[name]; ok && !fold {
+		return t.Field(i), true
+	}
+	if i, ok := idx.folded[strings.ToLower(name)]; ok && fold {
+		return t.Field(i), true
+	}
+	return reflect.StructField{}, false
+}
+
+// tagIndex maps the tag names of the fields of a struct type to the index
+// of the first field having them, exactly and lower-cased.
+type tagIndex struct {
+	exact, folded map[string]int
+}
+
+// tagIndexes caches the *tagIndex of struct types by tagKey, so that
+// evaluations don't parse the tags of the same type again.
+var tagIndexes sync.Map
+
+type tagKey struct {
+	t   reflect.Type
+	tag string
+}
+
+// structTags returns the *tagIndex of the struct type t for tag.
+func structTags(t reflect.Type, tag string) *tagIndex {
+	key := tagKey{t: t, tag: tag}
+	if idx, ok := tagIndexes.Load(key); ok {
+		return idx.(*tagIndex)
+	}
+
+	idx := &tagIndex{exact: map[string]int{}, folded: map[string]int{}}
+	for i := 0; i < t.NumField(); i++ {
+		name, visible := tagName(t.Field(i), tag)
+		if !visible || name == "" || hidden(t.Field(i)) {
+			continue
+		}
+		if _, ok := idx.exact[name]; !ok {
+			idx.exact[name] = i
+		}
+		if _, ok := idx.folded[strings.ToLower(name)]; !ok {
+			idx.folded[strings.ToLower(name)] = i
+		}
+	}
+	actual, _ := tagIndexes.LoadOrStore(key, idx)
+	return actual.(*tagIndex)
+}
+
+// foldedFieldsCache caches the result of foldedFields by struct type.
+var foldedFieldsCache sync.Map
+
+// foldedFields returns the Go names of the fields of the struct type t
+// which can be resolved, promoted fields included, by lower-cased name.
+func foldedFields(t reflect.Type) map[string][]string {
+	if names, ok := foldedFieldsCache.Load(t); ok {
+		return names.(map[string][]string)
+	}
+
+	names := map[string][]string{}
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || hidden(f) {
+			continue
+		}
+		if _, ok := t.FieldByName(f.Name); !ok {
+			// Ambiguous promoted fields can't be resolved.
+			continue
+		}
+		lower := strings.ToLower(f.Name)
+		names[lower] = append(names[lower], f.Name)
+	}
+	actual, _ := foldedFieldsCache.LoadOrStore(t, names)
+	return actual.(map[string][]string)
+}
+
+// foldedMap is a map indexed by foldedKey.
+type foldedMap struct {
+	// m keeps the map alive, so that no other map gets its address while
+	// it is indexed.
+	m reflect.Value
+	// keys are the keys of m by lower-cased key
+	keys map[string][]string
+}
+
+// foldedKey returns the key of the map m, with string keys, matching
+// name ignoring case. It returns the zero Value if none does, and an
+// *ErrAmbiguousField listing them if several do. The lower-cased keys of
+// a map are indexed once per evaluation.
+func (e *evaluator) foldedKey(m reflect.Value, path, name string) (reflect.Value, error) {
+	if e.foldedKeys == nil {
+		e.foldedKeys = map[uintptr]foldedMap{}
+	}
+	folded, ok := e.foldedKeys[m.Pointer()]
+	if !ok {
+		folded = foldedMap{m: m, keys: make(map[string][]string, m.Len())}
+		for iter := m.MapRange(); iter.Next(); {
+			k := iter.Key().String()
+			folded.keys[strings.ToLower(k)] = append(folded.keys[strings.ToLower(k)], k)
+		}
+		for _, candidates := range folded.keys {
+			sort.Strings(candidates)
+		}
+		e.foldedKeys[m.Pointer()] = folded
+	}
+	keys := folded.keys
+
+	switch candidates := keys[strings.ToLower(name)]; len(candidates) {
+	case 0:
+		return reflect.Value{}, nil
+	case 1:
+		return reflect.ValueOf(candidates[0]).Convert(m.Type().Key()), nil
+	default:
+		return reflect.Value{}, &ErrAmbiguousField{Path: path, Field: name, Type: m.Type().String(), Candidates: candidates}
+	}
+}
+
+// tagName returns the name given to the field f by its tag, without
+// options such as omitempty, and false if the tag is "-", which hides the
+// field as it does for encoding/json. A tag of "-," names the field "-".
+func tagName(f reflect.StructField, tag string) (string, bool) {
+	s := f.Tag.Get(tag)
+	if s == "-" {
+		return "", false
+	}
+	name, _, _ := strings.Cut(s, ",")
+	return name, true
+}
+
+// hidden tells whether the field f is tagged conditions:"-", which hides
+// it from expressions whatever its other tags.
+func hidden(f reflect.StructField) bool {
+	_, visible := tagName(f, conditionsTag)
+	return !visible
+}
+
+// dynamicValue is implemented by the values of dynamic messages, such as
+// *structpb.Value, which wrap a nil, bool, float64, string,
+// map[string]interface{} or []interface{}.
+type dynamicValue interface {
+	AsInterface() interface{}
+}
+
+// dynamicFields returns the fields of a dynamic message such as a
+// *structpb.Struct: a value with a GetFields method returning a map with
+// string keys. The method is found by reflection so that the package
+// doesn't depend on protobuf.
+func dynamicFields(args interface{}) (reflect.Value, bool) {
+	m := reflect.ValueOf(args).MethodByName("GetFields")
+	if !m.IsValid() {
+		return reflect.Value{}, false
+	}
+	t := m.Type()
+	if t.NumIn() != 0 || t.NumOut() != 1 || t.Out(0).Kind() != reflect.Map || t.Out(0).Key().Kind() != reflect.String {
+		return reflect.Value{}, false
+	}
+	return m.Call(nil)[0], true
+}
+
+// dynamicField returns the field called name of the fields of a dynamic
+// message, unwrapping values implementing dynamicValue.
+func dynamicField(fields reflect.Value, name string) (interface{}, bool, error) {
+	v := fields.MapIndex(reflect.ValueOf(name).Convert(fields.Type().Key()))
+	if !v.IsValid() {
+		return nil, false, nil
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil, true, nil
+	}
+	val := v.Interface()
+	if dv, ok := val.(dynamicValue); ok {
+		val = dv.AsInterface()
+	}
+	return val, true, nil
+}
@@ -0,0 +1,226 @@
+package conditions
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// RuleSet is a collection of named rules which can reference the result
+// of each other with @rule("name"). It is safe for concurrent use.
+type RuleSet struct {
+	mu    sync.RWMutex
+	rules map[string]Expr
+}
+
+// ruleResult is the memoized result of a rule for one evaluation.
+type ruleResult struct {
+	val bool
+	err error
+}
+
+// NewRuleSet returns an empty RuleSet.
+func NewRuleSet() *RuleSet {
+	return &RuleSet{rules: map[string]Expr{}}
+}
+
+// Add registers the rule called name, replacing any rule of that name.
+// Referenced rules may be added later, but a rule may not depend on itself:
+// a reference cycle is an *ErrRuleCycle and leaves the set unchanged.
+func (rs *RuleSet) Add(name string, expr Expr) error {
+	if expr == nil {
+		return fmt.Errorf("Provided expression is nil")
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	prev, replaced := rs.rules[name]
+	rs.rules[name] = expr
+	if path := rs.findCycle(name); path != nil {
+		if replaced {
+			rs.rules[name] = prev
+		} else {
+			delete(rs.rules, name)
+		}
+		return &ErrRuleCycle{Path: path}
+	}
+	return nil
+}
+
+// Rule returns the expression of the rule called name.
+func (rs *RuleSet) Rule(name string) (Expr, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	expr, ok := rs.rules[name]
+	return expr, ok
+}
+
+// Evaluate evaluates the rule called name using given args.
+func (rs *RuleSet) Evaluate(name string, args interface{}) (bool, error) {
+	return rs.EvaluateWithOptions(name, args)
+}
+
+// EvaluateWithOptions evaluates the rule called name using given args and
+// options, see Option. Each referenced rule is evaluated once, however
+// many times it is referenced.
+func (rs *RuleSet) EvaluateWithOptions(name string, args interface{}, opts ...Option) (bool, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	return rs.newEvaluator(args, opts).evaluateRule(name)
+}
+
+// EvaluateAll evaluates every rule using given args and returns the
+// results by rule name. Rules are evaluated once each, including when they
+// are referenced by other rules. The error of the first failing rule, in
+// name order, is returned along with the results of all the others.
+func (rs *RuleSet) EvaluateAll(args interface{}) (map[string]bool, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	e := rs.newEvaluator(args, nil)
+	results := map[string]bool{}
+	var firstErr error
+	for _, name := range rs.names() {
+		r, err := e.evaluateRule(name)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Rule %s: %w", name, err)
+			}
+			continue
+		}
+		results[name] = r
+	}
+	return results, firstErr
+}
+
+// Variables returns the variables used by the rule called name, including
+// the variables of the rules it references.
+func (rs *RuleSet) Variables(name string) []string {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	var vars []string
+	for _, n := range append([]string{name}, rs.dependencies(name)...) {
+		if expr, ok := rs.rules[n]; ok {
+			vars = append(vars, expr.Args()...)
+		}
+	}
+	return removeDuplicates(vars)
+}
+
+// Dependencies returns the sorted names of the rules referenced by the rule
+// called name, directly or through other rules.
+func (rs *RuleSet) Dependencies(name string) []string {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	deps := rs.dependencies(name)
+	sort.Strings(deps)
+	return deps
+}
+
+// dependencies returns the names of the rules referenced by the rule
+// called name, directly or not, in discovery order.
+func (rs *RuleSet) dependencies(name string) []string {
+	var deps []string
+	seen := map[string]bool{name: true}
+	var visit func(string)
+	visit = func(n string) {
+		expr, ok := rs.rules[n]
+		if !ok {
+			return
+		}
+		for _, ref := range RuleRefs(expr) {
+			if !seen[ref] {
+				seen[ref] = true
+				deps = append(deps, ref)
+				visit(ref)
+			}
+		}
+	}
+	visit(name)
+	return deps
+}
+
+// names returns the sorted names of the rules.
+func (rs *RuleSet) names() []string {
+	names := make([]string, 0, len(rs.rules))
+	for name := range rs.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findCycle returns the path of a reference cycle going through the rule
+// called start, starting and ending with it, or nil. The other rules are
+// known to be free of cycles.
+func (rs *RuleSet) findCycle(start string) []string {
+	var path []string
+	done := map[string]bool{}
+	var visit func(string) []string
+	visit = func(name string) []string {
+		if len(path) > 0 && name == start {
+			return append(path, name)
+		}
+		expr, ok := rs.rules[name]
+		if !ok || done[name] {
+			return nil
+		}
+		path = append(path, name)
+		for _, ref := range RuleRefs(expr) {
+			if cycle := visit(ref); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		done[name] = true
+		return nil
+	}
+	return visit(start)
+}
+
+// newEvaluator returns an evaluator resolving rule references in the set.
+func (rs *RuleSet) newEvaluator(args interface{}, opts []Option) *evaluator {
+	return &evaluator{args: indirectArgs(args), opts: collectOptions(opts), rules: rs, memo: map[string]ruleResult{}}
+}
+
+// RuleRefs returns the names of the rules referenced by expr.
+func RuleRefs(expr Expr) []string {
+	var names []string
+	WalkFunc(expr, func(n Node) {
+		if r, ok := n.(*RuleRef); ok {
+			names = append(names, r.Name)
+		}
+	})
+	return removeDuplicates(names)
+}
+
+// evaluateRule evaluates the rule called name, or returns its result if it
+// was already evaluated.
+func (e *evaluator) evaluateRule(name string) (bool, error) {
+	if r, ok := e.memo[name]; ok {
+		return r.val, r.err
+	}
+	expr, ok := e.rules.rules[name]
+	if !ok {
+		return false, fmt.Errorf("Unknown rule %s", name)
+	}
+
+	// Rules don't see the variables bound where they are referenced.
+	bindings := e.bindings
+	e.bindings = nil
+	v, err := e.evaluateSubtree(expr)
+	e.bindings = bindings
+
+	var r bool
+	if err == nil {
+		if r, err = getBoolean(v); err != nil {
+			err = fmt.Errorf("Rule %s does not evaluate to a boolean: %v", name, v)
+		}
+	}
+	e.memo[name] = ruleResult{val: r, err: err}
+	return r, err
+}
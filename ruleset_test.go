@@ -0,0 +1,143 @@
+package conditions
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleSet(t *testing.T) {
+	rs := NewRuleSet()
+	assert.NoError(t, rs.Add("adult", mustParse(t, `$age >= 18`)))
+	assert.NoError(t, rs.Add("vip", mustParse(t, `@rule("adult") AND $spend > 1000`)))
+	assert.NoError(t, rs.Add("promo", mustParse(t, `@rule("vip") OR (@rule("adult") AND $coupon == "X")`)))
+
+	for _, td := range []struct {
+		args              map[string]interface{}
+		adult, vip, promo bool
+	}{
+		{map[string]interface{}{"age": 30, "spend": 2000, "coupon": ""}, true, true, true},
+		{map[string]interface{}{"age": 30, "spend": 10, "coupon": "X"}, true, false, true},
+		{map[string]interface{}{"age": 12, "spend": 2000, "coupon": "X"}, false, false, false},
+	} {
+		for name, want := range map[string]bool{"adult": td.adult, "vip": td.vip, "promo": td.promo} {
+			r, err := rs.Evaluate(name, td.args)
+			assert.NoError(t, err, name)
+			assert.Equal(t, want, r, "%s %v", name, td.args)
+		}
+		all, err := rs.EvaluateAll(td.args)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]bool{"adult": td.adult, "vip": td.vip, "promo": td.promo}, all)
+	}
+
+	assert.Equal(t, []string{"adult", "vip"}, rs.Dependencies("promo"))
+	assert.Equal(t, []string{"adult"}, rs.Dependencies("vip"))
+	assert.Empty(t, rs.Dependencies("adult"))
+	assert.ElementsMatch(t, []string{"spend", "coupon", "age"}, rs.Variables("promo"))
+	assert.Equal(t, []string{"coupon"}, Variables(mustParse(t, `@rule("vip") OR $coupon == "X"`)))
+	assert.Equal(t, []string{"vip", "adult"}, RuleRefs(mustParse(t, `@rule("vip") OR (@rule("adult") AND @rule("vip"))`)))
+
+	expr, ok := rs.Rule("promo")
+	assert.True(t, ok)
+	assert.Equal(t, `@rule("vip") OR (@rule("adult") AND coupon == "X")`, expr.String())
+	assert.Equal(t, expr, mustParse(t, `@RULE("vip") OR (@rule("adult") AND $coupon == "X")`))
+}
+
+func TestRuleSetMemoization(t *testing.T) {
+	calls := 0
+	RegisterOperator("RULESET_PROBE", func(l, r Expr) (*BooleanLiteral, error) {
+		calls++
+		return applyEQ(l, r)
+	})
+
+	rs := NewRuleSet()
+	assert.NoError(t, rs.Add("base", mustParse(t, `$x RULESET_PROBE 1`)))
+	assert.NoError(t, rs.Add("a", mustParse(t, `@rule("base") AND @rule("base")`)))
+	assert.NoError(t, rs.Add("b", mustParse(t, `@rule("a") OR @rule("base")`)))
+	assert.NoError(t, rs.Add("c", mustParse(t, `@rule("b") AND @rule("a") AND @rule("base")`)))
+
+	args := map[string]interface{}{"x": 1}
+	r, err := rs.Evaluate("c", args)
+	assert.NoError(t, err)
+	assert.True(t, r)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	all, err := rs.EvaluateAll(args)
+	assert.NoError(t, err)
+	assert.Len(t, all, 4)
+	assert.Equal(t, 1, calls)
+
+	// Each evaluation has its own results.
+	calls = 0
+	r, err = rs.Evaluate("c", map[string]interface{}{"x": 2})
+	assert.NoError(t, err)
+	assert.False(t, r)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRuleSetCycles(t *testing.T) {
+	rs := NewRuleSet()
+	assert.NoError(t, rs.Add("a", mustParse(t, `@rule("b") AND $x == 1`)))
+	assert.NoError(t, rs.Add("b", mustParse(t, `@rule("c") OR $y == 1`)))
+
+	err := rs.Add("c", mustParse(t, `@rule("a")`))
+	var cycle *ErrRuleCycle
+	if assert.True(t, errors.As(err, &cycle), "%v", err) {
+		assert.Equal(t, []string{"c", "a", "b", "c"}, cycle.Path)
+		assert.Equal(t, "Rule cycle: c -> a -> b -> c", err.Error())
+	}
+	_, ok := rs.Rule("c")
+	assert.False(t, ok, "a rule closing a cycle is not added")
+
+	err = rs.Add("self", mustParse(t, `@rule("self") OR true`))
+	if assert.True(t, errors.As(err, &cycle)) {
+		assert.Equal(t, []string{"self", "self"}, cycle.Path)
+	}
+
+	// Replacing a rule by one closing a cycle keeps the previous rule.
+	assert.NoError(t, rs.Add("c", mustParse(t, `$z == 1`)))
+	assert.Error(t, rs.Add("c", mustParse(t, `@rule("b")`)))
+	expr, _ := rs.Rule("c")
+	assert.Equal(t, `z == 1.000`, expr.String())
+
+	r, err := rs.Evaluate("a", map[string]interface{}{"x": 1, "y": 0, "z": 1})
+	assert.NoError(t, err)
+	assert.True(t, r)
+}
+
+func TestRuleSetErrors(t *testing.T) {
+	rs := NewRuleSet()
+	assert.NoError(t, rs.Add("missing", mustParse(t, `@rule("later") AND true`)))
+	assert.NoError(t, rs.Add("number", mustParse(t, `$x + 1`)))
+	assert.NoError(t, rs.Add("uses-number", mustParse(t, `@rule("number") OR true`)))
+	assert.Error(t, rs.Add("nil", nil))
+
+	_, err := rs.Evaluate("missing", nil)
+	assert.Contains(t, err.Error(), "Unknown rule later")
+	_, err = rs.Evaluate("nope", nil)
+	assert.Error(t, err)
+	_, err = rs.Evaluate("uses-number", map[string]interface{}{"x": 1})
+	assert.Contains(t, err.Error(), "does not evaluate to a boolean")
+
+	// Rules added later are picked up.
+	assert.NoError(t, rs.Add("later", mustParse(t, `true`)))
+	r, err := rs.Evaluate("missing", nil)
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	all, err := rs.EvaluateAll(map[string]interface{}{"x": 1})
+	assert.Error(t, err)
+	assert.Equal(t, map[string]bool{"later": true, "missing": true}, all)
+
+	// Rule references need a RuleSet.
+	_, err = Evaluate(mustParse(t, `@rule("later")`), nil)
+	assert.Contains(t, err.Error(), "RuleSet")
+
+	for _, cond := range []string{`@rule(later)`, `@rule("a"`, `@rule "a"`, `@other("a")`, `@rule()`} {
+		_, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Error(t, err, cond)
+	}
+}
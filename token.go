@@ -39,18 +39,63 @@ const (
 
 	LPAREN // (
 	RPAREN // )
+
+	// New tokens are appended below so that the value of every token
+	// above stays the same. isLiteral, isOperator and isPostfix classify
+	// them.
+	INKEYS        // INKEYS
+	NOT           // NOT
+	ISBUSINESSDAY // ISBUSINESSDAY
+	ANY           // ANY
+	ALL           // ALL
+	ENTROPY       // ENTROPY
+	COMMA         // ,
+	FUNC          // function name followed by (
+	ISPOWEROFTWO  // ISPOWEROFTWO
+	ADD           // +
+	SUB           // -
+	MUL           // *
+	DIV           // /
+	BAND          // BAND
+	BOR           // BOR
+	BXOR          // BXOR
+	EXISTS        // EXISTS
+	PHONEEQ       // PHONEEQ
+	RULE          // @rule
+	NEARINT       // NEARINT
+	BEFORE        // BEFORE
+	AFTER         // AFTER
+	QUESTION      // ?
+	COLON         // :
+	SATISFIES     // SATISFIES
+	AS            // AS
+	SIZEBETWEEN   // SIZEBETWEEN
+	ISNTHWEEKDAY  // ISNTHWEEKDAY
+	NOTCONTAINS   // NOT CONTAINS
+	DURATION      // 5s, 1h30m
+	NULL          // NULL
+	LIKE          // LIKE
+	NOTLIKE       // NOT LIKE
+	ISNULL        // IS NULL
+	ISNOTNULL     // IS NOT NULL
+	BETWEEN       // BETWEEN
+
+	// Tokens of operators added by RegisterOperator start here.
+	customBegin
 )
 
 var tokens = [...]string{
 	ILLEGAL: "ILLEGAL",
 	EOF:     "EOF",
 
-	IDENT:  "IDENT",
-	NUMBER: "NUMBER",
-	STRING: "STRING",
-	ARRAY:  "ARRAY",
-	TRUE:   "TRUE",
-	FALSE:  "FALSE",
+	IDENT:    "IDENT",
+	NUMBER:   "NUMBER",
+	DURATION: "DURATION",
+	STRING:   "STRING",
+	ARRAY:    "ARRAY",
+	TRUE:     "TRUE",
+	FALSE:    "FALSE",
+	NULL:     "NULL",
 
 	AND: "AND",
 	OR:  "OR",
@@ -61,16 +106,52 @@ var tokens = [...]string{
 	GT:  ">",
 	GTE: ">=",
 
-	NAND:     "NAND",
-	XOR:      "XOR",
-	EREG:     "=~",
-	NEREG:    "!~",
-	IN:       "IN",
-	CONTAINS: "CONTAINS",
-	NOTIN:    "NOT IN",
+	NAND:         "NAND",
+	XOR:          "XOR",
+	EREG:         "=~",
+	NEREG:        "!~",
+	IN:           "IN",
+	CONTAINS:     "CONTAINS",
+	NOTIN:        "NOT IN",
+	NOTCONTAINS:  "NOT CONTAINS",
+	LIKE:         "LIKE",
+	NOTLIKE:      "NOT LIKE",
+	INKEYS:       "INKEYS",
+	PHONEEQ:      "PHONEEQ",
+	NEARINT:      "NEARINT",
+	BEFORE:       "BEFORE",
+	AFTER:        "AFTER",
+	SIZEBETWEEN:  "SIZEBETWEEN",
+	BETWEEN:      "BETWEEN",
+	ISNTHWEEKDAY: "ISNTHWEEKDAY",
+	ADD:          "+",
+	SUB:          "-",
+	MUL:          "*",
+	DIV:          "/",
+	BAND:         "BAND",
+	BOR:          "BOR",
+	BXOR:         "BXOR",
+
+	LPAREN:   "(",
+	RPAREN:   ")",
+	COMMA:    ",",
+	QUESTION: "?",
+	COLON:    ":",
+	FUNC:     "FUNC",
+	RULE:     "@rule",
+
+	NOT:       "NOT",
+	ANY:       "ANY",
+	ALL:       "ALL",
+	EXISTS:    "EXISTS",
+	SATISFIES: "SATISFIES",
+	AS:        "AS",
 
-	LPAREN: "(",
-	RPAREN: ")",
+	ISBUSINESSDAY: "ISBUSINESSDAY",
+	ENTROPY:       "ENTROPY",
+	ISPOWEROFTWO:  "ISPOWEROFTWO",
+	ISNULL:        "IS NULL",
+	ISNOTNULL:     "IS NOT NULL",
 }
 
 // String returns the string representation of the token.
@@ -78,6 +159,9 @@ func (tok Token) String() string {
 	if tok >= 0 && tok < Token(len(tokens)) {
 		return tokens[tok]
 	}
+	if op := lookupCustomOperator(tok); op != nil {
+		return op.name
+	}
 	return ""
 }
 
@@ -89,14 +173,85 @@ func (tok Token) Precedence() int {
 	case AND, NAND:
 		return 2
 
-	case EQ, NEQ, LT, LTE, GT, GTE, IN, NOTIN, EREG, NEREG:
+	case EQ, NEQ, LT, LTE, GT, GTE, IN, NOTIN, EREG, NEREG, CONTAINS, NOTCONTAINS, LIKE, NOTLIKE, INKEYS, PHONEEQ, NEARINT, BEFORE, AFTER, SIZEBETWEEN, BETWEEN, ISNTHWEEKDAY:
+		return 3
+	case NOT, ANY, ALL:
+		// Prefix operators apply to the whole comparison that follows them.
+		return 3
+	case ADD, SUB, BOR, BXOR:
+		return 4
+	case MUL, DIV, BAND:
+		return 5
+	}
+	if tok >= customBegin {
 		return 3
 	}
 	return 0
 }
 
-// isOperator returns true for operator tokens.
-func (tok Token) isOperator() bool { return tok > operatorBegin && tok < operatorEnd }
+// isLiteral returns true for literal tokens.
+func (tok Token) isLiteral() bool {
+	return (tok > literalBegin && tok < literalEnd) || tok == DURATION || tok == NULL
+}
+
+// isOperator returns true for binary operator tokens.
+func (tok Token) isOperator() bool {
+	switch tok {
+	case INKEYS, ADD, SUB, MUL, DIV, BAND, BOR, BXOR, PHONEEQ, NEARINT, BEFORE, AFTER, SIZEBETWEEN, ISNTHWEEKDAY, NOTCONTAINS, LIKE, NOTLIKE, BETWEEN:
+		return true
+	}
+	return (tok > operatorBegin && tok < operatorEnd) || lookupCustomOperator(tok) != nil
+}
+
+// isArithmetic returns true for the operators computing a number.
+func (tok Token) isArithmetic() bool {
+	switch tok {
+	case ADD, SUB, MUL, DIV, BAND, BOR, BXOR:
+		return true
+	}
+	return false
+}
+
+// operatorAliases lists the alternative spellings of binary operators.
+var operatorAliases = []string{"&&", "||", "=", "<>"}
+
+// operatorSpellings returns all the accepted spellings of binary operators.
+func operatorSpellings() []string {
+	var s []string
+	for tok := operatorBegin + 1; tok < customBegin; tok++ {
+		if tok.isOperator() {
+			s = append(s, tok.String())
+		}
+	}
+	s = append(s, operatorAliases...)
+
+	customOperatorsMu.RLock()
+	defer customOperatorsMu.RUnlock()
+	for _, op := range customOperators {
+		s = append(s, op.name)
+	}
+	return s
+}
+
+// isKeyword returns true if s is the upper-case spelling of an operator
+// keyword, built-in or registered.
+func isKeyword(s string) bool {
+	for tok := operatorBegin + 1; tok < customBegin; tok++ {
+		if !tok.isLiteral() && tok.String() == s {
+			return true
+		}
+	}
+	return lookupCustomOperatorName(s) != nil
+}
+
+// isPostfix returns true for postfix operator tokens.
+func (tok Token) isPostfix() bool {
+	switch tok {
+	case ISBUSINESSDAY, ENTROPY, ISPOWEROFTWO, ISNULL, ISNOTNULL:
+		return true
+	}
+	return false
+}
 
 // tokstr returns a literal if provided, otherwise returns the token string.
 func tokstr(tok Token, lit string) string {
@@ -0,0 +1,222 @@
+package conditions
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Trace records the evaluation of an expression node by node, see
+// EvaluateWithTrace. String explains the result, one line per operator:
+//
+//	AND → false because right side false
+//	  $Height(180) > 100 → true
+//	  $Name("ann") == "bob" → false
+type Trace struct {
+	// Node is the evaluated expression
+	Node Expr
+	// Value is the value of Node, nil if its evaluation failed
+	Value Expr
+	// Err is the error of the evaluation of Node
+	Err error
+	// Children are the traces of the operands of Node, in evaluation
+	// order. Operands skipped by AND, OR and ?: have none, the expression
+	// of ANY and ALL has one per element evaluated.
+	Children []*Trace
+}
+
+// EvaluateWithTrace is like EvaluateWithOptions, and also returns the
+// trace of the evaluation, partial when it fails. Tracing allocates for
+// every node evaluated, which counts against Options.MemoryBudget.
+// Evaluate and EvaluateWithOptions don't trace.
+func EvaluateWithTrace(expr Expr, args interface{}, opts ...Option) (bool, *Trace, error) {
+	if expr == nil {
+		return false, nil, fmt.Errorf("Provided expression is nil")
+	}
+
+	root := &Trace{}
+	e := &evaluator{args: indirectArgs(args), opts: collectOptions(opts), trace: root}
+	r, err := e.evaluate(expr)
+	if len(root.Children) == 0 {
+		return r, nil, err
+	}
+	return r, root.Children[0], err
+}
+
+// traceNode evaluates expr like evaluateNode, recording its trace as a
+// child of the trace of the node being evaluated.
+func (e *evaluator) traceNode(expr Expr) (Expr, error) {
+	parent := e.trace
+	t := &Trace{Node: expr}
+	parent.Children = append(parent.Children, t)
+	e.alloc(traceBytes)
+	e.trace = t
+	defer func() { e.trace = parent }()
+
+	v, err := e.evaluateNode(expr)
+	if err != nil {
+		t.Err = err
+	} else {
+		t.Value = v
+	}
+	return v, err
+}
+
+// String explains the evaluation, one line per node which is not a
+// variable or a literal, operands indented below the operator.
+func (t *Trace) String() string {
+	var lines []string
+	t.unparen().explain(&lines, 0)
+	return strings.Join(lines, "\n")
+}
+
+// explain appends the lines explaining t at the indentation depth.
+func (t *Trace) explain(lines *[]string, depth int) {
+	*lines = append(*lines, strings.Repeat("  ", depth)+t.line())
+	for _, c := range t.Children {
+		if c = c.unparen(); !isTraceLeaf(c.Node) {
+			c.explain(lines, depth+1)
+		}
+	}
+}
+
+// line returns the explanation of t alone, operands included.
+func (t *Trace) line() string {
+	result := " → " + t.result()
+	switch n := t.Node.(type) {
+	case *BinaryExpr:
+		if n.Op == AND || n.Op == OR {
+			return n.Op.String() + result + t.because(n.Op)
+		}
+		rhs := traceSource(n.RHS)
+		if len(t.Children) == 2 {
+			rhs = t.Children[1].operand()
+		}
+		if len(t.Children) > 0 {
+			return fmt.Sprintf("%s %s %s%s", t.Children[0].operand(), n.Op, rhs, result)
+		}
+	case *UnaryExpr:
+		if len(t.Children) == 1 {
+			if n.Op.isPostfix() {
+				return fmt.Sprintf("%s %s%s", t.Children[0].operand(), n.Op, result)
+			}
+			return fmt.Sprintf("%s %s%s", n.Op, t.Children[0].operand(), result)
+		}
+	}
+	return traceSource(t.Node) + result
+}
+
+// result returns the value of t, or its error.
+func (t *Trace) result() string {
+	if t.Err != nil {
+		return "error: " + t.Err.Error()
+	}
+	return traceValue(t.Value)
+}
+
+// because returns why the AND or OR of t has its value, from the operands
+// evaluated.
+func (t *Trace) because(op Token) string {
+	b, ok := t.Value.(*BooleanLiteral)
+	if !ok {
+		return ""
+	}
+	// The LHS decides the result alone when the RHS is skipped.
+	switch {
+	case b.Val == (op == OR) && len(t.Children) == 1:
+		return fmt.Sprintf(" because left side %t", b.Val)
+	case b.Val == (op == OR):
+		return fmt.Sprintf(" because right side %t", b.Val)
+	}
+	return fmt.Sprintf(" because both sides %t", b.Val)
+}
+
+// operand returns t as the operand of an operator: variables with their
+// value, such as $Height(180), literals as is, other nodes explained on
+// their own line.
+func (t *Trace) operand() string {
+	t = t.unparen()
+	switch t.Node.(type) {
+	case *VarRef:
+		return fmt.Sprintf("%s(%s)", traceSource(t.Node), t.result())
+	}
+	if isLiteral(t.Node) {
+		return traceValue(t.Node)
+	}
+	return "(" + traceSource(t.Node) + ")"
+}
+
+// unparen returns the trace of the expression in parentheses.
+func (t *Trace) unparen() *Trace {
+	for {
+		if _, ok := t.Node.(*ParenExpr); !ok || len(t.Children) != 1 {
+			return t
+		}
+		t = t.Children[0]
+	}
+}
+
+// isTraceLeaf reports whether x is shown with its value inline instead of
+// on its own line.
+func isTraceLeaf(x Expr) bool {
+	_, ok := x.(*VarRef)
+	return ok || isLiteral(x)
+}
+
+// traceValue returns the value v as written in expressions.
+func traceValue(v Expr) string {
+	switch x := v.(type) {
+	case nil:
+		return "?"
+	case *NumberLiteral:
+		return strconv.FormatFloat(x.Val, 'f', -1, 64)
+	}
+	return v.String()
+}
+
+// traceSource returns x close to how it is written in expressions, with
+// $ before variables and numbers without trailing zeros. Traces and
+// *ErrEvaluation describe nodes with it.
+func traceSource(x Expr) string {
+	switch n := x.(type) {
+	case *VarRef:
+		return "$" + n.String()
+	case *ParenExpr:
+		return "(" + traceSource(n.Expr) + ")"
+	case *BinaryExpr:
+		return fmt.Sprintf("%s %s %s", traceSource(n.LHS), n.Op, traceSource(n.RHS))
+	case *UnaryExpr:
+		if n.Op.isPostfix() {
+			return fmt.Sprintf("%s %s", traceSource(n.Expr), n.Op)
+		}
+		return fmt.Sprintf("%s %s", n.Op, traceSource(n.Expr))
+	case *QuantifierExpr:
+		switch n.Binder {
+		case "":
+			return fmt.Sprintf("%s %s", n.Op, traceSource(n.Expr))
+		case "_":
+			return fmt.Sprintf("%s %s %s %s", n.Op, traceSource(n.Var), SATISFIES, traceSource(n.Expr))
+		}
+		return fmt.Sprintf("%s %s %s $%s %s %s", n.Op, traceSource(n.Var), AS, QuoteIdent(n.Binder), SATISFIES, traceSource(n.Expr))
+	case *CallExpr:
+		params := make([]string, len(n.Params))
+		for i, p := range n.Params {
+			params[i] = traceSource(p)
+		}
+		return fmt.Sprintf("%s(%s)", n.Name, strings.Join(params, ", "))
+	case *ConditionalExpr:
+		return fmt.Sprintf("%s ? %s : %s", traceSource(n.Cond), traceSource(n.Then), traceSource(n.Else))
+	case *RangeExpr:
+		return fmt.Sprintf("%s %s %s", traceSource(n.Low), AND, traceSource(n.High))
+	case *TupleExpr:
+		elems := make([]string, len(n.Elems))
+		for i, e := range n.Elems {
+			elems[i] = traceSource(e)
+		}
+		return strings.Join(elems, " ")
+	}
+	if isLiteral(x) {
+		return traceValue(x)
+	}
+	return x.String()
+}
@@ -0,0 +1,95 @@
+package conditions
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluateWithTrace(t *testing.T) {
+	args := map[string]interface{}{"Height": 180, "Name": "ann", "Tags": []string{"a", "b"}, "Weight": 70}
+
+	for _, tc := range []struct {
+		cond   string
+		result bool
+		trace  string
+	}{
+		{`$Height > 100`, true, `$Height(180) > 100 → true`},
+		{`$Height > 100 AND $Name == "bob"`, false, `AND → false because right side false
+  $Height(180) > 100 → true
+  $Name("ann") == "bob" → false`},
+		{`$Height < 100 AND $Name == "bob"`, false, `AND → false because left side false
+  $Height(180) < 100 → false`},
+		{`($Height < 100 OR "a" IN $Tags) AND NOT ($Weight / 2 > 30)`, false, `AND → false because right side false
+  OR → true because right side true
+    $Height(180) < 100 → false
+    "a" IN $Tags([a b]) → true
+  NOT ($Weight / 2 > 30) → false
+    ($Weight / 2) > 30 → true
+      $Weight(70) / 2 → 35`},
+		{`$Height < 100 OR $Name == "bob"`, false, `OR → false because both sides false
+  $Height(180) < 100 → false
+  $Name("ann") == "bob" → false`},
+		{`EXISTS $Name AND $Name IS NOT NULL`, true, `AND → true because both sides true
+  EXISTS $Name → true
+  $Name("ann") IS NOT NULL → true`},
+	} {
+		r, trace, err := EvaluateWithTrace(mustParse(t, tc.cond), args)
+		assert.NoError(t, err, tc.cond)
+		assert.Equal(t, tc.result, r, tc.cond)
+		assert.Equal(t, tc.trace, trace.String(), tc.cond)
+
+		want, err := Evaluate(mustParse(t, tc.cond), args)
+		assert.NoError(t, err)
+		assert.Equal(t, want, r, tc.cond)
+	}
+
+	// The trace is a tree of the evaluated nodes.
+	_, trace, err := EvaluateWithTrace(mustParse(t, `$Height > 100 AND $Name == "bob"`), args)
+	assert.NoError(t, err)
+	assert.Equal(t, &BooleanLiteral{Val: false}, trace.Value)
+	if assert.Len(t, trace.Children, 2) {
+		cmp := trace.Children[0]
+		assert.Equal(t, `Height > 100.000`, cmp.Node.String())
+		assert.Equal(t, &NumberLiteral{Val: 180}, cmp.Children[0].Value)
+	}
+
+	// Failures are traced up to the failing node.
+	r, trace, err := EvaluateWithTrace(mustParse(t, `$Height > 1 AND $Missing == 1`), args)
+	assert.Error(t, err)
+	assert.False(t, r)
+	assert.Equal(t, "AND → error: Argument: `Missing` not found\n"+
+		"  $Height(180) > 1 → true\n"+
+		"  $Missing(error: Argument: `Missing` not found) == 1 → error: Argument: `Missing` not found", trace.String())
+
+	_, trace, err = EvaluateWithTrace(nil, args)
+	assert.Error(t, err)
+	assert.Nil(t, trace)
+}
+
+func TestTraceMemoryBudget(t *testing.T) {
+	nums := make([]float64, 5000)
+	for i := range nums {
+		nums[i] = float64(i)
+	}
+	args := map[string]interface{}{"nums": nums}
+	expr := mustParse(t, `ANY $nums == -1`)
+
+	// The trace of every element doesn't fit in a budget which the
+	// evaluation alone fits in.
+	r, err := EvaluateWithOptions(expr, args, WithMemoryBudget(1<<20))
+	assert.NoError(t, err)
+	assert.False(t, r)
+
+	r, trace, err := EvaluateWithTrace(expr, args, WithMemoryBudget(1<<20))
+	var budgetErr *ErrMemoryBudget
+	if assert.True(t, errors.As(err, &budgetErr), "%v", err) {
+		assert.Equal(t, 1<<20, budgetErr.Budget)
+	}
+	assert.False(t, r)
+	assert.NotNil(t, trace)
+
+	_, _, err = EvaluateWithTrace(expr, args, WithMemoryBudget(4<<20))
+	assert.NoError(t, err)
+}
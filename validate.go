@@ -0,0 +1,126 @@
+package conditions
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Validate checks the variables referenced by expr against the fields of
+// the struct schema, which may be a struct value, a pointer to a struct or
+// a reflect.Type. It returns an error for the first variable which is not
+// a field of the struct or whose type can't be evaluated. Fields are
+// looked up as EvaluateWithOptions does with the same options, by their
+// tags and Options.CaseInsensitiveFields included.
+func Validate(expr Expr, schema interface{}, opts ...Option) error {
+	o := collectOptions(opts)
+	t, ok := schema.(reflect.Type)
+	if !ok {
+		t = reflect.TypeOf(schema)
+	}
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("Schema: `%v` is not a struct", schema)
+	}
+
+	for _, name := range Variables(expr) {
+		ft, err := fieldType(t, o, name)
+		if err != nil {
+			return err
+		}
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if isUnsupportedKind(ft.Kind()) {
+			return &ErrUnsupportedFieldType{Name: name, Type: ft.String()}
+		}
+	}
+	return nil
+}
+
+// fieldType returns the type of the field of the struct type t called
+// name, following dotted paths through nested structs and pointers. Keys
+// of maps can't be checked, the path is accepted from there on.
+func fieldType(t reflect.Type, o *Options, name string) (reflect.Type, error) {
+	if f, ok, err := schemaField(t, o, name, name); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return f.Type, nil
+	}
+	if fields := promotedFields(t, name); len(fields) > 1 {
+		return nil, &ErrAmbiguousField{Path: name, Field: name, Type: t.String(), Candidates: fields}
+	}
+	if !strings.Contains(name, ".") {
+		return nil, fmt.Errorf("Argument: `%v` not found in %s", name, t)
+	}
+
+	segments := strings.Split(name, ".")
+	for i, seg := range segments {
+		if i > 0 {
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if t.Kind() == reflect.Map || t.Kind() == reflect.Interface {
+				return t, nil
+			}
+			if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+				if _, err := strconv.Atoi(seg); err != nil {
+					return nil, fmt.Errorf("$%s: field %q is a %s, %q is not an index", name, segments[i-1], t, seg)
+				}
+				t = t.Elem()
+				continue
+			}
+			if t.Kind() != reflect.Struct {
+				return nil, fmt.Errorf("$%s: field %q is a %s, not a map, struct or slice", name, segments[i-1], t)
+			}
+		}
+		f, ok, err := schemaField(t, o, name, seg)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if fields := promotedFields(t, seg); len(fields) > 1 {
+				return nil, &ErrAmbiguousField{Path: name, Field: seg, Type: t.String(), Candidates: fields}
+			}
+			return nil, &ErrFieldNotFound{Path: name, Field: seg}
+		}
+		t = f.Type
+	}
+	return t, nil
+}
+
+// schemaField returns the field of the struct type t called name, see
+// findField, or a field standing for the result of the method called
+// name. A conditions tag naming another field is an *ErrShadowedField:
+// the tagged field wins during evaluations, which is easily a mistake.
+func schemaField(t reflect.Type, o *Options, path, name string) (reflect.StructField, bool, error) {
+	f, ok, names := findField(t, o, name)
+	if len(names) > 1 {
+		return reflect.StructField{}, false, &ErrAmbiguousField{Path: path, Field: name, Type: t.String(), Candidates: names}
+	}
+	if ok {
+		if _, tagged := structTags(t, conditionsTag).exact[name]; tagged {
+			if other, ok := t.FieldByName(name); ok && !hidden(other) && other.Name != f.Name {
+				return f, true, &ErrShadowedField{Path: path, Field: f.Name, Shadowed: other.Name, Type: t.String()}
+			}
+		}
+		return f, true, nil
+	}
+	if _, ok := t.FieldByName(name); ok {
+		// Hidden fields don't fall back to methods.
+		return reflect.StructField{}, false, nil
+	}
+	// Methods resolve to their result, see structMethod.
+	m, ok := reflect.PtrTo(t).MethodByName(name)
+	if !ok {
+		return reflect.StructField{}, false, nil
+	}
+	if m.Type.NumIn() != 1 || m.Type.NumOut() != 1 {
+		return reflect.StructField{}, false, fmt.Errorf("$%s: method %s of %s must take no arguments and return a single value", path, name, t)
+	}
+	return reflect.StructField{Name: m.Name, Type: m.Type.Out(0)}, true, nil
+}
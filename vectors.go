@@ -0,0 +1,236 @@
+package conditions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Vector is a conformance test vector: an expression, the args it is
+// evaluated against and the outcome of the evaluation. Vectors are shared
+// with other implementations of the language as JSON.
+type Vector struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	// Args is a JSON object. Arrays of strings or numbers become []string
+	// and []float64, objects of the form {"$time": "<RFC 3339>"} become
+	// time.Time values, objects of the form {"$duration": "1h30m"}
+	// become time.Duration values and objects of the form
+	// {"$number": "12.50"} become json.Number values.
+	Args    json.RawMessage `json:"args,omitempty"`
+	Options *VectorOptions  `json:"options,omitempty"`
+	// Result is the expected result when evaluation succeeds.
+	Result *bool `json:"result,omitempty"`
+	// Error is the expected error class when it fails, see VectorError*.
+	Error string `json:"error,omitempty"`
+}
+
+// Error classes of conformance vectors.
+const (
+	VectorErrorParse    = "parse"
+	VectorErrorEvaluate = "evaluate"
+)
+
+// VectorOptions are the evaluation options a vector requires.
+type VectorOptions struct {
+	CoerceStrings bool   `json:"coerce_strings,omitempty"`
+	Decimal       string `json:"decimal_separator,omitempty"`
+	Grouping      string `json:"grouping_separator,omitempty"`
+	// Location is an IANA time zone name.
+	Location string `json:"location,omitempty"`
+	// Now is the RFC 3339 time returned by the clock.
+	Now string `json:"now,omitempty"`
+	// Equality is "lenient" or "strict", see EqualityMode.
+	Equality string `json:"equality,omitempty"`
+	NilFalse bool   `json:"nil_false,omitempty"`
+}
+
+// vectorFile is the JSON document holding conformance vectors.
+type vectorFile struct {
+	Version int      `json:"version"`
+	Vectors []Vector `json:"vectors"`
+}
+
+// vectorFormatVersion is bumped when the vector file format changes.
+const vectorFormatVersion = 3
+
+// ExportVectors evaluates every vector of the corpus and returns the JSON
+// vector file recording the outcomes. Expected outcomes already present
+// in the corpus are ignored.
+func ExportVectors(corpus []Vector) ([]byte, error) {
+	f := vectorFile{Version: vectorFormatVersion}
+	for _, v := range corpus {
+		r, class, err := v.run()
+		if class == "" && err != nil {
+			return nil, fmt.Errorf("Vector %s: %s", v.Name, err)
+		}
+		v.Result, v.Error = nil, class
+		if class == "" {
+			v.Result = &r
+		}
+		f.Vectors = append(f.Vectors, v)
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// RunVectors runs the vectors of a JSON vector file and returns an error
+// describing every vector whose outcome differs from the expected one.
+func RunVectors(data []byte) error {
+	var f vectorFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("Invalid vector file: %s", err)
+	}
+	if f.Version != vectorFormatVersion {
+		return fmt.Errorf("Unsupported vector file version %d", f.Version)
+	}
+
+	var failures []string
+	for _, v := range f.Vectors {
+		r, class, err := v.run()
+		switch {
+		case class == "" && err != nil:
+			failures = append(failures, fmt.Sprintf("%s: %s", v.Name, err))
+		case v.Error != class:
+			failures = append(failures, fmt.Sprintf("%s: expected error %q, got %q (%v)", v.Name, v.Error, class, err))
+		case v.Error == "" && (v.Result == nil || *v.Result != r):
+			failures = append(failures, fmt.Sprintf("%s: expected result %v, got %v", v.Name, v.Result, r))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d vectors failed:\n%s", len(failures), len(f.Vectors), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// run parses and evaluates the vector. It returns the result and the
+// error class of a failure, or an error if the vector itself is invalid.
+func (v Vector) run() (bool, string, error) {
+	opts, err := v.Options.options()
+	if err != nil {
+		return false, "", err
+	}
+	args, err := vectorArgs(v.Args)
+	if err != nil {
+		return false, "", err
+	}
+
+	expr, err := NewParser(strings.NewReader(v.Expression)).Parse()
+	if err != nil {
+		return false, VectorErrorParse, err
+	}
+	r, err := EvaluateWithOptions(expr, args, opts)
+	if err != nil {
+		return false, VectorErrorEvaluate, err
+	}
+	return r, "", nil
+}
+
+// options converts the vector options to evaluation options.
+func (o *VectorOptions) options() (Options, error) {
+	if o == nil {
+		return Options{}, nil
+	}
+	opts := Options{CoerceStrings: o.CoerceStrings, NilFalse: o.NilFalse}
+	if o.Decimal != "" || o.Grouping != "" {
+		f := &NumberFormat{}
+		for _, c := range o.Decimal {
+			f.Decimal = c
+		}
+		for _, c := range o.Grouping {
+			f.Grouping = c
+		}
+		opts.NumberFormat = f
+	}
+	if o.Location != "" {
+		loc, err := time.LoadLocation(o.Location)
+		if err != nil {
+			return opts, err
+		}
+		opts.Location = loc
+	}
+	if o.Now != "" {
+		now, err := time.Parse(time.RFC3339, o.Now)
+		if err != nil {
+			return opts, err
+		}
+		opts.Clock = func() time.Time { return now }
+	}
+	switch o.Equality {
+	case "":
+	case "lenient":
+		opts.Equality = EqualityLenient
+	case "strict":
+		opts.Equality = EqualityStrict
+	default:
+		return opts, fmt.Errorf("Unknown equality mode %q", o.Equality)
+	}
+	return opts, nil
+}
+
+// vectorArgs decodes the args of a vector.
+func vectorArgs(data json.RawMessage) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Invalid args: %s", err)
+	}
+	return vectorValue(doc)
+}
+
+// vectorValue converts decoded JSON values to the Go types described by
+// Vector.Args.
+func vectorValue(doc interface{}) (interface{}, error) {
+	switch n := doc.(type) {
+	case map[string]interface{}:
+		if ts, ok := n["$time"].(string); ok && len(n) == 1 {
+			return time.Parse(time.RFC3339, ts)
+		}
+		if ds, ok := n["$duration"].(string); ok && len(n) == 1 {
+			return parseDuration(ds)
+		}
+		if ns, ok := n["$number"].(string); ok && len(n) == 1 {
+			return json.Number(ns), nil
+		}
+		m := map[string]interface{}{}
+		for k, v := range n {
+			cv, err := vectorValue(v)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = cv
+		}
+		return m, nil
+	case []interface{}:
+		strs, nums := []string{}, []float64{}
+		for _, e := range n {
+			switch x := e.(type) {
+			case string:
+				strs = append(strs, x)
+			case float64:
+				nums = append(nums, x)
+			default:
+				return nil, fmt.Errorf("Unsupported array element %v", e)
+			}
+		}
+		if len(nums) == 0 {
+			return strs, nil
+		}
+		if len(strs) == 0 {
+			return nums, nil
+		}
+		return nil, fmt.Errorf("Mixed array %v", n)
+	}
+	return doc, nil
+}
@@ -0,0 +1,273 @@
+package conditions
+
+import "encoding/json"
+
+// vec returns a corpus vector evaluating expression against the JSON args.
+func vec(name, expression, args string) Vector {
+	v := Vector{Name: name, Expression: expression}
+	if args != "" {
+		v.Args = json.RawMessage(args)
+	}
+	return v
+}
+
+// withOptions returns the vector requiring the given options.
+func withOptions(v Vector, o VectorOptions) Vector {
+	v.Options = &o
+	return v
+}
+
+// ConformanceCorpus is the curated set of vectors covering every operator
+// and edge case of the language. Export it with ExportVectors whenever the
+// behavior of the engine changes.
+var ConformanceCorpus = []Vector{
+	// Literals
+	vec("literal/true", `true`, ""),
+	vec("literal/false", `FALSE`, ""),
+	vec("literal/number-root", `56.43`, ""),
+	vec("literal/string-root", `"OFF"`, ""),
+	vec("literal/negative-number", `$a > -100 AND $a < -50`, `{"a": -75.4}`),
+
+	// Variables
+	vec("var/dollar", `$a`, `{"a": true}`),
+	vec("var/brackets", `[a]`, `{"a": false}`),
+	vec("var/nested-brackets", `[foo][bar] == true`, `{"foo.bar": true}`),
+	vec("var/at-brackets", `[@foo][a] == 1`, `{"@foo.a": 1}`),
+	vec("var/nested-path", `$foo.bar.baz == 1`, `{"foo": {"bar": {"baz": 1}}}`),
+	vec("var/index", `$s[0] == "a" AND $s[-1] == "c"`, `{"s": ["a", "b", "c"]}`),
+	vec("var/index-out-of-range", `$s[3] == "a"`, `{"s": ["a", "b", "c"]}`),
+	vec("var/missing", `$missing == 1`, `{"a": 1}`),
+	vec("var/no-args", `$a == 1`, ""),
+	vec("var/literal-name", `${user-id} == 7 AND ${a.b} == 1`, `{"user-id": 7, "a.b": 1}`),
+	vec("var/literal-name-not-path", `${a.b} == 1`, `{"a": {"b": 1}}`),
+
+	// Logical operators
+	vec("and/tt", `$a AND $b`, `{"a": true, "b": true}`),
+	vec("and/tf", `$a AND $b`, `{"a": true, "b": false}`),
+	vec("and/alias", `$a && $b`, `{"a": true, "b": true}`),
+	vec("or/ff", `$a OR $b`, `{"a": false, "b": false}`),
+	vec("or/ft", `$a or $b`, `{"a": false, "b": true}`),
+	vec("or/alias", `$a || $b`, `{"a": false, "b": true}`),
+	vec("xor/tt", `true XOR true`, ""),
+	vec("xor/tf", `true xor false`, ""),
+	vec("nand/tt", `true NAND true`, ""),
+	vec("nand/ff", `false NAND false`, ""),
+	vec("not/keyword", `NOT $a`, `{"a": false}`),
+	vec("not/alias", `!$a`, `{"a": true}`),
+	vec("not/comparison", `NOT $a == 1 AND $b`, `{"a": 2, "b": true}`),
+	vec("logical/non-boolean", `$a AND true`, `{"a": 1}`),
+	vec("logical/unknown-and", `$a & $b`, `{"a": true, "b": true}`),
+	vec("and/short-circuit", `false AND $missing == 1`, `{}`),
+	vec("and/right-error", `true AND $missing == 1`, `{}`),
+	vec("or/short-circuit", `true OR $a > "x"`, `{"a": 1}`),
+	vec("or/right-error", `false OR $a > "x"`, `{"a": 1}`),
+
+	// Precedence
+	vec("precedence/and-over-or", `$a OR $b AND $c`, `{"a": true, "b": false, "c": false}`),
+	vec("precedence/parens", `($a OR $b) AND $c`, `{"a": true, "b": false, "c": false}`),
+	vec("precedence/chain", `$a == 1 AND $b == 2 AND $c == 3`, `{"a": 1, "b": 2, "c": 3}`),
+	vec("precedence/nested", `((false OR true) AND false) OR (false OR true)`, ""),
+
+	// Comparison operators
+	vec("eq/number", `$a == 1`, `{"a": 1}`),
+	vec("eq/string", `$a == "x"`, `{"a": "x"}`),
+	vec("eq/single-quoted", `$a == 'say "x"'`, `{"a": "say \"x\""}`),
+	vec("eq/escapes", `$a == "say \"hi\"\tC:\\temp"`, `{"a": "say \"hi\"\tC:\\temp"}`),
+	vec("eq/boolean", `$a == false`, `{"a": false}`),
+	vec("eq/alias", `$a = 1`, `{"a": 1}`),
+	vec("eq/string-number", `$a == 1`, `{"a": "1"}`),
+	vec("eq/number-string", `$a == "1"`, `{"a": 1}`),
+	vec("eq/boolean-number", `$a == 1`, `{"a": true}`),
+	vec("neq/number", `$a != 1`, `{"a": 2}`),
+	vec("neq/alias", `$a <> "x"`, `{"a": "x"}`),
+	vec("gt/number", `$a > 10`, `{"a": 14}`),
+	vec("gt/equal", `$a > 10`, `{"a": 10}`),
+	vec("gt/boolean", `$a > true`, `{"a": 43}`),
+	vec("gte/equal", `$a >= 10`, `{"a": 10}`),
+	vec("lt/number", `$a < 10`, `{"a": 9.99}`),
+	vec("lte/equal", `$a <= 10`, `{"a": 10}`),
+	vec("lt/string", `$a < 10`, `{"a": "9"}`),
+	vec("eq/json-number", `$a == 12.5 AND $b > 2`, `{"a": {"$number": "12.50"}, "b": {"$number": "3"}}`),
+	vec("eq/invalid-json-number", `$a == 1`, `{"a": {"$number": "one"}}`),
+	vec("eq/slice", `$s == ["a", "b"] AND ["a", "b"] == $s`, `{"s": ["a", "b"]}`),
+	vec("eq/slice-order", `$s == ["b", "a"]`, `{"s": ["a", "b"]}`),
+	vec("eq/slice-length", `$s == [1, 2, 3]`, `{"s": [1, 2]}`),
+	vec("neq/slice", `$s != [1, 2, 3]`, `{"s": [1, 2]}`),
+	vec("eq/null", `$a == NULL`, `{"a": null}`),
+	vec("eq/null-present", `$a == NULL`, `{"a": 0}`),
+	vec("neq/null", `$a != NULL`, `{"a": "x"}`),
+	vec("eq/nil", `$a == 1`, `{"a": null}`),
+	withOptions(vec("eq/nil-false", `$a == 1`, `{"a": null}`), VectorOptions{NilFalse: true}),
+	withOptions(vec("eq/null-nil-false", `$a == NULL`, `{"a": null}`), VectorOptions{NilFalse: true}),
+	vec("eq/slice-string", `$s == "a" OR $s != "a"`, `{"s": ["a"]}`),
+	vec("eq/string-slice", `"a" == $s OR "a" != $s`, `{"s": ["a"]}`),
+	vec("eq/time-number", `$t == 1`, `{"t": {"$time": "2024-03-01T00:00:00Z"}}`),
+	withOptions(vec("eq/slice-string-lenient", `$s == "a" OR "a" != $s`, `{"s": ["a"]}`), VectorOptions{Equality: "lenient"}),
+	withOptions(vec("eq/slice-string-strict", `$s == "a"`, `{"s": ["a"]}`), VectorOptions{Equality: "strict"}),
+	withOptions(vec("eq/string-slice-strict", `"a" != $s`, `{"s": ["a"]}`), VectorOptions{Equality: "strict"}),
+	withOptions(vec("eq/time-strict", `$t == $t`, `{"t": {"$time": "2024-03-01T00:00:00Z"}}`), VectorOptions{Equality: "strict"}),
+	withOptions(vec("eq/slice-strict", `$s == ["a"]`, `{"s": ["a"]}`), VectorOptions{Equality: "strict"}),
+
+	// Regular expressions
+	vec("ereg/match", `$status =~ /^5\d\d/`, `{"status": "500"}`),
+	vec("ereg/no-match", `$status =~ /^4\d\d/`, `{"status": "500"}`),
+	vec("ereg/string-pattern", `$status =~ "^5"`, `{"status": "500"}`),
+	vec("ereg/raw-string", "$status =~ `^5\\d\\d$`", `{"status": "500"}`),
+	vec("nereg/match", `$status !~ /^5\d\d/`, `{"status": "500"}`),
+	vec("nereg/no-match", `$status !~ /^4\d\d/`, `{"status": "500"}`),
+	vec("ereg/number", `$status =~ /^5/`, `{"status": 500}`),
+	vec("ereg/invalid", `$status =~ /(/`, `{"status": "500"}`),
+
+	// Membership
+	vec("in/var-string", `$foo IN $list`, `{"foo": "b", "list": ["a", "b"]}`),
+	vec("in/literal-string", `$foo in ["bonjour", "le monde"]`, `{"foo": "le monde"}`),
+	vec("in/literal-string-missing", `$foo in ["bonjour", "le monde"]`, `{"foo": "world"}`),
+	vec("in/literal-number", `$foo IN [2, 3, 4]`, `{"foo": 4}`),
+	vec("in/literal-number-missing", `$foo IN [2, 3, 4]`, `{"foo": 5}`),
+	vec("in/mismatch", `$foo IN [2, 3, 4]`, `{"foo": "4"}`),
+	vec("in/literal-single", `$foo IN ["a"]`, `{"foo": "a"}`),
+	vec("in/literal-negative", `$foo IN [-1, 1]`, `{"foo": -1}`),
+	vec("notin/string", `$foo NOT IN ["a", "b"]`, `{"foo": "c"}`),
+	vec("notin/number", `$foo not in [2, 3]`, `{"foo": 2}`),
+	vec("contains/string", `$list CONTAINS "a"`, `{"list": ["a", "b"]}`),
+	vec("contains/number", `$list CONTAINS 3`, `{"list": [1, 2]}`),
+	vec("contains/precedence", `$list CONTAINS "a" AND $b`, `{"list": ["a"], "b": true}`),
+	vec("contains/substring", `$name CONTAINS "ell"`, `{"name": "hello"}`),
+	vec("contains/number-in-string", `$sku CONTAINS 12`, `{"sku": "abc123"}`),
+	vec("contains/mismatch", `$list CONTAINS 1`, `{"list": ["1"]}`),
+	vec("notcontains/string", `$list NOT CONTAINS "c"`, `{"list": ["a", "b"]}`),
+	vec("notcontains/number", `$list not contains 2`, `{"list": [1, 2]}`),
+	vec("notcontains/substring", `$name NOT CONTAINS "ell"`, `{"name": "hello"}`),
+	vec("order/strings", `$v < "abd"`, `{"v": "abc"}`),
+	vec("order/string-prefix", `$v > "ab"`, `{"v": "abc"}`),
+	vec("order/string-number", `$v > 1`, `{"v": "2"}`),
+	vec("like/wildcards", `$name LIKE "J%n_"`, `{"name": "Johnny"}`),
+	vec("like/anchored", `$name LIKE "oh%"`, `{"name": "John"}`),
+	vec("notlike/wildcards", `$name NOT LIKE "%y"`, `{"name": "Johnny"}`),
+	vec("inkeys/present", `"dark" INKEYS $flags`, `{"flags": {"dark": false}}`),
+	vec("inkeys/missing", `"dark" INKEYS $flags`, `{"flags": {"beta": true}}`),
+	vec("inkeys/not-map", `"dark" INKEYS $flags`, `{"flags": "dark"}`),
+	vec("exists/empty-value", `EXISTS $user.email`, `{"user.email": ""}`),
+	vec("exists/absent", `EXISTS $user.email`, `{"user.name": "Ann"}`),
+	vec("phoneeq/formatted", `$p PHONEEQ "+1 555 123 4567"`, `{"p": "(555) 123-4567"}`),
+	vec("phoneeq/different", `$p PHONEEQ "555 123 4568"`, `{"p": "(555) 123-4567"}`),
+	vec("nearint/within", `$x NEARINT 0.25`, `{"x": 2.75}`),
+	vec("nearint/beyond", `$x NEARINT 0.125`, `{"x": -2.75}`),
+	vec("sizebetween/at-bound", `$l SIZEBETWEEN 1 AND 2`, `{"l": ["a", "b"]}`),
+	vec("sizebetween/outside", `$l SIZEBETWEEN 3 AND 5`, `{"l": ["a", "b"]}`),
+	vec("sizebetween/then-and", `$l SIZEBETWEEN 0 AND 2 AND $b`, `{"l": [], "b": true}`),
+	vec("between/char", `$g BETWEEN "A" AND "F"`, `{"g": "C"}`),
+	vec("between/char-bound", `$g BETWEEN "A" AND "F"`, `{"g": "F"}`),
+	vec("between/char-outside", `$g BETWEEN "A" AND "F"`, `{"g": "a"}`),
+	vec("between/number", `$n BETWEEN 1 AND 10 AND $b`, `{"n": 10, "b": true}`),
+	vec("between/mixed", `$g BETWEEN 1 AND 10`, `{"g": "C"}`),
+	vec("between/mixed-high", `$g BETWEEN "D" AND 10`, `{"g": "C"}`),
+
+	// Conditional expressions
+	vec("conditional/then", `($t == "A" ? $a : $b) > 10`, `{"t": "A", "a": 11}`),
+	vec("conditional/else", `($t == "A" ? $a : $b) > 10`, `{"t": "B", "a": 11, "b": 1}`),
+	vec("conditional/not-boolean", `$t ? true : false`, `{"t": "A"}`),
+
+	// Quantifiers
+	vec("any/true", `ANY $s > 90`, `{"s": [50, 95]}`),
+	vec("any/false", `ANY $s > 90`, `{"s": [50, 85]}`),
+	vec("any/empty", `ANY $s > 90`, `{"s": []}`),
+	vec("all/true", `ALL $s > 50`, `{"s": [51, 95]}`),
+	vec("all/false", `ALL $s > 50`, `{"s": [50, 95]}`),
+	vec("all/empty", `ALL $s > 50`, `{"s": []}`),
+	vec("all/strings", `ALL $s != "spam"`, `{"s": ["a", "b"]}`),
+	vec("any/not-slice", `ANY $s > 1`, `{"s": 3}`),
+	vec("satisfies/any", `ANY $s SATISFIES ($_ > 90 AND $_ < 100)`, `{"s": [50, 95]}`),
+	vec("satisfies/all", `ALL $s SATISFIES $_ > $min`, `{"s": [50, 95], "min": 50}`),
+	vec("satisfies/named", `ANY $s AS $x SATISFIES $x == "b"`, `{"s": ["a", "b"]}`),
+	vec("satisfies/nested", `ANY $s AS $x SATISFIES ALL $t AS $y SATISFIES $x > $y`, `{"s": [1, 5], "t": [2, 3]}`),
+
+	// Postfix operators and functions
+	vec("entropy/low", `$v ENTROPY > 3.5`, `{"v": "aaaa"}`),
+	vec("entropy/high", `$v ENTROPY > 3.5`, `{"v": "kR9#vT2qLm8$Xw4zPb7N"}`),
+	vec("isnull/nil", `$v IS NULL`, `{"v": null}`),
+	vec("isnull/present", `$v IS NULL`, `{"v": 0}`),
+	vec("isnotnull/nil", `$v IS NOT NULL`, `{"v": null}`),
+	vec("isnull/missing", `$v IS NULL`, `{}`),
+	vec("ispoweroftwo/true", `$n ISPOWEROFTWO`, `{"n": 1024}`),
+	vec("ispoweroftwo/false", `$n ISPOWEROFTWO`, `{"n": 1000}`),
+	vec("ispoweroftwo/fraction", `$n ISPOWEROFTWO`, `{"n": 1.5}`),
+	vec("isbusinessday/friday", `$at ISBUSINESSDAY`, `{"at": {"$time": "2024-01-05T23:30:00Z"}}`),
+	withOptions(vec("isbusinessday/location", `$at ISBUSINESSDAY`, `{"at": {"$time": "2024-01-05T23:30:00Z"}}`), VectorOptions{Location: "Asia/Tokyo"}),
+	vec("part/index", `part($p, "/", 2) == "users"`, `{"p": "/api/users/42"}`),
+	vec("part/out-of-range", `part($p, "/", 9) == "users"`, `{"p": "/api/users/42"}`),
+	vec("overlaps/intersecting", `overlaps($a, $b, $c, $d)`, `{"a": {"$time": "2024-03-01T09:00:00Z"}, "b": {"$time": "2024-03-01T11:00:00Z"}, "c": {"$time": "2024-03-01T10:00:00Z"}, "d": {"$time": "2024-03-01T12:00:00Z"}}`),
+	vec("overlaps/adjacent", `overlaps($a, $b, $c, $d)`, `{"a": {"$time": "2024-03-01T09:00:00Z"}, "b": {"$time": "2024-03-01T10:00:00Z"}, "c": {"$time": "2024-03-01T10:00:00Z"}, "d": {"$time": "2024-03-01T11:00:00Z"}}`),
+	vec("function/unknown", `nope($p) == 1`, `{"p": 1}`),
+	vec("sample/in", `sample($u, 36)`, `{"u": "user-2"}`),
+	vec("sample/out", `sample($u, 35)`, `{"u": "user-2"}`),
+	vec("sample/salt", `sample($u, 74, "exp-42")`, `{"u": "user-2"}`),
+	vec("sample/percent-out-of-range", `sample($u, $p)`, `{"u": "user-2", "p": 150}`),
+	vec("extract/group", `extract($p, "/users/(\\d+)") == "42"`, `{"p": "/api/users/42"}`),
+	vec("extract/no-group", `extract($p, "/users/\\d+") == "/users/42"`, `{"p": "/api/users/42"}`),
+	vec("extract/no-match", `extract($p, "/teams/(\\d+)") == ""`, `{"p": "/api/users/42"}`),
+	vec("extract/invalid-pattern", `extract($p, "(") == ""`, `{"p": "/api/users/42"}`),
+
+	// Arithmetic
+	vec("arithmetic/precedence", `$a + 2 * 3 == 7`, `{"a": 1}`),
+	vec("arithmetic/division-float", `$a / 2 == 1.5`, `{"a": 3}`),
+	vec("arithmetic/division-by-zero", `$a / 0 == 1`, `{"a": 3}`),
+	vec("arithmetic/string", `$a + 1 == 2`, `{"a": "1"}`),
+	vec("arithmetic/regex-after-division", `$a / 2 == 1 AND $b =~ /^x\/y$/`, `{"a": 2, "b": "x/y"}`),
+	vec("floor/negative", `floor($a / 2) == -4`, `{"a": -7}`),
+	vec("trunc/negative", `trunc($a / 2) == -3`, `{"a": -7}`),
+	vec("round/half-away-from-zero", `round($a) == -3 AND round($b) == 3`, `{"a": -2.5, "b": 2.5}`),
+	vec("idiv/negative", `idiv($a, 2) == -3`, `{"a": -7}`),
+	vec("idiv/zero", `idiv($a, 0) == 0`, `{"a": 7}`),
+	vec("sum/numbers", `sum($s) == 6`, `{"s": [1, 2, 3]}`),
+	vec("avg/numbers", `avg($s) == 2`, `{"s": [1, 2, 3]}`),
+	vec("avg/empty", `avg($s) == 0`, `{"s": []}`),
+	vec("abs/negative", `abs($a) == 2.5`, `{"a": -2.5}`),
+	vec("abs/expression", `abs($a / 2) == 3.5`, `{"a": -7}`),
+	vec("abs/string", `abs($a) == 1`, `{"a": "-1"}`),
+	vec("bitwise/mask", `$f BAND 4 == 4 AND $f BAND 2 == 0`, `{"f": 5}`),
+	vec("bitwise/or-xor", `$f BOR 2 == 7 AND $f BXOR 0x1 == 4`, `{"f": 5}`),
+	vec("bitwise/fraction", `$f BAND 1 == 1`, `{"f": 1.5}`),
+
+	// Coercion
+	withOptions(vec("coerce/string-gt", `$h > 100`, `{"h": "180"}`), VectorOptions{CoerceStrings: true}),
+	withOptions(vec("coerce/not-number", `$h > 100`, `{"h": "tall"}`), VectorOptions{CoerceStrings: true}),
+	withOptions(vec("coerce/european", `$p == 1234.5`, `{"p": "1.234,5"}`), VectorOptions{Decimal: ",", Grouping: "."}),
+
+	// Durations
+	vec("duration/literals", `90s < 2m AND 1h30m == 90m AND 1w == 7d`, ""),
+	vec("duration/arg-literal", `$d > 5s`, `{"d": {"$duration": "1m"}}`),
+	vec("duration/arg-string", `$d <= "1h30m"`, `{"d": {"$duration": "90m"}}`),
+	vec("duration/arg-number", `$d > 5`, `{"d": {"$duration": "1m"}}`),
+	vec("duration/invalid-string", `$d > "soon"`, `{"d": {"$duration": "1m"}}`),
+	vec("duration/invalid-literal", `$d > 5x`, `{"d": {"$duration": "1m"}}`),
+
+	// Times
+	vec("before/time", `$t BEFORE "2024-03-01T00:00:00Z"`, `{"t": {"$time": "2024-02-29T23:00:00Z"}}`),
+	vec("after/time", `$t AFTER $u`, `{"t": {"$time": "2024-02-29T23:00:00Z"}, "u": {"$time": "2024-03-01T00:00:00Z"}}`),
+	withOptions(vec("before/duration", `$t BEFORE 2d`, `{"t": {"$time": "2024-02-28T11:00:00Z"}}`), VectorOptions{Now: "2024-03-01T12:00:00Z"}),
+	withOptions(vec("after/duration", `$t AFTER 1h30m`, `{"t": {"$time": "2024-03-01T11:00:00Z"}}`), VectorOptions{Now: "2024-03-01T12:00:00Z"}),
+	withOptions(vec("before/days", `$t BEFORE 1.5`, `{"t": {"$time": "2024-02-28T23:00:00Z"}}`), VectorOptions{Now: "2024-03-01T12:00:00Z"}),
+	vec("before/not-time", `$t BEFORE "tomorrow"`, `{"t": {"$time": "2024-02-29T23:00:00Z"}}`),
+	withOptions(vec("now/compare", `$t < NOW() AND NOW() AFTER $t`, `{"t": {"$time": "2024-03-01T11:00:00Z"}}`), VectorOptions{Now: "2024-03-01T12:00:00Z"}),
+	withOptions(vec("now/number", `NOW() > 5`, ""), VectorOptions{Now: "2024-03-01T12:00:00Z"}),
+	vec("isnthweekday/first", `$t ISNTHWEEKDAY 1 "Fri"`, `{"t": {"$time": "2024-03-01T10:00:00Z"}}`),
+	vec("isnthweekday/last", `$t ISNTHWEEKDAY -1 "fri"`, `{"t": {"$time": "2024-03-29T10:00:00Z"}}`),
+	vec("isnthweekday/other", `$t ISNTHWEEKDAY 2 "Fri"`, `{"t": {"$time": "2024-03-01T10:00:00Z"}}`),
+	vec("isnthweekday/invalid", `$t ISNTHWEEKDAY 6 "Fri"`, `{"t": {"$time": "2024-03-01T10:00:00Z"}}`),
+
+	// Comments
+	vec("comment/line", "$a > 1 // the size\nAND $b", `{"a": 2, "b": true}`),
+	vec("comment/block", `$a /* the size */ > 1`, `{"a": 2}`),
+	vec("comment/in-string", `$s == "a // b /* c */"`, `{"s": "a // b /* c */"}`),
+	vec("comment/unterminated", `$a == 1 /* the size`, `{"a": 1}`),
+	vec("comment/only", `// nothing`, ""),
+
+	// Syntax errors
+	vec("syntax/empty", ``, ""),
+	vec("syntax/bare-word", `A`, ""),
+	vec("syntax/missing-paren", `($a == 1`, `{"a": 1}`),
+	vec("syntax/trailing", `$a == 1 $b`, `{"a": 1}`),
+	vec("syntax/unknown-operator", `$a ~ 1`, `{"a": 1}`),
+	vec("syntax/unknown-escape", `$a == "\d"`, `{"a": "d"}`),
+}
@@ -0,0 +1,51 @@
+package conditions
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var updateVectors = flag.Bool("update", false, "update testdata/conformance.json")
+
+const vectorsFile = "testdata/conformance.json"
+
+func TestConformanceVectors(t *testing.T) {
+	data, err := ExportVectors(ConformanceCorpus)
+	assert.NoError(t, err)
+
+	if *updateVectors {
+		assert.NoError(t, os.WriteFile(vectorsFile, data, 0644))
+	}
+
+	shipped, err := os.ReadFile(vectorsFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, RunVectors(shipped))
+	assert.Equal(t, string(shipped), string(data), "conformance vectors are out of date, run go test -update")
+}
+
+func TestRunVectorsMismatch(t *testing.T) {
+	err := RunVectors([]byte(`{"version": 3, "vectors": [
+		{"name": "ok", "expression": "$a == 1", "args": {"a": 1}, "result": true},
+		{"name": "wrong-result", "expression": "$a == 1", "args": {"a": 1}, "result": false},
+		{"name": "wrong-error", "expression": "$a == ", "error": "evaluate"},
+		{"name": "unexpected-error", "expression": "$a == 1", "result": true}
+	]}`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "3 of 4 vectors failed")
+		assert.Contains(t, err.Error(), "wrong-result")
+		assert.Contains(t, err.Error(), "wrong-error")
+		assert.Contains(t, err.Error(), "unexpected-error")
+		assert.NotContains(t, err.Error(), "ok:")
+	}
+
+	assert.Error(t, RunVectors([]byte(`{"version": 3, "vectors": [
+		{"name": "bad-mode", "expression": "true", "options": {"equality": "loose"}, "result": true}
+	]}`)))
+	assert.Error(t, RunVectors([]byte(`{"version": 1}`)))
+	assert.Error(t, RunVectors([]byte(`{`)))
+}
@@ -0,0 +1,133 @@
+package conditions
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Codes of the warnings reported by Parser.ParseWithWarnings. Each code
+// names a construct which still parses but has a preferred spelling.
+const (
+	// WarnAndAlias reports && used instead of AND
+	WarnAndAlias = "and-alias"
+	// WarnOrAlias reports || used instead of OR
+	WarnOrAlias = "or-alias"
+	// WarnNotAlias reports ! used instead of NOT
+	WarnNotAlias = "not-alias"
+	// WarnEqAlias reports = used instead of ==
+	WarnEqAlias = "eq-alias"
+	// WarnNeqAlias reports <> used instead of !=
+	WarnNeqAlias = "neq-alias"
+	// WarnNotInToken reports NOTIN written as a single token
+	WarnNotInToken = "notin-token"
+	// WarnDayCount reports a number of days on the right of BEFORE or
+	// AFTER instead of a duration
+	WarnDayCount = "day-count"
+)
+
+// Warning describes a deprecated construct found while parsing. Warnings
+// never change the parsed expression nor its evaluation.
+type Warning struct {
+	// Code identifies the kind of warning, one of the Warn constants
+	Code string
+	// Msg describes the problem
+	Msg string
+	// Token is the literal of the deprecated token
+	Token string
+	// Pos is the position of the deprecated token
+	Pos Pos
+	// Suggestion is the replacement for Token, empty if there is none
+	Suggestion string
+}
+
+// warn records a warning about the token lit at pos, unless its code is
+// suppressed by the parser options.
+func (p *Parser) warn(code, lit string, pos Pos, suggestion string) {
+	p.addWarning(Warning{
+		Code:       code,
+		Msg:        "Deprecated " + lit + ", use " + suggestion,
+		Token:      lit,
+		Pos:        pos,
+		Suggestion: suggestion,
+	})
+}
+
+// warnDayCount records a warning if the next token, the RHS of the time
+// operator op, is a number of days.
+func (p *Parser) warnDayCount(op Token) {
+	tok, lit := p.scanWithMapping()
+	pos := p.last.pos
+	p.unscanMapped(tok, lit)
+	if tok != NUMBER {
+		return
+	}
+	days, err := strconv.ParseFloat(lit, 64)
+	if err != nil {
+		return
+	}
+	suggestion := dayCount(days).String()
+	p.addWarning(Warning{
+		Code:       WarnDayCount,
+		Msg:        fmt.Sprintf("Deprecated day count %s after %s, use %s", lit, op, suggestion),
+		Token:      lit,
+		Pos:        pos,
+		Suggestion: suggestion,
+	})
+}
+
+// addWarning records w, unless its code is suppressed by the parser
+// options.
+func (p *Parser) addWarning(w Warning) {
+	for _, c := range p.opts.SuppressWarnings {
+		if c == w.Code {
+			return
+		}
+	}
+	p.warnings = append(p.warnings, w)
+}
+
+// Modernize returns a copy of expr where the deprecated constructs
+// reported by ParseWithWarnings are written the preferred way: a number
+// of days on the right of BEFORE or AFTER becomes a duration, so that
+// $t BEFORE 2 becomes $t BEFORE 2d. Aliases such as && and the NOTIN
+// token parse to the same tree as their keywords, which String prints.
+// The input expression is left untouched.
+func Modernize(expr Expr) Expr {
+	switch n := expr.(type) {
+	case *BinaryExpr:
+		rhs := Modernize(n.RHS)
+		if num, ok := n.RHS.(*NumberLiteral); ok && (n.Op == BEFORE || n.Op == AFTER) {
+			rhs = dayCount(num.Val)
+		}
+		return &BinaryExpr{Op: n.Op, LHS: Modernize(n.LHS), RHS: rhs}
+	case *ParenExpr:
+		return &ParenExpr{Expr: Modernize(n.Expr)}
+	case *UnaryExpr:
+		return &UnaryExpr{Op: n.Op, Expr: Modernize(n.Expr)}
+	case *QuantifierExpr:
+		return &QuantifierExpr{Op: n.Op, Var: n.Var, Binder: n.Binder, Expr: Modernize(n.Expr)}
+	case *CallExpr:
+		call := &CallExpr{Name: n.Name, Params: make([]Expr, len(n.Params))}
+		for i, a := range n.Params {
+			call.Params[i] = Modernize(a)
+		}
+		return call
+	case *ConditionalExpr:
+		return &ConditionalExpr{Cond: Modernize(n.Cond), Then: Modernize(n.Then), Else: Modernize(n.Else)}
+	case *RangeExpr:
+		return &RangeExpr{Low: Modernize(n.Low), High: Modernize(n.High)}
+	case *TupleExpr:
+		tuple := &TupleExpr{Elems: make([]Expr, len(n.Elems))}
+		for i, x := range n.Elems {
+			tuple.Elems[i] = Modernize(x)
+		}
+		return tuple
+	}
+	return expr
+}
+
+// dayCount returns the duration of the given number of days.
+func dayCount(days float64) *DurationLiteral {
+	return &DurationLiteral{Val: time.Duration(days * float64(24*time.Hour))}
+}
@@ -0,0 +1,104 @@
+// Package window evaluates a condition over a rolling time window of
+// payloads, e.g. "more than 5 failed logins in 10 minutes".
+package window
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yowenter/conditions"
+)
+
+// Window keeps the timestamps of the observations which matched an
+// expression during the last Size duration.
+type Window struct {
+	// Now returns the current time used by Exceeds, time.Now if nil.
+	Now func() time.Time
+
+	expr conditions.Expr
+	size time.Duration
+
+	mu sync.Mutex
+	// Matching timestamps in ascending order, starting at head.
+	times []time.Time
+	head  int
+}
+
+// New returns a window of the given size evaluating expr.
+func New(expr conditions.Expr, size time.Duration) *Window {
+	return &Window{expr: expr, size: size}
+}
+
+// Size returns the duration covered by the window.
+func (w *Window) Size() time.Duration { return w.size }
+
+// Observe evaluates the expression against args and records t if it
+// matches. Observations older than the window are ignored.
+func (w *Window) Observe(t time.Time, args interface{}) error {
+	matched, err := conditions.Evaluate(w.expr, args)
+	if err != nil || !matched {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Timestamps usually arrive in order, so appending is the common case.
+	n := len(w.times)
+	if n == w.head || !t.Before(w.times[n-1]) {
+		w.times = append(w.times, t)
+		w.evict(t)
+		return nil
+	}
+	latest := w.times[n-1]
+	if !t.After(latest.Add(-w.size)) {
+		return nil
+	}
+	i := w.head + sort.Search(n-w.head, func(i int) bool { return w.times[w.head+i].After(t) })
+	w.times = append(w.times, time.Time{})
+	copy(w.times[i+1:], w.times[i:])
+	w.times[i] = t
+	return nil
+}
+
+// CountSince returns the number of matching observations at or after t
+// which are still in the window.
+func (w *Window) CountSince(t time.Time) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	live := w.times[w.head:]
+	return len(live) - sort.Search(len(live), func(i int) bool { return !live[i].Before(t) })
+}
+
+// Exceeds reports whether more than n matching observations happened
+// within the window ending now.
+func (w *Window) Exceeds(n int) bool {
+	now := time.Now
+	if w.Now != nil {
+		now = w.Now
+	}
+	t := now()
+
+	w.mu.Lock()
+	w.evict(t)
+	w.mu.Unlock()
+
+	return w.CountSince(t.Add(-w.size).Add(1)) > n
+}
+
+// evict drops the timestamps which fell out of the window ending at now.
+// It must be called with the lock held.
+func (w *Window) evict(now time.Time) {
+	limit := now.Add(-w.size)
+	for w.head < len(w.times) && !w.times[w.head].After(limit) {
+		w.head++
+	}
+	// Reclaim the evicted prefix once it dominates the buffer.
+	if w.head > 0 && w.head >= len(w.times)/2 {
+		n := copy(w.times, w.times[w.head:])
+		w.times = w.times[:n]
+		w.head = 0
+	}
+}
@@ -0,0 +1,129 @@
+package window
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yowenter/conditions"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+func failedLogins(t *testing.T) *Window {
+	expr, err := conditions.NewParser(strings.NewReader(`$Event == "login" AND $Success == false`)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(expr, 10*time.Minute)
+}
+
+var (
+	failed  = map[string]interface{}{"Event": "login", "Success": false}
+	success = map[string]interface{}{"Event": "login", "Success": true}
+)
+
+func TestWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	w := failedLogins(t)
+	w.Now = clock.Now
+	start := clock.Now()
+
+	// 6 failures, one every 2 minutes, with successes in between.
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, w.Observe(clock.Now(), failed))
+		assert.NoError(t, w.Observe(clock.Now(), success))
+		if i < 5 {
+			clock.Advance(2 * time.Minute)
+		}
+	}
+	// Failures at 0, 2, 4, 6, 8, 10 minutes, now is 10 minutes: the
+	// failure at 0 is exactly 10 minutes old and fell out of the window.
+	assert.Equal(t, 5, w.CountSince(start))
+	assert.Equal(t, 3, w.CountSince(start.Add(5*time.Minute)))
+	assert.True(t, w.Exceeds(4))
+	assert.False(t, w.Exceeds(5))
+
+	// Crossing the next bucket boundary evicts the failure at 2 minutes.
+	clock.Advance(time.Minute)
+	assert.False(t, w.Exceeds(5))
+	assert.True(t, w.Exceeds(4))
+	clock.Advance(time.Minute)
+	assert.False(t, w.Exceeds(4))
+	assert.True(t, w.Exceeds(3))
+
+	// Much later, everything is gone.
+	clock.Advance(time.Hour)
+	assert.False(t, w.Exceeds(0))
+	assert.Equal(t, 0, w.CountSince(start))
+}
+
+func TestWindowOutOfOrder(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	w := failedLogins(t)
+	w.Now = clock.Now
+	start := clock.Now()
+
+	assert.NoError(t, w.Observe(start.Add(5*time.Minute), failed))
+	assert.NoError(t, w.Observe(start.Add(1*time.Minute), failed))
+	assert.NoError(t, w.Observe(start.Add(3*time.Minute), failed))
+	// Older than the window relative to the latest observation.
+	assert.NoError(t, w.Observe(start.Add(-6*time.Minute), failed))
+
+	assert.Equal(t, 3, w.CountSince(start))
+	assert.Equal(t, 2, w.CountSince(start.Add(2*time.Minute)))
+
+	clock.Advance(12 * time.Minute)
+	assert.True(t, w.Exceeds(1))
+	assert.False(t, w.Exceeds(2))
+}
+
+func TestWindowError(t *testing.T) {
+	w := failedLogins(t)
+	assert.Error(t, w.Observe(time.Now(), map[string]interface{}{"Event": "login"}))
+	assert.Equal(t, 10*time.Minute, w.Size())
+}
+
+func TestWindowConcurrentObserve(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	w := failedLogins(t)
+	w.Now = clock.Now
+	start := clock.Now()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				ts := start.Add(time.Duration(i) * time.Second)
+				assert.NoError(t, w.Observe(ts, failed))
+				w.Exceeds(10)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	clock.Advance(99 * time.Second)
+	assert.Equal(t, 800, w.CountSince(start))
+	assert.True(t, w.Exceeds(799))
+	assert.False(t, w.Exceeds(800))
+}